@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"net_exercise/pkg/restore"
+	"net_exercise/pkg/storage"
+)
+
+// How long the agent waits before polling again after the server could not
+// be reached
+const agentRetryInterval = 10 * time.Second
+
+// agentMain runs this binary as an agent of a central server, see agents.go:
+//
+//	NETX_AGENT_TOKEN=<api key> netx agent --server https://netx.example.com --name edge-1 --storage shared
+//
+// The token is an API key with the operator role. The storage backend must
+// be configured in NETX_CONFIG and reachable by the users of the tasks.
+func agentMain(args []string) int {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	server := flags.String("server", "", "URL of the central server (required)")
+	name := flags.String("name", "", "name the agent registers under, typically its cluster's (required)")
+	storageName := flags.String("storage", "", "storage backend backups are uploaded to and downloaded from (required)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *server == "" || *name == "" || *storageName == "" {
+		fmt.Fprintln(os.Stderr, "agent: --server, --name and --storage are required")
+		flags.Usage()
+		return exitUsage
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil)).With("agent", *name)
+	if err := initClients(); err != nil {
+		logger.Error("agent failed", "error", err)
+		return exitFailed
+	}
+	if err := loadStorageBackends(cfg.Storage); err != nil {
+		logger.Error("agent failed", "error", err)
+		return exitFailed
+	}
+	backend, err := storageBackend(*storageName)
+	if err == nil && backend == nil {
+		err = errors.New("the agent needs a shared storage backend, not the local one")
+	}
+	if err != nil {
+		logger.Error("agent failed", "error", err)
+		return exitFailed
+	}
+
+	a := &agent{
+		server:  strings.TrimSuffix(*server, "/") + "/agents/" + url.PathEscape(*name),
+		token:   os.Getenv("NETX_AGENT_TOKEN"),
+		storage: *storageName,
+		backend: backend,
+		client:  &http.Client{Timeout: agentPollWait + time.Minute},
+		logger:  logger,
+	}
+	logger.Info("agent started", "server", *server, "storage", *storageName)
+	a.run(context.Background())
+	return 0
+}
+
+type agent struct {
+	// Base URL of the agent's endpoints on the server
+	server  string
+	token   string
+	storage string
+	backend storage.Backend
+	client  *http.Client
+	logger  *slog.Logger
+}
+
+func (a *agent) run(ctx context.Context) {
+	for {
+		task, ok, err := a.poll(ctx)
+		if err != nil {
+			a.logger.Warn("polling the server", "error", err)
+			time.Sleep(agentRetryInterval)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		logger := a.logger.With("task_id", task.TaskID, "type", task.Type, "namespace", task.Namespace)
+		logger.Info("task started", "key", task.Key)
+		output, err := a.runTask(ctx, task, logger)
+		report := map[string]any{}
+		if output != nil {
+			report["output"] = output
+		}
+		if err != nil {
+			logger.Error("task failed", "error", err)
+			report["error"] = err.Error()
+		} else {
+			logger.Info("task completed")
+		}
+
+		// The task is lost if its outcome can't be reported, keep trying
+		// until the server no longer expects it, e.g. after the task's lease
+		// ran out
+		for {
+			err := a.call(ctx, http.MethodPut, "/tasks/"+task.TaskID+"/result", report, nil)
+			if err == nil {
+				break
+			}
+			var statusErr *agentStatusError
+			if errors.As(err, &statusErr) && statusErr.permanent() {
+				logger.Error("the server refused the task result", "error", err)
+				break
+			}
+			logger.Warn("reporting the task result", "error", err)
+			time.Sleep(agentRetryInterval)
+		}
+	}
+}
+
+// poll waits for the next task, ok is false if there is none yet.
+func (a *agent) poll(ctx context.Context) (task agentTask, ok bool, err error) {
+	var body []byte
+	err = a.call(ctx, http.MethodPost, "/poll", map[string]string{"storage": a.storage}, &body)
+	if err != nil || len(body) == 0 {
+		return task, false, err
+	}
+	return task, true, json.Unmarshal(body, &task)
+}
+
+// runTask runs a task through the backup and restore subcommands' code and
+// returns the restore result or plan the restore subcommand would print.
+func (a *agent) runTask(ctx context.Context, task agentTask, logger *slog.Logger) (any, error) {
+	dir, err := os.MkdirTemp("", "netx-agent-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+
+	switch task.Type {
+	case agentTaskBackup:
+		app := Application{Name: task.Namespace, Namespace: task.Namespace, LabelSelector: task.LabelSelector}
+		if err := app.validate(); err != nil {
+			return nil, err
+		}
+		if err := runBackupCommand(app, archivePath, logger); err != nil {
+			return nil, err
+		}
+		return nil, storage.UploadFile(ctx, a.backend, archivePath, task.Key)
+
+	case agentTaskRestore, agentTaskPlan:
+		if err := storage.DownloadFile(ctx, a.backend, task.Key, archivePath); err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", task.Key, err)
+		}
+		return runRestoreCommand(ctx, archivePath, task.Namespace, task.Type == agentTaskPlan, restore.Options{
+			ExistingResourcePolicy: task.ExistingResourcePolicy,
+			ConfirmToken:           task.ConfirmToken,
+			FinalizerRules:         cfg.RestoreFinalizers,
+		})
+	}
+	return nil, fmt.Errorf("unknown task type %q", task.Type)
+}
+
+// call sends body as JSON to one of the agent's endpoints and stores the
+// response body in response, if not nil.
+func (a *agent) call(ctx context.Context, method, path string, body any, response *[]byte) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.server+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %w: %s", method, path, &agentStatusError{resp.StatusCode, resp.Status}, bytes.TrimSpace(respBody))
+	}
+	if response != nil {
+		*response = respBody
+	}
+	return nil
+}
+
+// agentStatusError is an error status the server answered a call with.
+type agentStatusError struct {
+	code   int
+	status string
+}
+
+func (e *agentStatusError) Error() string {
+	return e.status
+}
+
+// permanent reports whether retrying the call can't succeed: the agent's
+// name is bound to another credential, or the task is unknown or no longer
+// running.
+func (e *agentStatusError) permanent() bool {
+	return e.code == http.StatusForbidden || e.code == http.StatusNotFound || e.code == http.StatusConflict
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"net_exercise/pkg/auth"
+	"net_exercise/pkg/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Agents run in clusters this service cannot reach. They poll the server
+// over an outbound connection for tasks, run them against their own cluster
+// and exchange backups with the server's users through a storage backend
+// both sides are configured with, see agent.go.
+
+const (
+	agentTaskBackup  = "backup"
+	agentTaskRestore = "restore"
+	// Plans a restore without changing anything, e.g. for its confirm_token
+	agentTaskPlan = "plan"
+
+	agentTaskQueued    = "queued"
+	agentTaskRunning   = "running"
+	agentTaskCompleted = "completed"
+	agentTaskFailed    = "failed"
+)
+
+// How long a poll waits for a task before returning empty handed. Agents
+// poll again right away, so this bounds how long a new task waits.
+const agentPollWait = 25 * time.Second
+
+// A running task without a result after this long fails, its agent is
+// assumed gone.
+const agentTaskLease = time.Hour
+
+// Times a task is handed to its agent before it fails, see
+// requeueAgentTasksLocked.
+const agentTaskAttempts = 3
+
+type agentInfo struct {
+	Name string `json:"name"`
+	// Storage backend the agent uploads backups to and downloads them from
+	Storage  string    `json:"storage"`
+	LastSeen time.Time `json:"last_seen"`
+	// Credential the name is bound to, see agentOwner. Only its caller can
+	// poll for the agent's tasks and report their results.
+	Owner string `json:"owner"`
+}
+
+var errAgentOwned = errors.New("the agent name is registered with another credential")
+
+type agentTaskRequest struct {
+	// backup, restore or plan
+	Type          string `json:"type" binding:"required,oneof=backup restore plan"`
+	Namespace     string `json:"namespace" binding:"required,dns1123label"`
+	LabelSelector string `json:"label_selector,omitempty"`
+	// Key of the backup archive in the agent's storage backend. Backups
+	// default to agents/<agent>/<task_id>.tar.gz, restores and plans need one.
+	Key                    string `json:"key,omitempty"`
+	ExistingResourcePolicy string `json:"existing_resource_policy,omitempty" binding:"omitempty,oneof=skip replace repair"`
+	ConfirmToken           string `json:"confirm_token,omitempty"`
+}
+
+type agentTask struct {
+	TaskID string `json:"task_id"`
+	Agent  string `json:"agent"`
+	agentTaskRequest
+
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Times the task was handed to the agent
+	Attempts   int        `json:"attempts,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Restore result or plan as the restore subcommand prints it
+	Output json.RawMessage `json:"output,omitempty"`
+}
+
+// Tasks live in memory only, tasks queued or running when the server stops
+// are lost. Agents are saved in the metadata store, so their names stay
+// bound to their credentials. Lock agentsMu before stateMu.
+var (
+	agentsMu         sync.Mutex
+	agents           = map[string]*agentInfo{}
+	agentTasks       = map[string]*agentTask{}
+	agentTaskCounter int
+)
+
+// loadAgents restores the agents saved by a previous run.
+func loadAgents(saved map[string]agentInfo) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	agents = make(map[string]*agentInfo, len(saved))
+	for name, a := range saved {
+		agents[name] = &a
+	}
+}
+
+// agentOwner identifies the credential of the caller: the API key by ID,
+// so the binding survives rotations, other callers by subject.
+func agentOwner(c *gin.Context) string {
+	identity := auth.FromContext(c)
+	switch {
+	case identity == nil:
+		return ""
+	case identity.APIKeyID != "":
+		return "api-key/" + identity.APIKeyID
+	}
+	return identity.Subject
+}
+
+func listAgents(c *gin.Context) {
+	agentsMu.Lock()
+	list := make([]agentInfo, 0, len(agents))
+	for _, a := range agents {
+		list = append(list, *a)
+	}
+	agentsMu.Unlock()
+
+	slices.SortFunc(list, func(a, b agentInfo) int { return compareIDs(a.Name, b.Name) })
+	c.JSON(http.StatusOK, gin.H{"agents": list})
+}
+
+// queueAgentTask queues a backup, restore or plan for an agent that has polled
+// before.
+func queueAgentTask(c *gin.Context) {
+	var requestBody agentTaskRequest
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+	if requestBody.Type != agentTaskBackup && requestBody.Key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "key is required to restore or plan"})
+		return
+	}
+
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	name := c.Param("name")
+	if _, ok := agents[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No agent " + name + " has connected"})
+		return
+	}
+
+	agentTaskCounter++
+	task := agentTask{
+		TaskID:           fmt.Sprintf("task_%d", agentTaskCounter),
+		Agent:            name,
+		agentTaskRequest: requestBody,
+		Status:           agentTaskQueued,
+		CreatedAt:        time.Now().UTC(),
+	}
+	if task.Type == agentTaskBackup && task.Key == "" {
+		task.Key = fmt.Sprintf("agents/%s/%s.tar.gz", name, task.TaskID)
+	}
+	agentTasks[task.TaskID] = &task
+
+	c.JSON(http.StatusAccepted, task)
+}
+
+// deleteAgent forgets an agent, e.g. after its API key was revoked, so its
+// name can be registered with another credential. Its unfinished tasks fail.
+func deleteAgent(c *gin.Context) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	name := c.Param("name")
+	if _, ok := agents[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No agent " + name + " has connected"})
+		return
+	}
+	delete(agents, name)
+	stateMu.Lock()
+	persistLocked(store.Delete(bucketAgents, name))
+	stateMu.Unlock()
+
+	now := time.Now().UTC()
+	for _, task := range agentTasks {
+		if task.Agent == name && (task.Status == agentTaskQueued || task.Status == agentTaskRunning) {
+			failAgentTaskLocked(task, now, "the agent was deleted")
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Agent deleted", "name": name})
+}
+
+func getAgentTask(c *gin.Context) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	expireAgentTasksLocked(time.Now().UTC())
+
+	task, ok := agentTasks[c.Param("id")]
+	if !ok || task.Agent != c.Param("name") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid task_id"})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// pollAgentTasks registers the calling agent and hands it its oldest queued
+// task, waiting up to agentPollWait for one. 204 No Content means there is
+// nothing to do yet. The first poll binds the agent's name to the caller's
+// credential, polls with another one are refused.
+func pollAgentTasks(c *gin.Context) {
+	var requestBody struct {
+		Storage string `json:"storage" binding:"required"`
+	}
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+	name := c.Param("name")
+	if err := registerAgent(name, requestBody.Storage, agentOwner(c)); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	deadline := time.Now().Add(agentPollWait)
+	for {
+		if task, ok := nextAgentTask(name); ok {
+			c.JSON(http.StatusOK, task)
+			return
+		}
+		if time.Now().After(deadline) {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// registerAgent records that the agent was seen, binding its name to owner
+// if it is new. An agent runs one task at a time, so the tasks it was given
+// before are lost when it polls, see requeueAgentTasksLocked.
+func registerAgent(name, storage, owner string) error {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	now := time.Now().UTC()
+	a, ok := agents[name]
+	if ok && a.Owner != owner {
+		return fmt.Errorf("agent %s: %w", name, errAgentOwned)
+	}
+	if !ok || a.Storage != storage {
+		a = &agentInfo{Name: name, Storage: storage, Owner: owner}
+		agents[name] = a
+		stateMu.Lock()
+		persistLocked(store.Put(bucketAgents, name, a))
+		stateMu.Unlock()
+	}
+	a.LastSeen = now
+	requeueAgentTasksLocked(name, now)
+	expireAgentTasksLocked(now)
+	return nil
+}
+
+// requeueAgentTasksLocked puts the tasks name is running back in the queue,
+// e.g. after the agent restarted or the poll handing them out never reached
+// it. Tasks handed out agentTaskAttempts times fail instead.
+func requeueAgentTasksLocked(name string, now time.Time) {
+	for _, task := range agentTasks {
+		if task.Agent != name || task.Status != agentTaskRunning {
+			continue
+		}
+		if task.Attempts >= agentTaskAttempts {
+			failAgentTaskLocked(task, now, fmt.Sprintf("the agent stopped running the task %d times", task.Attempts))
+			continue
+		}
+		task.Status = agentTaskQueued
+		task.StartedAt = nil
+	}
+}
+
+// expireAgentTasksLocked fails running tasks that got no result within
+// agentTaskLease.
+func expireAgentTasksLocked(now time.Time) {
+	for _, task := range agentTasks {
+		if task.Status == agentTaskRunning && now.Sub(*task.StartedAt) > agentTaskLease {
+			failAgentTaskLocked(task, now, fmt.Sprintf("no result from the agent within %s", agentTaskLease))
+		}
+	}
+}
+
+func failAgentTaskLocked(task *agentTask, now time.Time, reason string) {
+	task.Status = agentTaskFailed
+	task.Error = reason
+	task.FinishedAt = &now
+}
+
+// nextAgentTask marks the oldest queued task of the agent running.
+func nextAgentTask(name string) (agentTask, bool) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	var next *agentTask
+	for _, task := range agentTasks {
+		if task.Agent == name && task.Status == agentTaskQueued && (next == nil || compareIDs(task.TaskID, next.TaskID) < 0) {
+			next = task
+		}
+	}
+	if next == nil {
+		return agentTask{}, false
+	}
+
+	now := time.Now().UTC()
+	next.Status = agentTaskRunning
+	next.StartedAt = &now
+	next.Attempts++
+	return *next, true
+}
+
+// completeAgentTask records the outcome an agent reports for a task. Only
+// the credential the agent is bound to may report it, and only while the
+// task's lease runs.
+func completeAgentTask(c *gin.Context) {
+	var requestBody struct {
+		Error  string          `json:"error"`
+		Output json.RawMessage `json:"output"`
+	}
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	if a, ok := agents[c.Param("name")]; ok && a.Owner != agentOwner(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("agent %s: %v", a.Name, errAgentOwned)})
+		return
+	}
+	expireAgentTasksLocked(time.Now().UTC())
+	task, ok := agentTasks[c.Param("id")]
+	if !ok || task.Agent != c.Param("name") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid task_id"})
+		return
+	}
+	if task.Status != agentTaskRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Task is " + task.Status})
+		return
+	}
+
+	now := time.Now().UTC()
+	task.FinishedAt = &now
+	task.Status = agentTaskCompleted
+	task.Error = requestBody.Error
+	if task.Error != "" {
+		task.Status = agentTaskFailed
+	}
+	task.Output = requestBody.Output
+	c.JSON(http.StatusOK, task)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"net_exercise/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type tokenAuthenticator map[string]*auth.Identity
+
+func (a tokenAuthenticator) Authenticate(token string) (*auth.Identity, error) {
+	if identity, ok := a[token]; ok {
+		return identity, nil
+	}
+	return nil, errors.New("unknown token")
+}
+
+// An agent's name is bound to the API key that polled first, and tasks it
+// stopped running are handed out again until their attempts or lease run out.
+func TestAgentTasks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := registerValidations(); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Use(auth.Middleware(tokenAuthenticator{
+		"first":  {Subject: "api-key/edge", Role: auth.RoleOperator, APIKeyID: "key_1"},
+		"second": {Subject: "api-key/edge", Role: auth.RoleOperator, APIKeyID: "key_2"},
+	}))
+	router.POST("/agents/:name/tasks", queueAgentTask)
+	router.POST("/agents/:name/poll", pollAgentTasks)
+	router.PUT("/agents/:name/tasks/:id/result", completeAgentTask)
+	t.Cleanup(func() {
+		agents, agentTasks, agentTaskCounter = map[string]*agentInfo{}, map[string]*agentTask{}, 0
+	})
+
+	call := func(token, method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	poll := func(token string) *httptest.ResponseRecorder {
+		return call(token, http.MethodPost, "/agents/edge-1/poll", `{"storage": "shared"}`)
+	}
+
+	if err := registerAgent("edge-1", "shared", "api-key/key_1"); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if r := call("first", http.MethodPost, "/agents/edge-1/tasks", `{"type": "backup", "namespace": "shop"}`); r.Code != http.StatusAccepted {
+			t.Fatalf("queueing a task: status %d: %s", r.Code, r.Body)
+		}
+	}
+
+	if r := poll("first"); r.Code != http.StatusOK {
+		t.Fatalf("poll: status %d: %s", r.Code, r.Body)
+	}
+	if r := poll("second"); r.Code != http.StatusForbidden {
+		t.Errorf("poll with another API key: status %d, want %d", r.Code, http.StatusForbidden)
+	}
+	if r := call("second", http.MethodPut, "/agents/edge-1/tasks/task_1/result", `{}`); r.Code != http.StatusForbidden {
+		t.Errorf("result with another API key: status %d, want %d", r.Code, http.StatusForbidden)
+	}
+
+	// The agent restarted while running task_1, which is handed out again
+	for attempt := 2; attempt <= agentTaskAttempts; attempt++ {
+		if r := poll("first"); r.Code != http.StatusOK {
+			t.Fatalf("poll: status %d: %s", r.Code, r.Body)
+		}
+		if task := agentTasks["task_1"]; task.Status != agentTaskRunning || task.Attempts != attempt {
+			t.Fatalf("task_1 after re-poll: status %s, attempts %d, want running, %d", task.Status, task.Attempts, attempt)
+		}
+	}
+	// Out of attempts, task_2 is next
+	if r := poll("first"); r.Code != http.StatusOK {
+		t.Fatalf("poll: status %d: %s", r.Code, r.Body)
+	}
+	if task := agentTasks["task_1"]; task.Status != agentTaskFailed {
+		t.Errorf("task_1 after %d attempts: status %s, want failed", agentTaskAttempts, task.Status)
+	}
+	if task := agentTasks["task_2"]; task.Status != agentTaskRunning {
+		t.Fatalf("task_2: status %s, want running", task.Status)
+	}
+
+	// The lease ran out, the result comes too late
+	agentsMu.Lock()
+	startedAt := time.Now().UTC().Add(-agentTaskLease - time.Minute)
+	agentTasks["task_2"].StartedAt = &startedAt
+	agentsMu.Unlock()
+	if r := call("first", http.MethodPut, "/agents/edge-1/tasks/task_2/result", `{}`); r.Code != http.StatusConflict {
+		t.Errorf("result after the lease: status %d, want %d", r.Code, http.StatusConflict)
+	}
+	if task := agentTasks["task_2"]; task.Status != agentTaskFailed {
+		t.Errorf("task_2 after the lease: status %s, want failed", task.Status)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"net_exercise/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Only set when api_keys is enabled in the configuration
+var apiKeys *auth.APIKeyStore
+
+func createAPIKey(c *gin.Context) {
+	var requestBody struct {
+		Name      string     `json:"name" binding:"required"`
+		Role      auth.Role  `json:"role" binding:"required,oneof=viewer operator admin"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+	if requestBody.ExpiresAt != nil && !requestBody.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	key, secret, err := apiKeys.Create(requestBody.Name, requestBody.Role, requestBody.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	persistAPIKey(key.ID)
+
+	c.JSON(http.StatusCreated, gin.H{"api_key": key, "key": secret})
+}
+
+func listAPIKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"api_keys": apiKeys.List()})
+}
+
+func rotateAPIKey(c *gin.Context) {
+	key, secret, err := apiKeys.Rotate(c.Param("id"))
+	if err != nil {
+		c.JSON(apiKeyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	persistAPIKey(key.ID)
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key, "key": secret})
+}
+
+func revokeAPIKey(c *gin.Context) {
+	key, err := apiKeys.Revoke(c.Param("id"))
+	if err != nil {
+		c.JSON(apiKeyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	persistAPIKey(key.ID)
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key})
+}
+
+// persistAPIKey saves the key with ID id after a change.
+func persistAPIKey(id string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	persistLocked(apiKeyChanges(id)...)
+}
+
+func apiKeyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrAPIKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, auth.ErrInvalidToken):
+		// Revoked or expired keys cannot be rotated
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/config"
+
+	"github.com/gin-gonic/gin"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	applicationSpecAPIVersion = "netx/v1"
+	applicationSpecKind       = "Application"
+)
+
+// ApplicationSpec is the declarative form of an Application. It carries the
+// protection configuration only, never the server assigned app_id, so the
+// same file can be kept in Git and applied to any instance.
+type ApplicationSpec struct {
+	APIVersion          string                  `json:"apiVersion"`
+	Kind                string                  `json:"kind"`
+	Name                string                  `json:"name" binding:"required"`
+	Namespace           string                  `json:"namespace" binding:"required,dns1123label"`
+	Exclusions          []backup.Exclusion      `json:"exclusions,omitempty"`
+	IncludeFinished     bool                    `json:"include_finished,omitempty"`
+	KubeVirtSnapshots   bool                    `json:"kubevirt_snapshots,omitempty"`
+	NotifyEmails        []string                `json:"notify_emails,omitempty" binding:"omitempty,dive,email"`
+	TargetRPO           *config.Duration        `json:"target_rpo,omitempty"`
+	TargetRTO           *config.Duration        `json:"target_rto,omitempty"`
+	VersionKeys         []string                `json:"version_keys,omitempty"`
+	SkipUnchanged       bool                    `json:"skip_unchanged,omitempty"`
+	CaptureStatus       []string                `json:"capture_status,omitempty"`
+	LabelSelector       string                  `json:"label_selector,omitempty"`
+	CaptureStorage      bool                    `json:"capture_storage,omitempty"`
+	VolumeSnapshots     bool                    `json:"volume_snapshots,omitempty"`
+	VolumeSnapshotClass string                  `json:"volume_snapshot_class,omitempty"`
+	RestoreOrder        []string                `json:"restore_order,omitempty"`
+	DataMover           bool                    `json:"data_mover,omitempty"`
+	Retention           *config.BackupRetention `json:"retention,omitempty"`
+}
+
+func specFromApplication(app Application) ApplicationSpec {
+	return ApplicationSpec{
+		APIVersion:          applicationSpecAPIVersion,
+		Kind:                applicationSpecKind,
+		Name:                app.Name,
+		Namespace:           app.Namespace,
+		Exclusions:          app.Exclusions,
+		IncludeFinished:     app.IncludeFinished,
+		KubeVirtSnapshots:   app.KubeVirtSnapshots,
+		NotifyEmails:        app.NotifyEmails,
+		TargetRPO:           app.TargetRPO,
+		TargetRTO:           app.TargetRTO,
+		VersionKeys:         app.VersionKeys,
+		SkipUnchanged:       app.SkipUnchanged,
+		CaptureStatus:       app.CaptureStatus,
+		LabelSelector:       app.LabelSelector,
+		CaptureStorage:      app.CaptureStorage,
+		VolumeSnapshots:     app.VolumeSnapshots,
+		VolumeSnapshotClass: app.VolumeSnapshotClass,
+		RestoreOrder:        app.RestoreOrder,
+		DataMover:           app.DataMover,
+		Retention:           app.Retention,
+	}
+}
+
+func (s ApplicationSpec) application() Application {
+	return Application{
+		Name:                s.Name,
+		Namespace:           s.Namespace,
+		Exclusions:          s.Exclusions,
+		IncludeFinished:     s.IncludeFinished,
+		KubeVirtSnapshots:   s.KubeVirtSnapshots,
+		NotifyEmails:        s.NotifyEmails,
+		TargetRPO:           s.TargetRPO,
+		TargetRTO:           s.TargetRTO,
+		VersionKeys:         s.VersionKeys,
+		SkipUnchanged:       s.SkipUnchanged,
+		CaptureStatus:       s.CaptureStatus,
+		LabelSelector:       s.LabelSelector,
+		CaptureStorage:      s.CaptureStorage,
+		VolumeSnapshots:     s.VolumeSnapshots,
+		VolumeSnapshotClass: s.VolumeSnapshotClass,
+		RestoreOrder:        s.RestoreOrder,
+		DataMover:           s.DataMover,
+		Retention:           s.Retention,
+	}
+}
+
+func exportApplicationSpec(c *gin.Context) {
+	stateMu.Lock()
+	app, ok := apps[c.Param("id")]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid app_id"})
+		return
+	}
+
+	specYAML, err := yaml.Marshal(specFromApplication(app))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/yaml", specYAML)
+}
+
+func importApplicationSpec(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondInvalid(c, err)
+		return
+	}
+
+	// YAML is a superset of JSON, so both formats are accepted here
+	var spec ApplicationSpec
+	if err := yaml.UnmarshalStrict(body, &spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if spec.APIVersion != applicationSpecAPIVersion || spec.Kind != applicationSpecKind {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Spec must have apiVersion " + applicationSpecAPIVersion + " and kind " + applicationSpecKind})
+		return
+	}
+	if !validateStruct(c, &spec) {
+		return
+	}
+
+	app := spec.application()
+	if err := app.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	appID, existingAppID := registerApplication(app)
+	if existingAppID != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Application with same name and namespace already exists", "existing_app_id": existingAppID})
+		return
+	}
+
+	response := gin.H{"app_id": appID}
+	if warnings := overlapWarnings(appID); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	c.JSON(http.StatusCreated, response)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"net_exercise/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listApplications returns the registered applications, limited to one
+// namespace with ?namespace=.
+func listApplications(c *gin.Context) {
+	namespace := c.Query("namespace")
+
+	stateMu.Lock()
+	list := []Application{}
+	for _, app := range apps {
+		if namespace == "" || app.Namespace == namespace {
+			list = append(list, app)
+		}
+	}
+	stateMu.Unlock()
+
+	slices.SortFunc(list, func(a, b Application) int { return compareIDs(a.AppID, b.AppID) })
+	respondJSON(c, gin.H{"applications": list}, time.Time{})
+}
+
+// getApplication returns an application with its backups, oldest first.
+func getApplication(c *gin.Context) {
+	appID := c.Param("id")
+
+	stateMu.Lock()
+	app, ok := apps[appID]
+	history := []Backup{}
+	for _, b := range backups {
+		if b.AppID == appID {
+			history = append(history, b)
+		}
+	}
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid app_id"})
+		return
+	}
+
+	slices.SortFunc(history, func(a, b Backup) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	respondJSON(c, gin.H{"application": app, "backups": history}, time.Time{})
+}
+
+// deleteApplication unregisters an application. Its backups are kept unless
+// ?cascade=true, which deletes them first; ?force=true also deletes backups
+// younger than backup_deletion min_age, which only admins may do.
+func deleteApplication(c *gin.Context) {
+	appID := c.Param("id")
+	cascade := c.Query("cascade") == "true"
+	force := c.Query("force") == "true"
+	if force && !auth.FromContext(c).Role.Allows(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forced deletion requires the admin role"})
+		return
+	}
+
+	stateMu.Lock()
+	_, ok := apps[appID]
+	var backupIDs []string
+	for id, b := range backups {
+		if b.AppID == appID {
+			backupIDs = append(backupIDs, id)
+		}
+	}
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid app_id"})
+		return
+	}
+
+	deleted := []string{}
+	if cascade {
+		slices.SortFunc(backupIDs, compareIDs)
+		for _, id := range backupIDs {
+			err := deleteBackup(id, force)
+			if errors.Is(err, errBackupNotFound) {
+				// Deleted in the meantime, e.g. by retention
+				continue
+			}
+			if err != nil {
+				// The application stays registered so the deletion can be retried
+				status := http.StatusInternalServerError
+				if errors.Is(err, errBackupTooRecent) || errors.Is(err, errBackupInUse) || errors.Is(err, errBackupDeleting) {
+					status = http.StatusConflict
+				}
+				c.JSON(status, gin.H{"error": fmt.Sprintf("deleting backup %s: %v", id, err), "deleted_backups": deleted})
+				return
+			}
+			deleted = append(deleted, id)
+		}
+	}
+
+	stateMu.Lock()
+	if app, ok := apps[appID]; ok {
+		delete(apps, appID)
+		delete(appNameNamespaceMap, fmt.Sprintf("%s_%s", app.Name, app.Namespace))
+		delete(missedSchedules, appID)
+		persistLocked(append(deleteSchedulesLocked(appID), appChange(appID))...)
+	}
+	stateMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Application deleted", "app_id": appID, "deleted_backups": deleted})
+}
+
+// compareIDs orders counter based IDs such as app_2 and app_10 numerically.
+func compareIDs(a, b string) int {
+	_, aNum, _ := strings.Cut(a, "_")
+	_, bNum, _ := strings.Cut(b, "_")
+	an, aErr := strconv.Atoi(aNum)
+	bn, bErr := strconv.Atoi(bNum)
+	if aErr != nil || bErr != nil || an == bn {
+		return strings.Compare(a, b)
+	}
+	return an - bn
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"net_exercise/pkg/joblog"
+
+	"github.com/gin-gonic/gin"
+)
+
+type backupLog struct {
+	appID     string
+	startedAt time.Time
+	*joblog.Buffer
+}
+
+// Log lines of the backups taken since the server started, by backup ID,
+// guarded by stateMu
+var backupLogs = map[string]backupLog{}
+
+// streamBackupLogs writes the log of a backup job as JSON lines. While the
+// backup runs, new lines are streamed as they are logged until it finishes;
+// ?follow=false only returns the lines logged so far. Running backups are
+// only listed once they finish, so "latest" with ?app_id= finds the most
+// recently started backup of an application.
+func streamBackupLogs(c *gin.Context) {
+	backupID := c.Param("id")
+	if backupID == latestBackupID {
+		backupID = latestBackupLog(c.Query("app_id"))
+	}
+
+	stateMu.Lock()
+	logs, ok := backupLogs[backupID]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No logs for this backup_id"})
+		return
+	}
+	follow := c.Query("follow") != "false"
+
+	// A long backup can be followed for longer than the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		c.Error(err)
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	next := 0
+	for {
+		lines, n, done, changed := logs.Lines(next)
+		for _, line := range lines {
+			if _, err := c.Writer.Write(line); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+		next = n
+
+		if done || !follow {
+			return
+		}
+		select {
+		case <-changed:
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func latestBackupLog(appID string) string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var latest string
+	var latestStart time.Time
+	for id, l := range backupLogs {
+		if l.appID == appID && l.startedAt.After(latestStart) {
+			latest, latestStart = id, l.startedAt
+		}
+	}
+	return latest
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/joblog"
+	"net_exercise/pkg/layout"
+)
+
+// backupPreview lists the objects a backup of an application would capture.
+type backupPreview struct {
+	AppID         string `json:"app_id"`
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"label_selector,omitempty"`
+	// <kind prefix>/<name> of every object, sorted
+	Objects []string       `json:"objects"`
+	Counts  map[string]int `json:"counts"`
+	// API server warnings by kind prefix, as the manifest would record them
+	Warnings map[string][]string `json:"warnings,omitempty"`
+	// Steps of the backup left out because they change the cluster or
+	// storage, e.g. "volume_snapshots"
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// previewBackup runs a backup of app into a scratch directory and lists what
+// it captured, so selectors, exclusions and the classes and CRDs picked up
+// from the Pod specs are exactly those of a real backup. The directory is
+// removed afterwards; no backup is recorded, stored or uploaded.
+func previewBackup(ctx context.Context, app Application, objects []backup.ObjectRef) (backupPreview, error) {
+	dir, err := os.MkdirTemp("", "netx-preview-")
+	if err != nil {
+		return backupPreview{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	logs := joblog.New()
+	defer logs.Close()
+
+	m, err := writeBackup(ctx, app, dir, backupOptions{Objects: objects, preview: true}, logs.Logger().With("app_id", app.AppID))
+	if err != nil {
+		return backupPreview{}, err
+	}
+
+	p := backupPreview{
+		AppID:         app.AppID,
+		Namespace:     app.Namespace,
+		LabelSelector: app.LabelSelector,
+		Objects:       []string{},
+		Counts:        m.Counts,
+		Warnings:      m.Warnings,
+	}
+	// Counts has every kind prefix written to
+	backupLayout := layout.Current(dir)
+	for prefix := range m.Counts {
+		files, err := backupLayout.ObjectFiles(prefix)
+		if err != nil {
+			return backupPreview{}, err
+		}
+		for _, file := range files {
+			p.Objects = append(p.Objects, prefix+"/"+backupLayout.ObjectName(file, prefix))
+		}
+	}
+	slices.SortFunc(p.Objects, strings.Compare)
+	if app.KubeVirtSnapshots {
+		p.Skipped = append(p.Skipped, "kubevirt_snapshots")
+	}
+	if app.VolumeSnapshots {
+		p.Skipped = append(p.Skipped, "volume_snapshots")
+	}
+	if app.DataMover {
+		p.Skipped = append(p.Skipped, "data_mover")
+	}
+	return p, nil
+}
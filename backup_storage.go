@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"net_exercise/pkg/archive"
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/compression"
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/manifest"
+	"net_exercise/pkg/storage"
+)
+
+// Configured storage backends by name. Backups in the local backend only
+// live in ./backups and have no entry.
+var storageBackends = map[string]storage.Backend{}
+
+func loadStorageBackends(c config.Storage) error {
+	for _, b := range c.Backends {
+		backend, err := storage.New(b)
+		if err != nil {
+			return err
+		}
+		storageBackends[b.Name] = backend
+	}
+	return nil
+}
+
+// storageBackend returns the backend called name, nil for the local one.
+func storageBackend(name string) (storage.Backend, error) {
+	if name == "" || name == config.LocalStorage {
+		return nil, nil
+	}
+	backend, ok := storageBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("storage backend %s is not configured", name)
+	}
+	return backend, nil
+}
+
+func backupArchivePath(backupID string) string {
+	return fmt.Sprintf("./backups/%s.tar.gz", backupID)
+}
+
+// archiveBackup packs the backup directory into its archive, manifest first,
+// and removes the directory.
+func archiveBackup(backupID string) error {
+	backupDir := fmt.Sprintf("./backups/%s", backupID)
+	if err := archive.Pack(backupDir, backupArchivePath(backupID), manifest.FileName); err != nil {
+		return err
+	}
+	return os.RemoveAll(backupDir)
+}
+
+// storeBackup uploads a completed backup to its storage backend. Archives are
+// one object, <backup_id>.tar.gz. Of directories the manifest goes last, so a
+// backup without one was not uploaded completely.
+func storeBackup(ctx context.Context, b Backup) error {
+	backend, err := storageBackend(b.Storage)
+	if err != nil || backend == nil {
+		return err
+	}
+	if b.Format == config.FormatArchive {
+		return storage.UploadFile(ctx, backend, backupArchivePath(b.BackupID), b.BackupID+".tar.gz")
+	}
+	return storage.Upload(ctx, backend, fmt.Sprintf("./backups/%s", b.BackupID), b.BackupID+"/", manifest.FileName)
+}
+
+// backupFiles returns a directory holding the files of a backup, in either
+// format. It downloads them from the storage backend when the local copy is
+// gone, e.g. after the service moved to another node, and unpacks archives
+// into a temporary directory that cleanup removes. Incremental backups are
+// materialized from their parent chain into a temporary directory too, and
+// encrypted or compressed backups decrypted and decompressed, so callers
+// always see a full plaintext backup.
+func backupFiles(ctx context.Context, backupID string) (dir string, cleanup func(), err error) {
+	dir, cleanup, err = storedBackupFiles(ctx, backupID)
+	if err != nil {
+		return "", nil, err
+	}
+	m, ok, err := manifest.Read(dir)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if ok && (m.Encryption != nil || m.Compression != "") {
+		plain, plainCleanup, err := plainBackupFiles(dir, m)
+		cleanup()
+		if err != nil {
+			return "", nil, fmt.Errorf("backup %s: %w", backupID, err)
+		}
+		dir, cleanup = plain, plainCleanup
+		m.Encryption, m.Compression = nil, ""
+	}
+	if !ok || m.Parent == "" {
+		return dir, cleanup, nil
+	}
+	defer cleanup()
+
+	parentDir, parentCleanup, err := backupFiles(ctx, m.Parent)
+	if err != nil {
+		return "", nil, fmt.Errorf("parent backup %s: %w", m.Parent, err)
+	}
+	defer parentCleanup()
+
+	full, err := os.MkdirTemp("", backupID+"-")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := manifest.Materialize(full, dir, parentDir, m); err != nil {
+		os.RemoveAll(full)
+		return "", nil, fmt.Errorf("materializing incremental backup %s: %w", backupID, err)
+	}
+	return full, func() { os.RemoveAll(full) }, nil
+}
+
+// plainBackupFiles decrypts and decompresses the files of the backup in dir
+// into a temporary directory that cleanup removes, next to a manifest without
+// Encryption and Compression.
+func plainBackupFiles(dir string, m manifest.Manifest) (plain string, cleanup func(), err error) {
+	if m.Encryption != nil && keyring == nil {
+		return "", nil, fmt.Errorf("the backup is encrypted with key %s but encryption is not configured", m.Encryption.KeyID)
+	}
+	plain, err = os.MkdirTemp("", "netx-plain-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(plain) }
+
+	src := dir
+	if m.Encryption != nil {
+		if err := keyring.DecryptDir(plain, src, m.Encryption.KeyID, manifest.FileName); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("decrypting: %w", err)
+		}
+		src, m.Encryption = plain, nil
+	}
+	if m.Compression != "" {
+		if err := compression.DecompressDir(plain, src, manifest.FileName); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("decompressing: %w", err)
+		}
+		m.Compression = ""
+	}
+	if err := manifest.Write(plain, m); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return plain, cleanup, nil
+}
+
+// storedBackupFiles returns a directory holding the files stored for a
+// backup, see backupFiles.
+func storedBackupFiles(ctx context.Context, backupID string) (dir string, cleanup func(), err error) {
+	stateMu.Lock()
+	b := backups[backupID]
+	stateMu.Unlock()
+
+	backupDir := fmt.Sprintf("./backups/%s", backupID)
+	if b.Format != config.FormatArchive {
+		// Read in place, so kept from being swapped until cleanup
+		lock := backupDirLock(backupID)
+		lock.RLock()
+		if err := fetchBackupDir(ctx, b, backupDir); err != nil {
+			lock.RUnlock()
+			return "", nil, err
+		}
+		return backupDir, lock.RUnlock, nil
+	}
+
+	if err := fetchBackupArchive(ctx, b); err != nil {
+		return "", nil, err
+	}
+	dir, err = os.MkdirTemp("", backupID+"-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	if err := archive.Unpack(backupArchivePath(backupID), dir); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+func fetchBackupDir(ctx context.Context, b Backup, backupDir string) error {
+	if _, err := os.Stat(backupDir); err == nil {
+		return nil
+	}
+	backend, err := storageBackend(b.Storage)
+	if err != nil || backend == nil {
+		return err
+	}
+
+	// Downloaded next to the backup directory and renamed, so a failed
+	// download never leaves a partial backup behind
+	tmp := backupDir + ".download"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := storage.Download(ctx, backend, b.BackupID+"/", tmp); err != nil {
+		os.RemoveAll(tmp)
+		return downloadError(b, err)
+	}
+	return os.Rename(tmp, backupDir)
+}
+
+func fetchBackupArchive(ctx context.Context, b Backup) error {
+	path := backupArchivePath(b.BackupID)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	backend, err := storageBackend(b.Storage)
+	if err != nil {
+		return err
+	}
+	if backend == nil {
+		return fmt.Errorf("archive of backup %s is missing", b.BackupID)
+	}
+
+	tmp := path + ".download"
+	if err := storage.DownloadFile(ctx, backend, b.BackupID+".tar.gz", tmp); err != nil {
+		os.Remove(tmp)
+		return downloadError(b, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func downloadError(b Backup, err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("backup %s is missing from storage backend %s", b.BackupID, b.Storage)
+	}
+	return fmt.Errorf("downloading backup %s from storage backend %s: %w", b.BackupID, b.Storage, err)
+}
+
+// readManifest returns the manifest of a backup in either format; ok is false
+// for backups without one.
+func readManifest(ctx context.Context, backupID string) (m manifest.Manifest, ok bool, err error) {
+	stateMu.Lock()
+	b := backups[backupID]
+	stateMu.Unlock()
+
+	if b.Format != config.FormatArchive {
+		backupDir := fmt.Sprintf("./backups/%s", backupID)
+		if err := fetchBackupDir(ctx, b, backupDir); err != nil {
+			return m, false, err
+		}
+		return manifest.Read(backupDir)
+	}
+
+	// The manifest is the first entry, the archive doesn't have to be unpacked
+	if err := fetchBackupArchive(ctx, b); err != nil {
+		return m, false, err
+	}
+	data, err := archive.ReadFile(backupArchivePath(backupID), manifest.FileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	return m, true, json.Unmarshal(data, &m)
+}
+
+// deleteBackupFiles deletes the local and remote copies of a backup and the
+// volume snapshots taken for it. The snapshots go first: once the files are
+// gone, a failed deletion couldn't be retried.
+func deleteBackupFiles(ctx context.Context, b Backup) error {
+	if len(b.VolumeSnapshots) > 0 {
+		if !cluster.Connected() {
+			return fmt.Errorf("backup %s has volume snapshots and the Kubernetes API server is not connected", b.BackupID)
+		}
+		if err := backup.DeleteVolumeSnapshots(ctx, restoreClients.Dynamic, b.VolumeSnapshots); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(fmt.Sprintf("./backups/%s", b.BackupID)); err != nil {
+		return err
+	}
+	if err := os.Remove(backupArchivePath(b.BackupID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	backend, err := storageBackend(b.Storage)
+	if err != nil || backend == nil {
+		return err
+	}
+	if err := storage.DeleteAll(ctx, backend, b.BackupID+"/"); err != nil {
+		return err
+	}
+	return backend.Delete(ctx, b.BackupID+".tar.gz")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"net_exercise/pkg/auth"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/redact"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamBackup writes every object of a backup as newline-delimited JSON so
+// scanners and indexers can consume it without reading the backup directory.
+// Repeat the kind query parameter to limit the stream, e.g. ?kind=configmap&kind=secret.
+func streamBackup(c *gin.Context) {
+	backupID := c.Param("id")
+
+	stateMu.Lock()
+	b, ok := backups[backupID]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid backup_id"})
+		return
+	}
+
+	kinds := layout.Kinds
+	if names := c.QueryArray("kind"); len(names) > 0 {
+		kinds = nil
+		for _, name := range names {
+			k, ok := layout.LookupKind(name)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown kind %q", name)})
+				return
+			}
+			kinds = append(kinds, k)
+		}
+	}
+
+	canReadSecrets := auth.FromContext(c).CanReadSecrets()
+
+	// Backups never change once taken, the stream only depends on the
+	// selected kinds and on whether Secrets are redacted
+	etag := fmt.Sprintf("%s-%t", backupID, canReadSecrets)
+	for _, k := range kinds {
+		etag += "-" + k.Prefix
+	}
+	sum := sha256.Sum256([]byte(etag))
+	if notModified(c, `"`+hex.EncodeToString(sum[:16])+`"`, b.CreatedAt) {
+		return
+	}
+
+	backupDir, cleanup, err := backupFiles(c.Request.Context(), backupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer cleanup()
+
+	backupLayout, err := layout.Open(backupDir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Large backups take longer to stream than the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		c.Error(err)
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	for _, k := range kinds {
+		files, err := backupLayout.ObjectFiles(k.Prefix)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		for _, file := range files {
+			obj, err := backupLayout.ReadObject(file, k)
+			if err != nil {
+				// The status line is already sent, all we can do is stop
+				c.Error(err)
+				return
+			}
+			if !canReadSecrets {
+				redact.Object(obj)
+			}
+			if err := encoder.Encode(obj.Object); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,913 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"net_exercise/pkg/auth"
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/compression"
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/joblog"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+	"net_exercise/pkg/notify"
+
+	"github.com/gin-gonic/gin"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	backupStatusCompleted = "completed"
+	backupStatusFailed    = "failed"
+	// Nothing changed since the backup in same_as, no files were written
+	backupStatusUnchanged = "unchanged"
+)
+
+var errNoVolumeData = errors.New(`backup type "full" needs volume_snapshots or data_mover on the application`)
+
+// withBackupType returns app set up for a backup of backupType, which is
+// returned resolved. Without a type, applications capturing volume data take
+// full backups and the others config backups.
+func withBackupType(app Application, backupType string) (Application, string, error) {
+	switch backupType {
+	case "":
+		if app.VolumeSnapshots || app.DataMover {
+			return app, config.BackupTypeFull, nil
+		}
+		return app, config.BackupTypeConfig, nil
+	case config.BackupTypeConfig:
+		app.VolumeSnapshots, app.DataMover = false, false
+		return app, backupType, nil
+	case config.BackupTypeFull:
+		if !app.VolumeSnapshots && !app.DataMover {
+			return app, "", errNoVolumeData
+		}
+		return app, backupType, nil
+	}
+	return app, "", fmt.Errorf("backup type must be one of: %s, %s", config.BackupTypeConfig, config.BackupTypeFull)
+}
+
+// backupType returns the type of b. Backups taken before there were types
+// are full if they took volume snapshots.
+func (b Backup) backupType() string {
+	switch {
+	case b.Type != "":
+		return b.Type
+	case len(b.VolumeSnapshots) > 0:
+		return config.BackupTypeFull
+	}
+	return config.BackupTypeConfig
+}
+
+// Perform backup operations for relevant resources
+var backupFuncs = []struct {
+	kind   string
+	backup func(backupClients, string, string, backup.Options) error
+}{
+	{layout.PVC, typed(backup.BackupPVCs)},
+	{layout.Pod, typed(backup.BackupPods)},
+	{layout.ReplicaSet, typed(backup.BackupReplicaSets)},
+	{layout.Deployment, typed(backup.BackupDeployments)},
+	{layout.ConfigMap, typed(backup.BackupConfigMaps)},
+	{layout.StatefulSet, typed(backup.BackupStatefulSet)},
+	{layout.Service, typed(backup.BackupServices)},
+	{layout.ServiceAccount, typed(backup.BackupServiceAccounts)},
+	{layout.Secret, typed(backup.BackupSecrets)},
+	{layout.Role, typed(backup.BackupRoles)},
+	{layout.RoleBinding, typed(backup.BackupRoleBindings)},
+	{layout.NetworkPolicy, typed(backup.BackupNetworkPolicies)},
+	{layout.PodTemplate, typed(backup.BackupPodTemplates)},
+	{layout.ReplicationController, typed(backup.BackupReplicationControllers)},
+	{layout.HPA, typed(backup.BackupHPAs)},
+	{layout.PDB, typed(backup.BackupPDBs)},
+	{layout.Job, typed(backup.BackupJobs)},
+	{layout.CronJob, typed(backup.BackupCronJobs)},
+	{layout.DataVolume, func(clients backupClients, namespace, backupDir string, opts backup.Options) error {
+		return backup.BackupDataVolumes(clients.dynamic, clients.clientset.Discovery(), namespace, backupDir, opts)
+	}},
+	{layout.VirtualMachine, func(clients backupClients, namespace, backupDir string, opts backup.Options) error {
+		return backup.BackupVirtualMachines(clients.dynamic, clients.clientset.Discovery(), namespace, backupDir, opts)
+	}},
+	{layout.ControllerRevision, typed(backup.BackupControllerRevisions)},
+}
+
+// validateObjectRefs checks that every object of a backup of a list of
+// objects is of a kind backups capture.
+func validateObjectRefs(refs []backup.ObjectRef) error {
+	for _, ref := range refs {
+		if err := ref.Validate(); err != nil {
+			return err
+		}
+		k, _ := layout.LookupKind(ref.Kind)
+		backedUp := false
+		for _, f := range backupFuncs {
+			backedUp = backedUp || f.kind == k.Prefix
+		}
+		if !backedUp {
+			return fmt.Errorf("object %s: %s objects are not backed up per namespace", ref, k.Kind)
+		}
+	}
+	return nil
+}
+
+// backupClients are the clients of a single backup, reporting the warnings
+// of the API server to its recorder.
+type backupClients struct {
+	clientset *kubernetes.Clientset
+	dynamic   dynamic.Interface
+	warnings  *backup.WarningRecorder
+}
+
+func newBackupClients() (backupClients, error) {
+	clients := backupClients{warnings: backup.NewWarningRecorder()}
+	config := rest.CopyConfig(restConfig)
+	config.WarningHandler = clients.warnings
+
+	var err error
+	clients.clientset, err = kubernetes.NewForConfig(config)
+	if err != nil {
+		return clients, err
+	}
+	clients.dynamic, err = dynamic.NewForConfig(config)
+	return clients, err
+}
+
+// typed adapts a backup function that only needs the typed clientset.
+func typed(f func(*kubernetes.Clientset, string, string, backup.Options) error) func(backupClients, string, string, backup.Options) error {
+	return func(clients backupClients, namespace, backupDir string, opts backup.Options) error {
+		return f(clients.clientset, namespace, backupDir, opts)
+	}
+}
+
+// allocateBackupID hands out the ID of a backup about to be queued, so the
+// caller can be told which backup to wait for.
+func allocateBackupID() string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return allocateBackupIDLocked()
+}
+
+// allocateBackupIDLocked generates a unique backup ID. Must be called with
+// stateMu held.
+func allocateBackupIDLocked() string {
+	backupCounter++
+	persistLocked(settingChange("backup_counter", backupCounter))
+	return fmt.Sprintf("backup_%d", backupCounter)
+}
+
+type backupOptions struct {
+	// Position of this backup within a retried scheduled run, starting at 1
+	Attempt int
+	// Informer cache of the namespace, set for scheduled backups of policies
+	// with an inventory_cache
+	Cache *backup.InventoryCache
+	// Storage backend to keep the backup in, storage.default if empty
+	Storage string
+	// directory or archive, storage.format if empty
+	Format string
+	// config or full, see withBackupType
+	Type string
+	// Schedule taking the backup, whose retention applies to it
+	Schedule string
+	// Leave out the files Parent has unchanged, see manifest.Inherit. An
+	// empty Parent is the latest completed backup, without one the backup
+	// is a full one.
+	Incremental bool
+	Parent      string
+	// Algorithm to compress the files with, see compression.CompressDir
+	Compression string
+	// Only back up these objects. The backup is a config backup that never
+	// counts as the latest one, see latestBackupWith.
+	Objects []backup.ObjectRef
+	// ID handed out before the backup was queued, by allocateBackupID. A
+	// new one is allocated if empty.
+	BackupID string
+
+	// Manifest of Parent, set by createBackup
+	parent *manifest.Manifest
+
+	// Set by createBackup for applications with skip_unchanged
+	resourceVersions map[string]string
+	// Set by previewBackup, leaves out the steps that create objects in the
+	// cluster or copy data
+	preview bool
+}
+
+// createBackup captures the namespace of app into a new backup directory.
+// Failed attempts are recorded too, without their partial files, so the
+// history shows them.
+func createBackup(ctx context.Context, app Application, opts backupOptions) (Backup, error) {
+	if len(opts.Objects) > 0 {
+		opts.Type = config.BackupTypeConfig
+	}
+	app, backupType, err := withBackupType(app, opts.Type)
+	if err != nil {
+		return Backup{}, err
+	}
+	if opts.Incremental {
+		if opts.Parent, err = incrementalParent(app.AppID, opts.Parent); err != nil {
+			return Backup{}, err
+		}
+		if opts.Parent != "" {
+			m, ok, err := readManifest(ctx, opts.Parent)
+			if err != nil {
+				return Backup{}, fmt.Errorf("reading manifest of parent backup %s: %w", opts.Parent, err)
+			}
+			if ok {
+				opts.parent = &m
+			}
+		}
+	}
+
+	stateMu.Lock()
+	backupID := opts.BackupID
+	if backupID == "" {
+		backupID = allocateBackupIDLocked()
+	}
+	logs := joblog.New()
+	startedAt := time.Now()
+	backupLogs[backupID] = backupLog{appID: app.AppID, startedAt: startedAt, Buffer: logs}
+	restoredFrom := lastRestoreIntoLocked(app.Namespace)
+	stateMu.Unlock()
+	defer logs.Close()
+
+	logger := logs.Logger().With("backup_id", backupID)
+	logger.Info("backup started", "app_id", app.AppID, "namespace", app.Namespace, "attempt", opts.Attempt)
+	publishEvent(notify.LifecycleEvent{Type: notify.LifecycleBackupCreated, BackupID: backupID, Attempt: opts.Attempt}, app)
+
+	// Volume data changes without the objects changing, only config
+	// backups of the whole application can be skipped
+	if app.SkipUnchanged && backupType == config.BackupTypeConfig && len(opts.Objects) == 0 {
+		var prev Backup
+		var unchanged bool
+		opts.resourceVersions, prev, unchanged = unchangedSince(app, opts.Cache, logger)
+		if unchanged {
+			b := Backup{
+				BackupID:     backupID,
+				AppID:        app.AppID,
+				CreatedAt:    time.Now().UTC(),
+				Status:       backupStatusUnchanged,
+				Attempt:      opts.Attempt,
+				AppVersion:   prev.AppVersion,
+				SameAs:       prev.BackupID,
+				Type:         backupType,
+				ScheduleID:   opts.Schedule,
+				RestoredFrom: restoredFrom,
+			}
+			stateMu.Lock()
+			backups[backupID] = b
+			persistLocked(backupChange(backupID))
+			stateMu.Unlock()
+
+			logger.Info("nothing changed since the previous backup, no files written", "same_as", prev.BackupID)
+			publishEvent(notify.LifecycleEvent{Type: notify.LifecycleBackupCompleted, BackupID: backupID, Status: b.Status, Attempt: opts.Attempt}, app)
+			return b, nil
+		}
+	}
+
+	backupDir := fmt.Sprintf("./backups/%s", backupID)
+	m, err := writeBackup(ctx, app, backupDir, opts, logger)
+
+	// Associate the backup ID with the app ID for future reference
+	b := Backup{
+		BackupID:        backupID,
+		AppID:           app.AppID,
+		CreatedAt:       time.Now().UTC(),
+		Status:          backupStatusCompleted,
+		Attempt:         opts.Attempt,
+		AppVersion:      m.AppVersion,
+		VolumeSnapshots: m.VolumeSnapshots,
+		Type:            backupType,
+		ScheduleID:      opts.Schedule,
+		Parent:          m.Parent,
+		RestoredFrom:    restoredFrom,
+		Objects:         m.Objects,
+	}
+	if m.Encryption != nil {
+		b.EncryptionKeyID = m.Encryption.KeyID
+	}
+	if opts.Storage == "" {
+		opts.Storage = cfg.Storage.Default
+	}
+	if opts.Storage != config.LocalStorage {
+		b.Storage = opts.Storage
+	}
+	if opts.Format == "" {
+		opts.Format = cfg.Storage.Format
+	}
+	if opts.Format == config.FormatArchive {
+		b.Format = opts.Format
+	}
+
+	if err == nil && b.Format == config.FormatArchive {
+		logger.Info("packing backup into an archive")
+		if err = archiveBackup(backupID); err != nil {
+			err = fmt.Errorf("packing archive: %w", err)
+		}
+	}
+	if err == nil && b.Storage != "" {
+		logger.Info("uploading backup", "storage", b.Storage)
+		if err = storeBackup(ctx, b); err != nil {
+			err = fmt.Errorf("uploading to storage backend %s: %w", b.Storage, err)
+		}
+	}
+
+	if err != nil {
+		b.Status = backupStatusFailed
+		b.Error = err.Error()
+		// Snapshots that couldn't be deleted stay recorded, deleting the
+		// failed backup tries again
+		if deleteErr := deleteBackupFiles(context.Background(), b); deleteErr != nil {
+			logger.Warn("deleting files of failed backup", "error", deleteErr)
+		} else {
+			b.VolumeSnapshots = nil
+		}
+		b.Storage, b.Format = "", ""
+		logger.Error("backup failed", "error", err)
+	} else {
+		logger.Info("backup completed", "duration", time.Since(startedAt).Round(time.Millisecond).String())
+	}
+	b.DurationSeconds = time.Since(startedAt).Seconds()
+
+	stateMu.Lock()
+	backups[backupID] = b
+	persistLocked(backupChange(backupID))
+	stateMu.Unlock()
+
+	eventType := notify.LifecycleBackupCompleted
+	if err != nil {
+		eventType = notify.LifecycleBackupFailed
+	}
+	publishEvent(notify.LifecycleEvent{Type: eventType, BackupID: backupID, Status: b.Status, Error: b.Error, Attempt: opts.Attempt}, app)
+
+	// Scheduled runs notify once they give up retrying
+	if err != nil && opts.Attempt == 0 {
+		sendNotification(notify.Event{Type: notify.EventBackupFailed, BackupID: backupID, Error: b.Error, Time: b.CreatedAt}, app)
+	}
+
+	return b, err
+}
+
+// writeBackup returns the manifest of the backup once it is complete.
+func writeBackup(ctx context.Context, app Application, backupDir string, backupOpts backupOptions, logger *slog.Logger) (manifest.Manifest, error) {
+	// Checked again here in case the allow-list changed after registration
+	if !namespaceAllowed(app.Namespace) {
+		return manifest.Manifest{}, fmt.Errorf("namespace %s is not in backup_namespaces, it cannot be backed up", app.Namespace)
+	}
+
+	createdAt := time.Now().UTC()
+
+	// Create a directory to store the backup files
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return manifest.Manifest{}, err
+	}
+
+	clients, err := newBackupClients()
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+	// Set once the manifest is written
+	completed := false
+
+	cluster, err := backup.ClusterInfo(clients.clientset)
+	if err != nil {
+		return manifest.Manifest{}, fmt.Errorf("reading cluster version: %w", err)
+	}
+
+	opts := backup.Options{
+		Exclusions:          app.Exclusions,
+		IncludeFinished:     app.IncludeFinished,
+		KubeVirtSnapshots:   app.KubeVirtSnapshots && !backupOpts.preview,
+		VolumeSnapshotClass: app.VolumeSnapshotClass,
+		Cache:               backupOpts.Cache,
+		CaptureStatus:       app.CaptureStatus,
+		LabelSelector:       app.LabelSelector,
+		Objects:             backupOpts.Objects,
+	}
+
+	// Taken before the objects, closest to the state they are captured in
+	health, err := backup.HealthSnapshot(ctx, clients.clientset, app.Namespace, app.LabelSelector)
+	if err != nil {
+		return manifest.Manifest{}, fmt.Errorf("recording application health: %w", err)
+	}
+
+	m := manifest.Manifest{
+		LayoutVersion:    layout.CurrentVersion,
+		AppID:            app.AppID,
+		Namespace:        app.Namespace,
+		CreatedAt:        createdAt,
+		LabelSelector:    app.LabelSelector,
+		Counts:           map[string]int{},
+		Cluster:          cluster,
+		Health:           health,
+		ResourceVersions: backupOpts.resourceVersions,
+	}
+	for _, ref := range backupOpts.Objects {
+		m.Objects = append(m.Objects, ref.String())
+	}
+	logger.Info("recorded application health", "pods", health.Pods, "ready_pods", health.ReadyPods)
+
+	m.NamespaceMetadata, err = backup.NamespaceMetadata(ctx, clients.clientset, app.Namespace)
+	if err != nil {
+		return manifest.Manifest{}, fmt.Errorf("reading namespace: %w", err)
+	}
+
+	if len(app.VersionKeys) > 0 {
+		m.Versions, m.AppVersion, err = backup.AppVersions(clients.clientset, app.Namespace, app.VersionKeys, opts)
+		if err != nil {
+			return manifest.Manifest{}, fmt.Errorf("recording application version: %w", err)
+		}
+		logger.Info("recorded application version", "app_version", m.AppVersion)
+	}
+
+	backupLayout := layout.Current(backupDir)
+	for _, f := range backupFuncs {
+		// Cancelled backups stop between kinds
+		if err := ctx.Err(); err != nil {
+			return manifest.Manifest{}, err
+		}
+		if !opts.Selects(f.kind) {
+			continue
+		}
+		logger.Info("backing up", "kind", f.kind)
+		clients.warnings.SetKind(f.kind)
+		if err := f.backup(clients, app.Namespace, backupDir, opts); err != nil {
+			return manifest.Manifest{}, fmt.Errorf("backing up %s: %w", f.kind, err)
+		}
+		m.Kinds = append(m.Kinds, f.kind)
+
+		if err := backup.SeparateStatus(backupDir, f.kind, opts); err != nil {
+			return manifest.Manifest{}, fmt.Errorf("separating %s status: %w", f.kind, err)
+		}
+
+		files, err := backupLayout.ObjectFiles(f.kind)
+		if err != nil {
+			return manifest.Manifest{}, err
+		}
+		m.Counts[f.kind] = len(files)
+		logger.Info("backed up", "kind", f.kind, "objects", len(files))
+	}
+
+	// A missing object is most likely a typo, the backup would not hold
+	// what it was taken for
+	var missing []string
+	for _, ref := range backupOpts.Objects {
+		k, _ := layout.LookupKind(ref.Kind)
+		if _, err := os.Stat(layout.ObjectFile(backupDir, k.Prefix, ref.Name)); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, ref.String())
+		}
+	}
+	if len(missing) > 0 {
+		return manifest.Manifest{}, fmt.Errorf("objects not found: %s", strings.Join(missing, ", "))
+	}
+
+	clients.warnings.SetKind("class")
+	if err := backup.BackupClasses(clients.clientset, backupDir); err != nil {
+		return manifest.Manifest{}, fmt.Errorf("backing up priority and runtime classes: %w", err)
+	}
+	clients.warnings.SetKind(layout.CustomResourceDefinition)
+	if err := backup.BackupCRDs(clients.dynamic, backupDir); err != nil {
+		return manifest.Manifest{}, fmt.Errorf("backing up custom resource definitions: %w", err)
+	}
+	if app.VolumeSnapshots && !backupOpts.preview {
+		logger.Info("taking volume snapshots")
+		clients.warnings.SetKind(layout.VolumeSnapshot)
+		m.VolumeSnapshots, m.SnapshotGroup, err = backup.SnapshotVolumes(clients.dynamic, clients.clientset.Discovery(), app.Namespace, backupDir, opts)
+		if err != nil {
+			return manifest.Manifest{}, fmt.Errorf("taking volume snapshots: %w", err)
+		}
+		if m.SnapshotGroup != nil {
+			logger.Info("took volume snapshots", "snapshots", len(m.VolumeSnapshots), "group", m.SnapshotGroup.ID, "skew_ms", m.SnapshotGroup.SkewMS)
+		}
+
+		// Incomplete backups are never restored, their snapshots would
+		// only take up space
+		defer func() {
+			if completed {
+				return
+			}
+			if err := backup.DeleteVolumeSnapshots(context.Background(), clients.dynamic, m.VolumeSnapshots); err != nil {
+				logger.Warn("deleting volume snapshots of failed backup", "error", err)
+			}
+		}()
+	}
+	if app.DataMover && !backupOpts.preview {
+		logger.Info("copying volume data")
+		m.VolumeData, err = moveVolumeData(context.Background(), app.Namespace, backupDir)
+		if err != nil {
+			return manifest.Manifest{}, fmt.Errorf("copying volume data: %w", err)
+		}
+		if m.VolumeData != nil {
+			logger.Info("copied volume data", "repository", m.VolumeData.Repository, "volumes", len(m.VolumeData.Snapshots))
+		}
+	}
+	if app.CaptureStorage {
+		clients.warnings.SetKind("storage")
+		if err := backup.BackupStorage(clients.clientset, backupDir); err != nil {
+			return manifest.Manifest{}, fmt.Errorf("backing up persistent volumes and storage classes: %w", err)
+		}
+	}
+	for _, prefix := range []string{layout.PriorityClass, layout.RuntimeClass, layout.CustomResourceDefinition, layout.PersistentVolume, layout.StorageClass, layout.VolumeSnapshot} {
+		files, err := backupLayout.ObjectFiles(prefix)
+		if err != nil {
+			return manifest.Manifest{}, err
+		}
+		if len(files) > 0 {
+			m.Counts[prefix] = len(files)
+		}
+	}
+
+	m.Warnings = clients.warnings.Warnings()
+	for kind, texts := range m.Warnings {
+		for _, text := range texts {
+			logger.Warn("API server warning", "kind", kind, "warning", text)
+		}
+	}
+
+	m.UIDs, err = objectUIDs(backupDir)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+
+	m.Checksums, err = manifest.Checksums(backupDir)
+	if err != nil {
+		return manifest.Manifest{}, fmt.Errorf("computing checksums: %w", err)
+	}
+	if backupOpts.parent != nil {
+		if err := manifest.Inherit(backupDir, &m, backupOpts.Parent, *backupOpts.parent); err != nil {
+			return manifest.Manifest{}, fmt.Errorf("leaving out files unchanged since %s: %w", backupOpts.Parent, err)
+		}
+		logger.Info("left out files unchanged since the parent backup", "parent", m.Parent, "files", len(m.Inherited))
+	}
+
+	// Compressed before they are encrypted, ciphertext doesn't compress
+	if backupOpts.Compression != "" && backupOpts.Compression != compression.None {
+		if err := compression.CompressDir(backupDir, backupOpts.Compression, manifest.FileName); err != nil {
+			return manifest.Manifest{}, fmt.Errorf("compressing backup files: %w", err)
+		}
+		m.Compression = backupOpts.Compression
+	}
+	// Preview backups are deleted right away
+	if keyring != nil && !backupOpts.preview {
+		if err := encryptBackup(backupDir, &m); err != nil {
+			return manifest.Manifest{}, fmt.Errorf("encrypting backup files: %w", err)
+		}
+		logger.Info("encrypted backup files", "key_id", m.Encryption.KeyID)
+	}
+
+	logger.Info("writing manifest", "objects", len(m.UIDs))
+
+	// The manifest is written last and marks the backup as complete
+	if err := manifest.Write(backupDir, m); err != nil {
+		return manifest.Manifest{}, err
+	}
+	completed = true
+	return m, nil
+}
+
+var (
+	errBackupNotFound  = errors.New("Invalid backup_id")
+	errBackupNotReady  = errors.New("only completed backups can be restored")
+	errBackupTooRecent = errors.New("backup is younger than backup_deletion min_age")
+	errBackupInUse     = errors.New("backup is being restored")
+	errBackupDeleting  = errors.New("backup is being deleted")
+	errBackupIsParent  = errors.New("backup is the parent of incremental backups")
+	errBackupIsSameAs  = errors.New("unchanged backup runs refer to this backup")
+)
+
+// Number of restores and plans reading each backup, and the backups whose
+// files are being removed. Guarded by stateMu.
+var (
+	backupReaders   = map[string]int{}
+	backupsDeleting = map[string]bool{}
+)
+
+// Locks of the local directories of backups: readers share them, see
+// storedBackupFiles, and re-encryption holds one alone while it swaps the
+// directory for the re-encrypted copy. Guarded by stateMu.
+var backupDirLocks = map[string]*sync.RWMutex{}
+
+func backupDirLock(backupID string) *sync.RWMutex {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	lock, ok := backupDirLocks[backupID]
+	if !ok {
+		lock = &sync.RWMutex{}
+		backupDirLocks[backupID] = lock
+	}
+	return lock
+}
+
+// acquireBackup keeps backupID from being deleted until release is called.
+func acquireBackup(backupID string) (release func(), err error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if backupsDeleting[backupID] {
+		return nil, errBackupDeleting
+	}
+	backupReaders[backupID]++
+	return func() {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+
+		backupReaders[backupID]--
+		if backupReaders[backupID] == 0 {
+			delete(backupReaders, backupID)
+		}
+	}, nil
+}
+
+// deleteBackup removes a backup from disk and forgets about it. Completed
+// backups younger than the configured minimum age are only deleted with force.
+// Backups being restored are never deleted, not even with force.
+func deleteBackup(backupID string, force bool) error {
+	stateMu.Lock()
+	b, ok := backups[backupID]
+	switch {
+	case !ok:
+		stateMu.Unlock()
+		return errBackupNotFound
+	case backupsDeleting[backupID]:
+		stateMu.Unlock()
+		return errBackupDeleting
+	case backupReaders[backupID] > 0:
+		stateMu.Unlock()
+		return errBackupInUse
+	}
+	// Even forced, deleting a parent would break the incremental backups
+	// built on it
+	for _, child := range backups {
+		if child.Parent == backupID {
+			stateMu.Unlock()
+			return fmt.Errorf("%w, delete %s first", errBackupIsParent, child.BackupID)
+		}
+		// Restores, incremental backups and the RPO resolve unchanged runs
+		// to the backup they are the same as
+		if child.SameAs == backupID {
+			stateMu.Unlock()
+			return fmt.Errorf("%w, delete %s first", errBackupIsSameAs, child.BackupID)
+		}
+	}
+	minAge := cfg.BackupDeletion.MinAge.Duration
+	if !force && b.Status == backupStatusCompleted && time.Since(b.CreatedAt) < minAge {
+		stateMu.Unlock()
+		return fmt.Errorf("%w (%s)", errBackupTooRecent, minAge)
+	}
+	backupsDeleting[backupID] = true
+	stateMu.Unlock()
+
+	if err := deleteBackupFiles(context.Background(), b); err != nil {
+		stateMu.Lock()
+		delete(backupsDeleting, backupID)
+		stateMu.Unlock()
+		return err
+	}
+
+	stateMu.Lock()
+	delete(backupsDeleting, backupID)
+	delete(backups, backupID)
+	delete(backupLogs, backupID)
+	delete(backupDirLocks, backupID)
+	persistLocked(backupChange(backupID))
+	stateMu.Unlock()
+	return nil
+}
+
+// unchangedSince compares the resourceVersions in the namespace of app with
+// the ones recorded by its latest completed backup. The current versions are
+// returned for the next backup to record, nil if they couldn't be listed.
+func unchangedSince(app Application, cache *backup.InventoryCache, logger *slog.Logger) (versions map[string]string, prev Backup, unchanged bool) {
+	versions, err := backup.ResourceVersions(context.Background(), restoreClients.Metadata, app.Namespace, app.LabelSelector, cache)
+	if err != nil {
+		// Not worth failing over, the backup is taken in full
+		logger.Warn("listing resource versions", "error", err)
+		return nil, prev, false
+	}
+
+	prev, ok := latestBackupWith(app.AppID, func(b Backup) bool {
+		return b.Status == backupStatusCompleted && b.backupType() == config.BackupTypeConfig
+	})
+	if !ok {
+		return versions, prev, false
+	}
+	m, ok, err := readManifest(context.Background(), prev.BackupID)
+	if err != nil {
+		logger.Warn("reading previous manifest", "backup_id", prev.BackupID, "error", err)
+		return versions, prev, false
+	}
+	return versions, prev, ok && m.ResourceVersions != nil && maps.Equal(m.ResourceVersions, versions)
+}
+
+// latestBackup returns the most recent completed backup of appID.
+func latestBackup(appID string) (Backup, bool) {
+	return latestBackupWith(appID, func(b Backup) bool { return b.Status == backupStatusCompleted })
+}
+
+// incrementalParent checks that parentID can be the parent of an incremental
+// backup of appID. An empty parentID is the latest completed backup of appID,
+// or none if there is none yet. Unchanged runs stand for the backup they
+// refer to.
+func incrementalParent(appID, parentID string) (string, error) {
+	if parentID == "" {
+		latest, _ := latestBackup(appID)
+		return latest.BackupID, nil
+	}
+
+	stateMu.Lock()
+	b, ok := backups[parentID]
+	stateMu.Unlock()
+	switch {
+	case !ok || b.AppID != appID:
+		return "", fmt.Errorf("parent %s is not a backup of %s", parentID, appID)
+	case b.Status == backupStatusUnchanged:
+		return b.SameAs, nil
+	case b.Status != backupStatusCompleted:
+		return "", fmt.Errorf("parent %s is not a completed backup", parentID)
+	}
+	return parentID, nil
+}
+
+// latestRecoveryPoint returns the most recent completed or unchanged backup
+// of appID, the last time its state is known to have been captured.
+func latestRecoveryPoint(appID string) (Backup, bool) {
+	return latestBackupWith(appID, func(b Backup) bool {
+		return b.Status == backupStatusCompleted || b.Status == backupStatusUnchanged
+	})
+}
+
+// latestAttempt returns the most recent backup of appID, failed or not.
+func latestAttempt(appID string) (Backup, bool) {
+	return latestBackupWith(appID, func(b Backup) bool { return true })
+}
+
+// latestBackupWith returns the most recent backup of appID that match accepts.
+// Backups of a list of objects only hold part of the application, they are
+// never the latest.
+func latestBackupWith(appID string, match func(Backup) bool) (Backup, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var latest Backup
+	found := false
+	for _, b := range backups {
+		if b.AppID != appID || len(b.Objects) > 0 || !match(b) {
+			continue
+		}
+		if !found || b.CreatedAt.After(latest.CreatedAt) {
+			latest = b
+			found = true
+		}
+	}
+	return latest, found
+}
+
+func objectUIDs(backupDir string) (map[string]string, error) {
+	backupLayout := layout.Current(backupDir)
+
+	uids := map[string]string{}
+	for _, k := range layout.Kinds {
+		files, err := backupLayout.ObjectFiles(k.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			obj, err := backupLayout.ReadObject(file, k)
+			if err != nil {
+				return nil, err
+			}
+			uids[k.Prefix+"/"+obj.GetName()] = string(obj.GetUID())
+		}
+	}
+	return uids, nil
+}
+
+// deleteBackupByID deletes a backup. ?force=true deletes backups younger than
+// backup_deletion min_age too, which only admins may do.
+func deleteBackupByID(c *gin.Context) {
+	force := c.Query("force") == "true"
+	if force && !auth.FromContext(c).Role.Allows(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forced deletion requires the admin role"})
+		return
+	}
+
+	backupID := c.Param("id")
+	err := deleteBackup(backupID, force)
+	switch {
+	case errors.Is(err, errBackupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errBackupTooRecent):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error() + ", pass force=true as an admin to delete it anyway"})
+		return
+	case errors.Is(err, errBackupInUse), errors.Is(err, errBackupDeleting), errors.Is(err, errBackupIsParent), errors.Is(err, errBackupIsSameAs):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Backup deleted", "backup_id": backupID})
+}
+
+// backupListItem is a backup with its size on disk.
+type backupListItem struct {
+	Backup
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// listBackups returns the backups oldest first, filtered by ?app_id= and by
+// creation time with ?created_after= and ?created_before= (RFC 3339).
+func listBackups(c *gin.Context) {
+	appID := c.Query("app_id")
+	backupType := c.Query("type")
+	if backupType != "" && backupType != config.BackupTypeConfig && backupType != config.BackupTypeFull {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of: config, full"})
+		return
+	}
+	var after, before time.Time
+	for _, f := range []struct {
+		param string
+		t     *time.Time
+	}{{"created_after", &after}, {"created_before", &before}} {
+		value := c.Query(f.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an RFC 3339 timestamp, e.g. 2024-01-02T15:04:05Z", f.param)})
+			return
+		}
+		*f.t = t
+	}
+
+	stateMu.Lock()
+	var matched []Backup
+	for _, b := range backups {
+		if appID != "" && b.AppID != appID {
+			continue
+		}
+		if backupType != "" && b.backupType() != backupType {
+			continue
+		}
+		if (!after.IsZero() && !b.CreatedAt.After(after)) || (!before.IsZero() && !b.CreatedAt.Before(before)) {
+			continue
+		}
+		matched = append(matched, b)
+	}
+	stateMu.Unlock()
+
+	slices.SortFunc(matched, func(a, b Backup) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	list := make([]backupListItem, 0, len(matched))
+	for _, b := range matched {
+		size, err := backupSizeBytes(b.BackupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		list = append(list, backupListItem{Backup: b, SizeBytes: size})
+	}
+	respondJSON(c, gin.H{"backups": list}, time.Time{})
+}
+
+// getBackupManifest returns the manifest of a backup.
+func getBackupManifest(c *gin.Context) {
+	backupID := c.Param("id")
+
+	stateMu.Lock()
+	b, ok := backups[backupID]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid backup_id"})
+		return
+	}
+
+	m, ok, err := readManifest(c.Request.Context(), backupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		// Failed and unchanged runs, and backups taken before manifests existed
+		c.JSON(http.StatusNotFound, gin.H{"error": "Backup has no manifest"})
+		return
+	}
+	respondJSON(c, m, b.CreatedAt)
+}
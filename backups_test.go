@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// chdir runs the rest of the test in dir, for the functions working on
+// ./backups.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestDeleteBackupReferencedByOtherRuns(t *testing.T) {
+	created := time.Now().Add(-time.Hour).UTC()
+
+	tests := []struct {
+		name    string
+		backups []Backup
+		delete  string
+		wantErr error
+	}{
+		{
+			name: "unreferenced",
+			backups: []Backup{
+				{BackupID: "backup_1", Status: backupStatusCompleted},
+			},
+			delete: "backup_1",
+		},
+		{
+			name: "parent of an incremental backup",
+			backups: []Backup{
+				{BackupID: "backup_1", Status: backupStatusCompleted},
+				{BackupID: "backup_2", Status: backupStatusCompleted, Parent: "backup_1"},
+			},
+			delete:  "backup_1",
+			wantErr: errBackupIsParent,
+		},
+		{
+			name: "same_as of an unchanged run",
+			backups: []Backup{
+				{BackupID: "backup_1", Status: backupStatusCompleted},
+				{BackupID: "backup_2", Status: backupStatusUnchanged, SameAs: "backup_1"},
+			},
+			delete:  "backup_1",
+			wantErr: errBackupIsSameAs,
+		},
+		{
+			name: "unchanged run itself",
+			backups: []Backup{
+				{BackupID: "backup_1", Status: backupStatusCompleted},
+				{BackupID: "backup_2", Status: backupStatusUnchanged, SameAs: "backup_1"},
+			},
+			delete: "backup_2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdir(t, t.TempDir())
+			backups = map[string]Backup{}
+			for _, b := range tt.backups {
+				b.AppID = "app_1"
+				b.CreatedAt = created
+				backups[b.BackupID] = b
+			}
+
+			err := deleteBackup(tt.delete, false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("deleteBackup() error = %v, want %v", err, tt.wantErr)
+			}
+			if _, ok := backups[tt.delete]; ok == (tt.wantErr == nil) {
+				t.Errorf("backup %s recorded = %v, want %v", tt.delete, ok, tt.wantErr != nil)
+			}
+		})
+	}
+}
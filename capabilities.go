@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/restore"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Optional engine features. Each flag is false until this deployment
+// supports it, so clients can check before offering an option.
+type engineFeatures struct {
+	// Copying volume data out of the cluster, not only PVC objects
+	SnapshotDataMovement bool `json:"snapshot_data_movement"`
+	Encryption           bool `json:"encryption"`
+	CustomResources      bool `json:"custom_resources"`
+	// CSI VolumeSnapshots of PVCs, see Application.VolumeSnapshots
+	VolumeSnapshots bool `json:"volume_snapshots"`
+}
+
+type capabilities struct {
+	LayoutVersion   int            `json:"layout_version"`
+	Kinds           []string       `json:"kinds"`
+	StorageBackends []string       `json:"storage_backends"`
+	BackupTypes     []string       `json:"backup_types"`
+	Features        engineFeatures `json:"features"`
+	Restore         struct {
+		ExistingResourcePolicies []string `json:"existing_resource_policies"`
+		GitOpsModes              []string `json:"gitops_modes"`
+		MissingClassPolicies     []string `json:"missing_class_policies"`
+		VolumePolicies           []string `json:"volume_policies"`
+	} `json:"restore"`
+	// What is switched on in the configuration
+	Enabled struct {
+		OIDC               bool `json:"oidc"`
+		APIKeys            bool `json:"api_keys"`
+		Webhooks           bool `json:"webhooks"`
+		ProtectionPolicies bool `json:"protection_policies"`
+	} `json:"enabled"`
+}
+
+// getCapabilities tells clients which optional features this deployment
+// supports and has enabled, so they can adapt without trial and error.
+func getCapabilities(c *gin.Context) {
+	caps := capabilities{
+		LayoutVersion:   layout.CurrentVersion,
+		StorageBackends: []string{"filesystem", config.StorageS3},
+		BackupTypes:     []string{config.BackupTypeConfig, config.BackupTypeFull},
+		Features:        engineFeatures{VolumeSnapshots: true},
+	}
+	for _, k := range layout.Kinds {
+		caps.Kinds = append(caps.Kinds, k.Kind)
+	}
+	for _, k := range layout.ClassKinds {
+		caps.Kinds = append(caps.Kinds, k.Kind.Kind)
+	}
+	caps.Kinds = append(caps.Kinds, layout.CRDKind.Kind, layout.PVKind.Kind, layout.StorageClassKind.Kind)
+
+	caps.Restore.ExistingResourcePolicies = []string{restore.PolicySkip, restore.PolicyReplace, restore.PolicyRepair}
+	caps.Restore.GitOpsModes = []string{restore.GitOpsWarn, restore.GitOpsSkip, restore.GitOpsPause}
+	caps.Restore.MissingClassPolicies = []string{restore.MissingClassKeep, restore.MissingClassStrip, restore.MissingClassCreate}
+	caps.Restore.VolumePolicies = []string{restore.VolumeKeep, restore.VolumeStrip, restore.VolumeCreate}
+
+	caps.Enabled.OIDC = cfg.OIDC != nil
+	caps.Enabled.APIKeys = apiKeys != nil
+	caps.Enabled.Webhooks = len(webhooks) > 0
+	caps.Enabled.ProtectionPolicies = len(cfg.ProtectionPolicies) > 0
+
+	c.JSON(http.StatusOK, caps)
+}
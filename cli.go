@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"net_exercise/pkg/archive"
+	"net_exercise/pkg/manifest"
+	"net_exercise/pkg/restore"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Exit codes of the backup and restore subcommands
+const (
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+// backupCommand backs up a namespace straight into a directory or .tar.gz
+// archive, without the API server or its metadata, e.g. from a Job or CI:
+//
+//	netx backup --namespace shop --output /backups/shop.tar.gz
+func backupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	namespace := flags.String("namespace", "", "namespace to back up (required)")
+	output := flags.String("output", "", "new directory to write the backup to, or a path ending in .tar.gz for an archive (required)")
+	labelSelector := flags.String("label-selector", "", "only back up the objects matching this label selector")
+	captureStorage := flags.Bool("capture-storage", false, "also back up the bound PersistentVolumes and their StorageClasses")
+	volumeSnapshots := flags.Bool("volume-snapshots", false, "take a CSI VolumeSnapshot of every bound PVC")
+	dataMover := flags.Bool("data-mover", false, "copy the files of every bound PVC to the data_mover restic repository")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *namespace == "" || *output == "" {
+		fmt.Fprintln(os.Stderr, "backup: --namespace and --output are required")
+		flags.Usage()
+		return exitUsage
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if err := initClients(); err != nil {
+		logger.Error("backup failed", "error", err)
+		return exitFailed
+	}
+
+	app := Application{Name: *namespace, Namespace: *namespace, LabelSelector: *labelSelector, CaptureStorage: *captureStorage, VolumeSnapshots: *volumeSnapshots, DataMover: *dataMover}
+	if err := app.validate(); err != nil {
+		logger.Error("backup failed", "error", err)
+		return exitFailed
+	}
+
+	if err := runBackupCommand(app, *output, logger); err != nil {
+		logger.Error("backup failed", "error", err)
+		return exitFailed
+	}
+	return 0
+}
+
+func runBackupCommand(app Application, output string, logger *slog.Logger) error {
+	if _, err := os.Stat(output); err == nil {
+		return fmt.Errorf("%s already exists", output)
+	}
+
+	backupDir := output
+	packed := strings.HasSuffix(output, ".tar.gz")
+	if packed {
+		var err error
+		backupDir, err = os.MkdirTemp("", "netx-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(backupDir)
+	}
+
+	m, err := writeBackup(context.Background(), app, backupDir, backupOptions{}, logger)
+	if err != nil {
+		if !packed {
+			os.RemoveAll(backupDir)
+		}
+		return err
+	}
+	if packed {
+		if err := archive.Pack(backupDir, output, manifest.FileName); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("backup written", "output", output, "objects", len(m.UIDs))
+	return nil
+}
+
+// restoreCommand restores a backup directory or archive, as written by the
+// backup subcommand or found under ./backups, and prints the result as JSON.
+// With --plan it prints the plan instead and changes nothing.
+func restoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := flags.String("from", "", "backup directory or .tar.gz archive to restore (required)")
+	namespace := flags.String("namespace", "", "namespace to restore into, the backed up namespace by default")
+	policy := flags.String("existing-resource-policy", "", "what to do with objects that already exist: skip (default), replace or repair")
+	confirmToken := flags.String("confirm-token", "", "confirm_token of the plan, required when the restore deletes objects")
+	volumePolicy := flags.String("volume-policy", "", "what to do with PVCs bound to volumes the cluster lacks: keep (default), strip or create")
+	restoreSnapshots := flags.Bool("restore-snapshots", false, "provision PVCs from the volume snapshots in the backup")
+	createNamespace := flags.Bool("create-namespace", false, "create the namespace if it doesn't exist, with the labels and annotations of the backed up one")
+	planOnly := flags.Bool("plan", false, "print the restore plan without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *from == "" {
+		fmt.Fprintln(os.Stderr, "restore: --from is required")
+		flags.Usage()
+		return exitUsage
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if err := initClients(); err != nil {
+		logger.Error("restore failed", "error", err)
+		return exitFailed
+	}
+
+	out, err := runRestoreCommand(context.Background(), *from, *namespace, *planOnly, restore.Options{
+		ExistingResourcePolicy: *policy,
+		ConfirmToken:           *confirmToken,
+		VolumePolicy:           *volumePolicy,
+		RestoreSnapshots:       *restoreSnapshots,
+		FinalizerRules:         cfg.RestoreFinalizers,
+		CreateNamespace:        *createNamespace,
+	})
+	if out != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(out)
+	}
+	if errors.Is(err, restore.ErrConfirmationRequired) {
+		logger.Error("restore failed, review the plan with --plan and pass its confirm_token with --confirm-token", "error", err)
+		return exitFailed
+	}
+	if err != nil {
+		logger.Error("restore failed", "error", err)
+		return exitFailed
+	}
+	return 0
+}
+
+// runRestoreCommand returns the plan or result to print, which is also set
+// for restores failing part way.
+func runRestoreCommand(ctx context.Context, from, namespace string, planOnly bool, opts restore.Options) (any, error) {
+	backupDir := from
+	if strings.HasSuffix(from, ".tar.gz") {
+		var err error
+		backupDir, err = os.MkdirTemp("", "netx-restore-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(backupDir)
+		if err := archive.Unpack(from, backupDir); err != nil {
+			return nil, err
+		}
+	}
+
+	m, ok, err := manifest.Read(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s has no %s, it is not a complete backup", from, manifest.FileName)
+	}
+	if m.Encryption != nil || m.Compression != "" {
+		plain, cleanup, err := plainBackupFiles(backupDir, m)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		backupDir = plain
+	}
+	if namespace == "" {
+		namespace = m.Namespace
+	}
+	if namespace == "" {
+		return nil, errors.New("the backup does not record its namespace, pass --namespace")
+	}
+	opts.BackupTime = m.CreatedAt
+	opts.SourceNamespace = m.Namespace
+
+	if !opts.CreateNamespace {
+		if _, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{}); err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", namespace, err)
+		}
+	}
+
+	if planOnly {
+		plan, err := restore.BuildPlan(ctx, backupDir, namespace, restoreClients, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer plan.Close()
+		return plan, nil
+	}
+
+	result, err := restore.RestoreResources(ctx, backupDir, namespace, restoreClients, opts)
+	if result == nil {
+		return nil, err
+	}
+	return result, err
+}
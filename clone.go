@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cloneRequest takes the restore settings that make sense for a fresh copy.
+// Objects keep their names; they are moved to Namespace.
+type cloneRequest struct {
+	Namespace            string              `json:"namespace" binding:"required,dns1123label"`
+	GitOpsMode           string              `json:"gitops_mode" binding:"omitempty,oneof=warn skip pause"`
+	PriorityClassMapping map[string]string   `json:"priority_class_mapping"`
+	RuntimeClassMapping  map[string]string   `json:"runtime_class_mapping"`
+	MissingClassPolicy   string              `json:"missing_class_policy" binding:"omitempty,oneof=keep strip create"`
+	SchedulingTimeout    *config.Duration    `json:"scheduling_timeout"`
+	GenerateNamePolicy   string              `json:"generate_name_policy" binding:"omitempty,oneof=keep skip regenerate"`
+	ConfigMapOverrides   []configMapOverride `json:"config_map_overrides" binding:"dive"`
+	CreateNamespace      bool                `json:"create_namespace"`
+}
+
+func (r cloneRequest) restoreRequest(backupID string) restoreRequest {
+	return restoreRequest{
+		Namespace:            r.Namespace,
+		BackupID:             backupID,
+		GitOpsMode:           r.GitOpsMode,
+		PriorityClassMapping: r.PriorityClassMapping,
+		RuntimeClassMapping:  r.RuntimeClassMapping,
+		MissingClassPolicy:   r.MissingClassPolicy,
+		SchedulingTimeout:    r.SchedulingTimeout,
+		GenerateNamePolicy:   r.GenerateNamePolicy,
+		ConfigMapOverrides:   r.ConfigMapOverrides,
+		CreateNamespace:      r.CreateNamespace,
+	}
+}
+
+// cloneApplication duplicates an application into another namespace: a
+// job takes a backup and restores it right away. Both show up in the
+// history.
+func cloneApplication(c *gin.Context) {
+	var requestBody cloneRequest
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+
+	stateMu.Lock()
+	app, ok := apps[c.Param("id")]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid app_id"})
+		return
+	}
+	if requestBody.Namespace == app.Namespace {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespace must differ from the application's namespace"})
+		return
+	}
+	if err := checkConfigMapOverrides(requestBody.ConfigMapOverrides, app.Namespace, requestBody.Namespace); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Checked before the backup is taken, so a typo doesn't cost a backup
+	if !requestBody.CreateNamespace {
+		_, err := clientset.CoreV1().Namespaces().Get(c.Request.Context(), requestBody.Namespace, metav1.GetOptions{})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Namespace does not exist"})
+			return
+		}
+	}
+
+	submitJob(c, "clone", cloneJob(app, requestBody))
+}
+
+// cloneJob backs up app and restores the backup as requestBody asks, its
+// result names both.
+func cloneJob(app Application, requestBody cloneRequest) worker.Func {
+	return func(ctx context.Context) (any, error) {
+		b, err := createBackup(ctx, app, backupOptions{})
+		if err != nil {
+			return gin.H{"backup_id": b.BackupID}, err
+		}
+
+		// An unchanged run restores the backup it refers to
+		backupID, err := resolveBackupID(app.AppID, b.BackupID, "", "")
+		if err != nil {
+			return gin.H{"backup_id": b.BackupID}, err
+		}
+		restoreReq := requestBody.restoreRequest(backupID)
+		opts, err := restoreReq.options(ctx, backupID)
+		if err != nil {
+			return gin.H{"backup_id": b.BackupID}, err
+		}
+
+		record, result, err := runRestore(ctx, restoreReq, backupID, opts)
+		response := restoreJobResult(record, result, err)
+		if err == nil {
+			response["message"] = "Application cloned successfully"
+		}
+		response["backup_id"] = b.BackupID
+		return response, err
+	}
+}
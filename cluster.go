@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long one connectivity check may take before it counts as failed
+const clusterCheckTimeout = 10 * time.Second
+
+// clusterStatus is whether the Kubernetes API server was reached. Until it
+// is, the service runs degraded and only serves read-only metadata.
+type clusterStatus struct {
+	mu        sync.Mutex
+	connected bool
+	attempts  int
+	lastErr   string
+}
+
+var cluster clusterStatus
+
+func (s *clusterStatus) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// checkCluster asks the API server for its version.
+func checkCluster() error {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterCheckTimeout)
+	defer cancel()
+	return clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// connectCluster checks the API server until it is reachable, waiting twice
+// as long after every failed attempt, and then calls onConnected. The first
+// check runs before connectCluster returns, so a reachable cluster is ready
+// from the start; otherwise the checks continue in the background.
+func connectCluster(onConnected func()) {
+	if tryConnectCluster() {
+		onConnected()
+		return
+	}
+	log.Printf("Kubernetes API server unreachable, starting in degraded mode: %s", cluster.lastErr)
+
+	go func() {
+		backoff := cfg.Cluster.ConnectBackoff.Duration
+		for {
+			time.Sleep(backoff)
+			if tryConnectCluster() {
+				log.Printf("connected to the Kubernetes API server after %d attempts", cluster.attempts)
+				onConnected()
+				return
+			}
+			backoff = min(2*backoff, cfg.Cluster.ConnectMaxBackoff.Duration)
+			log.Printf("Kubernetes API server still unreachable, retrying in %s: %s", backoff, cluster.lastErr)
+		}
+	}()
+}
+
+func tryConnectCluster() bool {
+	err := checkCluster()
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	cluster.attempts++
+	if err != nil {
+		cluster.lastErr = err.Error()
+		return false
+	}
+	cluster.connected = true
+	cluster.lastErr = ""
+	return true
+}
+
+// readyz reports whether the service is connected to the cluster, for
+// readiness probes.
+func readyz(c *gin.Context) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	if !cluster.connected {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":   "degraded",
+			"attempts": cluster.attempts,
+			"error":    cluster.lastErr,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// requireCluster refuses requests that need the cluster or change state while
+// the service is degraded.
+func requireCluster(c *gin.Context) {
+	if !cluster.Connected() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "not connected to the Kubernetes API server, only read-only endpoints are available"})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondJSON writes body like c.JSON, with an ETag of the response so
+// clients polling listings and manifests can revalidate with If-None-Match
+// and get 304 Not Modified instead of the same body again. lastModified is
+// sent as Last-Modified unless it is zero.
+func respondJSON(c *gin.Context, body any, lastModified time.Time) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sum := sha256.Sum256(data)
+	if notModified(c, `"`+hex.EncodeToString(sum[:16])+`"`, lastModified) {
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// notModified sets the ETag and Last-Modified headers and, if the client's
+// copy is current, answers 304 Not Modified. If-None-Match takes precedence
+// over If-Modified-Since, as in RFC 9110.
+func notModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				c.Status(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !lastModified.IsZero() &&
+		!lastModified.Truncate(time.Second).After(since) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/datamover"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// moveVolumeData copies the files of the bound PVCs in backupDir to the
+// data mover's restic repository for the namespace.
+func moveVolumeData(ctx context.Context, namespace, backupDir string) (*manifest.VolumeData, error) {
+	if cfg.DataMover == nil {
+		return nil, fmt.Errorf("data_mover is not configured")
+	}
+	mover, err := newDataMover(*cfg.DataMover, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	backupLayout := layout.Current(backupDir)
+	files, err := backupLayout.ObjectFiles(layout.PVC)
+	if err != nil {
+		return nil, err
+	}
+	pvcKind, _ := layout.LookupKind(layout.PVC)
+	var pvcs []string
+	for _, file := range files {
+		pvc, err := backupLayout.ReadObject(file, pvcKind)
+		if err != nil {
+			return nil, err
+		}
+		// Only bound PVCs can be mounted
+		if volumeName, _, _ := unstructured.NestedString(pvc.Object, "spec", "volumeName"); volumeName != "" {
+			pvcs = append(pvcs, pvc.GetName())
+		}
+	}
+	if len(pvcs) == 0 {
+		return nil, nil
+	}
+
+	snapshots, err := mover.BackupPVCs(ctx, namespace, pvcs)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest.VolumeData{Repository: mover.Repository, Snapshots: snapshots}, nil
+}
+
+// newDataMover points a Mover at the repository of namespace, below
+// restic/<namespace> in the data mover's storage backend.
+func newDataMover(c config.DataMover, namespace string) (datamover.Mover, error) {
+	i := slices.IndexFunc(cfg.Storage.Backends, func(b config.StorageBackend) bool { return b.Name == c.Storage })
+	s3 := cfg.Storage.Backends[i].S3
+
+	password := os.Getenv(c.PasswordEnv)
+	if password == "" {
+		return datamover.Mover{}, fmt.Errorf("data_mover: environment variable %s must hold the repository password", c.PasswordEnv)
+	}
+	accessKeyIDEnv, secretAccessKeyEnv := s3.AccessKeyIDEnv, s3.SecretAccessKeyEnv
+	if accessKeyIDEnv == "" {
+		accessKeyIDEnv = "AWS_ACCESS_KEY_ID"
+	}
+	if secretAccessKeyEnv == "" {
+		secretAccessKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	env := map[string]string{
+		"RESTIC_PASSWORD":       password,
+		"AWS_ACCESS_KEY_ID":     os.Getenv(accessKeyIDEnv),
+		"AWS_SECRET_ACCESS_KEY": os.Getenv(secretAccessKeyEnv),
+		"AWS_DEFAULT_REGION":    s3.Region,
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		env["AWS_SESSION_TOKEN"] = token
+	}
+
+	// The Pods reach the endpoint through the backend's proxy, not this process's
+	if s3.Proxy != "" {
+		env["HTTPS_PROXY"] = s3.Proxy
+		env["HTTP_PROXY"] = s3.Proxy
+	}
+	var caCert []byte
+	if s3.CAFile != "" {
+		var err error
+		caCert, err = os.ReadFile(s3.CAFile)
+		if err != nil {
+			return datamover.Mover{}, fmt.Errorf("data_mover: reading ca_file of storage backend %s: %w", c.Storage, err)
+		}
+	}
+
+	host := "s3." + s3.Region + ".amazonaws.com"
+	if s3.Endpoint != "" {
+		host = strings.TrimSuffix(s3.Endpoint, "/")
+	}
+	return datamover.Mover{
+		Clientset:   clientset,
+		Image:       c.Image,
+		Repository:  fmt.Sprintf("s3:%s/%s/%srestic/%s", host, s3.Bucket, s3.Prefix, namespace),
+		Env:         env,
+		Timeout:     c.Timeout.Duration,
+		CACert:      string(caCert),
+		InsecureTLS: s3.InsecureSkipVerify,
+	}, nil
+}
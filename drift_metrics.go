@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"net_exercise/pkg/drift"
+	"net_exercise/pkg/manifest"
+)
+
+// driftSample is how an application differed from its latest backup when the
+// drift analyzer last looked.
+type driftSample struct {
+	checkedAt time.Time
+	report    *drift.Report
+}
+
+// Latest sample of every application, guarded by stateMu
+var driftSamples = map[string]driftSample{}
+
+// runDriftAnalyzer compares every application with its latest backup every
+// interval, for the drift metrics, until the process exits.
+func runDriftAnalyzer(interval time.Duration) {
+	for {
+		stateMu.Lock()
+		appList := make([]Application, 0, len(apps))
+		for _, app := range apps {
+			appList = append(appList, app)
+		}
+		for id := range driftSamples {
+			if _, ok := apps[id]; !ok {
+				delete(driftSamples, id)
+			}
+		}
+		stateMu.Unlock()
+
+		for _, app := range appList {
+			if err := analyzeDrift(context.Background(), app); err != nil {
+				log.Printf("analyzing drift of %s: %v", app.AppID, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// analyzeDrift records how app differs from its latest completed backup. The
+// sample of an application without one is dropped.
+func analyzeDrift(ctx context.Context, app Application) error {
+	last, ok := latestBackup(app.AppID)
+	if !ok {
+		stateMu.Lock()
+		delete(driftSamples, app.AppID)
+		stateMu.Unlock()
+		return nil
+	}
+
+	backupDir, cleanup, err := backupFiles(ctx, last.BackupID)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	m, _, err := manifest.Read(backupDir)
+	if err != nil {
+		return err
+	}
+	report, err := drift.Compare(ctx, backupDir, app.Namespace, m.LabelSelector, last.CreatedAt, restoreClients.Metadata)
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	driftSamples[app.AppID] = driftSample{checkedAt: time.Now().UTC(), report: report}
+	stateMu.Unlock()
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"net_exercise/pkg/archive"
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/encryption"
+	"net_exercise/pkg/manifest"
+	"net_exercise/pkg/storage"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Only set when encryption is configured, see config.Encryption
+var keyring *encryption.Keyring
+
+// Key chosen with PUT /admin/encryption/key, saved in the metadata store so
+// it outlives restarts; empty while key_id of the configuration applies.
+// Guarded by stateMu.
+var encryptionKeyID string
+
+// Progress of the last re-encryption job, nil before the first. Guarded by
+// stateMu.
+var reencryption *reencryptionProgress
+
+var errReencryptionRunning = errors.New("a re-encryption job is already running")
+
+// reencryptionProgress reports how far a re-encryption job got. Backups that
+// are not encrypted, or already with KeyID, count as skipped.
+type reencryptionProgress struct {
+	JobID       string                `json:"job_id"`
+	KeyID       string                `json:"key_id"`
+	Total       int                   `json:"total"`
+	Reencrypted int                   `json:"reencrypted"`
+	Skipped     int                   `json:"skipped"`
+	Failed      []reencryptionFailure `json:"failed,omitempty"`
+	StartedAt   *time.Time            `json:"started_at,omitempty"`
+	FinishedAt  *time.Time            `json:"finished_at,omitempty"`
+}
+
+type reencryptionFailure struct {
+	BackupID string `json:"backup_id"`
+	Error    string `json:"error"`
+}
+
+// encryptBackup encrypts the files of a backup being written, except for its
+// manifest, and records the key in m. plainBackupFiles decrypts them.
+func encryptBackup(backupDir string, m *manifest.Manifest) error {
+	keyID, err := keyring.EncryptDir(backupDir, manifest.FileName)
+	if err != nil {
+		return err
+	}
+	m.Encryption = &manifest.Encryption{Algorithm: encryption.Algorithm, KeyID: keyID}
+	return nil
+}
+
+// loadEncryptionKeyLocked makes the key saved by a previous run current. A
+// key that was removed from the configuration since is ignored. It must be
+// called with stateMu held.
+func loadEncryptionKeyLocked(keyID string) {
+	encryptionKeyID = keyID
+	if keyring == nil || keyID == "" {
+		return
+	}
+	if err := keyring.SetCurrent(keyID); err != nil {
+		log.Printf("ALERT %v, encrypting new backups with key %s", err, keyring.Current())
+		encryptionKeyID = ""
+	}
+}
+
+func getEncryption(c *gin.Context) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	// Backups recorded before their key was, and unencrypted ones, are not
+	// counted
+	counts := map[string]int{}
+	for _, b := range backups {
+		if b.EncryptionKeyID != "" {
+			counts[b.EncryptionKeyID]++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":       keyring.Current(),
+		"keys":         keyring.KeyIDs(),
+		"backups":      counts,
+		"reencryption": reencryption,
+	})
+}
+
+// setEncryptionKey rotates the key new backups are encrypted with to another
+// configured key.
+func setEncryptionKey(c *gin.Context) {
+	var requestBody struct {
+		KeyID string `json:"key_id" binding:"required"`
+	}
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	previous := keyring.Current()
+	if err := keyring.SetCurrent(requestBody.KeyID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	encryptionKeyID = requestBody.KeyID
+	persistLocked(settingChange("encryption_key_id", encryptionKeyID))
+
+	c.JSON(http.StatusOK, gin.H{"key_id": requestBody.KeyID, "previous_key_id": previous})
+}
+
+// reencryptBackups queues a job re-encrypting the backups encrypted with
+// other keys with the current one, GET /admin/encryption reports its
+// progress.
+func reencryptBackups(c *gin.Context) {
+	stateMu.Lock()
+	if reencryption != nil && reencryption.FinishedAt == nil {
+		stateMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": errReencryptionRunning.Error(), "reencryption": reencryption})
+		return
+	}
+	progress := &reencryptionProgress{KeyID: keyring.Current()}
+	job, err := jobs.Submit("reencrypt", reencryptJob(progress))
+	if err != nil {
+		stateMu.Unlock()
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	progress.JobID = job.ID
+	reencryption = progress
+	stateMu.Unlock()
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// reencryptJob re-encrypts every completed backup with progress.KeyID, one
+// after the other. Its result is the final progress.
+func reencryptJob(progress *reencryptionProgress) worker.Func {
+	return func(ctx context.Context) (any, error) {
+		stateMu.Lock()
+		now := time.Now().UTC()
+		progress.StartedAt = &now
+		var ids []string
+		for id, b := range backups {
+			if b.Status == backupStatusCompleted && b.EncryptionKeyID != progress.KeyID {
+				ids = append(ids, id)
+			}
+		}
+		slices.SortFunc(ids, compareIDs)
+		progress.Total = len(ids)
+		stateMu.Unlock()
+
+		var err error
+		for _, id := range ids {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			keyID, reencrypted, backupErr := reencryptBackup(ctx, id, progress.KeyID)
+
+			stateMu.Lock()
+			switch {
+			case backupErr != nil:
+				progress.Failed = append(progress.Failed, reencryptionFailure{BackupID: id, Error: backupErr.Error()})
+			case reencrypted:
+				progress.Reencrypted++
+			default:
+				progress.Skipped++
+			}
+			if b, ok := backups[id]; ok && backupErr == nil && b.EncryptionKeyID != keyID {
+				b.EncryptionKeyID = keyID
+				backups[id] = b
+				persistLocked(backupChange(id))
+			}
+			stateMu.Unlock()
+		}
+
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		now = time.Now().UTC()
+		progress.FinishedAt = &now
+		if err == nil && len(progress.Failed) > 0 {
+			err = fmt.Errorf("%d of %d backups could not be re-encrypted", len(progress.Failed), progress.Total)
+		}
+		return *progress, err
+	}
+}
+
+// reencryptBackup re-encrypts the files of a backup with keyID, locally and
+// in its storage backend, and returns the key the backup is encrypted with
+// afterwards, empty if it isn't. The files are re-encrypted in a copy that
+// replaces the backup once complete, so the backup stays restorable if the
+// job fails half way. Readers of a directory are waited for before it is
+// replaced, and new ones wait until it is, so none sees it half swapped.
+func reencryptBackup(ctx context.Context, backupID, keyID string) (string, bool, error) {
+	release, err := acquireBackup(backupID)
+	if err != nil {
+		return "", false, err
+	}
+	defer release()
+
+	stateMu.Lock()
+	b := backups[backupID]
+	stateMu.Unlock()
+
+	dir, cleanup, err := storedBackupFiles(ctx, backupID)
+	if err != nil {
+		return "", false, err
+	}
+	// A directory is released once copied, it is swapped exclusively below
+	cleanup = sync.OnceFunc(cleanup)
+	defer cleanup()
+	m, ok, err := manifest.Read(dir)
+	if err != nil || !ok || m.Encryption == nil {
+		return "", false, err
+	}
+	if m.Encryption.KeyID == keyID {
+		return keyID, false, nil
+	}
+
+	// Archives are unpacked into a temporary directory already
+	work := dir
+	if b.Format != config.FormatArchive {
+		work = dir + ".reencrypt"
+		if err := os.RemoveAll(work); err != nil {
+			return "", false, err
+		}
+		if err := copyDir(work, dir); err != nil {
+			os.RemoveAll(work)
+			return "", false, err
+		}
+		defer os.RemoveAll(work)
+		cleanup()
+	}
+	if m.Encryption.KeyID, err = keyring.ReencryptDir(work, m.Encryption.KeyID, manifest.FileName); err != nil {
+		return "", false, err
+	}
+	if err := manifest.Write(work, m); err != nil {
+		return "", false, err
+	}
+
+	backend, err := storageBackend(b.Storage)
+	if err != nil {
+		return "", false, err
+	}
+	if b.Format == config.FormatArchive {
+		archivePath := backupArchivePath(backupID)
+		if err := archive.Pack(work, archivePath+".reencrypt", manifest.FileName); err != nil {
+			return "", false, err
+		}
+		if err := os.Rename(archivePath+".reencrypt", archivePath); err != nil {
+			return "", false, err
+		}
+		if backend != nil {
+			err = storage.UploadFile(ctx, backend, archivePath, backupID+".tar.gz")
+		}
+		return m.Encryption.KeyID, true, err
+	}
+
+	// Uploaded before the local copy is replaced: an interrupted upload
+	// leaves the old manifest in the backend, which the next run repairs
+	if backend != nil {
+		if err := storage.Upload(ctx, backend, work, backupID+"/", manifest.FileName); err != nil {
+			return "", false, err
+		}
+	}
+	if err := swapBackupDir(backupID, dir, work); err != nil {
+		return "", false, err
+	}
+	return m.Encryption.KeyID, true, os.RemoveAll(dir + ".old")
+}
+
+// swapBackupDir replaces the directory of a backup with work, keeping the
+// old one as dir.old. It waits for the readers of the backup, and holds off
+// new ones while dir is missing.
+func swapBackupDir(backupID, dir, work string) error {
+	lock := backupDirLock(backupID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(work, dir); err != nil {
+		os.Rename(dir+".old", dir)
+		return err
+	}
+	return nil
+}
+
+// copyDir copies the files under src to dst.
+func copyDir(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/encryption"
+	"net_exercise/pkg/manifest"
+)
+
+// Old backups of either format are re-encrypted with the new key, and stay
+// restorable once the old key is removed. Directories are only swapped once
+// their readers are done.
+func TestReencryptJob(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+	}{
+		{name: "directory"},
+		{name: "archive", format: config.FormatArchive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdir(t, t.TempDir())
+			encryptionConfig := config.Encryption{KeyID: "old"}
+			for _, id := range []string{"old", "new"} {
+				env := "NETX_TEST_KEY_" + strings.ToUpper(id)
+				t.Setenv(env, base64.StdEncoding.EncodeToString([]byte(strings.Repeat(id[:1], 32))))
+				encryptionConfig.Keys = append(encryptionConfig.Keys, config.EncryptionKey{ID: id, Env: env})
+			}
+			var err error
+			if keyring, err = encryption.NewKeyring(encryptionConfig); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { keyring = nil })
+
+			backupDir := "./backups/backup_1"
+			if err := os.MkdirAll(filepath.Join(backupDir, "configmap"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(backupDir, "configmap", "shop.json"), []byte(`{"data":{"mode":"live"}}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m := manifest.Manifest{Namespace: "shop"}
+			if err := encryptBackup(backupDir, &m); err != nil {
+				t.Fatal(err)
+			}
+			if err := manifest.Write(backupDir, m); err != nil {
+				t.Fatal(err)
+			}
+			b := Backup{BackupID: "backup_1", AppID: "app_1", Status: backupStatusCompleted, Format: tt.format, EncryptionKeyID: "old"}
+			if tt.format == config.FormatArchive {
+				if err := archiveBackup(b.BackupID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			backups = map[string]Backup{b.BackupID: b, "backup_2": {BackupID: "backup_2", AppID: "app_1", Status: backupStatusFailed}}
+
+			if err := keyring.SetCurrent("new"); err != nil {
+				t.Fatal(err)
+			}
+			progress := &reencryptionProgress{KeyID: "new"}
+			done := make(chan error, 1)
+			if tt.format == config.FormatArchive {
+				_, err := reencryptJob(progress)(context.Background())
+				done <- err
+			} else {
+				// A restore reading the directory keeps it from being swapped
+				dir, release, err := storedBackupFiles(context.Background(), "backup_1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				go func() {
+					_, err := reencryptJob(progress)(context.Background())
+					done <- err
+				}()
+				// Until the copy is re-encrypted, and a little longer
+				for {
+					if _, err := os.Stat(filepath.Join(backupDir+".reencrypt", manifest.FileName)); err == nil {
+						break
+					}
+					select {
+					case err := <-done:
+						t.Fatalf("re-encryption finished while the backup was read, error %v", err)
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+				select {
+				case err := <-done:
+					t.Fatalf("re-encryption finished while the backup was read, error %v", err)
+				case <-time.After(100 * time.Millisecond):
+				}
+				if m, _, err := manifest.Read(dir); err != nil || m.Encryption.KeyID != "old" {
+					t.Errorf("the backup was swapped while read: manifest %+v, error %v", m.Encryption, err)
+				}
+				release()
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if progress.Total != 1 || progress.Reencrypted != 1 || len(progress.Failed) != 0 || progress.FinishedAt == nil {
+				t.Errorf("progress = %+v, want backup_1 re-encrypted", *progress)
+			}
+			if got := backups["backup_1"].EncryptionKeyID; got != "new" {
+				t.Errorf("backup_1 is recorded with key %s, want new", got)
+			}
+			entries, err := os.ReadDir("./backups")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("./backups has %d entries after re-encryption, want only backup_1", len(entries))
+			}
+
+			// Without the old key
+			encryptionConfig.KeyID, encryptionConfig.Keys = "new", encryptionConfig.Keys[1:]
+			if keyring, err = encryption.NewKeyring(encryptionConfig); err != nil {
+				t.Fatal(err)
+			}
+			dir, cleanup, err := backupFiles(context.Background(), "backup_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			data, err := os.ReadFile(filepath.Join(dir, "configmap", "shop.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != `{"data":{"mode":"live"}}` {
+				t.Errorf("configmap/shop.json = %s after re-encryption", data)
+			}
+
+			// Nothing left to re-encrypt
+			progress = &reencryptionProgress{KeyID: "new"}
+			if _, err := reencryptJob(progress)(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if progress.Total != 0 {
+				t.Errorf("second run re-encrypts %d backups, want none", progress.Total)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"net_exercise/pkg/notify"
+)
+
+// Events waiting to be published, in order. Events that don't fit while the
+// event bus is unreachable are dropped rather than slowing down backups.
+const eventQueueSize = 256
+
+// Only set when the event bus is configured
+var eventQueue chan notify.LifecycleEvent
+
+// runEventPublisher publishes the queued events one after the other, so
+// subscribers see a backup created before it completed.
+func runEventPublisher(publisher *notify.NATSPublisher) {
+	for event := range eventQueue {
+		if err := publisher.Publish(event); err != nil {
+			log.Printf("publishing %s event: %v", event.Type, err)
+		}
+	}
+}
+
+// publishEvent queues event about app for the event bus.
+func publishEvent(event notify.LifecycleEvent, app Application) {
+	if eventQueue == nil {
+		return
+	}
+
+	// Restores of backups whose application was deleted since only know
+	// its app_id
+	if app.AppID != "" {
+		event.AppID = app.AppID
+		event.AppName = app.Name
+	}
+	if event.Namespace == "" {
+		event.Namespace = app.Namespace
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	select {
+	case eventQueue <- event:
+	default:
+		log.Printf("event queue is full, dropping %s event of %s", event.Type, event.AppID)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"net_exercise/pkg/restore"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Runs the backups and restores requested through the API
+var jobs *worker.Pool
+
+// submitJob queues run on the worker pool and answers with the queued job.
+func submitJob(c *gin.Context, kind string, run worker.Func) {
+	job, err := jobs.Submit(kind, run)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+// backupJob takes a backup of app, its result names the backup.
+func backupJob(app Application, opts backupOptions) worker.Func {
+	return func(ctx context.Context) (any, error) {
+		b, err := createBackup(ctx, app, opts)
+		return gin.H{"backup_id": b.BackupID, "app_id": b.AppID, "status": b.Status}, err
+	}
+}
+
+// restoreJob runs a restore prepared by restoreBackup, its result is what
+// the restore reports. An interactive restore that pauses for decisions
+// finishes the job, resumeRestoreJob continues it.
+func restoreJob(requestBody restoreRequest, backupID string, opts restore.Options) worker.Func {
+	return func(ctx context.Context) (any, error) {
+		record, result, err := runRestore(ctx, requestBody, backupID, opts)
+		if errors.Is(err, restore.ErrDecisionsPending) {
+			response := gin.H{
+				"message":           "Restore awaits decisions on objects modified since the backup",
+				"restore_id":        record.RestoreID,
+				"pending_decisions": record.PendingDecisions,
+				"confirm_token":     result.Plan.ConfirmToken,
+			}
+			if len(result.Plan.Warnings) > 0 {
+				response["warnings"] = result.Plan.Warnings
+			}
+			return response, nil
+		}
+		return restoreJobResult(record, result, err), err
+	}
+}
+
+// restoreJobResult is what a finished restore job reports.
+func restoreJobResult(record Restore, result *restore.Result, err error) gin.H {
+	response := gin.H{}
+	if err == nil {
+		response = restoreResponse(result)
+		response["message"] = "Restore completed successfully"
+	}
+	// Failures after the restore started are recorded too
+	if record.RestoreID != "" {
+		response["restore_id"] = record.RestoreID
+	}
+	return response
+}
+
+func listJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, jobs.List())
+}
+
+func getJob(c *gin.Context) {
+	job, ok := jobs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": worker.ErrNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// cancelJob cancels a queued or running job. Running backups stop before
+// the next kind, running restores fail at their next API call.
+func cancelJob(c *gin.Context) {
+	job, err := jobs.Cancel(c.Param("id"))
+	switch {
+	case errors.Is(err, worker.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, worker.ErrFinished):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, job)
+	}
+}
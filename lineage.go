@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lineageStep is a backup or restore in the provenance of an environment.
+type lineageStep struct {
+	// "backup" or "restore"
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	AppID     string    `json:"app_id,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Time      time.Time `json:"time"`
+	// The record was deleted, the chain can't be followed further
+	Missing bool `json:"missing,omitempty"`
+}
+
+// lastRestoreIntoLocked returns the last completed restore into namespace,
+// the one a backup of the namespace taken now originates from. Must be
+// called with stateMu held.
+func lastRestoreIntoLocked(namespace string) string {
+	var last Restore
+	for _, r := range restores {
+		if r.Namespace == namespace && r.Status == restoreStatusCompleted && r.FinishedAt.After(last.FinishedAt) {
+			last = r
+		}
+	}
+	return last.RestoreID
+}
+
+// getLineage traces where the state in a backup or restore came from: a
+// backup was taken of a namespace some restore filled from another backup,
+// which was taken of a namespace filled by a restore, and so on. The chain
+// starts at the given backup, restore, or the latest backup of the given
+// application, and ends at the first backup of a namespace nothing was
+// restored into.
+func getLineage(c *gin.Context) {
+	id := c.Param("id")
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if _, ok := apps[id]; ok {
+		var latest Backup
+		for _, b := range backups {
+			if b.AppID == id && (b.Status == backupStatusCompleted || b.Status == backupStatusUnchanged) && b.CreatedAt.After(latest.CreatedAt) {
+				latest = b
+			}
+		}
+		if latest.BackupID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "The application has no backups"})
+			return
+		}
+		id = latest.BackupID
+	}
+	_, isBackup := backups[id]
+	_, isRestore := restores[id]
+	if !isBackup && !isRestore {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No backup, restore or application has this ID"})
+		return
+	}
+
+	chain := []lineageStep{}
+	var path []string
+	// Every step goes back in time, seen only guards against a corrupted
+	// catalog
+	seen := map[string]bool{}
+	for id != "" && !seen[id] {
+		seen[id] = true
+		path = append(path, id)
+
+		if b, ok := backups[id]; ok {
+			chain = append(chain, lineageStep{Type: "backup", ID: id, AppID: b.AppID, Namespace: apps[b.AppID].Namespace, Time: b.CreatedAt})
+			id = b.RestoredFrom
+			continue
+		}
+		if r, ok := restores[id]; ok {
+			chain = append(chain, lineageStep{Type: "restore", ID: id, AppID: r.AppID, Namespace: r.Namespace, Time: r.FinishedAt})
+			id = r.BackupID
+			continue
+		}
+
+		stepType := "backup"
+		if strings.HasPrefix(id, "restore_") {
+			stepType = "restore"
+		}
+		chain = append(chain, lineageStep{Type: stepType, ID: id, Missing: true})
+		break
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":     chain[0].ID,
+		"origin": chain[len(chain)-1],
+		"chain":  chain,
+		"path":   strings.Join(path, " <- "),
+	})
+}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"net_exercise/pkg/auth"
 	"net_exercise/pkg/backup"
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/encryption"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+	"net_exercise/pkg/notify"
 	"net_exercise/pkg/restore"
+	"net_exercise/pkg/worker"
 
 	"github.com/gin-gonic/gin"
 
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,24 +36,187 @@ import (
 
 type Application struct {
 	AppID     string `json:"app_id"`
-	Namespace string `json:"namespace"`
-	Name      string `json:"name"`
+	Namespace string `json:"namespace" binding:"required,dns1123label"`
+	Name      string `json:"name" binding:"required"`
+	// Set when the application was registered by a protection policy
+	Policy string `json:"policy,omitempty"`
+	// Objects matching any of these rules are left out of backups
+	Exclusions []backup.Exclusion `json:"exclusions,omitempty"`
+	// Back up Succeeded and Failed Pods and Jobs too
+	IncludeFinished bool `json:"include_finished,omitempty"`
+	// Take a VirtualMachineSnapshot of every KubeVirt VirtualMachine
+	KubeVirtSnapshots bool `json:"kubevirt_snapshots,omitempty"`
+	// Notified in addition to the globally configured email recipients
+	NotifyEmails []string `json:"notify_emails,omitempty" binding:"omitempty,dive,email"`
+	// Recovery point and recovery time objectives, reported on by the
+	// protection status and /metrics
+	TargetRPO *config.Duration `json:"target_rpo,omitempty"`
+	TargetRTO *config.Duration `json:"target_rto,omitempty"`
+	// Labels or annotations of the Deployments and StatefulSets holding the
+	// application version, e.g. app.kubernetes.io/version. Backups only
+	// record versions and images when set.
+	VersionKeys []string `json:"version_keys,omitempty"`
+	// Record an unchanged run instead of a new backup when no object in the
+	// namespace was written to since the last backup
+	SkipUnchanged bool `json:"skip_unchanged,omitempty"`
+	// Kinds whose status is kept in a sidecar file, see layout.StatusFile.
+	// The status of other kinds is not backed up.
+	CaptureStatus []string `json:"capture_status,omitempty"`
+	// Only objects matching this label selector, e.g. app=shop, are backed
+	// up instead of the whole namespace
+	LabelSelector string `json:"label_selector,omitempty"`
+	// Also back up the PersistentVolumes bound to the PVCs and the
+	// StorageClasses they use, for restores into another cluster
+	CaptureStorage bool `json:"capture_storage,omitempty"`
+	// Take a CSI VolumeSnapshot of every bound PVC, with this
+	// VolumeSnapshotClass if set
+	VolumeSnapshots     bool   `json:"volume_snapshots,omitempty"`
+	VolumeSnapshotClass string `json:"volume_snapshot_class,omitempty"`
+	// Kinds restored first and in this order, e.g. custom resources an
+	// operator consumes before the Deployments, see restore.Options.RestoreOrder
+	RestoreOrder []string `json:"restore_order,omitempty"`
+	// Copy the files of every bound PVC to a restic repository, see
+	// config.DataMover
+	DataMover bool `json:"data_mover,omitempty"`
+	// Backups pruned once they fall out of it, see retainedBackupsLocked.
+	// Takes precedence over the retention of the protection policy.
+	Retention *config.BackupRetention `json:"retention,omitempty"`
+}
+
+func (app Application) validate() error {
+	if !namespaceAllowed(app.Namespace) {
+		return fmt.Errorf("namespace %s is not in backup_namespaces, it cannot be backed up", app.Namespace)
+	}
+	for _, e := range app.Exclusions {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, kind := range app.CaptureStatus {
+		if _, ok := layout.LookupKind(kind); !ok {
+			return fmt.Errorf("capture_status: unknown kind %q", kind)
+		}
+	}
+	if _, err := labels.Parse(app.LabelSelector); err != nil {
+		return fmt.Errorf("label_selector: %w", err)
+	}
+	if err := restore.ValidateRestoreOrder(app.RestoreOrder); err != nil {
+		return err
+	}
+	if app.DataMover && cfg.DataMover == nil {
+		return fmt.Errorf("data_mover needs the data_mover configuration")
+	}
+	if (app.TargetRPO != nil && app.TargetRPO.Duration <= 0) || (app.TargetRTO != nil && app.TargetRTO.Duration <= 0) {
+		return fmt.Errorf("target_rpo and target_rto must be positive")
+	}
+	if app.Retention != nil {
+		if err := app.Retention.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceAllowed reports whether the configuration allows backing up namespace.
+func namespaceAllowed(namespace string) bool {
+	return cfg.BackupNamespaces == nil || cfg.BackupNamespaces.Allows(namespace)
 }
 
 type Backup struct {
-	BackupID string `json:"backup_id"`
-	AppID    string `json:"app_id"`
+	BackupID  string    `json:"backup_id"`
+	AppID     string    `json:"app_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	// Only set for scheduled backups
+	Attempt int `json:"attempt,omitempty"`
+	// Version the application was running, see Application.VersionKeys
+	AppVersion string `json:"app_version,omitempty"`
+	// For unchanged runs, the backup holding the application's state
+	SameAs string `json:"same_as,omitempty"`
+	// Retention rules that kept the backup at the last prune, see
+	// retainedBackupsLocked
+	RetainedBy []string `json:"retained_by,omitempty"`
+	// Storage backend holding the backup besides ./backups, empty for local
+	Storage string `json:"storage,omitempty"`
+	// "archive" for backups packed into ./backups/<backup_id>.tar.gz
+	Format string `json:"format,omitempty"`
+	// How long the backup took, including packing and uploading
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// CSI snapshots taken for the backup, deleted along with it
+	VolumeSnapshots []manifest.VolumeSnapshot `json:"volume_snapshots,omitempty"`
+	// config or full, see backupType
+	Type string `json:"type,omitempty"`
+	// Schedule that took the backup
+	ScheduleID string `json:"schedule_id,omitempty"`
+	// Backup an incremental backup builds on, it can't be deleted before
+	// this one
+	Parent string `json:"parent,omitempty"`
+	// Last restore into the namespace before the backup, see getLineage
+	RestoredFrom string `json:"restored_from,omitempty"`
+	// Set when only these objects were backed up, by <kind>/<name>
+	Objects []string `json:"objects,omitempty"`
+	// Key the files are encrypted with, see encryption.go
+	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
 }
 
+const latestBackupID = "latest"
+
 var appCounter int = 0
 var backupCounter int = 0
 var apps map[string]Application = make(map[string]Application)
 var appNameNamespaceMap map[string]string = make(map[string]string)
 var backups map[string]Backup = make(map[string]Backup)
 
+var cfg config.Config
+
+// Guards the maps and counters above
+var stateMu sync.Mutex
+
 var clientset *kubernetes.Clientset // Declare clientset as a global variable
+var restoreClients restore.Clients
 
+// Configuration the clients above were built from
+var restConfig *rest.Config
+
+// main runs the API server, or with the backup and restore subcommands a
+// single operation against the cluster, see cli.go.
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	cfg, err = config.Load(os.Getenv("NETX_CONFIG"))
+	if err != nil {
+		panic(err.Error())
+	}
+	if cfg.Encryption != nil {
+		keyring, err = encryption.NewKeyring(*cfg.Encryption)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	switch command {
+	case "serve":
+		serve()
+	case "backup":
+		os.Exit(backupCommand(args))
+	case "restore":
+		os.Exit(restoreCommand(args))
+	case "agent":
+		os.Exit(agentMain(args))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, expected serve, backup, restore or agent\n", command)
+		os.Exit(2)
+	}
+}
+
+// initClients builds the Kubernetes clients from the kubeconfig file.
+func initClients() error {
 	// Set the KUBECONFIG environment variable to point to the kubeconfig file
 	kubeconfig := os.Getenv("HOME") + "/.kube/config"
 	os.Setenv("KUBECONFIG", kubeconfig)
@@ -43,161 +224,736 @@ func main() {
 	// Initialize Kubernetes clientset using kubeconfig file
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
+	restConfig = config
+
 	clientset, err = kubernetes.NewForConfig(config)
 	if err != nil {
+		return err
+	}
+
+	restoreClients.Dynamic, err = dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	restoreClients.Metadata, err = metadata.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	restoreClients.Discovery = clientset.Discovery()
+	return nil
+}
+
+// serve runs the API server.
+func serve() {
+	if err := initClients(); err != nil {
+		panic(err.Error())
+	}
+
+	if err := registerValidations(); err != nil {
+		panic(err.Error())
+	}
+
+	// Created before loading the state, which holds the keys
+	if cfg.APIKeys != nil && cfg.APIKeys.Enabled {
+		apiKeys = auth.NewAPIKeyStore()
+	}
+	if err := openMetadataStore(cfg.MetadataStore.Path); err != nil {
 		panic(err.Error())
 	}
+	if err := loadState(); err != nil {
+		panic(err.Error())
+	}
+
+	// Schedules start using it once the cluster is connected
+	jobs = worker.New(cfg.Workers.Concurrency, cfg.Workers.QueueSize)
+
+	connectCluster(func() {
+		if len(cfg.ProtectionPolicies) > 0 {
+			go runProtectionPolicies(cfg.ProtectionPolicies)
+		}
+		go runSchedules()
+		go runPruner()
+		if cfg.DriftMetrics != nil {
+			go runDriftAnalyzer(cfg.DriftMetrics.Interval.Duration)
+		}
+	})
+
+	var authenticators []auth.Authenticator
+	if cfg.OIDC != nil {
+		oidc, err := auth.NewOIDCAuthenticator(context.Background(), *cfg.OIDC)
+		if err != nil {
+			panic(err.Error())
+		}
+		authenticators = append(authenticators, oidc)
+	}
+	if apiKeys != nil {
+		if bootstrapKey := os.Getenv("NETX_BOOTSTRAP_API_KEY"); bootstrapKey != "" {
+			bootstrap, err := apiKeys.Import("bootstrap", auth.RoleAdmin, nil, bootstrapKey)
+			if err != nil {
+				panic(err.Error())
+			}
+			persistAPIKey(bootstrap.ID)
+		} else if cfg.OIDC == nil {
+			panic("api_keys without oidc needs NETX_BOOTSTRAP_API_KEY, otherwise no one can create a key")
+		}
+		authenticators = append(authenticators, apiKeys)
+	}
+
+	if cfg.Email != nil {
+		var err error
+		emailer, err = notify.NewEmailer(*cfg.Email)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	if cfg.EventBus != nil {
+		publisher, err := notify.NewNATSPublisher(*cfg.EventBus)
+		if err != nil {
+			panic(err.Error())
+		}
+		eventQueue = make(chan notify.LifecycleEvent, eventQueueSize)
+		go runEventPublisher(publisher)
+	}
+
+	if err := loadWebhooks(cfg.Webhooks); err != nil {
+		panic(err.Error())
+	}
+
+	if err := loadStorageBackends(cfg.Storage); err != nil {
+		panic(err.Error())
+	}
+
 	router := gin.Default()
+	router.Use(limitBody(cfg.HTTP.MaxBodyBytes))
+
+	// Webhook callers authenticate with a request signature instead of a
+	// bearer token, so this route is registered before the auth middleware
+	router.POST("/webhooks/:name", requireCluster, triggerWebhook)
+	// Probes are unauthenticated
+	router.GET("/readyz", readyz)
+
+	router.Use(auth.Middleware(authenticators...))
+
+	viewer := auth.RequireRole(auth.RoleViewer)
+	operator := auth.RequireRole(auth.RoleOperator)
+	admin := auth.RequireRole(auth.RoleAdmin)
+
+	router.GET("/capabilities", viewer, getCapabilities)
+	router.GET("/applications", viewer, listApplications)
+	router.GET("/applications/conflicts", viewer, applicationConflicts)
+	router.GET("/application/:id", viewer, getApplication)
+	router.PUT("/application", operator, requireCluster, defineApplication)
+	router.DELETE("/application/:id", operator, requireCluster, deleteApplication)
+	router.POST("/application/spec", operator, requireCluster, importApplicationSpec)
+	router.GET("/application/:id/spec", viewer, exportApplicationSpec)
+	router.GET("/applications/:id/protection", viewer, requireCluster, applicationProtection)
+	router.POST("/applications/:id/clone", operator, requireCluster, cloneApplication)
+	router.GET("/metrics", viewer, getMetrics)
+	router.GET("/metrics/dashboard", viewer, getGrafanaDashboard)
+	router.GET("/backups", viewer, listBackups)
+	router.PUT("/backup", operator, requireCluster, performBackup)
+	router.GET("/backup/:id/manifest", viewer, getBackupManifest)
+	router.GET("/backup/:id/stream", viewer, streamBackup)
+	router.GET("/backup/:id/logs", viewer, streamBackupLogs)
+	router.DELETE("/backup/:id", operator, requireCluster, deleteBackupByID)
+	router.PUT("/restore", operator, requireCluster, restoreBackup)
+	router.PUT("/restore/plan", operator, requireCluster, planRestore)
+	router.GET("/restore/:id/profile", viewer, restoreProfile)
+	router.GET("/restore/:id/health", viewer, requireCluster, restoreHealth)
+	router.GET("/restore/:id/decisions", viewer, pendingDecisions)
+	router.PATCH("/restore/:id/decisions", operator, requireCluster, decideRestore)
+	router.GET("/uid-mappings/:uid", viewer, resolveOriginalUID)
+	router.GET("/lineage/:id", viewer, getLineage)
+	router.GET("/schedules", viewer, listSchedules)
+	router.PUT("/schedule", operator, createSchedule)
+	router.POST("/schedule/:id/pause", operator, pauseSchedule)
+	router.POST("/schedule/:id/resume", operator, resumeSchedule)
+	router.DELETE("/schedule/:id", operator, deleteSchedule)
+	router.GET("/jobs", viewer, listJobs)
+	router.GET("/jobs/:id", viewer, getJob)
+	router.DELETE("/jobs/:id", operator, cancelJob)
+
+	router.POST("/admin/reindex", admin, reindex)
+
+	router.GET("/agents", viewer, listAgents)
+	router.DELETE("/agents/:name", admin, deleteAgent)
+	router.POST("/agents/:name/poll", operator, pollAgentTasks)
+	router.POST("/agents/:name/tasks", operator, queueAgentTask)
+	router.GET("/agents/:name/tasks/:id", viewer, getAgentTask)
+	router.PUT("/agents/:name/tasks/:id/result", operator, completeAgentTask)
+
+	if apiKeys != nil {
+		router.POST("/admin/api-keys", admin, createAPIKey)
+		router.GET("/admin/api-keys", admin, listAPIKeys)
+		router.POST("/admin/api-keys/:id/rotate", admin, rotateAPIKey)
+		router.DELETE("/admin/api-keys/:id", admin, revokeAPIKey)
+	}
+	if keyring != nil {
+		router.GET("/admin/encryption", admin, getEncryption)
+		router.PUT("/admin/encryption/key", admin, setEncryptionKey)
+		router.POST("/admin/encryption/reencrypt", admin, reencryptBackups)
+	}
 
-	router.PUT("/application", defineApplication)
-	router.PUT("/backup", performBackup)
-	router.PUT("/restore", restoreBackup)
+	server := &http.Server{
+		Addr:              ":8080",
+		Handler:           router,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.HTTP.ReadTimeout.Duration,
+		WriteTimeout:      cfg.HTTP.WriteTimeout.Duration,
+		IdleTimeout:       cfg.HTTP.IdleTimeout.Duration,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		panic(err.Error())
+	}
+}
 
-	router.Run(":8080")
+// limitBody makes reading more than maxBytes of a request body fail, which
+// the handlers answer with 413 Request Entity Too Large.
+func limitBody(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
 }
 
 func defineApplication(c *gin.Context) {
 	var app Application
-	if err := c.BindJSON(&app); err != nil {
+	if !bindJSON(c, &app) {
+		return
+	}
+	if err := app.validate(); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	appID, existingAppID := registerApplication(app)
+	if existingAppID != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Application with same name and namespace already exists", "existing_app_id": existingAppID})
+		return
+	}
+
+	response := gin.H{"app_id": appID}
+	if warnings := overlapWarnings(appID); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// registerApplication stores app under a new app_id. If an application with
+// the same name and namespace is already registered, its ID is returned as
+// existingAppID and nothing is stored.
+func registerApplication(app Application) (appID, existingAppID string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
 	// Check if the combination of app name and namespace already exists
 	appNameNamespaceKey := fmt.Sprintf("%s_%s", app.Name, app.Namespace)
 	if existingAppID, ok := appNameNamespaceMap[appNameNamespaceKey]; ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Application with same name and namespace already exists", "existing_app_id": existingAppID})
-		return
+		return "", existingAppID
 	}
 
 	// Increment appCounter for app_id
 	appCounter++
-	appID := fmt.Sprintf("app_%d", appCounter)
+	appID = fmt.Sprintf("app_%d", appCounter)
 
 	// Store the application in both maps
 	app.AppID = appID // Include the app_id in the Application struct
 
 	apps[appID] = app
 	appNameNamespaceMap[appNameNamespaceKey] = appID
+	persistLocked(appChange(appID), settingChange("app_counter", appCounter))
 
-	c.JSON(http.StatusOK, gin.H{"app_id": appID})
+	return appID, ""
 }
 
 func performBackup(c *gin.Context) {
 	var requestBody struct {
-		AppID string `json:"app_id"`
+		AppID string `json:"app_id" binding:"required"`
+		// Storage backend to keep the backup in, storage.default if empty
+		Storage string `json:"storage"`
+		Format  string `json:"format" binding:"omitempty,oneof=directory archive"`
+		// Overrides the label_selector of the application
+		LabelSelector string `json:"label_selector"`
+		// Overrides volume_snapshots of the application
+		VolumeSnapshots *bool `json:"volume_snapshots"`
+		// Only list the objects the backup would capture
+		Preview bool `json:"preview"`
+		// config or full, by default full if the application captures
+		// volume data
+		Type string `json:"type" binding:"omitempty,oneof=config full"`
+		// Only store the files that changed since parent, by default the
+		// latest completed backup
+		Incremental bool   `json:"incremental"`
+		Parent      string `json:"parent"`
+		// Compress every file of the backup, none by default
+		Compression string `json:"compression" binding:"omitempty,oneof=none gzip zstd"`
+		// Only back up these objects instead of everything matching the
+		// label selector
+		Objects []backup.ObjectRef `json:"objects" binding:"omitempty,dive"`
 	}
 
 	// Parse JSON request body
-	if err := c.BindJSON(&requestBody); err != nil {
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+	if _, err := storageBackend(requestBody.Storage); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := labels.Parse(requestBody.LabelSelector); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "label_selector: " + err.Error()})
+		return
+	}
 
 	// Retrieve the application details using the provided app ID
+	stateMu.Lock()
 	app, ok := apps[requestBody.AppID]
+	stateMu.Unlock()
 	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid app_id"})
 		return
 	}
 
-	// Generate a unique backup ID
-	backupCounter++
-	backupID := fmt.Sprintf("backup_%d", backupCounter)
-
-	// Create a directory to store the backup files
-	backupDir := fmt.Sprintf("./backups/%s", backupID)
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if requestBody.LabelSelector != "" {
+		app.LabelSelector = requestBody.LabelSelector
+	}
+	if requestBody.VolumeSnapshots != nil {
+		app.VolumeSnapshots = *requestBody.VolumeSnapshots
+	}
+	if len(requestBody.Objects) > 0 {
+		if err := validateObjectRefs(requestBody.Objects); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if requestBody.Incremental || requestBody.Type == config.BackupTypeFull {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "objects can't be combined with incremental or type full"})
+			return
+		}
+		requestBody.Type = config.BackupTypeConfig
+	}
+	app, _, err := withBackupType(app, requestBody.Type)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Perform backup operations for relevant resources
-	if err := backup.BackupPVCs(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if requestBody.Parent != "" {
+		if !requestBody.Incremental {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "parent requires incremental"})
+			return
+		}
+		if _, err := incrementalParent(app.AppID, requestBody.Parent); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if requestBody.Preview {
+		preview, err := previewBackup(c.Request.Context(), app, requestBody.Objects)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, preview)
 		return
 	}
+	submitJob(c, "backup", backupJob(app, backupOptions{
+		Storage:     requestBody.Storage,
+		Format:      requestBody.Format,
+		Type:        requestBody.Type,
+		Incremental: requestBody.Incremental,
+		Parent:      requestBody.Parent,
+		Compression: requestBody.Compression,
+		Objects:     requestBody.Objects,
+	}))
+}
+
+type restoreRequest struct {
+	// Target namespace, of backups whose namespace namespace_mapping doesn't
+	// map
+	Namespace string `json:"namespace" binding:"required_without=NamespaceMapping,omitempty,dns1123label"`
+	// Target namespace by the namespace a backup was taken from, so one
+	// table can be used for the restores of several applications
+	NamespaceMapping map[string]string `json:"namespace_mapping" binding:"omitempty,dive,keys,dns1123label,endkeys,dns1123label"`
+	// Create the target namespace if it doesn't exist, with the labels and
+	// annotations of the backed up one
+	CreateNamespace bool   `json:"create_namespace"`
+	BackupID        string `json:"backup_id" binding:"required"`
+	// Only needed to resolve backup_id "latest"
+	AppID string `json:"app_id" binding:"required_if=BackupID latest"`
+	// Makes "latest" the most recent backup taken while the app ran this version
+	AppVersion string `json:"app_version"`
+	// Makes "latest" the most recent backup of this type
+	BackupType             string `json:"backup_type" binding:"omitempty,oneof=config full"`
+	ExistingResourcePolicy string `json:"existing_resource_policy" binding:"omitempty,oneof=skip replace repair"`
+	ConfirmToken           string `json:"confirm_token"`
+	GitOpsMode             string `json:"gitops_mode" binding:"omitempty,oneof=warn skip pause"`
+	// PriorityClass and RuntimeClass renames, old name to new name
+	PriorityClassMapping map[string]string `json:"priority_class_mapping"`
+	RuntimeClassMapping  map[string]string `json:"runtime_class_mapping"`
+	MissingClassPolicy   string            `json:"missing_class_policy" binding:"omitempty,oneof=keep strip create"`
+	// StorageClass renames, old name to new name
+	StorageClassMapping map[string]string `json:"storage_class_mapping"`
+	VolumePolicy        string            `json:"volume_policy" binding:"omitempty,oneof=keep strip create"`
+	// Provision PVCs from the CSI snapshots taken with volume_snapshots
+	RestoreSnapshots bool `json:"restore_snapshots"`
+	// How long to wait for restored Pods to be scheduled, "0s" skips the scheduling report
+	SchedulingTimeout  *config.Duration `json:"scheduling_timeout"`
+	GenerateNamePolicy string           `json:"generate_name_policy" binding:"omitempty,oneof=keep skip regenerate"`
+	// Keys merged into backed up ConfigMaps, e.g. other endpoints for a staging copy
+	ConfigMapOverrides []configMapOverride `json:"config_map_overrides" binding:"dive"`
+	// Pause on objects modified since the backup until PATCH
+	// /restore/:id/decisions settles them, instead of skipping them
+	Interactive bool `json:"interactive"`
+	// Write the outcome of every object to the ConfigMap netx-restore-<n>
+	// in the target namespace once the restore is done
+	StatusConfigMap bool `json:"status_configmap"`
+	// Only restore some kinds or objects of the backup
+	restore.Filter
+}
+
+// targetNamespace sets Namespace to the target of the namespace backupID was
+// taken from in NamespaceMapping, if it has one, and checks that the
+// namespace exists unless the restore creates it. It returns the status to
+// answer with otherwise.
+func (r *restoreRequest) targetNamespace(ctx context.Context, backupID string) (int, error) {
+	if len(r.NamespaceMapping) > 0 {
+		m, _, err := readManifest(ctx, backupID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		source := m.Namespace
+		if source == "" {
+			stateMu.Lock()
+			source = apps[backups[backupID].AppID].Namespace
+			stateMu.Unlock()
+		}
+		if target, ok := r.NamespaceMapping[source]; ok {
+			r.Namespace = target
+		} else if r.Namespace == "" {
+			return http.StatusBadRequest, fmt.Errorf("namespace_mapping has no target for namespace %s of %s, and no namespace is given", source, backupID)
+		}
+	}
 
-	if err := backup.BackupPods(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if r.CreateNamespace {
+		return http.StatusOK, nil
 	}
-	if err := backup.BackupReplicaSets(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if _, err := clientset.CoreV1().Namespaces().Get(ctx, r.Namespace, metav1.GetOptions{}); err != nil {
+		return http.StatusBadRequest, errors.New("Namespace does not exist")
 	}
-	if err := backup.BackupDeployments(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	return http.StatusOK, nil
+}
+
+// configMapOverride merges the data of the ConfigMap From in the cluster into
+// the restored ConfigMap Name.
+type configMapOverride struct {
+	Name string `json:"name" binding:"required"`
+	From struct {
+		Namespace string `json:"namespace" binding:"required,dns1123label"`
+		Name      string `json:"name" binding:"required"`
+	} `json:"from"`
+}
+
+// checkConfigMapOverrides only lets overrides read ConfigMaps in the
+// restore's source or target namespace, and only if the namespace may be
+// backed up, so a restore can't copy e.g. kube-system's data into the
+// target namespace.
+func checkConfigMapOverrides(overrides []configMapOverride, source, target string) error {
+	for _, o := range overrides {
+		if o.From.Namespace != source && o.From.Namespace != target {
+			return fmt.Errorf("overrides for ConfigMap %s: from.namespace must be the restore's source namespace %s or target namespace %s", o.Name, source, target)
+		}
+		if !namespaceAllowed(o.From.Namespace) {
+			return fmt.Errorf("overrides for ConfigMap %s: namespace %s is not allowed by backup_namespaces", o.Name, o.From.Namespace)
+		}
 	}
-	if err := backup.BackupConfigMaps(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	return nil
+}
+
+// Default wait for restored Pods to be scheduled before reporting the pending ones
+const defaultSchedulingTimeout = 30 * time.Second
+
+func (r restoreRequest) options(ctx context.Context, backupID string) (restore.Options, error) {
+	if err := r.Filter.Validate(); err != nil {
+		return restore.Options{}, err
 	}
 
-	if err := backup.BackupStatefulSet(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	stateMu.Lock()
+	b := backups[backupID]
+	source := apps[b.AppID].Namespace
+	order := apps[b.AppID].RestoreOrder
+	stateMu.Unlock()
+
+	if err := checkConfigMapOverrides(r.ConfigMapOverrides, source, r.Namespace); err != nil {
+		return restore.Options{}, err
+	}
+	var overrides map[string]map[string]string
+	for _, o := range r.ConfigMapOverrides {
+		cm, err := clientset.CoreV1().ConfigMaps(o.From.Namespace).Get(ctx, o.From.Name, metav1.GetOptions{})
+		if err != nil {
+			return restore.Options{}, fmt.Errorf("reading overrides for ConfigMap %s: %w", o.Name, err)
+		}
+		if overrides == nil {
+			overrides = map[string]map[string]string{}
+		}
+		if overrides[o.Name] == nil {
+			overrides[o.Name] = map[string]string{}
+		}
+		// Later overrides of the same ConfigMap win
+		for key, value := range cm.Data {
+			overrides[o.Name][key] = value
+		}
 	}
 
-	if err := backup.BackupServices(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	return restore.Options{
+		ExistingResourcePolicy: r.ExistingResourcePolicy,
+		ConfirmToken:           r.ConfirmToken,
+		GitOpsMode:             r.GitOpsMode,
+		BackupTime:             b.CreatedAt,
+		PriorityClassMapping:   r.PriorityClassMapping,
+		RuntimeClassMapping:    r.RuntimeClassMapping,
+		MissingClassPolicy:     r.MissingClassPolicy,
+		StorageClassMapping:    r.StorageClassMapping,
+		VolumePolicy:           r.VolumePolicy,
+		RestoreSnapshots:       r.RestoreSnapshots,
+		FinalizerRules:         cfg.RestoreFinalizers,
+		ConfigMapOverrides:     overrides,
+		SourceNamespace:        source,
+		GenerateNamePolicy:     r.GenerateNamePolicy,
+		RestoreOrder:           order,
+		Interactive:            r.Interactive,
+		Filter:                 r.Filter,
+		CreateNamespace:        r.CreateNamespace,
+	}, nil
+}
+
+func restoreBackup(c *gin.Context) {
+	var requestBody restoreRequest
+
+	if !bindJSON(c, &requestBody) {
 		return
 	}
 
-	if err := backup.BackupServiceAccounts(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Get the context from gin.Context
+	ctx := c.Request.Context()
+
+	backupID, err := resolveBackupID(requestBody.AppID, requestBody.BackupID, requestBody.AppVersion, requestBody.BackupType)
+	if err != nil {
+		c.JSON(backupIDErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := requestBody.targetNamespace(ctx, backupID); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := backup.BackupSecrets(clientset, app.Namespace, backupDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	opts, err := requestBody.options(ctx, backupID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Associate the backup ID with the app ID for future reference
-	backup := Backup{
-		BackupID: backupID,
-		AppID:    app.AppID,
+	submitJob(c, "restore", restoreJob(requestBody, backupID, opts))
+}
+
+// runRestore restores backupID into the request's namespace, reports which
+// Pods can't be scheduled and records the restore.
+func runRestore(ctx context.Context, requestBody restoreRequest, backupID string, opts restore.Options) (Restore, *restore.Result, error) {
+	release, acquireErr := acquireBackup(backupID)
+	if acquireErr != nil {
+		return Restore{}, nil, acquireErr
+	}
+
+	// Get the backup directory
+	backupDir, cleanup, filesErr := backupFiles(ctx, backupID)
+	if filesErr != nil {
+		release()
+		return Restore{}, nil, filesErr
+	}
+
+	// Restore resources
+	startedAt := time.Now().UTC()
+	result, err := restore.RestoreResources(ctx, backupDir, requestBody.Namespace, restoreClients, opts)
+	if err == nil {
+		checkScheduling(ctx, requestBody, backupID, result)
+	}
+	record := recordRestore(backupID, requestBody.Namespace, startedAt, result, err)
+	if errors.Is(err, restore.ErrDecisionsPending) {
+		// The backup stays acquired and unpacked until the restore resumes
+		awaitDecisions(record.RestoreID, &pendingRestore{
+			request: requestBody,
+			result:  result,
+			release: release,
+			cleanup: cleanup,
+		})
+		return record, result, err
 	}
-	backups[backupID] = backup
+	cleanup()
+	release()
 
-	// Return response
-	c.JSON(http.StatusOK, gin.H{"backup_id": backupID, "app_id": app.AppID})
+	writeRestoreStatus(ctx, requestBody, record, result)
+	notifyRestore(record)
+	return record, result, err
 }
 
-func restoreBackup(c *gin.Context) {
-	var requestBody struct {
-		Namespace string `json:"namespace"`
-		BackupID  string `json:"backup_id"`
+// checkScheduling adds the Pods of the restored namespace that could not be
+// scheduled to the result.
+func checkScheduling(ctx context.Context, requestBody restoreRequest, backupID string, result *restore.Result) {
+	timeout := defaultSchedulingTimeout
+	if requestBody.SchedulingTimeout != nil {
+		timeout = requestBody.SchedulingTimeout.Duration
+	}
+	if timeout <= 0 {
+		return
+	}
+	// A failed check does not make the restore fail, the report is only missing
+	report, err := restore.CheckScheduling(ctx, clientset, requestBody.Namespace, timeout)
+	if err != nil {
+		log.Printf("checking scheduling after restore of %s: %v", backupID, err)
+	}
+	result.Scheduling = report
+}
+
+// restoreResponse holds what a successful restore reports besides its ID.
+func restoreResponse(result *restore.Result) gin.H {
+	response := gin.H{}
+	if len(result.Plan.Warnings) > 0 {
+		response["warnings"] = result.Plan.Warnings
+	}
+	if result.Scheduling != nil {
+		response["scheduling"] = result.Scheduling
 	}
+	if result.CreatedNamespace {
+		response["created_namespace"] = true
+	}
+	return response
+}
 
-	if err := c.BindJSON(&requestBody); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// planRestore reports what a restore would do without touching the cluster.
+// The returned confirm_token must be passed back to /restore before a
+// replace policy is allowed to delete anything. With ?format=bundle the
+// objects are returned as YAML instead, to be reviewed or applied with kubectl.
+func planRestore(c *gin.Context) {
+	var requestBody restoreRequest
+
+	if !bindJSON(c, &requestBody) {
 		return
 	}
 
-	// Get the context from gin.Context
 	ctx := c.Request.Context()
 
-	// Validate if the namespace exists
-	_, err := clientset.CoreV1().Namespaces().Get(ctx, requestBody.Namespace, metav1.GetOptions{})
+	backupID, err := resolveBackupID(requestBody.AppID, requestBody.BackupID, requestBody.AppVersion, requestBody.BackupType)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Namespace does not exist"})
+		c.JSON(backupIDErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := requestBody.targetNamespace(ctx, backupID); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get the backup directory
-	backupDir := fmt.Sprintf("./backups/%s", requestBody.BackupID)
+	opts, err := requestBody.options(ctx, backupID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// Restore resources
-	if err := restore.RestoreResources(backupDir, requestBody.Namespace, clientset); err != nil {
+	release, err := acquireBackup(backupID)
+	if err != nil {
+		c.JSON(restoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	backupDir, cleanup, err := backupFiles(ctx, backupID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	defer cleanup()
+
+	plan, err := restore.BuildPlan(ctx, backupDir, requestBody.Namespace, restoreClients, opts)
+	if err != nil {
+		c.JSON(restoreErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	defer plan.Close()
+
+	if c.Query("format") == "bundle" {
+		writeRestoreBundle(c, backupID, plan)
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Restore completed successfully"})
+// resolveBackupID turns the "latest" shortcut into the most recent backup of
+// appID, taken while it ran appVersion and of backupType if given. Other
+// backup IDs must name a completed backup, an unchanged run resolves to the
+// backup it refers to.
+func resolveBackupID(appID, backupID, appVersion, backupType string) (string, error) {
+	if backupID != latestBackupID {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		b, ok := backups[backupID]
+		if ok && b.Status == backupStatusUnchanged {
+			b, ok = backups[b.SameAs]
+		}
+		switch {
+		case !ok:
+			return "", errBackupNotFound
+		case b.Status != backupStatusCompleted:
+			return "", fmt.Errorf("backup %s is %s: %w", b.BackupID, b.Status, errBackupNotReady)
+		}
+		return b.BackupID, nil
+	}
+	if appID == "" {
+		return "", errors.New("backup_id \"latest\" requires app_id")
+	}
+
+	latest, ok := latestBackupWith(appID, func(b Backup) bool {
+		return b.Status == backupStatusCompleted &&
+			(appVersion == "" || slices.Contains(strings.Split(b.AppVersion, ","), appVersion)) &&
+			(backupType == "" || b.backupType() == backupType)
+	})
+	if !ok {
+		msg := "no backups found for app_id " + appID
+		if backupType != "" {
+			msg = fmt.Sprintf("no %s backups found for app_id %s", backupType, appID)
+		}
+		if appVersion != "" {
+			msg += " at version " + appVersion
+		}
+		return "", errors.New(msg)
+	}
+	return latest.BackupID, nil
+}
+
+// backupIDErrorStatus is the status to answer a backup_id resolveBackupID
+// refused with.
+func backupIDErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBackupNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errBackupNotReady):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func restoreErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, restore.ErrInvalidPolicy), errors.Is(err, restore.ErrInvalidGitOpsMode), errors.Is(err, restore.ErrInvalidMissingClassPolicy), errors.Is(err, restore.ErrInvalidVolumePolicy),
+		errors.Is(err, restore.ErrInvalidGenerateNamePolicy), errors.Is(err, restore.ErrInvalidRestoreOrder), errors.Is(err, restore.ErrInvalidFilter):
+		return http.StatusBadRequest
+	case errors.Is(err, restore.ErrConfirmationRequired), errors.Is(err, errBackupDeleting):
+		return http.StatusConflict
+	case errors.Is(err, restore.ErrPreflight), errors.Is(err, manifest.ErrIntegrity):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"net_exercise/pkg/config"
+)
+
+// ConfigMap overrides are only read from the restore's own namespaces, and
+// only from those the allow-list lets the service back up.
+func TestCheckConfigMapOverrides(t *testing.T) {
+	previous := cfg.BackupNamespaces
+	cfg.BackupNamespaces = &config.NamespaceAllowList{Names: []string{"shop", "shop-staging"}}
+	t.Cleanup(func() { cfg.BackupNamespaces = previous })
+
+	tests := []struct {
+		name      string
+		namespace string
+		source    string
+		target    string
+		wantErr   bool
+	}{
+		{name: "source namespace", namespace: "shop", source: "shop", target: "shop-staging"},
+		{name: "target namespace", namespace: "shop-staging", source: "shop", target: "shop-staging"},
+		{name: "other namespace", namespace: "kube-system", source: "shop", target: "shop-staging", wantErr: true},
+		{name: "target not allowed", namespace: "blog", source: "shop", target: "blog", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := configMapOverride{Name: "settings"}
+			o.From.Namespace, o.From.Name = tt.namespace, "settings-staging"
+			err := checkConfigMapOverrides([]configMapOverride{o}, tt.source, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkConfigMapOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Restores only accept completed backups, an unchanged run standing in for
+// the one it refers to.
+func TestResolveBackupID(t *testing.T) {
+	backups = map[string]Backup{
+		"backup_1": {BackupID: "backup_1", Status: backupStatusCompleted},
+		"backup_2": {BackupID: "backup_2", Status: backupStatusUnchanged, SameAs: "backup_1"},
+		"backup_3": {BackupID: "backup_3", Status: backupStatusFailed},
+		"backup_4": {BackupID: "backup_4", Status: backupStatusUnchanged, SameAs: "backup_9"},
+	}
+	t.Cleanup(func() { backups = map[string]Backup{} })
+
+	tests := []struct {
+		backupID   string
+		want       string
+		wantStatus int
+	}{
+		{backupID: "backup_1", want: "backup_1"},
+		{backupID: "backup_2", want: "backup_1"},
+		{backupID: "backup_3", wantStatus: http.StatusConflict},
+		{backupID: "backup_4", wantStatus: http.StatusNotFound},
+		{backupID: "backup_9", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backupID, func(t *testing.T) {
+			got, err := resolveBackupID("", tt.backupID, "", "")
+			if tt.wantStatus != 0 {
+				if err == nil || backupIDErrorStatus(err) != tt.wantStatus {
+					t.Errorf("resolveBackupID() = %q, %v, want status %d", got, err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolveBackupID() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Grafana dashboard of the metrics below, importable as is
+//
+//go:embed dashboards/grafana.json
+var grafanaDashboard []byte
+
+// getMetrics serves the recovery status and backup activity of every
+// application in the Prometheus text exposition format, for SLA dashboards
+// and alerts.
+func getMetrics(c *gin.Context) {
+	stateMu.Lock()
+	var appList []Application
+	for _, app := range apps {
+		appList = append(appList, app)
+	}
+	lastBackups := map[string]Backup{}
+	statusCounts := map[string]map[string]int{}
+	for _, b := range backups {
+		if statusCounts[b.AppID] == nil {
+			statusCounts[b.AppID] = map[string]int{}
+		}
+		statusCounts[b.AppID][b.Status]++
+		if b.Status == backupStatusCompleted && b.DurationSeconds > 0 && b.CreatedAt.After(lastBackups[b.AppID].CreatedAt) {
+			lastBackups[b.AppID] = b
+		}
+	}
+	samples := maps.Clone(driftSamples)
+	stateMu.Unlock()
+	slices.SortFunc(appList, func(a, b Application) int { return strings.Compare(a.AppID, b.AppID) })
+
+	var rpo, targetRPO, rpoCompliant, rto, targetRTO, rtoCompliant []string
+	var duration, recorded, storageBytes []string
+	var drifted, driftedObjects, driftChecked []string
+	for _, app := range appList {
+		status := applicationRecovery(app)
+		labels := fmt.Sprintf(`{app_id=%q,name=%q,namespace=%q}`, app.AppID, app.Name, app.Namespace)
+
+		if status.ActualRPO != "" {
+			rpo = append(rpo, fmt.Sprintf("%s %g", labels, status.actualRPO.Seconds()))
+		}
+		if app.TargetRPO != nil {
+			targetRPO = append(targetRPO, fmt.Sprintf("%s %g", labels, app.TargetRPO.Seconds()))
+			rpoCompliant = append(rpoCompliant, fmt.Sprintf("%s %d", labels, boolMetric(*status.RPOCompliant)))
+		}
+		if status.EstimatedRTO != "" {
+			rto = append(rto, fmt.Sprintf("%s %g", labels, status.estimatedRTO.Seconds()))
+		}
+		if app.TargetRTO != nil {
+			targetRTO = append(targetRTO, fmt.Sprintf("%s %g", labels, app.TargetRTO.Seconds()))
+		}
+		if status.RTOCompliant != nil {
+			rtoCompliant = append(rtoCompliant, fmt.Sprintf("%s %d", labels, boolMetric(*status.RTOCompliant)))
+		}
+
+		if b, ok := lastBackups[app.AppID]; ok {
+			duration = append(duration, fmt.Sprintf("%s %g", labels, b.DurationSeconds))
+		}
+		for _, s := range []string{backupStatusCompleted, backupStatusFailed, backupStatusUnchanged} {
+			statusLabels := fmt.Sprintf(`{app_id=%q,name=%q,namespace=%q,status=%q}`, app.AppID, app.Name, app.Namespace, s)
+			recorded = append(recorded, fmt.Sprintf("%s %d", statusLabels, statusCounts[app.AppID][s]))
+		}
+		// Files that can't be read are left out rather than failing the scrape
+		if size, err := backupStorageBytes(app.AppID); err == nil {
+			storageBytes = append(storageBytes, fmt.Sprintf("%s %d", labels, size))
+		}
+
+		if sample, ok := samples[app.AppID]; ok {
+			drifted = append(drifted, fmt.Sprintf("%s %d", labels, boolMetric(sample.report.Drifted)))
+			driftChecked = append(driftChecked, fmt.Sprintf("%s %d", labels, sample.checkedAt.Unix()))
+			for _, k := range sample.report.Kinds {
+				for change, objects := range map[string][]string{"added": k.Added, "removed": k.Removed, "modified": k.Modified} {
+					changeLabels := fmt.Sprintf(`{app_id=%q,name=%q,namespace=%q,kind=%q,change=%q}`, app.AppID, app.Name, app.Namespace, k.Kind, change)
+					driftedObjects = append(driftedObjects, fmt.Sprintf("%s %d", changeLabels, len(objects)))
+				}
+			}
+		}
+	}
+	// The changes of a kind come out of a map
+	slices.Sort(driftedObjects)
+
+	var b strings.Builder
+	writeGauge(&b, "netx_application_rpo_seconds", "Time since the last successful backup.", rpo)
+	writeGauge(&b, "netx_application_target_rpo_seconds", "Recovery point objective of the application.", targetRPO)
+	writeGauge(&b, "netx_application_rpo_compliant", "1 if the last successful backup is within the recovery point objective.", rpoCompliant)
+	writeGauge(&b, "netx_application_estimated_rto_seconds", "Longest of the recent completed restores.", rto)
+	writeGauge(&b, "netx_application_target_rto_seconds", "Recovery time objective of the application.", targetRTO)
+	writeGauge(&b, "netx_application_rto_compliant", "1 if the estimated restore time is within the recovery time objective.", rtoCompliant)
+	writeGauge(&b, "netx_application_last_backup_duration_seconds", "Duration of the last completed backup.", duration)
+	writeGauge(&b, "netx_application_backups", "Recorded backups by status, pruned ones are not counted.", recorded)
+	writeGauge(&b, "netx_application_backup_storage_bytes", "Size of the local files of all recorded backups.", storageBytes)
+	if cfg.DriftMetrics != nil {
+		writeGauge(&b, "netx_application_drifted", "1 if the namespace changed since the latest completed backup.", drifted)
+		writeGauge(&b, "netx_application_drifted_objects", "Objects added, removed or modified since the latest completed backup, by kind.", driftedObjects)
+		writeGauge(&b, "netx_application_drift_checked_timestamp_seconds", "When the drift was last computed.", driftChecked)
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+// getGrafanaDashboard serves the Grafana dashboard of the metrics, to import
+// with a Prometheus data source scraping /metrics.
+func getGrafanaDashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", grafanaDashboard)
+}
+
+// writeGauge writes one gauge with its samples, each given as labels and value.
+func writeGauge(b *strings.Builder, name, help string, samples []string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, sample := range samples {
+		fmt.Fprintf(b, "%s%s\n", name, sample)
+	}
+}
+
+func boolMetric(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"net_exercise/pkg/notify"
+)
+
+// Only set when email is configured
+var emailer *notify.Emailer
+
+// Apps whose scheduled backups are overdue and were notified about, guarded
+// by stateMu. Cleared by the next successful backup.
+var missedSchedules = map[string]bool{}
+
+// sendNotification mails event about app in the background, to the global
+// recipients and the app's own.
+func sendNotification(event notify.Event, app Application) {
+	if emailer == nil {
+		return
+	}
+
+	event.AppID = app.AppID
+	event.AppName = app.Name
+	if event.Namespace == "" {
+		event.Namespace = app.Namespace
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	go func() {
+		if err := emailer.Send(event, app.NotifyEmails); err != nil {
+			log.Printf("sending %s notification for %s: %v", event.Type, app.AppID, err)
+		}
+	}()
+}
+
+// markScheduleMissed reports whether appID was not already known to be overdue.
+func markScheduleMissed(appID string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if missedSchedules[appID] {
+		return false
+	}
+	missedSchedules[appID] = true
+	return true
+}
+
+func clearScheduleMissed(appID string) {
+	stateMu.Lock()
+	delete(missedSchedules, appID)
+	stateMu.Unlock()
+}
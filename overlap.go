@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// applicationOverlap is a pair of applications in one namespace whose label
+// selectors can match the same object, which both then back up and restore.
+type applicationOverlap struct {
+	AppIDs         [2]string `json:"app_ids"`
+	LabelSelectors [2]string `json:"label_selectors"`
+}
+
+type namespaceApplications struct {
+	Namespace string `json:"namespace"`
+	// Every application registered in the namespace
+	AppIDs   []string             `json:"app_ids"`
+	Overlaps []applicationOverlap `json:"overlaps"`
+}
+
+// applicationConflicts lists the namespaces shared by several applications
+// and which of them overlap.
+func applicationConflicts(c *gin.Context) {
+	stateMu.Lock()
+	byNamespace := map[string][]Application{}
+	for _, app := range apps {
+		byNamespace[app.Namespace] = append(byNamespace[app.Namespace], app)
+	}
+	stateMu.Unlock()
+
+	report := []namespaceApplications{}
+	for namespace, shared := range byNamespace {
+		if len(shared) < 2 {
+			continue
+		}
+		slices.SortFunc(shared, func(a, b Application) int { return compareIDs(a.AppID, b.AppID) })
+
+		entry := namespaceApplications{Namespace: namespace, Overlaps: []applicationOverlap{}}
+		for i, a := range shared {
+			entry.AppIDs = append(entry.AppIDs, a.AppID)
+			for _, b := range shared[i+1:] {
+				if selectorsOverlap(a.LabelSelector, b.LabelSelector) {
+					entry.Overlaps = append(entry.Overlaps, applicationOverlap{
+						AppIDs:         [2]string{a.AppID, b.AppID},
+						LabelSelectors: [2]string{a.LabelSelector, b.LabelSelector},
+					})
+				}
+			}
+		}
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Namespace < report[j].Namespace })
+
+	c.JSON(http.StatusOK, gin.H{"namespaces": report})
+}
+
+// overlapWarnings describes the other applications in the namespace of appID
+// whose selectors overlap with its.
+func overlapWarnings(appID string) []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	app := apps[appID]
+	var others []Application
+	for _, other := range apps {
+		if other.AppID != app.AppID && other.Namespace == app.Namespace && selectorsOverlap(app.LabelSelector, other.LabelSelector) {
+			others = append(others, other)
+		}
+	}
+	slices.SortFunc(others, func(a, b Application) int { return compareIDs(a.AppID, b.AppID) })
+
+	var warnings []string
+	for _, other := range others {
+		warnings = append(warnings, fmt.Sprintf("%s (%s) in namespace %s %s, objects matching both are backed up and restored by each", other.AppID, other.Name, other.Namespace, describeSelector(other.LabelSelector)))
+	}
+	return warnings
+}
+
+func describeSelector(selector string) string {
+	if selector == "" {
+		return "covers the whole namespace"
+	}
+	return fmt.Sprintf("has the overlapping label_selector %q", selector)
+}
+
+// selectorsOverlap reports whether some set of labels could match both
+// selectors. An empty selector matches everything. Gt and Lt requirements
+// are assumed to overlap with anything but DoesNotExist.
+func selectorsOverlap(a, b string) bool {
+	selectorA, errA := labels.Parse(a)
+	selectorB, errB := labels.Parse(b)
+	// Registered selectors are validated, this only guards against old state
+	if errA != nil || errB != nil {
+		return true
+	}
+	requirementsA, _ := selectorA.Requirements()
+	requirementsB, _ := selectorB.Requirements()
+
+	byKey := map[string][]labels.Requirement{}
+	for _, r := range append(requirementsA, requirementsB...) {
+		byKey[r.Key()] = append(byKey[r.Key()], r)
+	}
+	for _, requirements := range byKey {
+		if !satisfiable(requirements) {
+			return false
+		}
+	}
+	return true
+}
+
+// satisfiable reports whether one label value, or its absence, meets all of
+// the requirements on a key.
+func satisfiable(requirements []labels.Requirement) bool {
+	var allowed sets.Set[string] // nil while any value is allowed
+	denied := sets.New[string]()
+	mustExist, mustNotExist := false, false
+
+	for _, r := range requirements {
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			mustExist = true
+			if allowed == nil {
+				allowed = sets.New(r.Values().UnsortedList()...)
+			} else {
+				allowed = allowed.Intersection(sets.New(r.Values().UnsortedList()...))
+			}
+		case selection.NotEquals, selection.NotIn:
+			// Also matched by objects without the label
+			denied.Insert(r.Values().UnsortedList()...)
+		case selection.Exists, selection.GreaterThan, selection.LessThan:
+			mustExist = true
+		case selection.DoesNotExist:
+			mustNotExist = true
+		}
+	}
+
+	if mustExist && mustNotExist {
+		return false
+	}
+	if allowed != nil && allowed.Difference(denied).Len() == 0 {
+		return false
+	}
+	return true
+}
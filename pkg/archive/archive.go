@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Pack writes the files below dir into a gzip compressed tar archive at path.
+// The files in first, paths relative to dir, are written before all others so
+// ReadFile finds them without reading the whole archive. The archive is
+// written to a temporary file and renamed, it is never left half written.
+func Pack(dir, path string, first ...string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	for _, rel := range first {
+		if err := addFile(tw, filepath.Join(dir, rel), rel); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || slices.Contains(first, rel) {
+			return err
+		}
+		return addFile(tw, file, rel)
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func addFile(tw *tar.Writer, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Unpack extracts the archive at path into dir, which is created.
+func Unpack(path, dir string) error {
+	return walk(path, func(header *tar.Header, r io.Reader) (bool, error) {
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return false, fmt.Errorf("%s: entry %s escapes the archive", path, header.Name)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return true, nil
+		}
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return false, err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return false, err
+		}
+		return true, f.Close()
+	})
+}
+
+// ReadFile returns the content of the file name in the archive at path, or
+// an error wrapping fs.ErrNotExist.
+func ReadFile(path, name string) ([]byte, error) {
+	var data []byte
+	err := walk(path, func(header *tar.Header, r io.Reader) (bool, error) {
+		if header.Name != name {
+			return true, nil
+		}
+		var err error
+		data, err = io.ReadAll(r)
+		return false, err
+	})
+	if err == nil && data == nil {
+		err = fmt.Errorf("%s in %s: %w", name, path, fs.ErrNotExist)
+	}
+	return data, err
+}
+
+// walk calls fn for every entry of the archive at path until it returns false.
+func walk(path string, fn func(*tar.Header, io.Reader) (bool, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		more, err := fn(header, tr)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every generated API key starts with this, so leaked keys are easy to spot
+const apiKeyPrefix = "netx_"
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey describes a long-lived credential for scripts and pipelines. The
+// key itself is only returned when it is created or rotated; the store keeps
+// its SHA-256 hash.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Scope of the key, checked like the role of any other caller
+	Role      Role       `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+
+	hash string
+}
+
+func (k *APIKey) usable(now time.Time) error {
+	if k.RevokedAt != nil {
+		return fmt.Errorf("%w: API key %s was revoked", ErrInvalidToken, k.ID)
+	}
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return fmt.Errorf("%w: API key %s expired", ErrInvalidToken, k.ID)
+	}
+	return nil
+}
+
+type APIKeyStore struct {
+	mu      sync.Mutex
+	counter int
+	keys    map[string]*APIKey
+	// Key hash to key ID
+	byHash map[string]string
+}
+
+// StoredAPIKey is a key as it is saved, with the hash of its secret.
+type StoredAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+// APIKeyState is what an APIKeyStore saves to survive restarts.
+type APIKeyState struct {
+	Counter int            `json:"counter"`
+	Keys    []StoredAPIKey `json:"keys"`
+}
+
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{
+		keys:   map[string]*APIKey{},
+		byHash: map[string]string{},
+	}
+}
+
+// Create stores a new key and returns it together with the secret key, which
+// cannot be retrieved again.
+func (s *APIKeyStore) Create(name string, role Role, expiresAt *time.Time) (APIKey, string, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	if err := validateAPIKey(name, role); err != nil {
+		return APIKey{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addLocked(name, role, expiresAt, key), key, nil
+}
+
+// Import stores a key chosen by the caller under name, such as the bootstrap
+// key handed to the service through its environment on every start. If a
+// key of that name is stored already it is returned as it is, whatever its
+// secret: a bootstrap key that was rotated or revoked stays so on restart,
+// instead of the secret in the environment working again.
+func (s *APIKeyStore) Import(name string, role Role, expiresAt *time.Time, key string) (APIKey, error) {
+	if err := validateAPIKey(name, role); err != nil {
+		return APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range s.keys {
+		if k.Name == name {
+			return *k, nil
+		}
+	}
+	return s.addLocked(name, role, expiresAt, key), nil
+}
+
+func validateAPIKey(name string, role Role) error {
+	if name == "" {
+		return errors.New("API key needs a name")
+	}
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %q, must be one of: viewer, operator, admin", role)
+	}
+	return nil
+}
+
+func (s *APIKeyStore) addLocked(name string, role Role, expiresAt *time.Time, key string) APIKey {
+	hash := hashAPIKey(key)
+	s.counter++
+	k := &APIKey{
+		ID:        fmt.Sprintf("key_%d", s.counter),
+		Name:      name,
+		Role:      role,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+		hash:      hash,
+	}
+	s.keys[k.ID] = k
+	s.byHash[k.hash] = k.ID
+	return *k
+}
+
+// State returns the keys with their hashes, for saving them.
+func (s *APIKeyStore) State() APIKeyState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := APIKeyState{Counter: s.counter, Keys: make([]StoredAPIKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		state.Keys = append(state.Keys, StoredAPIKey{APIKey: *k, Hash: k.hash})
+	}
+	sort.Slice(state.Keys, func(i, j int) bool { return state.Keys[i].CreatedAt.Before(state.Keys[j].CreatedAt) })
+	return state
+}
+
+// Stored returns the key with the hash of its secret and the counter its ID
+// was taken from, for saving it after a change.
+func (s *APIKeyStore) Stored(id string) (key StoredAPIKey, counter int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return StoredAPIKey{}, s.counter, false
+	}
+	return StoredAPIKey{APIKey: *k, Hash: k.hash}, s.counter, true
+}
+
+// Load replaces the keys of the store with the saved ones.
+func (s *APIKeyStore) Load(state APIKeyState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counter = state.Counter
+	s.keys = make(map[string]*APIKey, len(state.Keys))
+	s.byHash = make(map[string]string, len(state.Keys))
+	for _, stored := range state.Keys {
+		k := stored.APIKey
+		k.hash = stored.Hash
+		s.keys[k.ID] = &k
+		// Revoked keys are kept for auditing but never authenticate
+		if k.RevokedAt == nil {
+			s.byHash[k.hash] = k.ID
+		}
+	}
+}
+
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Rotate replaces the secret of a key, keeping its ID, name, role and
+// expiry. The old secret stops working immediately.
+func (s *APIKeyStore) Rotate(id string) (APIKey, string, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, "", ErrAPIKeyNotFound
+	}
+	if err := k.usable(time.Now()); err != nil {
+		return APIKey{}, "", err
+	}
+
+	now := time.Now().UTC()
+	delete(s.byHash, k.hash)
+	k.hash = hashAPIKey(key)
+	k.RotatedAt = &now
+	s.byHash[k.hash] = k.ID
+	return *k, key, nil
+}
+
+// Revoke disables a key for good. Revoked keys stay listed for auditing.
+func (s *APIKeyStore) Revoke(id string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		k.RevokedAt = &now
+		delete(s.byHash, k.hash)
+	}
+	return *k, nil
+}
+
+func (s *APIKeyStore) Authenticate(token string) (*Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.byHash[hashAPIKey(token)]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	k := s.keys[id]
+	if err := k.usable(time.Now()); err != nil {
+		return nil, err
+	}
+	return &Identity{Subject: "api-key:" + k.Name, Role: k.Role, APIKeyID: k.ID}, nil
+}
+
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(secret), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// Keys are saved with the metadata and loaded on the next start, where the
+// bootstrap key is imported again.
+func TestAPIKeyStoreLoad(t *testing.T) {
+	const bootstrapKey = "netx_bootstrap"
+
+	saved := NewAPIKeyStore()
+	if _, err := saved.Import("bootstrap", RoleAdmin, nil, bootstrapKey); err != nil {
+		t.Fatal(err)
+	}
+	_, ciKey, err := saved.Create("ci", RoleOperator, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedKey, err := saved.Create("old", RoleViewer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saved.Revoke(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Through JSON, like the metadata store
+	data, err := json.Marshal(saved.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state APIKeyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewAPIKeyStore()
+	loaded.Load(state)
+	if _, err := loaded.Import("bootstrap", RoleAdmin, nil, bootstrapKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		wantRole Role
+		wantErr  error
+	}{
+		{name: "bootstrap key", key: bootstrapKey, wantRole: RoleAdmin},
+		{name: "created key", key: ciKey, wantRole: RoleOperator},
+		{name: "revoked key", key: revokedKey, wantErr: ErrInvalidToken},
+		{name: "unknown key", key: "netx_unknown", wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := loaded.Authenticate(tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && identity.Role != tt.wantRole {
+				t.Errorf("Authenticate() role = %s, want %s", identity.Role, tt.wantRole)
+			}
+		})
+	}
+
+	if keys := loaded.List(); len(keys) != 3 {
+		t.Errorf("List() has %d keys after importing the bootstrap key again, want 3", len(keys))
+	}
+	key, _, err := loaded.Create("next", RoleViewer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != "key_4" {
+		t.Errorf("Create() after Load() has ID %s, want key_4", key.ID)
+	}
+}
+
+// The bootstrap key is imported on every start. Once it was rotated or
+// revoked, the secret in the environment must not work again.
+func TestAPIKeyStoreBootstrapImport(t *testing.T) {
+	const bootstrapKey = "netx_bootstrap"
+
+	tests := []struct {
+		name string
+		// Applied to the bootstrap key before the restart, returning its
+		// new secret if it has one
+		change     func(s *APIKeyStore, id string) (string, error)
+		wantOldErr error
+	}{
+		{
+			name:   "unchanged",
+			change: func(s *APIKeyStore, id string) (string, error) { return "", nil },
+		},
+		{
+			name: "rotated",
+			change: func(s *APIKeyStore, id string) (string, error) {
+				_, key, err := s.Rotate(id)
+				return key, err
+			},
+			wantOldErr: ErrInvalidToken,
+		},
+		{
+			name: "revoked",
+			change: func(s *APIKeyStore, id string) (string, error) {
+				_, err := s.Revoke(id)
+				return "", err
+			},
+			wantOldErr: ErrInvalidToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := NewAPIKeyStore()
+			bootstrap, err := saved.Import("bootstrap", RoleAdmin, nil, bootstrapKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newKey, err := tt.change(saved, bootstrap.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Restart
+			loaded := NewAPIKeyStore()
+			loaded.Load(saved.State())
+			imported, err := loaded.Import("bootstrap", RoleAdmin, nil, bootstrapKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if imported.ID != bootstrap.ID {
+				t.Errorf("Import() returned key %s, want the stored %s", imported.ID, bootstrap.ID)
+			}
+			if keys := loaded.List(); len(keys) != 1 {
+				t.Errorf("List() has %d keys after importing the bootstrap key again, want 1", len(keys))
+			}
+			if _, err := loaded.Authenticate(bootstrapKey); !errors.Is(err, tt.wantOldErr) {
+				t.Errorf("Authenticate() with the bootstrap secret error = %v, want %v", err, tt.wantOldErr)
+			}
+			if newKey != "" {
+				if _, err := loaded.Authenticate(newKey); err != nil {
+					t.Errorf("Authenticate() with the rotated secret error = %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+func (r Role) Valid() bool {
+	return roleRank[r] > 0
+}
+
+// Allows reports whether r includes the permissions of required.
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+type Identity struct {
+	Subject string   `json:"subject"`
+	Groups  []string `json:"groups,omitempty"`
+	Role    Role     `json:"role"`
+	// Set for callers authenticated with an API key. Unlike the name in
+	// Subject it is unique and survives rotations.
+	APIKeyID string `json:"api_key_id,omitempty"`
+}
+
+// CanReadSecrets reports whether Secret contents may be returned to the
+// caller. Everyone else gets them masked by pkg/redact.
+func (i *Identity) CanReadSecrets() bool {
+	return i.Role.Allows(RoleAdmin)
+}
+
+// Anonymous is used for every request when no authenticator is configured.
+var Anonymous = &Identity{Subject: "anonymous", Role: RoleAdmin}
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+const identityKey = "netx.identity"
+
+// Middleware resolves the bearer token of every request to an Identity. The
+// first authenticator that accepts the token wins. Without authenticators
+// authentication is disabled and every caller is Anonymous.
+func Middleware(authenticators ...Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(authenticators) == 0 {
+			c.Set(identityKey, Anonymous)
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+
+		var lastErr error
+		for _, a := range authenticators {
+			identity, err := a.Authenticate(token)
+			if err == nil {
+				c.Set(identityKey, identity)
+				return
+			}
+			lastErr = err
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": lastErr.Error()})
+	}
+}
+
+// RequireRole rejects callers whose role does not include role.
+func RequireRole(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := FromContext(c)
+		if identity == nil || !identity.Role.Allows(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This operation requires the " + string(role) + " role"})
+		}
+	}
+}
+
+func FromContext(c *gin.Context) *Identity {
+	v, ok := c.Get(identityKey)
+	if !ok {
+		return nil
+	}
+	identity, _ := v.(*Identity)
+	return identity
+}
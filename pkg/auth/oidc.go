@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"net_exercise/pkg/config"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// Allowed difference between our clock and the issuer's
+const clockSkew = time.Minute
+
+// Signing algorithms accepted for ID tokens. go-oidc only verifies a
+// signature with a key of the algorithm's type.
+var oidcSigningAlgs = []string{oidc.RS256, oidc.ES256}
+
+// OIDCAuthenticator accepts ID tokens issued by a single OpenID Connect
+// provider and maps the caller's groups to a role. Discovery, the provider's
+// signing keys and the verification of the tokens are left to go-oidc, which
+// fetches the keys again when a token names one it doesn't know.
+type OIDCAuthenticator struct {
+	cfg      config.OIDC
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCAuthenticator runs the discovery of the provider at
+// cfg.IssuerURL. ctx is used to fetch the provider's keys for as long as the
+// authenticator is used.
+func NewOIDCAuthenticator(ctx context.Context, cfg config.OIDC) (*OIDCAuthenticator, error) {
+	for group, role := range cfg.RoleMapping {
+		if !Role(role).Valid() {
+			return nil, fmt.Errorf("oidc role_mapping: group %s maps to unknown role %q", group, role)
+		}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	ctx = oidc.ClientContext(ctx, &http.Client{Timeout: 10 * time.Second})
+	// Checks that the discovery document names cfg.IssuerURL as its issuer
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	verifier := provider.Verifier(&oidc.Config{
+		ClientID:             cfg.ClientID,
+		SupportedSigningAlgs: oidcSigningAlgs,
+		// Tokens are accepted for clockSkew after they expire
+		Now: func() time.Time { return time.Now().Add(-clockSkew) },
+	})
+	return &OIDCAuthenticator{cfg: cfg, verifier: verifier}, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(token string) (*Identity, error) {
+	// Checks the signature, issuer, audience and expiry
+	idToken, err := a.verifier.Verify(context.Background(), token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	subject := idToken.Subject
+	groups := stringsClaim(claims[a.cfg.GroupsClaim])
+
+	if len(a.cfg.AllowedGroups) > 0 && !slices.ContainsFunc(groups, func(g string) bool {
+		return slices.Contains(a.cfg.AllowedGroups, g)
+	}) {
+		return nil, fmt.Errorf("%w: %s is not in an allowed group", ErrInvalidToken, subject)
+	}
+
+	// The caller gets the highest role of any of their groups
+	var role Role
+	for _, g := range groups {
+		if mapped := Role(a.cfg.RoleMapping[g]); mapped.Valid() && !role.Allows(mapped) {
+			role = mapped
+		}
+	}
+	if !role.Valid() {
+		return nil, fmt.Errorf("%w: no role is mapped to the groups of %s", ErrInvalidToken, subject)
+	}
+
+	return &Identity{Subject: subject, Groups: groups, Role: role}, nil
+}
+
+// stringsClaim reads a claim that may be a single string or a list of strings,
+// like the groups claim of some providers.
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"net_exercise/pkg/config"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// ID tokens are only accepted with a signature of the provider's key, by an
+// algorithm matching that key, before they expire.
+func TestOIDCAuthenticator(t *testing.T) {
+	providerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &providerKey.PublicKey, KeyID: "key-1", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+
+	a, err := NewOIDCAuthenticator(context.Background(), config.OIDC{
+		IssuerURL:   server.URL,
+		ClientID:    "netx",
+		RoleMapping: map[string]string{"sre": "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(expiresIn time.Duration) map[string]any {
+		return map[string]any{
+			"iss":    server.URL,
+			"aud":    "netx",
+			"sub":    "alice",
+			"groups": []string{"sre"},
+			"exp":    time.Now().Add(expiresIn).Unix(),
+		}
+	}
+	sign := func(alg jose.SignatureAlgorithm, key any, claims map[string]any) string {
+		t.Helper()
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "key-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	unsigned := func(claims map[string]any) string {
+		t.Helper()
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encode := base64.RawURLEncoding.EncodeToString
+		return encode([]byte(`{"alg":"none","kid":"key-1"}`)) + "." + encode(payload) + "."
+	}
+	publicKeyJSON, err := json.Marshal(jose.JSONWebKey{Key: &providerKey.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongAudience := claims(time.Hour)
+	wrongAudience["aud"] = "other"
+
+	tests := []struct {
+		name     string
+		token    string
+		wantRole Role
+		wantErr  error
+	}{
+		{name: "valid", token: sign(jose.RS256, providerKey, claims(time.Hour)), wantRole: RoleAdmin},
+		{name: "expired within the clock skew", token: sign(jose.RS256, providerKey, claims(-clockSkew/2)), wantRole: RoleAdmin},
+		{name: "expired", token: sign(jose.RS256, providerKey, claims(-time.Hour)), wantErr: ErrInvalidToken},
+		{name: "wrong key", token: sign(jose.RS256, otherKey, claims(time.Hour)), wantErr: ErrInvalidToken},
+		// The public key used as an HMAC secret
+		{name: "HMAC algorithm", token: sign(jose.HS256, publicKeyJSON, claims(time.Hour)), wantErr: ErrInvalidToken},
+		{name: "no algorithm", token: unsigned(claims(time.Hour)), wantErr: ErrInvalidToken},
+		// ES256 is allowed, but not with the provider's RSA key
+		{name: "algorithm of another key type", token: sign(jose.ES256, ecKey, claims(time.Hour)), wantErr: ErrInvalidToken},
+		{name: "algorithm not allowed", token: sign(jose.PS256, providerKey, claims(time.Hour)), wantErr: ErrInvalidToken},
+		{name: "wrong audience", token: sign(jose.RS256, providerKey, wrongAudience), wantErr: ErrInvalidToken},
+		{name: "malformed", token: "not-a-token", wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := a.Authenticate(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (identity.Subject != "alice" || identity.Role != tt.wantRole) {
+				t.Errorf("Authenticate() = %+v, want alice with role %s", identity, tt.wantRole)
+			}
+		})
+	}
+}
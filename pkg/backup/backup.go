@@ -3,23 +3,37 @@ package backup
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"os"
-	"path/filepath"
 
+	"net_exercise/pkg/layout"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
-func BackupPVCs(clientset *kubernetes.Clientset, namespace, backupDir string) error {
+// Every namespace gets this ConfigMap from the cluster, it is never backed up
+const RootCAConfigMap = "kube-root-ca.crt"
+
+func BackupPVCs(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
 	// Retrieve PVCs in the namespace
-	pvcList, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), metav1.ListOptions{})
+	pvcs, err := listPVCs(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
 
 	// Backup each PVC
-	for _, pvc := range pvcList.Items {
+	for _, pvc := range pvcs {
+		// CDI creates these from the DataVolume, which is backed up instead
+		if ownedBy(pvc.OwnerReferences, "DataVolume") {
+			continue
+		}
+		if excluded, err := opts.excluded(layout.PVC, &pvc); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		// Marshal PVC object to JSON
 		pvcJSON, err := json.MarshalIndent(pvc, "", "  ")
 		if err != nil {
@@ -27,8 +41,7 @@ func BackupPVCs(clientset *kubernetes.Clientset, namespace, backupDir string) er
 		}
 
 		// Write PVC JSON to file
-		filename := filepath.Join(backupDir, fmt.Sprintf("%s.json", pvc.Name))
-		if err := os.WriteFile(filename, pvcJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.PVC, pvc.Name, pvcJSON); err != nil {
 			return err
 		}
 	}
@@ -36,33 +49,45 @@ func BackupPVCs(clientset *kubernetes.Clientset, namespace, backupDir string) er
 	return nil
 }
 
-func BackupPods(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	podList, err := clientset.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
+func BackupPods(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	pods, err := listPods(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
-	for _, pod := range podList.Items {
+	for _, pod := range pods {
+		if !opts.IncludeFinished && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+			continue
+		}
+		if excluded, err := opts.excluded(layout.Pod, &pod); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		podJSON, err := json.MarshalIndent(pod, "", "  ")
 		if err != nil {
 			return err
 		}
-		filename := filepath.Join(backupDir, fmt.Sprintf("pod-%s.json", pod.Name))
-		if err := os.WriteFile(filename, podJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.Pod, pod.Name, podJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupSecrets(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	ctx := context.Background()
-
-	secretsList, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+func BackupSecrets(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	secrets, err := listSecrets(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
 
-	for _, secret := range secretsList.Items {
+	for _, secret := range secrets {
+		if excluded, err := opts.excluded(layout.Secret, &secret); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		// Marshal Secret object to JSON
 		secretJSON, err := json.MarshalIndent(secret, "", "  ")
 		if err != nil {
@@ -70,66 +95,78 @@ func BackupSecrets(clientset *kubernetes.Clientset, namespace, backupDir string)
 		}
 
 		// Write Secret JSON to file
-		filename := filepath.Join(backupDir, "secret-"+secret.Name+".json")
-		if err := os.WriteFile(filename, secretJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.Secret, secret.Name, secretJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupReplicaSets(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	rsList, err := clientset.AppsV1().ReplicaSets(namespace).List(context.Background(), metav1.ListOptions{})
+func BackupReplicaSets(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	replicaSets, err := listReplicaSets(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
-	for _, rs := range rsList.Items {
+	for _, rs := range replicaSets {
+		if excluded, err := opts.excluded(layout.ReplicaSet, &rs); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		rsJSON, err := json.MarshalIndent(rs, "", "  ")
 		if err != nil {
 			return err
 		}
-		filename := filepath.Join(backupDir, fmt.Sprintf("replicaset-%s.json", rs.Name))
-		if err := os.WriteFile(filename, rsJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.ReplicaSet, rs.Name, rsJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupDeployments(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	deploymentList, err := clientset.AppsV1().Deployments(namespace).List(context.Background(), metav1.ListOptions{})
+func BackupDeployments(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	deployments, err := listDeployments(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
-	for _, deployment := range deploymentList.Items {
+	for _, deployment := range deployments {
+		if excluded, err := opts.excluded(layout.Deployment, &deployment); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		deploymentJSON, err := json.MarshalIndent(deployment, "", "  ")
 		if err != nil {
 			return err
 		}
-		filename := filepath.Join(backupDir, fmt.Sprintf("deployment-%s.json", deployment.Name))
-		if err := os.WriteFile(filename, deploymentJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.Deployment, deployment.Name, deploymentJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupConfigMaps(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	ctx := context.Background()
-
-	cmList, err := clientset.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+func BackupConfigMaps(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	configMaps, err := listConfigMaps(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
-	for _, cm := range cmList.Items {
+	for _, cm := range configMaps {
+		if excluded, err := opts.excluded(layout.ConfigMap, &cm); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
 
 		// https://github.com/kubernetes/kubernetes/blob/master/CHANGELOG/CHANGELOG-1.20.md#introducing-rootcaconfigmap
-		if cm.Name == "kube-root-ca.crt" {
+		if cm.Name == RootCAConfigMap {
 			continue
 		}
 
 		// Check if ConfigMap already exists in backup directory
-		filename := filepath.Join(backupDir, fmt.Sprintf("configmap-%s.json", cm.Name))
+		filename := layout.ObjectFile(backupDir, layout.ConfigMap, cm.Name)
 		if _, err := os.Stat(filename); err == nil {
 			// Skip if ConfigMap already exists in backup directory
 			continue
@@ -143,23 +180,27 @@ func BackupConfigMaps(clientset *kubernetes.Clientset, namespace, backupDir stri
 		if err != nil {
 			return err
 		}
-		if err := os.WriteFile(filename, cmJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.ConfigMap, cm.Name, cmJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupStatefulSet(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	ctx := context.Background()
-
-	statefulSetList, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+func BackupStatefulSet(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	statefulSets, err := listStatefulSets(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
-	for _, statefulSet := range statefulSetList.Items {
+	for _, statefulSet := range statefulSets {
+		if excluded, err := opts.excluded(layout.StatefulSet, &statefulSet); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		// Check if StatefulSet already exists in backup directory
-		filename := filepath.Join(backupDir, fmt.Sprintf("statefulset-%s.json", statefulSet.Name))
+		filename := layout.ObjectFile(backupDir, layout.StatefulSet, statefulSet.Name)
 		if _, err := os.Stat(filename); err == nil {
 			// Skip if StatefulSet already exists in backup directory
 			continue
@@ -173,23 +214,27 @@ func BackupStatefulSet(clientset *kubernetes.Clientset, namespace, backupDir str
 		if err != nil {
 			return err
 		}
-		if err := os.WriteFile(filename, statefulSetJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.StatefulSet, statefulSet.Name, statefulSetJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupServices(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	ctx := context.Background()
-
-	serviceList, err := clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+func BackupServices(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	services, err := listServices(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
-	for _, service := range serviceList.Items {
+	for _, service := range services {
+		if excluded, err := opts.excluded(layout.Service, &service); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		// Check if Service already exists in backup directory
-		filename := filepath.Join(backupDir, fmt.Sprintf("service-%s.json", service.Name))
+		filename := layout.ObjectFile(backupDir, layout.Service, service.Name)
 		if _, err := os.Stat(filename); err == nil {
 			// Skip if Service already exists in backup directory
 			continue
@@ -203,24 +248,28 @@ func BackupServices(clientset *kubernetes.Clientset, namespace, backupDir string
 		if err != nil {
 			return err
 		}
-		if err := os.WriteFile(filename, serviceJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.Service, service.Name, serviceJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupServiceAccounts(clientset *kubernetes.Clientset, namespace, backupDir string) error {
-	ctx := context.Background()
-
+func BackupServiceAccounts(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
 	// Retrieve ServiceAccounts in the namespace
-	saList, err := clientset.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+	serviceAccounts, err := listServiceAccounts(clientset, namespace, opts)
 	if err != nil {
 		return err
 	}
 
 	// Backup each ServiceAccount
-	for _, sa := range saList.Items {
+	for _, sa := range serviceAccounts {
+		if excluded, err := opts.excluded(layout.ServiceAccount, &sa); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
 		// Marshal ServiceAccount object to JSON
 		saJSON, err := json.MarshalIndent(sa, "", "  ")
 		if err != nil {
@@ -228,10 +277,47 @@ func BackupServiceAccounts(clientset *kubernetes.Clientset, namespace, backupDir
 		}
 
 		// Write ServiceAccount JSON to file
-		filename := filepath.Join(backupDir, fmt.Sprintf("serviceaccount-%s.json", sa.Name))
-		if err := os.WriteFile(filename, saJSON, 0644); err != nil {
+		if err := layout.WriteObject(backupDir, layout.ServiceAccount, sa.Name, saJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackupControllerRevisions records the revision history of the StatefulSets
+// and DaemonSets in namespace, to see after the fact what was rolled out
+// before the backup. Restores leave it out.
+func BackupControllerRevisions(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	revisionList, err := clientset.AppsV1().ControllerRevisions(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return err
+	}
+	for _, revision := range revisionList.Items {
+		if !ownedBy(revision.OwnerReferences, "StatefulSet") && !ownedBy(revision.OwnerReferences, "DaemonSet") {
+			continue
+		}
+		if excluded, err := opts.excluded(layout.ControllerRevision, &revision); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		revisionJSON, err := json.MarshalIndent(revision, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.ControllerRevision, revision.Name, revisionJSON); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func ownedBy(owners []metav1.OwnerReference, kind string) bool {
+	for _, owner := range owners {
+		if owner.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
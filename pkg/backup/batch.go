@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BackupJobs stores the Jobs of namespace. Jobs created by a CronJob are left
+// out, the restored CronJob schedules new ones.
+func BackupJobs(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	jobs, err := listJobs(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if ownedBy(job.OwnerReferences, "CronJob") {
+			continue
+		}
+		if !opts.IncludeFinished && jobFinished(&job) {
+			continue
+		}
+		if excluded, err := opts.excluded(layout.Job, &job); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		jobJSON, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.Job, job.Name, jobJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func BackupCronJobs(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	cronJobs, err := listCronJobs(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+	for _, cronJob := range cronJobs {
+		if excluded, err := opts.excluded(layout.CronJob, &cronJob); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		cronJobJSON, err := json.MarshalIndent(cronJob, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.CronJob, cronJob.Name, cronJobJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
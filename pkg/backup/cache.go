@@ -0,0 +1,429 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"net_exercise/pkg/layout"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// InventoryCache keeps the objects of one namespace in informer caches, so
+// that repeated backups read them from memory instead of listing everything
+// from the API server every run. A nil *InventoryCache is valid and makes
+// backups list from the API server.
+type InventoryCache struct {
+	clientset kubernetes.Interface
+	namespace string
+	// Caches older than this are rebuilt from a fresh list, bounding how
+	// long a missed watch event can go unnoticed
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	factory informers.SharedInformerFactory
+	// By kind prefix
+	informers map[string]cache.SharedIndexInformer
+	stop      chan struct{}
+	started   time.Time
+}
+
+func NewInventoryCache(clientset kubernetes.Interface, namespace string, maxAge time.Duration) *InventoryCache {
+	c := &InventoryCache{clientset: clientset, namespace: namespace, maxAge: maxAge}
+	c.start()
+	return c
+}
+
+// start must be called with c.mu held, or before c is shared.
+func (c *InventoryCache) start() {
+	c.factory = informers.NewSharedInformerFactoryWithOptions(c.clientset, 0, informers.WithNamespace(c.namespace))
+	c.informers = map[string]cache.SharedIndexInformer{
+		layout.PVC:                   c.factory.Core().V1().PersistentVolumeClaims().Informer(),
+		layout.Pod:                   c.factory.Core().V1().Pods().Informer(),
+		layout.ReplicaSet:            c.factory.Apps().V1().ReplicaSets().Informer(),
+		layout.Deployment:            c.factory.Apps().V1().Deployments().Informer(),
+		layout.ConfigMap:             c.factory.Core().V1().ConfigMaps().Informer(),
+		layout.StatefulSet:           c.factory.Apps().V1().StatefulSets().Informer(),
+		layout.Service:               c.factory.Core().V1().Services().Informer(),
+		layout.ServiceAccount:        c.factory.Core().V1().ServiceAccounts().Informer(),
+		layout.Secret:                c.factory.Core().V1().Secrets().Informer(),
+		layout.Role:                  c.factory.Rbac().V1().Roles().Informer(),
+		layout.RoleBinding:           c.factory.Rbac().V1().RoleBindings().Informer(),
+		layout.NetworkPolicy:         c.factory.Networking().V1().NetworkPolicies().Informer(),
+		layout.PodTemplate:           c.factory.Core().V1().PodTemplates().Informer(),
+		layout.ReplicationController: c.factory.Core().V1().ReplicationControllers().Informer(),
+		layout.HPA:                   c.factory.Autoscaling().V2().HorizontalPodAutoscalers().Informer(),
+		layout.PDB:                   c.factory.Policy().V1().PodDisruptionBudgets().Informer(),
+		layout.Job:                   c.factory.Batch().V1().Jobs().Informer(),
+		layout.CronJob:               c.factory.Batch().V1().CronJobs().Informer(),
+	}
+	c.stop = make(chan struct{})
+	c.started = time.Now()
+	c.factory.Start(c.stop)
+}
+
+func (c *InventoryCache) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.stop)
+}
+
+// fresh returns the informer factory if every cache has synced and is within
+// maxAge, nil otherwise. An expired cache is rebuilt for the next backup.
+func (c *InventoryCache) fresh() informers.SharedInformerFactory {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.started) > c.maxAge {
+		close(c.stop)
+		c.start()
+		return nil
+	}
+	for _, informer := range c.informers {
+		if !informer.HasSynced() {
+			return nil
+		}
+	}
+	return c.factory
+}
+
+// resourceVersions returns the resourceVersion of every cached object of one
+// kind matching selector by name, ok is false if the kind isn't cached or the
+// cache isn't fresh.
+func (c *InventoryCache) resourceVersions(prefix string, selector labels.Selector) (versions map[string]string, ok bool) {
+	if c.fresh() == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	informer, ok := c.informers[prefix]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	versions = map[string]string{}
+	for _, obj := range informer.GetStore().List() {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, false
+		}
+		if !selector.Matches(labels.Set(accessor.GetLabels())) {
+			continue
+		}
+		versions[accessor.GetName()] = accessor.GetResourceVersion()
+	}
+	return versions, true
+}
+
+// values copies objects out of the cache, which must not be modified.
+func values[T any](ptrs []*T) []T {
+	out := make([]T, 0, len(ptrs))
+	for _, p := range ptrs {
+		out = append(out, *p)
+	}
+	return out
+}
+
+func listPVCs(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.PersistentVolumeClaim, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().PersistentVolumeClaims().Lister().PersistentVolumeClaims(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listPods(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.Pod, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().Pods().Lister().Pods(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().Pods(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listSecrets(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.Secret, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().Secrets().Lister().Secrets(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().Secrets(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listReplicaSets(clientset *kubernetes.Clientset, namespace string, opts Options) ([]appsv1.ReplicaSet, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Apps().V1().ReplicaSets().Lister().ReplicaSets(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.AppsV1().ReplicaSets(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listDeployments(clientset *kubernetes.Clientset, namespace string, opts Options) ([]appsv1.Deployment, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Apps().V1().Deployments().Lister().Deployments(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.AppsV1().Deployments(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listConfigMaps(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.ConfigMap, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().ConfigMaps().Lister().ConfigMaps(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().ConfigMaps(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listStatefulSets(clientset *kubernetes.Clientset, namespace string, opts Options) ([]appsv1.StatefulSet, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Apps().V1().StatefulSets().Lister().StatefulSets(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.AppsV1().StatefulSets(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listServices(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.Service, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().Services().Lister().Services(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().Services(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listServiceAccounts(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.ServiceAccount, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().ServiceAccounts().Lister().ServiceAccounts(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().ServiceAccounts(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listRoles(clientset *kubernetes.Clientset, namespace string, opts Options) ([]rbacv1.Role, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Rbac().V1().Roles().Lister().Roles(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.RbacV1().Roles(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listRoleBindings(clientset *kubernetes.Clientset, namespace string, opts Options) ([]rbacv1.RoleBinding, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Rbac().V1().RoleBindings().Lister().RoleBindings(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.RbacV1().RoleBindings(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listNetworkPolicies(clientset *kubernetes.Clientset, namespace string, opts Options) ([]networkingv1.NetworkPolicy, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Networking().V1().NetworkPolicies().Lister().NetworkPolicies(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.NetworkingV1().NetworkPolicies(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listJobs(clientset *kubernetes.Clientset, namespace string, opts Options) ([]batchv1.Job, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Batch().V1().Jobs().Lister().Jobs(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.BatchV1().Jobs(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listCronJobs(clientset *kubernetes.Clientset, namespace string, opts Options) ([]batchv1.CronJob, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Batch().V1().CronJobs().Lister().CronJobs(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.BatchV1().CronJobs(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listHPAs(clientset *kubernetes.Clientset, namespace string, opts Options) ([]autoscalingv2.HorizontalPodAutoscaler, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Autoscaling().V2().HorizontalPodAutoscalers().Lister().HorizontalPodAutoscalers(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listPDBs(clientset *kubernetes.Clientset, namespace string, opts Options) ([]policyv1.PodDisruptionBudget, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Policy().V1().PodDisruptionBudgets().Lister().PodDisruptionBudgets(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.PolicyV1().PodDisruptionBudgets(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listPodTemplates(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.PodTemplate, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().PodTemplates().Lister().PodTemplates(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().PodTemplates(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func listReplicationControllers(clientset *kubernetes.Clientset, namespace string, opts Options) ([]corev1.ReplicationController, error) {
+	if f := opts.Cache.fresh(); f != nil {
+		selector, err := opts.selector()
+		if err != nil {
+			return nil, err
+		}
+		cached, err := f.Core().V1().ReplicationControllers().Lister().ReplicationControllers(namespace).List(selector)
+		return values(cached), err
+	}
+	list, err := clientset.CoreV1().ReplicationControllers(namespace).List(context.Background(), opts.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Every cluster has these, they are never backed up
+var builtinPriorityClasses = map[string]bool{
+	"system-cluster-critical": true,
+	"system-node-critical":    true,
+}
+
+// BackupClasses stores the PriorityClasses and RuntimeClasses referred to by
+// the Pod specs already in backupDir, so a restore can recreate them on a
+// cluster that lacks them. It has to run after the workloads are backed up.
+func BackupClasses(clientset *kubernetes.Clientset, backupDir string) error {
+	ctx := context.Background()
+
+	for _, class := range layout.ClassKinds {
+		names, err := referencedClasses(layout.Current(backupDir), class)
+		if err != nil {
+			return err
+		}
+
+		for name := range names {
+			if class.Prefix == layout.PriorityClass && builtinPriorityClasses[name] {
+				continue
+			}
+
+			var obj any
+			switch class.Prefix {
+			case layout.PriorityClass:
+				obj, err = clientset.SchedulingV1().PriorityClasses().Get(ctx, name, metav1.GetOptions{})
+			case layout.RuntimeClass:
+				obj, err = clientset.NodeV1().RuntimeClasses().Get(ctx, name, metav1.GetOptions{})
+			}
+			// Workloads using a class that does not exist cannot run here either
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			classJSON, err := json.MarshalIndent(obj, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := layout.WriteObject(backupDir, class.Prefix, name, classJSON); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func referencedClasses(backupLayout layout.Reader, class layout.ClassKind) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, k := range layout.Kinds {
+		if k.PodSpec == nil {
+			continue
+		}
+		files, err := backupLayout.ObjectFiles(k.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			obj, err := backupLayout.ReadObject(file, k)
+			if err != nil {
+				return nil, err
+			}
+			name, _, _ := unstructured.NestedString(obj.Object, k.PodSpecField(class.Field)...)
+			if name != "" {
+				names[name] = true
+			}
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"sort"
+	"strings"
+
+	"net_exercise/pkg/manifest"
+
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ClusterInfo records the server version and the kinds served by every API
+// group version of the cluster being backed up.
+func ClusterInfo(clientset *kubernetes.Clientset) (*manifest.Cluster, error) {
+	return DescribeCluster(clientset.Discovery())
+}
+
+func DescribeCluster(client discovery.DiscoveryInterface) (*manifest.Cluster, error) {
+	version, err := client.ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unavailable aggregated APIs only make the result partial
+	_, resourceLists, err := client.ServerGroupsAndResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	cluster := &manifest.Cluster{
+		ServerVersion: version.GitVersion,
+		APIResources:  map[string][]string{},
+	}
+	for _, list := range resourceLists {
+		var kinds []string
+		for _, resource := range list.APIResources {
+			// Skip subresources such as deployments/scale
+			if strings.Contains(resource.Name, "/") {
+				continue
+			}
+			kinds = append(kinds, resource.Kind)
+		}
+		sort.Strings(kinds)
+		cluster.APIResources[list.GroupVersion] = kinds
+	}
+	return cluster, nil
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// BackupCRDs stores the CustomResourceDefinitions of the custom kinds with
+// objects in backupDir, so a restore can create them before the objects on a
+// cluster that lacks them. It has to run after the objects are backed up.
+func BackupCRDs(client dynamic.Interface, backupDir string) error {
+	ctx := context.Background()
+	backupLayout := layout.Current(backupDir)
+
+	for _, k := range layout.Kinds {
+		if !k.Custom {
+			continue
+		}
+		files, err := backupLayout.ObjectFiles(k.Prefix)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		crd, err := client.Resource(layout.CRDKind.GVR).Get(ctx, k.CRDName(), metav1.GetOptions{})
+		// Served by an aggregated API server rather than a CRD
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		crdJSON, err := json.MarshalIndent(crd.Object, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.CustomResourceDefinition, crd.GetName(), crdJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"time"
+
+	"net_exercise/pkg/manifest"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HealthSnapshot records the replica counts of the Deployments and
+// StatefulSets in namespace and the phase and readiness of its Pods, of those
+// matching labelSelector if set.
+func HealthSnapshot(ctx context.Context, clientset *kubernetes.Clientset, namespace, labelSelector string) (*manifest.Health, error) {
+	listOptions := metav1.ListOptions{LabelSelector: labelSelector}
+	health := &manifest.Health{
+		CapturedAt: time.Now().UTC(),
+		Workloads:  []manifest.WorkloadHealth{},
+		PodPhases:  map[string]int{},
+	}
+
+	deploymentList, err := clientset.AppsV1().Deployments(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deploymentList.Items {
+		health.Workloads = append(health.Workloads, manifest.WorkloadHealth{
+			Kind:              "Deployment",
+			Name:              d.Name,
+			Replicas:          d.Status.Replicas,
+			ReadyReplicas:     d.Status.ReadyReplicas,
+			AvailableReplicas: d.Status.AvailableReplicas,
+		})
+	}
+
+	statefulSetList, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range statefulSetList.Items {
+		health.Workloads = append(health.Workloads, manifest.WorkloadHealth{
+			Kind:              "StatefulSet",
+			Name:              s.Name,
+			Replicas:          s.Status.Replicas,
+			ReadyReplicas:     s.Status.ReadyReplicas,
+			AvailableReplicas: s.Status.AvailableReplicas,
+		})
+	}
+
+	podList, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range podList.Items {
+		health.Pods++
+		health.PodPhases[string(pod.Status.Phase)]++
+		if podReady(&pod) {
+			health.ReadyPods++
+		}
+	}
+	return health, nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+var virtualMachineSnapshotGVR = schema.GroupVersionResource{Group: "snapshot.kubevirt.io", Version: "v1beta1", Resource: "virtualmachinesnapshots"}
+
+// How long to wait for a VirtualMachineSnapshot to become ready to use
+const virtualMachineSnapshotTimeout = 5 * time.Minute
+
+// BackupDataVolumes captures the CDI DataVolumes of namespace. It does
+// nothing on clusters without KubeVirt.
+func BackupDataVolumes(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface, namespace, backupDir string, opts Options) error {
+	return backupKubeVirt(client, discoveryClient, layout.DataVolume, namespace, backupDir, opts)
+}
+
+// BackupVirtualMachines captures the KubeVirt VirtualMachines of namespace.
+// With opts.KubeVirtSnapshots a VirtualMachineSnapshot is taken of every
+// VirtualMachine first; KubeVirt freezes and thaws the guest file systems
+// through the guest agent while the snapshot is taken.
+func BackupVirtualMachines(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface, namespace, backupDir string, opts Options) error {
+	return backupKubeVirt(client, discoveryClient, layout.VirtualMachine, namespace, backupDir, opts)
+}
+
+func backupKubeVirt(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface, prefix, namespace, backupDir string, opts Options) error {
+	ctx := context.Background()
+	k, _ := layout.LookupKind(prefix)
+
+	served, err := serves(discoveryClient, k.GVR)
+	if err != nil || !served {
+		return err
+	}
+
+	list, err := client.Resource(k.GVR).Namespace(namespace).List(ctx, opts.listOptions())
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if excluded, err := opts.excluded(prefix, obj); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		if prefix == layout.VirtualMachine && opts.KubeVirtSnapshots {
+			if err := snapshotVirtualMachine(ctx, client, namespace, obj.GetName(), backupDir); err != nil {
+				return fmt.Errorf("snapshot of VirtualMachine %s: %w", obj.GetName(), err)
+			}
+		}
+
+		objJSON, err := json.MarshalIndent(obj.Object, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, prefix, obj.GetName(), objJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotVirtualMachine takes a VirtualMachineSnapshot and waits until it is
+// ready. The snapshot stays in the cluster; the backup keeps a record of it.
+func snapshotVirtualMachine(ctx context.Context, client dynamic.Interface, namespace, name, backupDir string) error {
+	snapshots := client.Resource(virtualMachineSnapshotGVR).Namespace(namespace)
+
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": virtualMachineSnapshotGVR.GroupVersion().String(),
+		"kind":       "VirtualMachineSnapshot",
+		"metadata": map[string]interface{}{
+			"generateName": "netx-" + name + "-",
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{
+				"apiGroup": "kubevirt.io",
+				"kind":     "VirtualMachine",
+				"name":     name,
+			},
+		},
+	}}
+	snapshot, err := snapshots.Create(ctx, snapshot, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	err = wait.PollUntilContextTimeout(ctx, 2*time.Second, virtualMachineSnapshotTimeout, true, func(ctx context.Context) (bool, error) {
+		snapshot, err = snapshots.Get(ctx, snapshot.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		return ready, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	snapshotJSON, err := json.MarshalIndent(snapshot.Object, "", "  ")
+	if err != nil {
+		return err
+	}
+	return layout.WriteObject(backupDir, layout.VirtualMachineSnapshot, snapshot.GetName(), snapshotJSON)
+}
+
+func serves(client discovery.DiscoveryInterface, gvr schema.GroupVersionResource) (bool, error) {
+	resources, err := client.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BackupPodTemplates stores the PodTemplates of namespace, which older
+// tooling keeps as the source of its Pods.
+func BackupPodTemplates(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	templates, err := listPodTemplates(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+	for _, template := range templates {
+		if excluded, err := opts.excluded(layout.PodTemplate, &template); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		templateJSON, err := json.MarshalIndent(template, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.PodTemplate, template.Name, templateJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackupReplicationControllers stores the standalone ReplicationControllers
+// of namespace. Those with a controller are left out, it recreates them.
+func BackupReplicationControllers(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	controllers, err := listReplicationControllers(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+	for _, rc := range controllers {
+		if metav1.GetControllerOf(&rc) != nil {
+			continue
+		}
+		if excluded, err := opts.excluded(layout.ReplicationController, &rc); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		rcJSON, err := json.MarshalIndent(rc, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.ReplicationController, rc.Name, rcJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package backup
+
+import (
+	"context"
+
+	"net_exercise/pkg/manifest"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NamespaceMetadata records the labels and annotations of namespace, which
+// restores creating the namespace copy.
+func NamespaceMetadata(ctx context.Context, clientset *kubernetes.Clientset, namespace string) (*manifest.NamespaceMetadata, error) {
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &manifest.NamespaceMetadata{Labels: ns.Labels, Annotations: ns.Annotations}, nil
+}
@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/layout"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+type Options struct {
+	Exclusions []Exclusion
+	// Also back up Pods and Jobs that ran to completion or failed. They only
+	// add noise and can't be meaningfully restored, so they are skipped by
+	// default.
+	IncludeFinished bool
+	// Take a VirtualMachineSnapshot of every KubeVirt VirtualMachine
+	KubeVirtSnapshots bool
+	// VolumeSnapshotClass of the CSI snapshots taken by SnapshotVolumes, the
+	// default class of each PVC's driver if empty
+	VolumeSnapshotClass string
+	// Read objects from this cache while it is fresh instead of listing them
+	Cache *InventoryCache
+	// Kinds whose status is kept in a sidecar file instead of being dropped
+	CaptureStatus []string
+	// Only objects matching this label selector are backed up, all objects
+	// of the namespace if empty
+	LabelSelector string
+	// Only these objects are backed up if set, see ObjectRef
+	Objects []ObjectRef
+}
+
+// ObjectRef names one object of a backup that only captures a list of
+// objects, e.g. the ones about to be edited by hand.
+type ObjectRef struct {
+	// Kind prefix ("deployment") or Kind ("Deployment")
+	Kind string `json:"kind" binding:"required"`
+	Name string `json:"name" binding:"required"`
+}
+
+func (r ObjectRef) Validate() error {
+	if _, ok := layout.LookupKind(r.Kind); !ok {
+		return fmt.Errorf("object %s/%s: unknown kind %q", r.Kind, r.Name, r.Kind)
+	}
+	return nil
+}
+
+// String is the object's <kind prefix>/<name>, as in manifest.Manifest.UIDs.
+func (r ObjectRef) String() string {
+	if k, ok := layout.LookupKind(r.Kind); ok {
+		return k.Prefix + "/" + r.Name
+	}
+	return r.Kind + "/" + r.Name
+}
+
+// Selects reports whether objects of the kind prefix are backed up.
+func (o Options) Selects(kind string) bool {
+	if len(o.Objects) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(o.Objects, func(r ObjectRef) bool {
+		k, ok := layout.LookupKind(r.Kind)
+		return ok && k.Prefix == kind
+	})
+}
+
+// listOptions are the options of every List call of a backup.
+func (o Options) listOptions() metav1.ListOptions {
+	return metav1.ListOptions{LabelSelector: o.LabelSelector}
+}
+
+// selector is LabelSelector parsed, for filtering cached objects.
+func (o Options) selector() (labels.Selector, error) {
+	return labels.Parse(o.LabelSelector)
+}
+
+const (
+	OperatorIn     = "In"
+	OperatorNotIn  = "NotIn"
+	OperatorExists = "Exists"
+)
+
+// Exclusion leaves objects of one kind out of a backup when the value at a
+// JSONPath matches, e.g. Services with {.spec.type} In [ExternalName].
+type Exclusion struct {
+	// Kind prefix ("service") or Kind ("Service")
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	// In (default), NotIn or Exists
+	Operator string   `json:"operator,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (e Exclusion) Validate() error {
+	if _, ok := layout.LookupKind(e.Kind); !ok {
+		return fmt.Errorf("exclusion: unknown kind %q", e.Kind)
+	}
+	if _, err := e.parsePath(); err != nil {
+		return fmt.Errorf("exclusion %s %s: %w", e.Kind, e.Path, err)
+	}
+	switch e.Operator {
+	case "", OperatorIn, OperatorNotIn:
+		if len(e.Values) == 0 {
+			return fmt.Errorf("exclusion %s %s: values are required", e.Kind, e.Path)
+		}
+	case OperatorExists:
+	default:
+		return fmt.Errorf("exclusion %s %s: operator must be one of: In, NotIn, Exists", e.Kind, e.Path)
+	}
+	return nil
+}
+
+// parsePath accepts "{.spec.type}", ".spec.type" and "spec.type".
+func (e Exclusion) parsePath() (*jsonpath.JSONPath, error) {
+	path := e.Path
+	if !strings.HasPrefix(path, "{") {
+		path = "{." + strings.TrimPrefix(path, ".") + "}"
+	}
+
+	jp := jsonpath.New("exclusion").AllowMissingKeys(true)
+	if err := jp.Parse(path); err != nil {
+		return nil, err
+	}
+	return jp, nil
+}
+
+func (e Exclusion) matches(obj map[string]interface{}) (bool, error) {
+	jp, err := e.parsePath()
+	if err != nil {
+		return false, err
+	}
+	results, err := jp.FindResults(obj)
+	if err != nil {
+		return false, err
+	}
+
+	var found []string
+	for _, result := range results {
+		for _, value := range result {
+			found = append(found, fmt.Sprint(value.Interface()))
+		}
+	}
+
+	switch e.Operator {
+	case OperatorExists:
+		return len(found) > 0, nil
+	case OperatorNotIn:
+		return !slices.ContainsFunc(found, func(v string) bool { return slices.Contains(e.Values, v) }), nil
+	}
+	return slices.ContainsFunc(found, func(v string) bool { return slices.Contains(e.Values, v) }), nil
+}
+
+// excluded reports whether obj, of the given kind prefix, matches one of the
+// exclusion rules or is not one of Objects.
+func (o Options) excluded(kind string, obj interface{}) (bool, error) {
+	if len(o.Objects) > 0 {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return false, err
+		}
+		ref := ObjectRef{Kind: kind, Name: accessor.GetName()}.String()
+		if !slices.ContainsFunc(o.Objects, func(r ObjectRef) bool { return r.String() == ref }) {
+			return true, nil
+		}
+	}
+
+	var content map[string]interface{}
+	for _, e := range o.Exclusions {
+		if k, ok := layout.LookupKind(e.Kind); !ok || k.Prefix != kind {
+			continue
+		}
+
+		if content == nil {
+			var err error
+			content, err = runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		matched, err := e.matches(content)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
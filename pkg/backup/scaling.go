@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// BackupHPAs stores the HorizontalPodAutoscalers of namespace, so restored
+// workloads scale as before.
+func BackupHPAs(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	hpas, err := listHPAs(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+	for _, hpa := range hpas {
+		if excluded, err := opts.excluded(layout.HPA, &hpa); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		hpaJSON, err := json.MarshalIndent(hpa, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.HPA, hpa.Name, hpaJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BackupPDBs(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	pdbs, err := listPDBs(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+	for _, pdb := range pdbs {
+		if excluded, err := opts.excluded(layout.PDB, &pdb); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		pdbJSON, err := json.MarshalIndent(pdb, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.PDB, pdb.Name, pdbJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
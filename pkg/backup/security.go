@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// BackupRoles stores the RBAC Roles of namespace. Restoring them requires the
+// restoring identity to hold every permission they grant.
+func BackupRoles(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	roles, err := listRoles(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if excluded, err := opts.excluded(layout.Role, &role); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		roleJSON, err := json.MarshalIndent(role, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.Role, role.Name, roleJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackupRoleBindings stores the RoleBindings of namespace, including the ones
+// binding ClusterRoles. The ClusterRoles themselves are not backed up.
+func BackupRoleBindings(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	bindings, err := listRoleBindings(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, binding := range bindings {
+		if excluded, err := opts.excluded(layout.RoleBinding, &binding); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		bindingJSON, err := json.MarshalIndent(binding, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.RoleBinding, binding.Name, bindingJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BackupNetworkPolicies(clientset *kubernetes.Clientset, namespace, backupDir string, opts Options) error {
+	policies, err := listNetworkPolicies(clientset, namespace, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		if excluded, err := opts.excluded(layout.NetworkPolicy, &policy); err != nil {
+			return err
+		} else if excluded {
+			continue
+		}
+
+		policyJSON, err := json.MarshalIndent(policy, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.NetworkPolicy, policy.Name, policyJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
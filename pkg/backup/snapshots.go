@@ -0,0 +1,314 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+// How long to wait for a VolumeSnapshot to become ready to use
+const volumeSnapshotTimeout = 10 * time.Minute
+
+// Set on the VolumeSnapshots a backup takes, naming the PVC
+const SnapshotPVCLabel = "netx.io/pvc"
+
+// Set on the VolumeSnapshots a backup takes, naming the consistency group
+// they were taken in
+const SnapshotGroupLabel = "netx.io/snapshot-group"
+
+// SnapshotVolumes takes a CSI VolumeSnapshot of every bound PVC already in
+// backupDir and records it with its VolumeSnapshotContent. The snapshots
+// form a consistency group: they are all requested at once, before waiting
+// for any of them, and labelled with the group's ID, which is returned with
+// the time between the first and the last one being cut. The contents are
+// switched to the Retain deletion policy, so the snapshots outlive the
+// namespace and can restore it after it was deleted, until the backup is
+// deleted with DeleteVolumeSnapshots. If a snapshot fails, the whole group
+// is deleted again.
+func SnapshotVolumes(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface, namespace, backupDir string, opts Options) ([]manifest.VolumeSnapshot, *manifest.SnapshotGroup, error) {
+	ctx := context.Background()
+	backupLayout := layout.Current(backupDir)
+
+	files, err := backupLayout.ObjectFiles(layout.PVC)
+	if err != nil || len(files) == 0 {
+		return nil, nil, err
+	}
+	served, err := serves(discoveryClient, layout.VolumeSnapshotKind.GVR)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !served {
+		return nil, nil, fmt.Errorf("the cluster does not serve %s, install the CSI snapshot controller", layout.VolumeSnapshotKind.GVR.GroupVersion())
+	}
+
+	pvcKind, _ := layout.LookupKind(layout.PVC)
+	var pvcs []string
+	for _, file := range files {
+		pvc, err := backupLayout.ReadObject(file, pvcKind)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Only bound PVCs have data to snapshot
+		if volumeName, _, _ := unstructured.NestedString(pvc.Object, "spec", "volumeName"); volumeName != "" {
+			pvcs = append(pvcs, pvc.GetName())
+		}
+	}
+	if len(pvcs) == 0 {
+		return nil, nil, nil
+	}
+	groupID, err := newSnapshotGroupID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	taken, err := createSnapshots(ctx, client, namespace, groupID, pvcs, opts)
+	if err != nil {
+		return nil, nil, abandonSnapshots(ctx, client, taken, err)
+	}
+	for i := range taken {
+		if err := waitForSnapshot(ctx, client, &taken[i]); err != nil {
+			return nil, nil, abandonSnapshots(ctx, client, taken, fmt.Errorf("snapshot of PVC %s: %w", taken[i].PVC, err))
+		}
+	}
+	for _, record := range taken {
+		if err := writeSnapshot(ctx, client, record, backupDir); err != nil {
+			return nil, nil, abandonSnapshots(ctx, client, taken, fmt.Errorf("snapshot of PVC %s: %w", record.PVC, err))
+		}
+	}
+	return taken, snapshotGroup(groupID, taken), nil
+}
+
+func newSnapshotGroupID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// createSnapshots requests a VolumeSnapshot of every PVC at the same time,
+// so the CSI driver cuts them as close together as it can. It returns the
+// snapshots created, also when creating another one failed.
+func createSnapshots(ctx context.Context, client dynamic.Interface, namespace, groupID string, pvcs []string, opts Options) ([]manifest.VolumeSnapshot, error) {
+	records := make([]manifest.VolumeSnapshot, len(pvcs))
+	errs := make([]error, len(pvcs))
+	var wg sync.WaitGroup
+	for i, pvc := range pvcs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			records[i], errs[i] = createSnapshot(ctx, client, namespace, groupID, pvc, opts)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("snapshot of PVC %s: %w", pvc, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	var created []manifest.VolumeSnapshot
+	for i := range records {
+		if errs[i] == nil {
+			created = append(created, records[i])
+		}
+	}
+	return created, errors.Join(errs...)
+}
+
+// snapshotGroup records the group of snapshots taken, with the skew between
+// the creation times the CSI driver reported for them.
+func snapshotGroup(id string, taken []manifest.VolumeSnapshot) *manifest.SnapshotGroup {
+	group := &manifest.SnapshotGroup{ID: id}
+	for _, snapshot := range taken {
+		if snapshot.CreationTime == nil {
+			continue
+		}
+		if group.FirstSnapshotAt == nil || snapshot.CreationTime.Before(*group.FirstSnapshotAt) {
+			group.FirstSnapshotAt = snapshot.CreationTime
+		}
+		if group.LastSnapshotAt == nil || snapshot.CreationTime.After(*group.LastSnapshotAt) {
+			group.LastSnapshotAt = snapshot.CreationTime
+		}
+	}
+	if group.FirstSnapshotAt != nil {
+		group.SkewMS = group.LastSnapshotAt.Sub(*group.FirstSnapshotAt).Milliseconds()
+	}
+	return group
+}
+
+// abandonSnapshots deletes the snapshots taken before err and returns err.
+func abandonSnapshots(ctx context.Context, client dynamic.Interface, taken []manifest.VolumeSnapshot, err error) error {
+	if deleteErr := DeleteVolumeSnapshots(ctx, client, taken); deleteErr != nil {
+		return fmt.Errorf("%w (deleting the snapshots already taken: %v)", err, deleteErr)
+	}
+	return err
+}
+
+func createSnapshot(ctx context.Context, client dynamic.Interface, namespace, groupID, pvcName string, opts Options) (manifest.VolumeSnapshot, error) {
+	snapshots := client.Resource(layout.VolumeSnapshotKind.GVR).Namespace(namespace)
+
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvcName,
+		},
+	}
+	if opts.VolumeSnapshotClass != "" {
+		spec["volumeSnapshotClassName"] = opts.VolumeSnapshotClass
+	}
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": layout.VolumeSnapshotKind.GVR.GroupVersion().String(),
+		"kind":       layout.VolumeSnapshotKind.Kind,
+		"metadata": map[string]interface{}{
+			"generateName": "netx-" + pvcName + "-",
+			"labels":       map[string]interface{}{SnapshotPVCLabel: pvcName, SnapshotGroupLabel: groupID},
+		},
+		"spec": spec,
+	}}
+	snapshot, err := snapshots.Create(ctx, snapshot, metav1.CreateOptions{})
+	if err != nil {
+		return manifest.VolumeSnapshot{}, err
+	}
+	return manifest.VolumeSnapshot{Namespace: namespace, Name: snapshot.GetName(), PVC: pvcName, Group: groupID}, nil
+}
+
+// waitForSnapshot waits for the snapshot of record to become ready to use,
+// then records when it was cut and its content, and switches the content to
+// the Retain deletion policy. Until then, deleting the snapshot deletes the
+// content with it.
+func waitForSnapshot(ctx context.Context, client dynamic.Interface, record *manifest.VolumeSnapshot) error {
+	snapshots := client.Resource(layout.VolumeSnapshotKind.GVR).Namespace(record.Namespace)
+
+	var snapshot *unstructured.Unstructured
+	err := wait.PollUntilContextTimeout(ctx, 2*time.Second, volumeSnapshotTimeout, true, func(ctx context.Context) (bool, error) {
+		current, err := snapshots.Get(ctx, record.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		snapshot = current
+		if message, _, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); message != "" {
+			return false, fmt.Errorf("VolumeSnapshot %s: %s", snapshot.GetName(), message)
+		}
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		return ready, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if creationTime, _, _ := unstructured.NestedString(snapshot.Object, "status", "creationTime"); creationTime != "" {
+		if t, err := time.Parse(time.RFC3339, creationTime); err == nil {
+			record.CreationTime = &t
+		}
+	}
+
+	contents := client.Resource(layout.VolumeSnapshotContentKind.GVR)
+	record.Content, _, _ = unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+	content, err := contents.Get(ctx, record.Content, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	record.DeletionPolicy, _, _ = unstructured.NestedString(content.Object, "spec", "deletionPolicy")
+	if record.DeletionPolicy == deletionPolicyRetain {
+		return nil
+	}
+	if err := setDeletionPolicy(ctx, client, record.Content, deletionPolicyRetain); err != nil {
+		return fmt.Errorf("retaining VolumeSnapshotContent %s: %w", record.Content, err)
+	}
+	return nil
+}
+
+// writeSnapshot stores the VolumeSnapshot and VolumeSnapshotContent of
+// record in backupDir.
+func writeSnapshot(ctx context.Context, client dynamic.Interface, record manifest.VolumeSnapshot, backupDir string) error {
+	snapshot, err := client.Resource(layout.VolumeSnapshotKind.GVR).Namespace(record.Namespace).Get(ctx, record.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	content, err := client.Resource(layout.VolumeSnapshotContentKind.GVR).Get(ctx, record.Content, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	snapshotJSON, err := json.MarshalIndent(snapshot.Object, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := layout.WriteObject(backupDir, layout.VolumeSnapshot, snapshot.GetName(), snapshotJSON); err != nil {
+		return err
+	}
+	contentJSON, err := json.MarshalIndent(content.Object, "", "  ")
+	if err != nil {
+		return err
+	}
+	return layout.WriteObject(backupDir, layout.VolumeSnapshotContent, content.GetName(), contentJSON)
+}
+
+const (
+	deletionPolicyRetain = "Retain"
+	deletionPolicyDelete = "Delete"
+)
+
+func setDeletionPolicy(ctx context.Context, client dynamic.Interface, contentName, policy string) error {
+	patch := []byte(fmt.Sprintf(`{"spec":{"deletionPolicy":%q}}`, policy))
+	_, err := client.Resource(layout.VolumeSnapshotContentKind.GVR).Patch(ctx, contentName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// DeleteVolumeSnapshots deletes the VolumeSnapshots taken for a backup.
+// Contents that had the Delete policy before the backup retained them are
+// switched back and deleted, so the CSI driver deletes the snapshots in the
+// storage system too. Contents that were already retained are left alone,
+// as deleting a VolumeSnapshot would. Snapshots that are gone already are
+// skipped.
+func DeleteVolumeSnapshots(ctx context.Context, client dynamic.Interface, snapshots []manifest.VolumeSnapshot) error {
+	var errs []error
+	for _, snapshot := range snapshots {
+		if err := deleteVolumeSnapshot(ctx, client, snapshot); err != nil {
+			errs = append(errs, fmt.Errorf("deleting VolumeSnapshot %s/%s: %w", snapshot.Namespace, snapshot.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func deleteVolumeSnapshot(ctx context.Context, client dynamic.Interface, snapshot manifest.VolumeSnapshot) error {
+	deleteContent := snapshot.Content != "" && snapshot.DeletionPolicy == deletionPolicyDelete
+	if deleteContent {
+		if err := setDeletionPolicy(ctx, client, snapshot.Content, deletionPolicyDelete); err != nil {
+			if apierrors.IsNotFound(err) {
+				deleteContent = false
+			} else {
+				return err
+			}
+		}
+	}
+
+	err := client.Resource(layout.VolumeSnapshotKind.GVR).Namespace(snapshot.Namespace).Delete(ctx, snapshot.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if !deleteContent {
+		return nil
+	}
+	// Deleting the snapshot deletes its content, unless the snapshot went
+	// with its namespace before the content was switched back
+	err = client.Resource(layout.VolumeSnapshotContentKind.GVR).Delete(ctx, snapshot.Content, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
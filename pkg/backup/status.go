@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"net_exercise/pkg/layout"
+)
+
+// SeparateStatus removes the status from the backed up objects of kind. It
+// describes the cluster at backup time and is dropped on restore anyway.
+// For kinds in opts.CaptureStatus, e.g. to see Deployment conditions when
+// investigating an incident, the status is moved to layout.StatusFile.
+// Kinds that are never restored keep their status, it is all they record.
+func SeparateStatus(backupDir, kind string, opts Options) error {
+	if _, restored := layout.LookupKind(kind); !restored {
+		return nil
+	}
+
+	backupLayout := layout.Current(backupDir)
+	files, err := backupLayout.ObjectFiles(kind)
+	if err != nil {
+		return err
+	}
+	capture := opts.capturesStatus(kind)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		status, ok := obj["status"]
+		if !ok {
+			continue
+		}
+		delete(obj, "status")
+
+		if capture {
+			statusFile := layout.StatusFile(backupDir, kind, backupLayout.ObjectName(file, kind))
+			if err := os.MkdirAll(filepath.Dir(statusFile), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(statusFile, status, 0644); err != nil {
+				return err
+			}
+		}
+
+		data, err = json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o Options) capturesStatus(kind string) bool {
+	for _, name := range o.CaptureStatus {
+		if k, ok := layout.LookupKind(name); ok && k.Prefix == kind {
+			return true
+		}
+	}
+	return false
+}
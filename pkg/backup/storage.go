@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BackupStorage stores the PersistentVolumes bound to the PVCs already in
+// backupDir and the StorageClasses of both, so a restore into another
+// cluster can recreate or remap them. It has to run after the PVCs are
+// backed up.
+func BackupStorage(clientset *kubernetes.Clientset, backupDir string) error {
+	ctx := context.Background()
+	backupLayout := layout.Current(backupDir)
+
+	files, err := backupLayout.ObjectFiles(layout.PVC)
+	if err != nil {
+		return err
+	}
+	pvcKind, _ := layout.LookupKind(layout.PVC)
+
+	classes := map[string]bool{}
+	for _, file := range files {
+		pvc, err := backupLayout.ReadObject(file, pvcKind)
+		if err != nil {
+			return err
+		}
+		if class, _, _ := unstructured.NestedString(pvc.Object, "spec", "storageClassName"); class != "" {
+			classes[class] = true
+		}
+
+		volumeName, _, _ := unstructured.NestedString(pvc.Object, "spec", "volumeName")
+		if volumeName == "" {
+			continue
+		}
+		pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, volumeName, metav1.GetOptions{})
+		// Released between the two reads, the PVC is restored without it
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if pv.Spec.StorageClassName != "" {
+			classes[pv.Spec.StorageClassName] = true
+		}
+		pvJSON, err := json.MarshalIndent(pv, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.PersistentVolume, pv.Name, pvJSON); err != nil {
+			return err
+		}
+	}
+
+	for name := range classes {
+		class, err := clientset.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+		// Classes that only name a statically provisioned pool have no object
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		classJSON, err := json.MarshalIndent(class, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := layout.WriteObject(backupDir, layout.StorageClass, class.Name, classJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"context"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/metadata"
+)
+
+// ResourceVersions returns the resourceVersion of every object in namespace
+// of the kinds a backup captures, keyed by <kind>/<name>. Two equal results
+// mean nothing in the namespace was written to in between. Kinds are read
+// from cache while it is fresh and listed metadata-only otherwise; kinds the
+// cluster doesn't serve are left out. With a labelSelector only the matching
+// objects are included.
+func ResourceVersions(ctx context.Context, client metadata.Interface, namespace, labelSelector string, cache *InventoryCache) (map[string]string, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[string]string{}
+	for _, k := range layout.Kinds {
+		if cached, ok := cache.resourceVersions(k.Prefix, selector); ok {
+			for name, rv := range cached {
+				versions[k.Prefix+"/"+name] = rv
+			}
+			continue
+		}
+
+		list, err := client.Resource(k.GVR).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			versions[k.Prefix+"/"+item.Name] = item.ResourceVersion
+		}
+	}
+	return versions, nil
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/manifest"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AppVersions records the version of every Deployment and StatefulSet in
+// namespace, read from the first of keys set as a label or annotation, e.g.
+// app.kubernetes.io/version, along with its container images. appVersion is
+// the version the workloads agree on, or their distinct versions joined by ",".
+func AppVersions(clientset *kubernetes.Clientset, namespace string, keys []string, opts Options) (versions []manifest.WorkloadVersion, appVersion string, err error) {
+	deployments, err := listDeployments(clientset, namespace, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, d := range deployments {
+		versions = append(versions, workloadVersion("Deployment", d.ObjectMeta, d.Spec.Template.Spec, keys))
+	}
+
+	statefulSets, err := listStatefulSets(clientset, namespace, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, s := range statefulSets {
+		versions = append(versions, workloadVersion("StatefulSet", s.ObjectMeta, s.Spec.Template.Spec, keys))
+	}
+
+	var distinct []string
+	for _, v := range versions {
+		if v.Version != "" && !slices.Contains(distinct, v.Version) {
+			distinct = append(distinct, v.Version)
+		}
+	}
+	slices.Sort(distinct)
+	return versions, strings.Join(distinct, ","), nil
+}
+
+func workloadVersion(kind string, meta metav1.ObjectMeta, podSpec corev1.PodSpec, keys []string) manifest.WorkloadVersion {
+	v := manifest.WorkloadVersion{Kind: kind, Name: meta.Name, Images: []string{}}
+	for _, key := range keys {
+		if version, ok := meta.Labels[key]; ok {
+			v.Version = version
+			break
+		}
+		if version, ok := meta.Annotations[key]; ok {
+			v.Version = version
+			break
+		}
+	}
+	for _, c := range podSpec.Containers {
+		v.Images = append(v.Images, c.Image)
+	}
+	return v
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// WarningRecorder collects the warnings the API server sends while a backup
+// runs, such as deprecation notices for the API versions it reads. Set it as
+// the WarningHandler of the backup's clients; warnings are attributed to the
+// kind set with SetKind, or to "cluster" before the first SetKind.
+type WarningRecorder struct {
+	mu       sync.Mutex
+	kind     string
+	warnings map[string][]string
+}
+
+func NewWarningRecorder() *WarningRecorder {
+	return &WarningRecorder{kind: "cluster", warnings: map[string][]string{}}
+}
+
+// SetKind attributes the warnings that follow to kind.
+func (r *WarningRecorder) SetKind(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kind = kind
+}
+
+// HandleWarningHeader implements rest.WarningHandler.
+func (r *WarningRecorder) HandleWarningHeader(code int, agent string, text string) {
+	// The API server only sends code 299, others come from proxies
+	if code != 299 || text == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.warnings[r.kind], text) {
+		r.warnings[r.kind] = append(r.warnings[r.kind], text)
+	}
+}
+
+// Warnings returns the distinct warnings received per kind, nil if there
+// were none.
+func (r *WarningRecorder) Warnings() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.warnings) == 0 {
+		return nil
+	}
+	warnings := make(map[string][]string, len(r.warnings))
+	for kind, texts := range r.warnings {
+		texts = slices.Clone(texts)
+		sort.Strings(texts)
+		warnings[kind] = texts
+	}
+	return warnings
+}
@@ -0,0 +1,131 @@
+// Package compression compresses the files of a backup one by one, keeping
+// their names, so the layout of a compressed backup is the same.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var ErrUnsupported = errors.New("unsupported compression")
+
+// CompressDir compresses every file in dir in place with algorithm, except
+// the files named in skip.
+func CompressDir(dir, algorithm string, skip ...string) error {
+	var compress func([]byte) ([]byte, error)
+	switch algorithm {
+	case Gzip:
+		compress = gzipCompress
+	case Zstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return err
+		}
+		defer enc.Close()
+		compress = func(data []byte) ([]byte, error) { return enc.EncodeAll(data, nil), nil }
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupported, algorithm)
+	}
+
+	return walkFiles(dir, skip, func(path, rel string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if data, err = compress(data); err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0644)
+	})
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressDir writes the files of src to dst, decompressed by the
+// algorithm each one was compressed with, which it detects. Files that are
+// not compressed are copied as they are, files named in skip are left out.
+// dst may be src.
+func DecompressDir(dst, src string, skip ...string) error {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	return walkFiles(src, skip, func(path, rel string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case bytes.HasPrefix(data, gzipMagic):
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			if data, err = io.ReadAll(gz); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		case bytes.HasPrefix(data, zstdMagic):
+			if data, err = dec.DecodeAll(data, nil); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+}
+
+// walkFiles calls fn with every file under dir and its slash separated path
+// relative to dir, except for the files named in skip.
+func walkFiles(dir string, skip []string, fn func(path, rel string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, s := range skip {
+			if rel == s {
+				return nil
+			}
+		}
+		return fn(path, rel)
+	})
+}
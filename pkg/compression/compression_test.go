@@ -0,0 +1,68 @@
+package compression
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompressDirRoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		"configmap/settings.json": []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"settings"}}`),
+		"manifest.json":           []byte(`{"layout_version":2}`),
+	}
+
+	tests := []struct {
+		algorithm string
+		magic     []byte
+	}{
+		{algorithm: Gzip, magic: gzipMagic},
+		{algorithm: Zstd, magic: zstdMagic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := CompressDir(dir, tt.algorithm, "manifest.json"); err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := os.ReadFile(filepath.Join(dir, "configmap", "settings.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(compressed, tt.magic) {
+				t.Errorf("compressed file starts with %x, want %x", compressed[:4], tt.magic)
+			}
+
+			dst := t.TempDir()
+			if err := DecompressDir(dst, dir); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range files {
+				got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s = %s, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressDirUnsupported(t *testing.T) {
+	if err := CompressDir(t.TempDir(), "lz4"); err == nil {
+		t.Error("CompressDir() with lz4 succeeded")
+	}
+}
@@ -0,0 +1,749 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is read from the YAML file named by the NETX_CONFIG environment
+// variable. Every setting is optional.
+type Config struct {
+	ProtectionPolicies []ProtectionPolicy `json:"protection_policies"`
+	// Authentication is disabled unless OIDC or API keys are configured
+	OIDC     *OIDC     `json:"oidc"`
+	APIKeys  *APIKeys  `json:"api_keys"`
+	Webhooks []Webhook `json:"webhooks"`
+	// If set, only these namespaces can be backed up
+	BackupNamespaces *NamespaceAllowList `json:"backup_namespaces"`
+	// Applied to the finalizers of every restored object, first match wins
+	RestoreFinalizers []FinalizerRule `json:"restore_finalizers"`
+	// Notifications are only sent when email is configured
+	Email          *Email         `json:"email"`
+	HTTP           HTTP           `json:"http"`
+	BackupDeletion BackupDeletion `json:"backup_deletion"`
+	MetadataStore  MetadataStore  `json:"metadata_store"`
+	Cluster        Cluster        `json:"cluster"`
+	Storage        Storage        `json:"storage"`
+	// Applications can only back up the files of their volumes when set
+	DataMover *DataMover `json:"data_mover"`
+	Workers   Workers    `json:"workers"`
+	// Backup files are written in plaintext unless set
+	Encryption *Encryption `json:"encryption"`
+	// Drift is only exported as metrics when set
+	DriftMetrics *DriftMetrics `json:"drift_metrics"`
+	// Lifecycle events are only published when set
+	EventBus *EventBus `json:"event_bus"`
+}
+
+// DriftMetrics compares every application with its latest backup on an
+// interval and exports what changed since as metrics. Each run lists every
+// kind in the applications' namespaces.
+type DriftMetrics struct {
+	// DefaultDriftMetricsInterval by default
+	Interval Duration `json:"interval"`
+}
+
+const DefaultDriftMetricsInterval = 15 * time.Minute
+
+func (d *DriftMetrics) setDefaults() {
+	if d.Interval.Duration == 0 {
+		d.Interval.Duration = DefaultDriftMetricsInterval
+	}
+}
+
+// Encryption encrypts the files of new backups at rest with AES-256-GCM.
+// Keys are 32 random bytes, base64 encoded, read from an environment
+// variable or a file, e.g. a mounted Secret or a volume a KMS CSI driver
+// provides. New backups use KeyID; the other keys only decrypt backups taken
+// before the key was rotated.
+type Encryption struct {
+	KeyID string          `json:"key_id"`
+	Keys  []EncryptionKey `json:"keys"`
+}
+
+// EncryptionKey names a key, recorded in the manifests of the backups it
+// encrypts. Exactly one of Env and File is set.
+type EncryptionKey struct {
+	ID   string `json:"id"`
+	Env  string `json:"env"`
+	File string `json:"file"`
+}
+
+// DataMover copies the files of PVCs to a restic repository in an S3 storage
+// backend, from short-lived Pods in the application's namespace. It is meant
+// for clusters without CSI snapshots.
+type DataMover struct {
+	// Name of the s3 storage backend holding the repository
+	Storage string `json:"storage"`
+	// restic image of the Pods, DefaultDataMoverImage by default
+	Image string `json:"image"`
+	// Environment variable holding the repository password,
+	// NETX_RESTIC_PASSWORD by default
+	PasswordEnv string `json:"password_env"`
+	// How long copying one volume may take, an hour by default
+	Timeout Duration `json:"timeout"`
+}
+
+var (
+	DefaultDataMoverImage       = "restic/restic:0.16.4"
+	DefaultDataMoverPasswordEnv = "NETX_RESTIC_PASSWORD"
+	DefaultDataMoverTimeout     = time.Hour
+)
+
+func (d *DataMover) setDefaults() {
+	if d.Image == "" {
+		d.Image = DefaultDataMoverImage
+	}
+	if d.PasswordEnv == "" {
+		d.PasswordEnv = DefaultDataMoverPasswordEnv
+	}
+	if d.Timeout.Duration == 0 {
+		d.Timeout.Duration = DefaultDataMoverTimeout
+	}
+}
+
+// Storage is where completed backups are kept besides ./backups, which
+// every backup is written to first and which caches remote backups.
+type Storage struct {
+	// Backend used when a backup request names none, "local" (./backups
+	// only) by default
+	Default  string           `json:"default"`
+	Backends []StorageBackend `json:"backends"`
+	// How new backups are kept, directory by default
+	Format string `json:"format"`
+}
+
+const (
+	// One JSON file per object in ./backups/<backup_id>/
+	FormatDirectory = "directory"
+	// Everything packed into ./backups/<backup_id>.tar.gz
+	FormatArchive = "archive"
+)
+
+// Backup types
+const (
+	// Only the objects of the application
+	BackupTypeConfig = "config"
+	// The objects and the data of the PVCs, copied by volume snapshots or
+	// the data mover
+	BackupTypeFull = "full"
+)
+
+// The built-in backend keeping backups in ./backups only
+const LocalStorage = "local"
+
+const (
+	StorageFS = "fs"
+	StorageS3 = "s3"
+)
+
+type StorageBackend struct {
+	Name string `json:"name"`
+	// fs or s3
+	Type string     `json:"type"`
+	FS   *FSStorage `json:"fs"`
+	S3   *S3Storage `json:"s3"`
+}
+
+// FSStorage keeps backups in a directory, e.g. an NFS mount.
+type FSStorage struct {
+	Path string `json:"path"`
+}
+
+// S3Storage keeps backups in an S3 bucket or an S3 compatible store such as
+// MinIO. Credentials are read from the environment.
+type S3Storage struct {
+	Bucket string `json:"bucket"`
+	// Prepended to every object key, e.g. "netx/"
+	Prefix string `json:"prefix"`
+	Region string `json:"region"`
+	// For S3 compatible stores, addressed path-style: <endpoint>/<bucket>/<key>
+	Endpoint string `json:"endpoint"`
+	// Environment variables holding the credentials, AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY by default. AWS_SESSION_TOKEN is used if set.
+	AccessKeyIDEnv     string `json:"access_key_id_env"`
+	SecretAccessKeyEnv string `json:"secret_access_key_env"`
+	// PEM file of CA certificates trusted besides the system ones, for
+	// endpoints with certificates of a private CA
+	CAFile string `json:"ca_file"`
+	// Accepts any certificate of the endpoint. Discouraged, use ca_file
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// Proxy for the requests to the endpoint, e.g. http://proxy.corp:3128.
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY are honored if empty.
+	Proxy string `json:"proxy"`
+	// KMS key that uploaded objects are encrypted with (SSE-KMS), by ID,
+	// ARN or alias. The bucket's default encryption applies if empty.
+	KMSKeyID string `json:"kms_key_id"`
+}
+
+// Cluster controls how the Kubernetes API server is reconnected to when it
+// is unreachable at startup. The wait between attempts starts at
+// ConnectBackoff and doubles up to ConnectMaxBackoff.
+type Cluster struct {
+	ConnectBackoff    Duration `json:"connect_backoff"`
+	ConnectMaxBackoff Duration `json:"connect_max_backoff"`
+}
+
+var DefaultCluster = Cluster{
+	ConnectBackoff:    Duration{time.Second},
+	ConnectMaxBackoff: Duration{time.Minute},
+}
+
+func (c *Cluster) setDefaults() {
+	if c.ConnectBackoff.Duration == 0 {
+		c.ConnectBackoff = DefaultCluster.ConnectBackoff
+	}
+	if c.ConnectMaxBackoff.Duration == 0 {
+		c.ConnectMaxBackoff = DefaultCluster.ConnectMaxBackoff
+	}
+}
+
+// MetadataStore is where applications, backups and restores are persisted
+// so they survive restarts.
+type MetadataStore struct {
+	Path string `json:"path"`
+}
+
+const DefaultMetadataStorePath = "./metadata.db"
+
+// BackupDeletion guards recent backups against accidental deletion, e.g.
+// right after an incident when they are needed most.
+type BackupDeletion struct {
+	// Completed backups younger than this can only be deleted with force by
+	// an admin, and are kept by retention. Zero disables the guard.
+	MinAge Duration `json:"min_age"`
+}
+
+// Workers bounds how many backups and restores requested through the API
+// run at the same time. Further requests wait in a queue.
+type Workers struct {
+	Concurrency int `json:"concurrency"`
+	// Requests beyond this many waiting ones are rejected
+	QueueSize int `json:"queue_size"`
+}
+
+var DefaultWorkers = Workers{
+	Concurrency: 4,
+	QueueSize:   100,
+}
+
+func (w *Workers) setDefaults() {
+	if w.Concurrency == 0 {
+		w.Concurrency = DefaultWorkers.Concurrency
+	}
+	if w.QueueSize == 0 {
+		w.QueueSize = DefaultWorkers.QueueSize
+	}
+}
+
+// HTTP limits how long the API server waits for clients and how much it
+// reads from them, so slow or huge requests can't exhaust the process.
+type HTTP struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	// Also bounds how long a synchronous request, e.g. a restore plan, may
+	// take; streamed responses are exempt
+	WriteTimeout Duration `json:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	MaxBodyBytes int64    `json:"max_body_bytes"`
+}
+
+var DefaultHTTP = HTTP{
+	ReadHeaderTimeout: Duration{10 * time.Second},
+	ReadTimeout:       Duration{time.Minute},
+	WriteTimeout:      Duration{15 * time.Minute},
+	IdleTimeout:       Duration{2 * time.Minute},
+	MaxBodyBytes:      1 << 20,
+}
+
+func (h *HTTP) setDefaults() {
+	if h.ReadHeaderTimeout.Duration == 0 {
+		h.ReadHeaderTimeout = DefaultHTTP.ReadHeaderTimeout
+	}
+	if h.ReadTimeout.Duration == 0 {
+		h.ReadTimeout = DefaultHTTP.ReadTimeout
+	}
+	if h.WriteTimeout.Duration == 0 {
+		h.WriteTimeout = DefaultHTTP.WriteTimeout
+	}
+	if h.IdleTimeout.Duration == 0 {
+		h.IdleTimeout = DefaultHTTP.IdleTimeout
+	}
+	if h.MaxBodyBytes == 0 {
+		h.MaxBodyBytes = DefaultHTTP.MaxBodyBytes
+	}
+}
+
+// Email sends notifications through an SMTP server. Applications can add
+// their own recipients with notify_emails.
+type Email struct {
+	SMTP       SMTP     `json:"smtp"`
+	From       string   `json:"from"`
+	Recipients []string `json:"recipients"`
+	// Events to send, all of them by default
+	Events []string `json:"events"`
+	// Overrides of the built-in templates by event, Go text/template syntax
+	Templates map[string]EmailTemplate `json:"templates"`
+}
+
+// EventBus publishes backup and restore lifecycle events as JSON messages to
+// NATS, on subjects such as <subject_prefix>.backup.completed.
+type EventBus struct {
+	NATS NATS `json:"nats"`
+	// Events to publish, all of them by default
+	Events []string `json:"events"`
+}
+
+type NATS struct {
+	// nats://host:4222, user and password can be part of it
+	URL string `json:"url"`
+	// DefaultNATSSubjectPrefix by default
+	SubjectPrefix string `json:"subject_prefix"`
+	// Environment variable holding the authentication token
+	TokenEnv string `json:"token_env"`
+	// DefaultNATSTimeout by default, for connecting and publishing one event
+	Timeout Duration `json:"timeout"`
+}
+
+const (
+	DefaultNATSSubjectPrefix = "netx"
+	DefaultNATSTimeout       = 5 * time.Second
+)
+
+func (e *EventBus) setDefaults() {
+	if e.NATS.SubjectPrefix == "" {
+		e.NATS.SubjectPrefix = DefaultNATSSubjectPrefix
+	}
+	if e.NATS.Timeout.Duration == 0 {
+		e.NATS.Timeout.Duration = DefaultNATSTimeout
+	}
+}
+
+type SMTP struct {
+	Host string `json:"host"`
+	// 587 by default
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	// Environment variable holding the password
+	PasswordEnv string `json:"password_env"`
+}
+
+type EmailTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// What a FinalizerRule does with a matching finalizer
+const (
+	FinalizerKeep   = "keep"
+	FinalizerStrip  = "strip"
+	FinalizerRename = "rename"
+)
+
+// FinalizerRule matches finalizers by exact name, or by prefix when Finalizer
+// ends in "*", e.g. "example.com/*".
+type FinalizerRule struct {
+	Finalizer string `json:"finalizer"`
+	Action    string `json:"action"`
+	// New name, for FinalizerRename
+	To string `json:"to"`
+}
+
+func (r FinalizerRule) Matches(finalizer string) bool {
+	if prefix, ok := strings.CutSuffix(r.Finalizer, "*"); ok {
+		return strings.HasPrefix(finalizer, prefix)
+	}
+	return r.Finalizer == finalizer
+}
+
+// NamespaceAllowList matches a namespace that is listed in Names or fully
+// matches one of the regular expressions in Patterns.
+type NamespaceAllowList struct {
+	Names    []string `json:"names"`
+	Patterns []string `json:"patterns"`
+
+	patterns []*regexp.Regexp
+}
+
+func (l *NamespaceAllowList) compile() error {
+	for _, p := range l.Patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return fmt.Errorf("backup_namespaces: %w", err)
+		}
+		l.patterns = append(l.patterns, re)
+	}
+	return nil
+}
+
+func (l *NamespaceAllowList) Allows(namespace string) bool {
+	if slices.Contains(l.Names, namespace) {
+		return true
+	}
+	for _, re := range l.patterns {
+		if re.MatchString(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook lets CI pipelines and GitHub deployment events trigger a backup of
+// one application by calling POST /webhooks/<name>. Requests are signed with
+// HMAC-SHA256 using the secret held in the SecretEnv environment variable.
+type Webhook struct {
+	Name        string `json:"name"`
+	SecretEnv   string `json:"secret_env"`
+	Application struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"application"`
+	// Only GitHub deployments to these environments trigger a backup, all by default
+	Environments []string `json:"environments"`
+}
+
+// APIKeys lets admins issue long-lived keys for scripts and pipelines. The
+// first admin key can be passed in NETX_BOOTSTRAP_API_KEY.
+type APIKeys struct {
+	Enabled bool `json:"enabled"`
+}
+
+// OIDC authenticates API callers with ID tokens from an OpenID Connect
+// provider such as the corporate SSO.
+type OIDC struct {
+	IssuerURL string `json:"issuer_url"`
+	// Expected audience of the tokens
+	ClientID string `json:"client_id"`
+	// Claim holding the caller's groups, "groups" by default
+	GroupsClaim string `json:"groups_claim"`
+	// If set, callers must be in at least one of these groups
+	AllowedGroups []string `json:"allowed_groups"`
+	// Group name to role: viewer, operator or admin
+	RoleMapping map[string]string `json:"role_mapping"`
+}
+
+// ProtectionPolicy protects every namespace matching NamespaceSelector,
+// e.g. "backup-tier=gold", without registering applications by hand.
+type ProtectionPolicy struct {
+	Name              string   `json:"name"`
+	NamespaceSelector string   `json:"namespace_selector"`
+	BackupInterval    Duration `json:"backup_interval"`
+	// Backups older than this are deleted, zero keeps them forever
+	Retention Duration `json:"retention"`
+	// Grandfather-father-son rotation, instead of retention
+	GFSRetention *GFSRetention `json:"gfs_retention"`
+	Retry        RetryPolicy   `json:"retry"`
+	// Keep the objects of matching namespaces in informer caches between
+	// scheduled backups, nil lists them from the API server every run
+	InventoryCache *InventoryCache `json:"inventory_cache"`
+	// config or full, empty takes full backups of applications that capture
+	// volume data and config backups of the others
+	BackupType string `json:"backup_type"`
+}
+
+// GFSRetention keeps the newest backup of each of the last Daily days, Weekly
+// ISO weeks and Monthly months that have backups, e.g. 7, 4 and 12. Days,
+// weeks and months are in UTC.
+type GFSRetention struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+// BackupRetention keeps the newest KeepLast completed backups and all
+// backups younger than MaxAge, the others are pruned. Either may be zero.
+type BackupRetention struct {
+	KeepLast int      `json:"keep_last,omitempty"`
+	MaxAge   Duration `json:"max_age"`
+}
+
+func (r BackupRetention) Validate() error {
+	if r.KeepLast < 0 || r.MaxAge.Duration < 0 {
+		return fmt.Errorf("retention keep_last and max_age must not be negative")
+	}
+	if r.KeepLast == 0 && r.MaxAge.Duration == 0 {
+		return fmt.Errorf("retention needs keep_last or max_age")
+	}
+	return nil
+}
+
+// InventoryCache bounds how stale a namespace cache may get. Caches are kept
+// current by watches; after MaxAge they are rebuilt from a full list anyway.
+type InventoryCache struct {
+	MaxAge Duration `json:"max_age"`
+}
+
+const DefaultInventoryCacheMaxAge = time.Hour
+
+// RetryPolicy controls how a failed scheduled backup is retried before the
+// run is given up. The wait between attempts starts at Backoff and doubles.
+type RetryPolicy struct {
+	Attempts    int      `json:"attempts"`
+	Backoff     Duration `json:"backoff"`
+	MaxDuration Duration `json:"max_duration"`
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:    3,
+	Backoff:     Duration{30 * time.Second},
+	MaxDuration: Duration{10 * time.Minute},
+}
+
+// SetDefaults fills in DefaultRetryPolicy for the settings left out.
+func (r *RetryPolicy) SetDefaults() {
+	if r.Attempts == 0 {
+		r.Attempts = DefaultRetryPolicy.Attempts
+	}
+	if r.Backoff.Duration == 0 {
+		r.Backoff = DefaultRetryPolicy.Backoff
+	}
+	if r.MaxDuration.Duration == 0 {
+		r.MaxDuration = DefaultRetryPolicy.MaxDuration
+	}
+}
+
+func (r RetryPolicy) Validate() error {
+	if r.Attempts < 0 || r.Backoff.Duration < 0 || r.MaxDuration.Duration < 0 {
+		return fmt.Errorf("retry settings must not be negative")
+	}
+	return nil
+}
+
+// Duration accepts Go duration strings such as "24h" or "720h".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func Load(path string) (Config, error) {
+	var cfg Config
+	if path == "" {
+		cfg.setDefaults()
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.setDefaults()
+	for i := range cfg.ProtectionPolicies {
+		cfg.ProtectionPolicies[i].Retry.SetDefaults()
+		if c := cfg.ProtectionPolicies[i].InventoryCache; c != nil && c.MaxAge.Duration == 0 {
+			c.MaxAge.Duration = DefaultInventoryCacheMaxAge
+		}
+	}
+	if cfg.DataMover != nil {
+		cfg.DataMover.setDefaults()
+	}
+	if cfg.DriftMetrics != nil {
+		cfg.DriftMetrics.setDefaults()
+	}
+	if cfg.EventBus != nil {
+		cfg.EventBus.setDefaults()
+	}
+	if cfg.Email != nil && cfg.Email.SMTP.Port == 0 {
+		cfg.Email.SMTP.Port = 587
+	}
+	if cfg.BackupNamespaces != nil {
+		if err := cfg.BackupNamespaces.compile(); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// setDefaults fills in the settings that apply without a configuration file.
+func (c *Config) setDefaults() {
+	c.HTTP.setDefaults()
+	c.Cluster.setDefaults()
+	c.Workers.setDefaults()
+	if c.Storage.Default == "" {
+		c.Storage.Default = LocalStorage
+	}
+	if c.Storage.Format == "" {
+		c.Storage.Format = FormatDirectory
+	}
+	if c.MetadataStore.Path == "" {
+		c.MetadataStore.Path = DefaultMetadataStorePath
+	}
+}
+
+func (c Config) validate() error {
+	if c.OIDC != nil && (c.OIDC.IssuerURL == "" || c.OIDC.ClientID == "") {
+		return fmt.Errorf("oidc needs an issuer_url and a client_id")
+	}
+	webhookNames := map[string]bool{}
+	for _, w := range c.Webhooks {
+		if w.Name == "" || w.SecretEnv == "" {
+			return fmt.Errorf("webhook needs a name and a secret_env")
+		}
+		if webhookNames[w.Name] {
+			return fmt.Errorf("webhook %s is defined twice", w.Name)
+		}
+		webhookNames[w.Name] = true
+		if w.Application.Name == "" || w.Application.Namespace == "" {
+			return fmt.Errorf("webhook %s: application needs a name and a namespace", w.Name)
+		}
+	}
+	for _, r := range c.RestoreFinalizers {
+		if r.Finalizer == "" {
+			return fmt.Errorf("restore finalizer rule needs a finalizer")
+		}
+		switch r.Action {
+		case FinalizerKeep, FinalizerStrip:
+		case FinalizerRename:
+			if r.To == "" {
+				return fmt.Errorf("restore finalizer rule %s: rename needs a to", r.Finalizer)
+			}
+		default:
+			return fmt.Errorf("restore finalizer rule %s: action must be one of: keep, strip, rename", r.Finalizer)
+		}
+	}
+	if c.DriftMetrics != nil && c.DriftMetrics.Interval.Duration < 0 {
+		return fmt.Errorf("drift_metrics interval must not be negative")
+	}
+	if c.BackupDeletion.MinAge.Duration < 0 {
+		return fmt.Errorf("backup_deletion min_age must not be negative")
+	}
+	h := c.HTTP
+	if h.ReadHeaderTimeout.Duration < 0 || h.ReadTimeout.Duration < 0 || h.WriteTimeout.Duration < 0 || h.IdleTimeout.Duration < 0 || h.MaxBodyBytes < 0 {
+		return fmt.Errorf("http timeouts and max_body_bytes must not be negative")
+	}
+	if c.Workers.Concurrency < 0 || c.Workers.QueueSize < 0 {
+		return fmt.Errorf("workers concurrency and queue_size must not be negative")
+	}
+	if c.Email != nil && (c.Email.SMTP.Host == "" || c.Email.From == "") {
+		return fmt.Errorf("email needs an smtp host and a from address")
+	}
+	if e := c.EventBus; e != nil {
+		u, err := url.Parse(e.NATS.URL)
+		if err != nil || u.Scheme != "nats" || u.Host == "" {
+			return fmt.Errorf("event_bus nats url must be a nats://host:port URL")
+		}
+		if e.NATS.Timeout.Duration < 0 {
+			return fmt.Errorf("event_bus nats timeout must not be negative")
+		}
+	}
+	if err := c.Storage.validate(); err != nil {
+		return err
+	}
+	if d := c.DataMover; d != nil {
+		i := slices.IndexFunc(c.Storage.Backends, func(b StorageBackend) bool { return b.Name == d.Storage })
+		if i < 0 || c.Storage.Backends[i].Type != StorageS3 {
+			return fmt.Errorf("data_mover storage must name an s3 storage backend")
+		}
+		if d.Timeout.Duration < 0 {
+			return fmt.Errorf("data_mover timeout must not be negative")
+		}
+	}
+	if e := c.Encryption; e != nil {
+		ids := map[string]bool{}
+		for _, k := range e.Keys {
+			if k.ID == "" || (k.Env == "") == (k.File == "") {
+				return fmt.Errorf("encryption key needs an id and either env or file")
+			}
+			if ids[k.ID] {
+				return fmt.Errorf("encryption key %s is defined twice", k.ID)
+			}
+			ids[k.ID] = true
+		}
+		if !ids[e.KeyID] {
+			return fmt.Errorf("encryption key_id must name one of the keys")
+		}
+	}
+	for _, p := range c.ProtectionPolicies {
+		if p.Name == "" || p.NamespaceSelector == "" {
+			return fmt.Errorf("protection policy needs a name and a namespace_selector")
+		}
+		if _, err := labels.Parse(p.NamespaceSelector); err != nil {
+			return fmt.Errorf("protection policy %s: %w", p.Name, err)
+		}
+		if p.BackupInterval.Duration <= 0 {
+			return fmt.Errorf("protection policy %s: backup_interval must be positive", p.Name)
+		}
+		if err := p.Retry.Validate(); err != nil {
+			return fmt.Errorf("protection policy %s: %w", p.Name, err)
+		}
+		if g := p.GFSRetention; g != nil {
+			if p.Retention.Duration != 0 {
+				return fmt.Errorf("protection policy %s: retention and gfs_retention are mutually exclusive", p.Name)
+			}
+			if g.Daily < 0 || g.Weekly < 0 || g.Monthly < 0 || g.Daily+g.Weekly+g.Monthly == 0 {
+				return fmt.Errorf("protection policy %s: gfs_retention needs a positive daily, weekly or monthly", p.Name)
+			}
+		}
+		if p.BackupType != "" && p.BackupType != BackupTypeConfig && p.BackupType != BackupTypeFull {
+			return fmt.Errorf("protection policy %s: backup_type must be one of: config, full", p.Name)
+		}
+		if p.InventoryCache != nil && p.InventoryCache.MaxAge.Duration < 0 {
+			return fmt.Errorf("protection policy %s: inventory_cache max_age must not be negative", p.Name)
+		}
+	}
+	return nil
+}
+
+func (s Storage) validate() error {
+	names := map[string]bool{LocalStorage: true}
+	for _, b := range s.Backends {
+		if b.Name == "" {
+			return fmt.Errorf("storage backend needs a name")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("storage backend %s is defined twice or uses a reserved name", b.Name)
+		}
+		names[b.Name] = true
+		switch b.Type {
+		case StorageFS:
+			if b.FS == nil || b.FS.Path == "" {
+				return fmt.Errorf("storage backend %s: fs needs a path", b.Name)
+			}
+		case StorageS3:
+			if b.S3 == nil || b.S3.Bucket == "" || b.S3.Region == "" {
+				return fmt.Errorf("storage backend %s: s3 needs a bucket and a region", b.Name)
+			}
+			if b.S3.Proxy != "" {
+				if u, err := url.Parse(b.S3.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+					return fmt.Errorf("storage backend %s: proxy must be a URL such as http://proxy:3128", b.Name)
+				}
+			}
+		default:
+			return fmt.Errorf("storage backend %s: type must be one of: fs, s3", b.Name)
+		}
+	}
+	if s.Format != FormatDirectory && s.Format != FormatArchive {
+		return fmt.Errorf("storage format must be one of: directory, archive")
+	}
+	if !names[s.Default] {
+		return fmt.Errorf("storage default %s is not a configured backend", s.Default)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Package cron parses the five field cron expressions of crontab(5) and
+// finds the times they match.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression. Bit n of a field is set when the
+// field matches value n.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day of month or day of week field was "*". As in cron,
+	// when both are restricted a day matching either one matches.
+	domStar, dowStar bool
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// Parse parses "minute hour day-of-month month day-of-week", e.g.
+// "30 2 * * 1-5", or one of the macros such as @daily. Fields take
+// numbers, ranges, steps, lists and "*"; months and days of week also
+// their English three letter names. Sunday is 0 or 7.
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return Schedule{}, fmt.Errorf("cron expression %q must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+
+	var s Schedule
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return Schedule{}, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return Schedule{}, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return Schedule{}, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return Schedule{}, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return Schedule{}, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is another Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseField parses a comma separated list of "*", "n", "a-b", each
+// optionally followed by "/step". names, if given, are the names of the
+// values from min on.
+func parseField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = parseValue(from, min, max, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseValue(to, min, max, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/15" is 5 to max every 15
+				hi = max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(value string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(value, name) {
+			return min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("%q is not a value from %d to %d", value, min, max)
+	}
+	return v, nil
+}
+
+// Every bit of the hour field set
+const everyHour = 1<<24 - 1
+
+// Next returns the first time after t that s matches, in t's location. It
+// returns the zero time if s never matches, e.g. on February 30.
+//
+// As in cron, schedules that run every hour follow the clock through
+// daylight saving time changes: they run in both passes of an hour the
+// clock is set back to, and not in an hour it skips. Schedules at given
+// hours run once a day: only in the first pass of a repeated hour, and
+// in a skipped hour, as much later as the clock was set forward.
+func (s Schedule) Next(t time.Time) time.Time {
+	if s.hour == everyHour {
+		return s.next(t)
+	}
+
+	// Find the times on the clock, then when the clock shows them
+	loc := t.Location()
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	for {
+		wall = s.next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		if next := inLocation(wall, loc); next.After(t) {
+			return next
+		}
+	}
+}
+
+// next returns the first time after t that s matches, stepping in t's
+// location.
+func (s Schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every combination of month and day recurs within 28 years
+	end := t.AddDate(28, 0, 0)
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = startOf(t.Year(), t.Month()+1, 1, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = startOf(t.Year(), t.Month(), t.Day()+1, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			// Not t.Truncate, which would miss the hour in locations
+			// offset from UTC by half an hour
+			t = startOf(t.Year(), t.Month(), t.Day(), t.Hour()+1, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// startOf returns when the clock in loc first shows the hour, or the end of
+// the gap if the clock skips it. time.Date would return a time before the
+// gap instead, e.g. the day before for a day starting at 1:00.
+func startOf(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	return inLocation(time.Date(year, month, day, hour, 0, 0, 0, time.UTC), loc)
+}
+
+// inLocation returns the first time the clock in loc shows wall, a time in
+// UTC. A time the clock skips is moved forward by the length of the gap.
+func inLocation(wall time.Time, loc *time.Location) time.Time {
+	guess := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, loc)
+	// The offsets in effect around wall, clocks change by less than 3 hours
+	var offsets [3]int
+	_, offsets[0] = guess.Add(-3 * time.Hour).Zone()
+	_, offsets[1] = guess.Zone()
+	_, offsets[2] = guess.Add(3 * time.Hour).Zone()
+
+	var first time.Time
+	for _, offset := range offsets {
+		at := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if at.Hour() == wall.Hour() && at.Minute() == wall.Minute() && (first.IsZero() || at.Before(first)) {
+			first = at
+		}
+	}
+	if first.IsZero() {
+		// Read with the offset before the gap, wall lands after it
+		return wall.Add(-time.Duration(offsets[0]) * time.Second).In(loc)
+	}
+	return first
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,132 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{name: "empty", expr: ""},
+		{name: "four fields", expr: "* * * *"},
+		{name: "six fields", expr: "0 * * * * *"},
+		{name: "unknown macro", expr: "@every 5m"},
+		{name: "minute too large", expr: "60 * * * *"},
+		{name: "hour too large", expr: "* 24 * * *"},
+		{name: "day of month zero", expr: "* * 0 * *"},
+		{name: "day of month too large", expr: "* * 32 * *"},
+		{name: "month too large", expr: "* * * 13 *"},
+		{name: "day of week too large", expr: "* * * * 8"},
+		{name: "negative value", expr: "-1 * * * *"},
+		{name: "reversed range", expr: "5-1 * * * *"},
+		{name: "range end out of bounds", expr: "* 20-25 * * *"},
+		{name: "zero step", expr: "*/0 * * * *"},
+		{name: "step not a number", expr: "*/x * * * *"},
+		{name: "range not a number", expr: "1-x * * * *"},
+		{name: "empty list item", expr: "1,,2 * * * *"},
+		{name: "unknown month name", expr: "* * * foo *"},
+		{name: "day name in month field", expr: "* * * mon *"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.expr); err == nil {
+				t.Errorf("Parse(%q) succeeded", tt.expr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	newYork := loadLocation(t, "America/New_York")
+	berlin := loadLocation(t, "Europe/Berlin")
+	kolkata := loadLocation(t, "Asia/Kolkata")
+	santiago := loadLocation(t, "America/Santiago")
+	// 2025-01-01 is a Wednesday
+	utc := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2025, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		// Zero if the expression never matches
+		want time.Time
+	}{
+		{name: "every minute", expr: "* * * * *", from: utc(1, 1, 0, 0).Add(30 * time.Second), want: utc(1, 1, 0, 1)},
+		{name: "strictly after from", expr: "0 0 * * *", from: utc(1, 1, 0, 0), want: utc(1, 2, 0, 0)},
+
+		// Ranges, steps and lists
+		{name: "range", expr: "0 9-17 * * *", from: utc(1, 1, 12, 0), want: utc(1, 1, 13, 0)},
+		{name: "after the range", expr: "0 9-17 * * *", from: utc(1, 1, 17, 30), want: utc(1, 2, 9, 0)},
+		{name: "step", expr: "*/15 * * * *", from: utc(1, 1, 0, 50), want: utc(1, 1, 1, 0)},
+		{name: "step from a value", expr: "5/20 * * * *", from: utc(1, 1, 0, 45), want: utc(1, 1, 1, 5)},
+		{name: "step in a range", expr: "0 0-12/6 * * *", from: utc(1, 1, 7, 0), want: utc(1, 1, 12, 0)},
+		{name: "after the stepped range", expr: "0 0-12/6 * * *", from: utc(1, 1, 12, 0), want: utc(1, 2, 0, 0)},
+		{name: "list", expr: "0 8,20 * * *", from: utc(1, 1, 9, 0), want: utc(1, 1, 20, 0)},
+		{name: "list of ranges", expr: "0 0 1-2,20-21 * *", from: utc(1, 2, 12, 0), want: utc(1, 20, 0, 0)},
+		{name: "month and day names", expr: "0 0 * feb-mar MON", from: utc(1, 1, 0, 0), want: utc(2, 3, 0, 0)},
+		{name: "Sunday as 7", expr: "0 0 * * 7", from: utc(1, 1, 0, 0), want: utc(1, 5, 0, 0)},
+		{name: "macro", expr: "@monthly", from: utc(1, 15, 0, 0), want: utc(2, 1, 0, 0)},
+		{name: "macro in capitals", expr: "@WEEKLY", from: utc(1, 1, 0, 0), want: utc(1, 5, 0, 0)},
+
+		// Day of month and day of week
+		{name: "day of month or day of week, the day of week first", expr: "0 0 13 * fri", from: utc(1, 1, 0, 0), want: utc(1, 3, 0, 0)},
+		{name: "day of month or day of week, the day of month first", expr: "0 0 13 * fri", from: utc(1, 10, 0, 0), want: utc(1, 13, 0, 0)},
+		{name: "day of month with any day of week", expr: "0 0 13 * *", from: utc(1, 14, 0, 0), want: utc(2, 13, 0, 0)},
+		{name: "day of week with any day of month", expr: "0 0 * * 1", from: utc(1, 1, 0, 0), want: utc(1, 6, 0, 0)},
+		// A field starting with "*" counts as unrestricted, so both must match
+		{name: "stepped day of month and day of week", expr: "0 0 */2 * 1", from: utc(1, 1, 0, 0), want: utc(1, 13, 0, 0)},
+
+		// Month ends
+		{name: "31st skips shorter months", expr: "0 0 31 * *", from: utc(1, 31, 0, 0), want: utc(3, 31, 0, 0)},
+		{name: "30th skips February", expr: "0 0 30 * *", from: utc(1, 30, 0, 0), want: utc(3, 30, 0, 0)},
+		{name: "leap day", expr: "0 0 29 2 *", from: utc(1, 1, 0, 0), want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "last minute of the year", expr: "59 23 31 12 *", from: utc(6, 1, 0, 0), want: utc(12, 31, 23, 59)},
+		{name: "February 30th never matches", expr: "0 0 30 2 *", from: utc(1, 1, 0, 0)},
+		{name: "April 31st never matches", expr: "0 0 31 4 *", from: utc(1, 1, 0, 0)},
+
+		// The clock is set back from 2:00 EDT to 1:00 EST on 2025-11-02
+		{name: "set back, first pass", expr: "30 1 * * *", from: time.Date(2025, 11, 2, 0, 0, 0, 0, newYork), want: time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC)},
+		{name: "set back, no second pass", expr: "30 1 * * *", from: time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC).In(newYork), want: time.Date(2025, 11, 3, 6, 30, 0, 0, time.UTC)},
+		{name: "set back, hourly runs in both passes", expr: "30 * * * *", from: time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC).In(newYork), want: time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC)},
+		{name: "set back east of UTC", expr: "30 2 * * *", from: time.Date(2025, 10, 26, 0, 0, 0, 0, berlin), want: time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC)},
+		{name: "set back east of UTC, no second pass", expr: "30 2 * * *", from: time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC).In(berlin), want: time.Date(2025, 10, 27, 1, 30, 0, 0, time.UTC)},
+		// The clock is set forward from 2:00 EST to 3:00 EDT on 2025-03-09
+		{name: "set forward, skipped time runs later", expr: "30 2 * * *", from: time.Date(2025, 3, 9, 0, 0, 0, 0, newYork), want: time.Date(2025, 3, 9, 3, 30, 0, 0, newYork)},
+		{name: "set forward, next day as usual", expr: "30 2 * * *", from: time.Date(2025, 3, 9, 3, 30, 0, 0, newYork), want: time.Date(2025, 3, 10, 2, 30, 0, 0, newYork)},
+		{name: "set forward, runs once when both times fall together", expr: "30 2,3 * * *", from: time.Date(2025, 3, 9, 3, 30, 0, 0, newYork), want: time.Date(2025, 3, 10, 2, 30, 0, 0, newYork)},
+		{name: "set forward, hourly skips the hour", expr: "30 * * * *", from: time.Date(2025, 3, 9, 1, 30, 0, 0, newYork), want: time.Date(2025, 3, 9, 3, 30, 0, 0, newYork)},
+		// The day starts at 1:00 on 2025-09-07
+		{name: "skipped midnight", expr: "0 0 * * *", from: time.Date(2025, 9, 6, 12, 0, 0, 0, santiago), want: time.Date(2025, 9, 7, 1, 0, 0, 0, santiago)},
+		{name: "day starting late", expr: "* * 7 9 *", from: time.Date(2025, 9, 6, 12, 0, 0, 0, santiago), want: time.Date(2025, 9, 7, 1, 0, 0, 0, santiago)},
+		{name: "half hour offset", expr: "0 11 * * *", from: time.Date(2025, 1, 1, 10, 15, 0, 0, kolkata), want: time.Date(2025, 1, 1, 11, 0, 0, 0, kolkata)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+			if !got.IsZero() && got.Location() != tt.from.Location() {
+				t.Errorf("Next(%s) is in %s, want %s", tt.from, got.Location(), tt.from.Location())
+			}
+		})
+	}
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone data: %v", err)
+	}
+	return loc
+}
@@ -0,0 +1,211 @@
+// Package datamover copies the files of PVCs to a restic repository from
+// short-lived Pods that mount them, for clusters without CSI snapshots.
+package datamover
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Set on the Pods and Secrets of the data mover
+const ComponentLabel = "netx.io/component"
+
+// The script run by the Pods: the repository is initialized on first use,
+// then the volume mounted at /data is backed up with JSON output, whose
+// summary line carries the snapshot ID.
+// NETX_RESTIC_FLAGS holds global flags such as --insecure-tls.
+const backupScript = `restic $NETX_RESTIC_FLAGS cat config >/dev/null 2>&1 || restic $NETX_RESTIC_FLAGS init || exit 1
+exec restic $NETX_RESTIC_FLAGS backup --json --host "$NETX_NAMESPACE" --tag "pvc=$NETX_PVC" /data`
+
+// The CA certificates are stored under this key of the Secret and mounted
+// at caCertPath, which RESTIC_CACERT points to
+const (
+	caCertKey  = "NETX_CA_CERT"
+	caCertDir  = "/etc/netx"
+	caCertPath = caCertDir + "/ca.crt"
+)
+
+type Mover struct {
+	Clientset kubernetes.Interface
+	Image     string
+	// Repository URL and the variables restic needs to open it, e.g.
+	// RESTIC_PASSWORD and AWS_ACCESS_KEY_ID. They are handed to the Pods
+	// through a Secret that only exists while the Pods run.
+	Repository string
+	Env        map[string]string
+	// How long copying one volume may take
+	Timeout time.Duration
+	// PEM encoded CA certificates restic trusts besides the image's
+	CACert string
+	// Accept any certificate of the repository's endpoint
+	InsecureTLS bool
+}
+
+// BackupPVCs copies the files of the PVCs of namespace one after the other
+// and returns the restic snapshot ID of each.
+func (m Mover) BackupPVCs(ctx context.Context, namespace string, pvcs []string) (map[string]string, error) {
+	data := map[string]string{"RESTIC_REPOSITORY": m.Repository}
+	for k, v := range m.Env {
+		data[k] = v
+	}
+	if m.CACert != "" {
+		data[caCertKey] = m.CACert
+		data["RESTIC_CACERT"] = caCertPath
+	}
+	secret, err := m.Clientset.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "netx-mover-",
+			Labels:       map[string]string{ComponentLabel: "data-mover"},
+		},
+		StringData: data,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating the repository Secret: %w", err)
+	}
+	defer m.Clientset.CoreV1().Secrets(namespace).Delete(context.Background(), secret.Name, metav1.DeleteOptions{})
+
+	snapshots := map[string]string{}
+	for _, pvc := range pvcs {
+		id, err := m.backupPVC(ctx, namespace, pvc, secret.Name)
+		if err != nil {
+			return nil, fmt.Errorf("PVC %s: %w", pvc, err)
+		}
+		snapshots[pvc] = id
+	}
+	return snapshots, nil
+}
+
+func (m Mover) backupPVC(ctx context.Context, namespace, pvc, secretName string) (string, error) {
+	pods := m.Clientset.CoreV1().Pods(namespace)
+
+	nodeName, err := m.nodeMounting(ctx, namespace, pvc)
+	if err != nil {
+		return "", err
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "netx-mover-" + pvc + "-",
+			Labels:       map[string]string{ComponentLabel: "data-mover"},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			// ReadWriteOnce volumes can only be mounted on the node using them
+			NodeName: nodeName,
+			Containers: []corev1.Container{{
+				Name:    "restic",
+				Image:   m.Image,
+				Command: []string{"/bin/sh", "-c", backupScript},
+				EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secretName}}}},
+				Env: []corev1.EnvVar{
+					{Name: "NETX_NAMESPACE", Value: namespace},
+					{Name: "NETX_PVC", Value: pvc},
+				},
+				VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc, ReadOnly: true},
+				},
+			}},
+		},
+	}
+	container := &pod.Spec.Containers[0]
+	if m.CACert != "" {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "ca",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: secretName, Items: []corev1.KeyToPath{{Key: caCertKey, Path: "ca.crt"}}},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: "ca", MountPath: caCertDir, ReadOnly: true})
+	}
+	if m.InsecureTLS {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "NETX_RESTIC_FLAGS", Value: "--insecure-tls"})
+	}
+	pod, err = pods.Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer pods.Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
+
+	var phase corev1.PodPhase
+	err = wait.PollUntilContextTimeout(ctx, 2*time.Second, m.Timeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		phase = pod.Status.Phase
+		return phase == corev1.PodSucceeded || phase == corev1.PodFailed, nil
+	})
+	if wait.Interrupted(err) {
+		return "", fmt.Errorf("Pod %s did not finish within %s", pod.Name, m.Timeout)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	logs, err := pods.GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("reading the logs of Pod %s: %w", pod.Name, err)
+	}
+	if phase == corev1.PodFailed {
+		return "", fmt.Errorf("Pod %s failed: %s", pod.Name, lastLine(logs))
+	}
+	return snapshotID(logs)
+}
+
+// nodeMounting returns the node of a running Pod mounting the PVC, empty if
+// there is none and the scheduler may pick any node.
+func (m Mover) nodeMounting(ctx context.Context, namespace, pvc string) (string, error) {
+	list, err := m.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range list.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Spec.NodeName == "" {
+			continue
+		}
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == pvc {
+				return pod.Spec.NodeName, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// snapshotID finds the summary restic backup --json prints last.
+func snapshotID(logs []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(logs))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var line struct {
+			MessageType string `json:"message_type"`
+			SnapshotID  string `json:"snapshot_id"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &line) == nil && line.MessageType == "summary" && line.SnapshotID != "" {
+			return line.SnapshotID, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("restic did not report a snapshot ID")
+}
+
+func lastLine(logs []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(logs)), "\n")
+	return lines[len(lines)-1]
+}
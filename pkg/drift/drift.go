@@ -0,0 +1,95 @@
+package drift
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/metadata"
+)
+
+type KindDrift struct {
+	Kind string `json:"kind"`
+	// In the namespace but not in the backup
+	Added []string `json:"added,omitempty"`
+	// In the backup but gone from the namespace
+	Removed []string `json:"removed,omitempty"`
+	// In both, but written to after the backup was taken
+	Modified []string `json:"modified,omitempty"`
+}
+
+type Report struct {
+	Drifted bool        `json:"drifted"`
+	Kinds   []KindDrift `json:"kinds"`
+}
+
+// Compare lists how the namespace, or its objects matching labelSelector if
+// set, differs from a backup taken at backupTime. Only object metadata is fetched: an object counts as modified when one of
+// its managedFields entries is newer than the backup.
+func Compare(ctx context.Context, backupDir, namespace, labelSelector string, backupTime time.Time, client metadata.Interface) (*Report, error) {
+	backupLayout, err := layout.Open(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Kinds: []KindDrift{}}
+	for _, k := range layout.Kinds {
+		files, err := backupLayout.ObjectFiles(k.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		backedUp := make(map[string]bool, len(files))
+		for _, file := range files {
+			backedUp[backupLayout.ObjectName(file, k.Prefix)] = true
+		}
+
+		live, err := client.Resource(k.GVR).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		// Optional kinds such as KubeVirt's are not served by every cluster
+		if apierrors.IsNotFound(err) && len(files) == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		kindDrift := KindDrift{Kind: k.Kind}
+		for _, item := range live.Items {
+			if k.Prefix == layout.ConfigMap && item.Name == backup.RootCAConfigMap {
+				continue
+			}
+			if !backedUp[item.Name] {
+				kindDrift.Added = append(kindDrift.Added, item.Name)
+			} else if LastWrite(item.ObjectMeta).After(backupTime) {
+				kindDrift.Modified = append(kindDrift.Modified, item.Name)
+			}
+			delete(backedUp, item.Name)
+		}
+		for name := range backedUp {
+			kindDrift.Removed = append(kindDrift.Removed, name)
+		}
+		sort.Strings(kindDrift.Removed)
+
+		if len(kindDrift.Added)+len(kindDrift.Removed)+len(kindDrift.Modified) > 0 {
+			report.Drifted = true
+			report.Kinds = append(report.Kinds, kindDrift)
+		}
+	}
+	return report, nil
+}
+
+// LastWrite returns when an object was last written to, going by its
+// managedFields.
+func LastWrite(meta metav1.ObjectMeta) time.Time {
+	last := meta.CreationTimestamp.Time
+	for _, entry := range meta.ManagedFields {
+		if entry.Time != nil && entry.Time.After(last) {
+			last = entry.Time.Time
+		}
+	}
+	return last
+}
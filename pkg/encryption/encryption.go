@@ -0,0 +1,214 @@
+// Package encryption encrypts the files of a backup at rest with AES-256-GCM.
+// Each file is sealed on its own, with its path in the backup as additional
+// data, so files can't be swapped or renamed unnoticed.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"net_exercise/pkg/config"
+)
+
+const Algorithm = "AES-256-GCM"
+
+// Encrypted files start with magic, followed by the nonce and the sealed
+// content
+var magic = []byte("NETXENC1")
+
+var ErrDecrypt = errors.New("decrypting backup file")
+
+// Keyring holds the configured keys.
+type Keyring struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring reads the keys of c.
+func NewKeyring(c config.Encryption) (*Keyring, error) {
+	k := &Keyring{current: c.KeyID, keys: map[string]cipher.AEAD{}}
+	for _, key := range c.Keys {
+		encoded := os.Getenv(key.Env)
+		if key.File != "" {
+			data, err := os.ReadFile(key.File)
+			if err != nil {
+				return nil, fmt.Errorf("encryption key %s: %w", key.ID, err)
+			}
+			encoded = string(data)
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not base64: %w", key.ID, err)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("encryption key %s must be 32 bytes, it is %d", key.ID, len(raw))
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		if k.keys[key.ID], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Current returns the ID of the key new backups are encrypted with.
+func (k *Keyring) Current() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// SetCurrent makes the configured key keyID the one new backups are
+// encrypted with. Backups encrypted with the previous key stay decryptable
+// as long as it is configured.
+func (k *Keyring) SetCurrent(keyID string) error {
+	if _, ok := k.keys[keyID]; !ok {
+		return fmt.Errorf("encryption key %s is not configured", keyID)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = keyID
+	return nil
+}
+
+// KeyIDs returns the IDs of the configured keys, sorted.
+func (k *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// EncryptDir encrypts every file in dir in place with the current key, except
+// the files named in skip, and returns the ID of the key.
+func (k *Keyring) EncryptDir(dir string, skip ...string) (string, error) {
+	current := k.Current()
+	aead := k.keys[current]
+	err := walkFiles(dir, skip, func(path, rel string) error {
+		plaintext, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sealed, err := seal(aead, plaintext, rel)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, sealed, 0644)
+	})
+	return current, err
+}
+
+// DecryptDir writes the files of src, encrypted by EncryptDir with keyID, to
+// dst in plaintext. Files named in skip are left out.
+func (k *Keyring) DecryptDir(dst, src, keyID string, skip ...string) error {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return fmt.Errorf("the backup is encrypted with key %s, which is not configured", keyID)
+	}
+	return walkFiles(src, skip, func(path, rel string) error {
+		sealed, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		plaintext, err := open(aead, sealed, rel)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(target, plaintext, 0644)
+	})
+}
+
+// ReencryptDir encrypts the files in dir, encrypted by EncryptDir with keyID,
+// in place with the current key and returns its ID. Files named in skip are
+// left alone. Files already encrypted with the current key are kept, so an
+// interrupted run can be repeated.
+func (k *Keyring) ReencryptDir(dir, keyID string, skip ...string) (string, error) {
+	old, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("the backup is encrypted with key %s, which is not configured", keyID)
+	}
+	current := k.Current()
+	aead := k.keys[current]
+	err := walkFiles(dir, skip, func(path, rel string) error {
+		sealed, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		plaintext, err := open(old, sealed, rel)
+		if err != nil {
+			if _, currentErr := open(aead, sealed, rel); currentErr == nil {
+				return nil
+			}
+			return err
+		}
+		if sealed, err = seal(aead, plaintext, rel); err != nil {
+			return err
+		}
+		return os.WriteFile(path, sealed, 0644)
+	})
+	return current, err
+}
+
+// seal encrypts the content of the file at rel with a random nonce.
+func seal(aead cipher.AEAD, plaintext []byte, rel string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return append(append(append([]byte{}, magic...), nonce...), aead.Seal(nil, nonce, plaintext, []byte(rel))...), nil
+}
+
+// open decrypts the content of the file at rel, sealed by seal.
+func open(aead cipher.AEAD, sealed []byte, rel string) ([]byte, error) {
+	header := len(magic) + aead.NonceSize()
+	if len(sealed) < header || string(sealed[:len(magic)]) != string(magic) {
+		return nil, fmt.Errorf("%w %s: not encrypted", ErrDecrypt, rel)
+	}
+	plaintext, err := aead.Open(nil, sealed[len(magic):header], sealed[header:], []byte(rel))
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrDecrypt, rel, err)
+	}
+	return plaintext, nil
+}
+
+// walkFiles calls fn with every file under dir and its slash separated path
+// relative to dir, except for the files named in skip.
+func walkFiles(dir string, skip []string, fn func(path, rel string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, s := range skip {
+			if rel == s {
+				return nil
+			}
+		}
+		return fn(path, rel)
+	})
+}
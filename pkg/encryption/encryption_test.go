@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"net_exercise/pkg/config"
+)
+
+// newTestKeyring returns a keyring of the keys with the given IDs, the first
+// one current.
+func newTestKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	c := config.Encryption{KeyID: ids[0]}
+	for i, id := range ids {
+		env := "NETX_TEST_KEY_" + strings.ToUpper(id)
+		t.Setenv(env, base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('a'+i)), 32))))
+		c.Keys = append(c.Keys, config.EncryptionKey{ID: id, Env: env})
+	}
+	k, err := NewKeyring(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSetCurrent(t *testing.T) {
+	k := newTestKeyring(t, "old", "new")
+
+	if err := k.SetCurrent("unknown"); err == nil {
+		t.Error("SetCurrent() of an unknown key succeeded")
+	}
+	if k.Current() != "old" {
+		t.Errorf("Current() = %s after a failed SetCurrent(), want old", k.Current())
+	}
+	if err := k.SetCurrent("new"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"configmap/shop.json": "{}"})
+	if keyID, err := k.EncryptDir(dir); err != nil || keyID != "new" {
+		t.Errorf("EncryptDir() = %s, %v, want new", keyID, err)
+	}
+}
+
+func TestReencryptDir(t *testing.T) {
+	files := map[string]string{
+		"configmap/shop.json": `{"data":{"mode":"live"}}`,
+		"secret/shop.json":    `{"data":{"password":"aHVudGVyMg=="}}`,
+	}
+
+	tests := []struct {
+		name string
+		// Encrypts the backup before it is re-encrypted from old to new
+		prepare func(t *testing.T, k *Keyring, dir string)
+		keyID   string
+		wantErr bool
+	}{
+		{
+			name: "encrypted with the old key",
+			prepare: func(t *testing.T, k *Keyring, dir string) {
+				if _, err := k.EncryptDir(dir, "manifest.json"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			keyID: "old",
+		},
+		{
+			name: "interrupted run",
+			prepare: func(t *testing.T, k *Keyring, dir string) {
+				if _, err := k.EncryptDir(dir, "manifest.json"); err != nil {
+					t.Fatal(err)
+				}
+				// Only the Secret was re-encrypted before
+				if err := k.SetCurrent("new"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := k.ReencryptDir(dir, "old", "manifest.json", "configmap/shop.json"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			keyID: "old",
+		},
+		{
+			name:    "not encrypted",
+			prepare: func(t *testing.T, k *Keyring, dir string) {},
+			keyID:   "old",
+			wantErr: true,
+		},
+		{
+			name: "unknown key",
+			prepare: func(t *testing.T, k *Keyring, dir string) {
+				if _, err := k.EncryptDir(dir, "manifest.json"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			keyID:   "removed",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newTestKeyring(t, "old", "new")
+			dir := t.TempDir()
+			writeFiles(t, dir, files)
+			writeFiles(t, dir, map[string]string{"manifest.json": "{}"})
+			tt.prepare(t, k, dir)
+
+			if err := k.SetCurrent("new"); err != nil {
+				t.Fatal(err)
+			}
+			keyID, err := k.ReencryptDir(dir, tt.keyID, "manifest.json")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReencryptDir() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if keyID != "new" {
+				t.Errorf("ReencryptDir() = %s, want new", keyID)
+			}
+
+			// Only the new key decrypts the files now
+			if err := k.DecryptDir(t.TempDir(), dir, "old", "manifest.json"); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("DecryptDir() with the old key error = %v, want %v", err, ErrDecrypt)
+			}
+			plain := t.TempDir()
+			if err := k.DecryptDir(plain, dir, "new", "manifest.json"); err != nil {
+				t.Fatal(err)
+			}
+			for rel, want := range files {
+				got, err := os.ReadFile(filepath.Join(plain, filepath.FromSlash(rel)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s = %s, want %s", rel, got, want)
+				}
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err != nil || string(data) != "{}" {
+				t.Errorf("manifest.json = %s, %v, want it untouched", data, err)
+			}
+		})
+	}
+}
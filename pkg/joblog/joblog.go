@@ -0,0 +1,77 @@
+package joblog
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// Number of lines a Buffer keeps, older lines are dropped
+const Size = 1000
+
+// Buffer keeps the most recent log lines of one job and lets readers follow
+// it while it runs. Every Write is one line.
+type Buffer struct {
+	mu sync.Mutex
+	// lines[i] is line number first+i
+	lines [][]byte
+	first int
+	done  bool
+	// Closed and replaced whenever a line is added or the job ends
+	changed chan struct{}
+}
+
+func New() *Buffer {
+	return &Buffer{changed: make(chan struct{})}
+}
+
+// Logger returns a logger writing JSON lines to b.
+func (b *Buffer) Logger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(b, nil))
+}
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines = append(b.lines, line)
+	if len(b.lines) > Size {
+		b.lines = b.lines[1:]
+		b.first++
+	}
+	b.notify()
+	return len(p), nil
+}
+
+// Close marks the job as finished, followers stop after the last line.
+func (b *Buffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done = true
+	b.notify()
+}
+
+// notify must be called with b.mu held.
+func (b *Buffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Lines returns the lines from line number from on, the number to continue
+// from, whether the job is finished, and a channel closed on the next change.
+// Lines that were already dropped are skipped.
+func (b *Buffer) Lines(from int) (lines [][]byte, next int, done bool, changed <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if from < b.first {
+		from = b.first
+	}
+	if i := from - b.first; i < len(b.lines) {
+		lines = b.lines[i:]
+	}
+	return lines, b.first + len(b.lines), b.done, b.changed
+}
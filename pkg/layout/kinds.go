@@ -0,0 +1,148 @@
+package layout
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type Kind struct {
+	Prefix string
+	Kind   string
+	GVR    schema.GroupVersionResource
+	// Path to the Pod spec, for Pods and the kinds with a Pod template
+	PodSpec []string
+	// Defined by a CustomResourceDefinition, see CRDName
+	Custom bool
+}
+
+// Kinds lists every resource kind a backup can contain, in restore order:
+// each kind comes after the kinds its objects depend on, so that Pods find
+// their ServiceAccount, Secrets, ConfigMaps and PVCs when they start.
+var Kinds = []Kind{
+	// Identities and the permissions granted to them
+	{Prefix: ServiceAccount, Kind: "ServiceAccount", GVR: schema.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}},
+	{Prefix: Role, Kind: "Role", GVR: schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles"}},
+	{Prefix: RoleBinding, Kind: "RoleBinding", GVR: schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings"}},
+	// Configuration mounted or referenced by Pods
+	{Prefix: Secret, Kind: "Secret", GVR: schema.GroupVersionResource{Version: "v1", Resource: "secrets"}},
+	{Prefix: ConfigMap, Kind: "ConfigMap", GVR: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}},
+	// Storage, KubeVirt DataVolumes have to exist before the VirtualMachines
+	// using them
+	{Prefix: PVC, Kind: "PersistentVolumeClaim", GVR: schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}},
+	{Prefix: DataVolume, Kind: "DataVolume", GVR: schema.GroupVersionResource{Group: "cdi.kubevirt.io", Version: "v1beta1", Resource: "datavolumes"}, Custom: true},
+	// Networking
+	{Prefix: Service, Kind: "Service", GVR: schema.GroupVersionResource{Version: "v1", Resource: "services"}},
+	{Prefix: NetworkPolicy, Kind: "NetworkPolicy", GVR: schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}},
+	// Workloads
+	{Prefix: PodTemplate, Kind: "PodTemplate", GVR: schema.GroupVersionResource{Version: "v1", Resource: "podtemplates"}, PodSpec: []string{"template", "spec"}},
+	{Prefix: Pod, Kind: "Pod", GVR: schema.GroupVersionResource{Version: "v1", Resource: "pods"}, PodSpec: []string{"spec"}},
+	{Prefix: ReplicaSet, Kind: "ReplicaSet", GVR: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}, PodSpec: podTemplateSpec},
+	{Prefix: ReplicationController, Kind: "ReplicationController", GVR: schema.GroupVersionResource{Version: "v1", Resource: "replicationcontrollers"}, PodSpec: podTemplateSpec},
+	{Prefix: Deployment, Kind: "Deployment", GVR: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, PodSpec: podTemplateSpec},
+	{Prefix: StatefulSet, Kind: "StatefulSet", GVR: schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}, PodSpec: podTemplateSpec},
+	{Prefix: Job, Kind: "Job", GVR: schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}, PodSpec: podTemplateSpec},
+	{Prefix: CronJob, Kind: "CronJob", GVR: schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}, PodSpec: []string{"spec", "jobTemplate", "spec", "template", "spec"}},
+	{Prefix: VirtualMachine, Kind: "VirtualMachine", GVR: schema.GroupVersionResource{Group: "kubevirt.io", Version: "v1", Resource: "virtualmachines"}, Custom: true},
+	// Policies applying to the workloads
+	{Prefix: HPA, Kind: "HorizontalPodAutoscaler", GVR: schema.GroupVersionResource{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers"}},
+	{Prefix: PDB, Kind: "PodDisruptionBudget", GVR: schema.GroupVersionResource{Group: "policy", Version: "v1", Resource: "poddisruptionbudgets"}},
+}
+
+// CRDKind stores the CustomResourceDefinitions of the custom kinds in a
+// backup, so a restore can create them on a cluster that lacks them. It is
+// cluster scoped and not part of Kinds.
+var CRDKind = Kind{Prefix: CustomResourceDefinition, Kind: "CustomResourceDefinition", GVR: schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}}
+
+// PVKind and StorageClassKind store the PersistentVolumes bound to the PVCs
+// of a backup and the StorageClasses they use, when the application captures
+// storage. They are cluster scoped and not part of Kinds.
+var (
+	PVKind           = Kind{Prefix: PersistentVolume, Kind: "PersistentVolume", GVR: schema.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"}}
+	StorageClassKind = Kind{Prefix: StorageClass, Kind: "StorageClass", GVR: schema.GroupVersionResource{Group: "storage.k8s.io", Version: "v1", Resource: "storageclasses"}}
+)
+
+// VolumeSnapshotKind and VolumeSnapshotContentKind record the CSI snapshots
+// of the PVCs of a backup. They are not part of Kinds, a restore only reads
+// them to provision PVCs from the snapshots.
+var (
+	VolumeSnapshotKind        = Kind{Prefix: VolumeSnapshot, Kind: "VolumeSnapshot", GVR: schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}}
+	VolumeSnapshotContentKind = Kind{Prefix: VolumeSnapshotContent, Kind: "VolumeSnapshotContent", GVR: schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshotcontents"}}
+)
+
+// CRDName returns the name of the CustomResourceDefinition defining k, e.g.
+// datavolumes.cdi.kubevirt.io.
+func (k Kind) CRDName() string {
+	return k.GVR.Resource + "." + k.GVR.Group
+}
+
+var podTemplateSpec = []string{"spec", "template", "spec"}
+
+// PodSpecField returns the path to a field of the Pod spec of k.
+func (k Kind) PodSpecField(field string) []string {
+	return append(slices.Clone(k.PodSpec), field)
+}
+
+// ClassKind is a cluster scoped kind that Pod specs refer to by name.
+type ClassKind struct {
+	Kind
+	// Pod spec field naming the class
+	Field string
+	// Pod spec fields admission fills in from the class, they have to be
+	// cleared when the class changes
+	Derived []string
+}
+
+// ClassKinds are stored in a backup when its Pod specs refer to them. They
+// are not part of Kinds, which only lists namespaced kinds.
+var ClassKinds = []ClassKind{
+	{
+		Kind:    Kind{Prefix: PriorityClass, Kind: "PriorityClass", GVR: schema.GroupVersionResource{Group: "scheduling.k8s.io", Version: "v1", Resource: "priorityclasses"}},
+		Field:   "priorityClassName",
+		Derived: []string{"priority", "preemptionPolicy"},
+	},
+	{
+		Kind:    Kind{Prefix: RuntimeClass, Kind: "RuntimeClass", GVR: schema.GroupVersionResource{Group: "node.k8s.io", Version: "v1", Resource: "runtimeclasses"}},
+		Field:   "runtimeClassName",
+		Derived: []string{"overhead"},
+	},
+}
+
+// LookupKind accepts either a kind prefix ("configmap") or a Kind ("ConfigMap").
+func LookupKind(name string) (Kind, bool) {
+	for _, k := range Kinds {
+		if k.Prefix == name || strings.EqualFold(k.Kind, name) {
+			return k, true
+		}
+	}
+	return Kind{}, false
+}
+
+// ReadObject decodes an object file. Objects from List calls are serialized
+// without type information, so apiVersion and kind are filled in from k.
+// Files whose metadata is not an object are rejected.
+func (r Reader) ReadObject(file string, k Kind) (*unstructured.Unstructured, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &obj.Object); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(file), err)
+	}
+	// Without it the object could not be named or moved to another namespace
+	if _, ok := obj.Object["metadata"].(map[string]any); !ok {
+		return nil, fmt.Errorf("%s: metadata is not an object", filepath.Base(file))
+	}
+
+	obj.SetAPIVersion(k.GVR.GroupVersion().String())
+	obj.SetKind(k.Kind)
+	return obj, nil
+}
@@ -0,0 +1,130 @@
+package layout
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"net_exercise/pkg/manifest"
+)
+
+// Kind prefixes name the per-kind directories of a backup. They must not
+// contain "-", because version 1 backups store every object as
+// <kind>-<name>.json in a single directory and are matched by prefix.
+const (
+	PVC                   = "pvc"
+	Pod                   = "pod"
+	ReplicaSet            = "replicaset"
+	Deployment            = "deployment"
+	ConfigMap             = "configmap"
+	Service               = "service"
+	StatefulSet           = "statefulset"
+	ServiceAccount        = "serviceaccount"
+	Secret                = "secret"
+	Role                  = "role"
+	RoleBinding           = "rolebinding"
+	NetworkPolicy         = "networkpolicy"
+	Job                   = "job"
+	CronJob               = "cronjob"
+	HPA                   = "horizontalpodautoscaler"
+	PDB                   = "poddisruptionbudget"
+	PodTemplate           = "podtemplate"
+	ReplicationController = "replicationcontroller"
+	DataVolume            = "datavolume"
+	VirtualMachine        = "virtualmachine"
+
+	// Cluster scoped, see ClassKinds, CRDKind, PVKind and StorageClassKind
+	PriorityClass            = "priorityclass"
+	RuntimeClass             = "runtimeclass"
+	CustomResourceDefinition = "customresourcedefinition"
+	PersistentVolume         = "persistentvolume"
+	StorageClass             = "storageclass"
+
+	// Records of the KubeVirt snapshots taken during a backup, never restored
+	VirtualMachineSnapshot = "virtualmachinesnapshot"
+	// Records of the CSI snapshots of PVCs taken during a backup, see
+	// VolumeSnapshotKind. Restores provision PVCs from them on request.
+	VolumeSnapshot        = "volumesnapshot"
+	VolumeSnapshotContent = "volumesnapshotcontent"
+	// Revision history of StatefulSets and DaemonSets, kept for forensics and
+	// never restored: the controllers start a new history for restored objects
+	ControllerRevision = "controllerrevision"
+)
+
+const (
+	// Flat directory of <kind>-<name>.json files, backups without a manifest
+	Version1 = 1
+	// One directory per kind: <kind>/<name>.json
+	Version2 = 2
+
+	CurrentVersion = Version2
+)
+
+// ObjectFile returns where a new backup stores the given object.
+func ObjectFile(backupDir, kind, name string) string {
+	return filepath.Join(backupDir, kind, name+".json")
+}
+
+// StatusFile returns where a new backup stores the status of the given
+// object. Status files live outside the kind directories, so restores and
+// every other reader of object files never see them.
+func StatusFile(backupDir, kind, name string) string {
+	return filepath.Join(backupDir, "status", kind, name+".json")
+}
+
+func WriteObject(backupDir, kind, name string, data []byte) error {
+	filename := ObjectFile(backupDir, kind, name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// Reader locates object files in a backup of any layout version.
+type Reader struct {
+	dir     string
+	version int
+}
+
+// Current reads a backup being written with CurrentVersion, before its
+// manifest exists.
+func Current(backupDir string) Reader {
+	return Reader{dir: backupDir, version: CurrentVersion}
+}
+
+func Open(backupDir string) (Reader, error) {
+	m, ok, err := manifest.Read(backupDir)
+	if err != nil {
+		return Reader{}, err
+	}
+	if !ok {
+		return Reader{dir: backupDir, version: Version1}, nil
+	}
+
+	switch m.LayoutVersion {
+	case Version1, Version2:
+		return Reader{dir: backupDir, version: m.LayoutVersion}, nil
+	}
+	return Reader{}, fmt.Errorf("backup %s has unsupported layout version %d", backupDir, m.LayoutVersion)
+}
+
+func (r Reader) Version() int {
+	return r.version
+}
+
+func (r Reader) ObjectFiles(kind string) ([]string, error) {
+	if r.version == Version1 {
+		return filepath.Glob(filepath.Join(r.dir, kind+"-*.json"))
+	}
+	return filepath.Glob(filepath.Join(r.dir, kind, "*.json"))
+}
+
+// ObjectName returns the name of the object stored in file.
+func (r Reader) ObjectName(file, kind string) string {
+	name := strings.TrimSuffix(filepath.Base(file), ".json")
+	if r.version == Version1 {
+		name = strings.TrimPrefix(name, kind+"-")
+	}
+	return name
+}
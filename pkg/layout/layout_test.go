@@ -0,0 +1,166 @@
+package layout
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"net_exercise/pkg/manifest"
+)
+
+// Version 1 backups are matched by <kind>- prefix, a kind prefix containing
+// "-" would match the files of another kind.
+func TestKindPrefixes(t *testing.T) {
+	seen := map[string]bool{}
+	for _, k := range Kinds {
+		if strings.Contains(k.Prefix, "-") {
+			t.Errorf("kind prefix %q contains -", k.Prefix)
+		}
+		if seen[k.Prefix] {
+			t.Errorf("kind prefix %q is used twice", k.Prefix)
+		}
+		seen[k.Prefix] = true
+	}
+}
+
+func TestReaderObjectFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		// Files of the backup, relative to its directory
+		files []string
+		kind  string
+		want  []string
+	}{
+		{
+			name:    "v2 kind directory",
+			version: Version2,
+			files:   []string{"pvc/data.json", "pod/shop.json"},
+			kind:    PVC,
+			want:    []string{"data"},
+		},
+		{
+			name:    "v2 PVC named like a Pod",
+			version: Version2,
+			files:   []string{"pvc/pod-x.json", "pod/shop.json"},
+			kind:    Pod,
+			want:    []string{"shop"},
+		},
+		{
+			name:    "v2 status files are not objects",
+			version: Version2,
+			files:   []string{"pod/shop.json", "status/pod/shop.json"},
+			kind:    Pod,
+			want:    []string{"shop"},
+		},
+		{
+			name:    "v1 flat directory",
+			version: Version1,
+			files:   []string{"pvc-data.json", "pod-shop.json"},
+			kind:    PVC,
+			want:    []string{"data"},
+		},
+		{
+			name:    "v1 PVC named like a Pod",
+			version: Version1,
+			files:   []string{"pvc-pod-x.json", "pod-shop.json"},
+			kind:    PVC,
+			want:    []string{"pod-x"},
+		},
+		{
+			name:    "v1 prefix of another kind",
+			version: Version1,
+			files:   []string{"role-shop.json", "rolebinding-shop.json"},
+			kind:    Role,
+			want:    []string{"shop"},
+		},
+		{
+			name:    "no files of the kind",
+			version: Version2,
+			files:   []string{"pod/shop.json"},
+			kind:    Secret,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range tt.files {
+				path := filepath.Join(dir, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := Reader{dir: dir, version: tt.version}
+
+			files, err := r.ObjectFiles(tt.kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, file := range files {
+				names = append(names, r.ObjectName(file, tt.kind))
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("objects of %s = %v, want %v", tt.kind, names, tt.want)
+			}
+		})
+	}
+}
+
+// Objects written by a backup are found again under their own kind.
+func TestWriteObjectRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for _, k := range Kinds {
+		if err := WriteObject(dir, k.Prefix, "pod-x", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := Current(dir)
+	for _, k := range Kinds {
+		files, err := r.ObjectFiles(k.Prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0] != ObjectFile(dir, k.Prefix, "pod-x") || r.ObjectName(files[0], k.Prefix) != "pod-x" {
+			t.Errorf("objects of %s = %v, want only pod-x", k.Prefix, files)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    *manifest.Manifest
+		wantVersion int
+		wantErr     bool
+	}{
+		{name: "no manifest", wantVersion: Version1},
+		{name: "version 1", manifest: &manifest.Manifest{LayoutVersion: Version1}, wantVersion: Version1},
+		{name: "version 2", manifest: &manifest.Manifest{LayoutVersion: Version2}, wantVersion: Version2},
+		{name: "unsupported version", manifest: &manifest.Manifest{LayoutVersion: CurrentVersion + 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.manifest != nil {
+				if err := manifest.Write(dir, *tt.manifest); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, err := Open(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && r.Version() != tt.wantVersion {
+				t.Errorf("Open() version = %d, want %d", r.Version(), tt.wantVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package manifest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files returns the SHA-256 of every file of the backup by path, including
+// the files an incremental backup inherits.
+func (m Manifest) Files() map[string]string {
+	files := make(map[string]string, len(m.Checksums)+len(m.Inherited))
+	for path, sum := range m.Inherited {
+		files[path] = sum
+	}
+	for path, sum := range m.Checksums {
+		files[path] = sum
+	}
+	return files
+}
+
+// Inherit turns the backup in backupDir into an incremental backup of the
+// backup parentID described by parent: files the parent has with the same
+// content are removed and recorded in m.Inherited. m.Checksums must be set.
+// Parents without checksums have nothing to inherit and m stays a full
+// backup.
+func Inherit(backupDir string, m *Manifest, parentID string, parent Manifest) error {
+	parentFiles := parent.Files()
+	if len(parentFiles) == 0 {
+		return nil
+	}
+
+	m.Parent = parentID
+	m.Inherited = map[string]string{}
+	for path, sum := range m.Checksums {
+		if parentFiles[path] != sum {
+			continue
+		}
+		if err := os.Remove(filepath.Join(backupDir, filepath.FromSlash(path))); err != nil {
+			return err
+		}
+		m.Inherited[path] = sum
+		delete(m.Checksums, path)
+	}
+	return nil
+}
+
+// Materialize writes the full backup an incremental backup stands for into
+// dst: the files of backupDir, the files it inherits from parentDir, which
+// must hold the full parent backup, and a manifest of a full backup.
+func Materialize(dst, backupDir, parentDir string, m Manifest) error {
+	for path := range m.Checksums {
+		if err := copyFile(filepath.Join(dst, filepath.FromSlash(path)), filepath.Join(backupDir, filepath.FromSlash(path))); err != nil {
+			return err
+		}
+	}
+	for path := range m.Inherited {
+		if err := copyFile(filepath.Join(dst, filepath.FromSlash(path)), filepath.Join(parentDir, filepath.FromSlash(path))); err != nil {
+			return fmt.Errorf("inherited file %s: %w", path, err)
+		}
+	}
+
+	m.Checksums = m.Files()
+	m.Parent = ""
+	m.Inherited = nil
+	return Write(dst, m)
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,243 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const FileName = "manifest.json"
+
+// Manifest describes a backup directory. It is written last, once all
+// objects have been stored.
+type Manifest struct {
+	LayoutVersion int       `json:"layout_version"`
+	AppID         string    `json:"app_id,omitempty"`
+	Namespace     string    `json:"namespace,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	// Set when only the objects matching it were backed up
+	LabelSelector string `json:"label_selector,omitempty"`
+	// Set when only these objects were backed up, by <kind>/<name>
+	Objects []string `json:"objects,omitempty"`
+	// Kind prefixes that were captured
+	Kinds []string `json:"kinds"`
+	// Number of objects per kind prefix
+	Counts map[string]int `json:"counts,omitempty"`
+	// SHA-256 of every other file in the backup by slash separated path,
+	// e.g. "configmap/settings.json", see Verify
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Cluster   *Cluster          `json:"cluster,omitempty"`
+	// Copies of the PVCs' files taken by the data mover
+	VolumeData *VolumeData `json:"volume_data,omitempty"`
+	// CSI snapshots of the PVCs taken for the backup, deleted with it
+	VolumeSnapshots []VolumeSnapshot `json:"volume_snapshots,omitempty"`
+	// Consistency group the volume snapshots were taken in
+	SnapshotGroup *SnapshotGroup `json:"snapshot_group,omitempty"`
+	// UID of every object in the backup, keyed by <kind>/<name>
+	UIDs map[string]string `json:"uids,omitempty"`
+	// State of the application when the backup was taken
+	Health *Health `json:"health,omitempty"`
+	// Labels and annotations of the namespace, for restores that create it
+	NamespaceMetadata *NamespaceMetadata `json:"namespace_metadata,omitempty"`
+	// Warnings the API server sent while the backup was taken, by kind
+	// prefix, e.g. that an API version read is deprecated
+	Warnings map[string][]string `json:"warnings,omitempty"`
+	// Versions the workloads were running, only recorded for applications
+	// with version_keys
+	Versions []WorkloadVersion `json:"versions,omitempty"`
+	// The version all workloads agree on, or their versions joined by ","
+	AppVersion string `json:"app_version,omitempty"`
+	// resourceVersion of every object by <kind>/<name> before the backup was
+	// taken, only recorded for applications with skip_unchanged
+	ResourceVersions map[string]string `json:"resource_versions,omitempty"`
+	// Backup an incremental backup builds on, see Inherit
+	Parent string `json:"parent,omitempty"`
+	// SHA-256 of the files an incremental backup left out because its
+	// parent has them unchanged, by path like Checksums
+	Inherited map[string]string `json:"inherited,omitempty"`
+	// Set when every other file of the backup is encrypted. Checksums are
+	// of the plaintext.
+	Encryption *Encryption `json:"encryption,omitempty"`
+	// Algorithm every other file of the backup is compressed with, empty
+	// if they are not. Checksums are of the uncompressed files.
+	Compression string `json:"compression,omitempty"`
+}
+
+// Encryption records how the files of a backup were encrypted.
+type Encryption struct {
+	// AES-256-GCM
+	Algorithm string `json:"algorithm"`
+	// ID of the configured key, see config.Encryption
+	KeyID string `json:"key_id"`
+}
+
+// VolumeData records where the data mover copied the files of the PVCs.
+type VolumeData struct {
+	// restic repository, e.g. s3:s3.eu-west-1.amazonaws.com/bucket/restic/shop
+	Repository string `json:"repository"`
+	// restic snapshot ID by PVC name
+	Snapshots map[string]string `json:"snapshots"`
+}
+
+type NamespaceMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// VolumeSnapshot records a VolumeSnapshot taken for a backup and its
+// VolumeSnapshotContent.
+type VolumeSnapshot struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	PVC       string `json:"pvc"`
+	Content   string `json:"content"`
+	// Deletion policy of the content before the backup switched it to
+	// Retain, restored when the backup is deleted
+	DeletionPolicy string `json:"deletion_policy"`
+	// ID of the SnapshotGroup the snapshot was taken in
+	Group string `json:"group,omitempty"`
+	// When the CSI driver cut the snapshot
+	CreationTime *time.Time `json:"creation_time,omitempty"`
+}
+
+// SnapshotGroup records the VolumeSnapshots of a backup that were requested
+// together, so that the PVCs of an application, e.g. a database and its
+// replica, hold data of nearly the same moment.
+type SnapshotGroup struct {
+	// Also set as the netx.io/snapshot-group label of the snapshots
+	ID string `json:"id"`
+	// Creation times of the first and the last snapshot cut, unset if the
+	// CSI driver reported none
+	FirstSnapshotAt *time.Time `json:"first_snapshot_at,omitempty"`
+	LastSnapshotAt  *time.Time `json:"last_snapshot_at,omitempty"`
+	// Milliseconds between the first and the last snapshot
+	SkewMS int64 `json:"skew_ms"`
+}
+
+type WorkloadVersion struct {
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Version string   `json:"version,omitempty"`
+	Images  []string `json:"images"`
+}
+
+// Health is a point-in-time view of how healthy an application was, to
+// compare a restored application against.
+type Health struct {
+	CapturedAt time.Time        `json:"captured_at"`
+	Workloads  []WorkloadHealth `json:"workloads"`
+	// Number of Pods per phase, e.g. "Running": 3
+	PodPhases map[string]int `json:"pod_phases"`
+	Pods      int            `json:"pods"`
+	ReadyPods int            `json:"ready_pods"`
+}
+
+type WorkloadHealth struct {
+	Kind              string `json:"kind"`
+	Name              string `json:"name"`
+	Replicas          int32  `json:"replicas"`
+	ReadyReplicas     int32  `json:"ready_replicas"`
+	AvailableReplicas int32  `json:"available_replicas"`
+}
+
+// Cluster describes the cluster a backup was taken from.
+type Cluster struct {
+	ServerVersion string `json:"server_version"`
+	// Kinds served per group version, e.g. "apps/v1": ["Deployment", ...]
+	APIResources map[string][]string `json:"api_resources"`
+}
+
+func Write(backupDir string, m Manifest) error {
+	manifestJSON, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(backupDir, FileName), manifestJSON, 0644)
+}
+
+// Read returns the manifest of backupDir. Backups taken before manifests were
+// introduced have none, in which case ok is false.
+func Read(backupDir string) (m Manifest, ok bool, err error) {
+	manifestJSON, err := os.ReadFile(filepath.Join(backupDir, FileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Manifest{}, false, nil
+	}
+	if err != nil {
+		return Manifest{}, false, err
+	}
+	if err := json.Unmarshal(manifestJSON, &m); err != nil {
+		return Manifest{}, false, err
+	}
+	return m, true, nil
+}
+
+// ErrIntegrity is returned when backup files do not match their checksums.
+var ErrIntegrity = errors.New("backup integrity check failed")
+
+// Checksums returns the SHA-256 of every file in backupDir but the manifest.
+func Checksums(backupDir string) (map[string]string, error) {
+	sums := map[string]string{}
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(backupDir, path)
+		if err != nil || rel == FileName {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sums[filepath.ToSlash(rel)] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return sums, err
+}
+
+// Verify checks that backupDir holds exactly the files m has checksums for,
+// unchanged. Backups taken before checksums were recorded pass.
+func Verify(backupDir string, m Manifest) error {
+	if m.Checksums == nil {
+		return nil
+	}
+	sums, err := Checksums(backupDir)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for path, want := range m.Checksums {
+		got, ok := sums[path]
+		switch {
+		case !ok:
+			problems = append(problems, path+" is missing")
+		case got != want:
+			problems = append(problems, path+" was modified")
+		}
+	}
+	for path := range sums {
+		if _, ok := m.Checksums[path]; !ok {
+			problems = append(problems, path+" was added")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %s", ErrIntegrity, strings.Join(problems, ", "))
+	}
+	return nil
+}
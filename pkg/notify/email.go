@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"net_exercise/pkg/config"
+)
+
+const (
+	EventBackupFailed     = "backup_failed"
+	EventScheduleMissed   = "schedule_missed"
+	EventRestoreCompleted = "restore_completed"
+)
+
+var events = []string{EventBackupFailed, EventScheduleMissed, EventRestoreCompleted}
+
+// Event is what the email templates are rendered with.
+type Event struct {
+	Type      string
+	AppID     string
+	AppName   string
+	Namespace string
+	BackupID  string
+	RestoreID string
+	// Outcome of a restore, "completed" or "failed"
+	Status string
+	Error  string
+	Time   time.Time
+}
+
+var defaultTemplates = map[string]config.EmailTemplate{
+	EventBackupFailed: {
+		Subject: "[netx] Backup of {{.AppName}} failed",
+		Body: `The backup {{.BackupID}} of application {{.AppName}} ({{.AppID}}) in namespace {{.Namespace}} failed at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+
+Error: {{.Error}}
+`,
+	},
+	EventScheduleMissed: {
+		Subject: "[netx] Scheduled backups of {{.AppName}} are overdue",
+		Body: `Application {{.AppName}} ({{.AppID}}) in namespace {{.Namespace}} has not had a successful scheduled backup in time.
+{{if .BackupID}}
+The last successful backup is {{.BackupID}}.{{else}}
+It has never been backed up successfully.{{end}}
+`,
+	},
+	EventRestoreCompleted: {
+		Subject: "[netx] Restore {{.RestoreID}} into {{.Namespace}} {{.Status}}",
+		Body: `Restore {{.RestoreID}} of backup {{.BackupID}} into namespace {{.Namespace}} {{.Status}} at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+{{if .Error}}
+Error: {{.Error}}
+{{end}}`,
+	},
+}
+
+type emailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// Emailer sends event notifications through SMTP.
+type Emailer struct {
+	cfg       config.Email
+	password  string
+	templates map[string]emailTemplate
+}
+
+func NewEmailer(cfg config.Email) (*Emailer, error) {
+	e := &Emailer{cfg: cfg, templates: map[string]emailTemplate{}}
+
+	if len(cfg.Events) == 0 {
+		e.cfg.Events = events
+	}
+	for _, event := range e.cfg.Events {
+		if !slices.Contains(events, event) {
+			return nil, fmt.Errorf("email: unknown event %q, must be one of: %s", event, strings.Join(events, ", "))
+		}
+	}
+
+	if cfg.SMTP.PasswordEnv != "" {
+		e.password = os.Getenv(cfg.SMTP.PasswordEnv)
+		if e.password == "" {
+			return nil, fmt.Errorf("email: environment variable %s is not set", cfg.SMTP.PasswordEnv)
+		}
+	}
+
+	for _, event := range events {
+		t := defaultTemplates[event]
+		if override, ok := cfg.Templates[event]; ok {
+			if override.Subject != "" {
+				t.Subject = override.Subject
+			}
+			if override.Body != "" {
+				t.Body = override.Body
+			}
+		}
+
+		subject, err := template.New(event + " subject").Parse(t.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("email template: %w", err)
+		}
+		body, err := template.New(event + " body").Parse(t.Body)
+		if err != nil {
+			return nil, fmt.Errorf("email template: %w", err)
+		}
+		e.templates[event] = emailTemplate{subject: subject, body: body}
+	}
+	for event := range cfg.Templates {
+		if !slices.Contains(events, event) {
+			return nil, fmt.Errorf("email: template for unknown event %q", event)
+		}
+	}
+	return e, nil
+}
+
+// Send mails event to the configured recipients and extraRecipients, unless
+// the event type is not enabled.
+func (e *Emailer) Send(event Event, extraRecipients []string) error {
+	if !slices.Contains(e.cfg.Events, event.Type) {
+		return nil
+	}
+
+	var recipients []string
+	for _, r := range append(slices.Clone(e.cfg.Recipients), extraRecipients...) {
+		if !slices.Contains(recipients, r) {
+			recipients = append(recipients, r)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	t := e.templates[event.Type]
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, event); err != nil {
+		return err
+	}
+	if err := t.body.Execute(&body, event); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(recipients, ", "))
+	// Rendered values could otherwise inject headers
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject.String()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if e.cfg.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", e.cfg.SMTP.Username, e.password, e.cfg.SMTP.Host)
+	}
+	addr := net.JoinHostPort(e.cfg.SMTP.Host, strconv.Itoa(e.cfg.SMTP.Port))
+	return smtp.SendMail(addr, auth, e.cfg.From, recipients, msg.Bytes())
+}
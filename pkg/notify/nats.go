@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"net_exercise/pkg/config"
+)
+
+// Lifecycle events published to the event bus, on <subject_prefix>.<type>
+const (
+	LifecycleBackupCreated    = "backup.created"
+	LifecycleBackupCompleted  = "backup.completed"
+	LifecycleBackupFailed     = "backup.failed"
+	LifecycleRestoreCompleted = "restore.completed"
+	LifecycleRestoreFailed    = "restore.failed"
+)
+
+var lifecycleEvents = []string{
+	LifecycleBackupCreated, LifecycleBackupCompleted, LifecycleBackupFailed,
+	LifecycleRestoreCompleted, LifecycleRestoreFailed,
+}
+
+// LifecycleEvent is the JSON body of the messages published to the event bus.
+type LifecycleEvent struct {
+	Type      string `json:"type"`
+	AppID     string `json:"app_id,omitempty"`
+	AppName   string `json:"app_name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	BackupID  string `json:"backup_id,omitempty"`
+	RestoreID string `json:"restore_id,omitempty"`
+	// Status of the backup or restore, e.g. "unchanged" for completed
+	// backups nothing was written for
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Attempt of a scheduled backup, failed attempts are retried
+	Attempt int       `json:"attempt,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// NATSPublisher publishes lifecycle events to a NATS server. It connects for
+// every event, which is plenty for how few of them there are.
+type NATSPublisher struct {
+	cfg    config.NATS
+	events []string
+	addr   string
+	user   string
+	pass   string
+	token  string
+}
+
+func NewNATSPublisher(cfg config.EventBus) (*NATSPublisher, error) {
+	p := &NATSPublisher{cfg: cfg.NATS, events: cfg.Events}
+
+	if len(p.events) == 0 {
+		p.events = lifecycleEvents
+	}
+	for _, event := range p.events {
+		if !slices.Contains(lifecycleEvents, event) {
+			return nil, fmt.Errorf("event_bus: unknown event %q, must be one of: %s", event, strings.Join(lifecycleEvents, ", "))
+		}
+	}
+
+	u, err := url.Parse(cfg.NATS.URL)
+	if err != nil {
+		return nil, fmt.Errorf("event_bus: %w", err)
+	}
+	p.addr = u.Host
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.pass, _ = u.User.Password()
+	}
+
+	if cfg.NATS.TokenEnv != "" {
+		p.token = os.Getenv(cfg.NATS.TokenEnv)
+		if p.token == "" {
+			return nil, fmt.Errorf("event_bus: environment variable %s is not set", cfg.NATS.TokenEnv)
+		}
+	}
+	return p, nil
+}
+
+// Publish sends event to its subject, unless the event type is not enabled.
+// It returns once the server acknowledged it, NATS keeps no copy for
+// subscribers that are not connected.
+func (p *NATSPublisher) Publish(event LifecycleEvent) error {
+	if !slices.Contains(p.events, event.Type) {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, p.cfg.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(p.cfg.Timeout.Duration)); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	// The server greets with its INFO, which the client has no use for
+	line, err := readNATSLine(r)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+
+	connect, err := json.Marshal(map[string]any{
+		"verbose":    false,
+		"pedantic":   false,
+		"name":       "netx",
+		"lang":       "go",
+		"version":    "1.0.0",
+		"protocol":   0,
+		"user":       p.user,
+		"pass":       p.pass,
+		"auth_token": p.token,
+	})
+	if err != nil {
+		return err
+	}
+
+	subject := p.cfg.SubjectPrefix + "." + event.Type
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "CONNECT %s\r\n", connect)
+	fmt.Fprintf(&msg, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	// The PONG tells the PUB was processed, errors come before it
+	msg.WriteString("PING\r\n")
+	if _, err := conn.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("nats: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
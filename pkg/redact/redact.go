@@ -0,0 +1,35 @@
+package redact
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Mask replaces every Secret value shown to callers without Secret access
+const Mask = "REDACTED"
+
+// kubectl apply keeps a full copy of the object, Secret data included, here
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Object masks obj in place if it is a Secret. Keys are kept so callers can
+// still see what a Secret holds, only the values are replaced.
+func Object(obj *unstructured.Unstructured) {
+	if obj.GetKind() != "Secret" {
+		return
+	}
+
+	for _, field := range []string{"data", "stringData"} {
+		values, ok, _ := unstructured.NestedMap(obj.Object, field)
+		if !ok {
+			continue
+		}
+		for key := range values {
+			values[key] = Mask
+		}
+		unstructured.SetNestedMap(obj.Object, values, field)
+	}
+
+	if annotations := obj.GetAnnotations(); annotations[lastAppliedAnnotation] != "" {
+		annotations[lastAppliedAnnotation] = Mask
+		obj.SetAnnotations(annotations)
+	}
+}
@@ -0,0 +1,25 @@
+package restore
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// EachManifest calls fn with a copy of every object the plan creates or
+// replaces, in restore order and with every transformation applied, exactly
+// as it would be sent to the API server. It stops at the first error.
+func (p *Plan) EachManifest(fn func(*unstructured.Unstructured) error) error {
+	for i := range p.Objects {
+		planned := &p.Objects[i]
+		if planned.Action == ActionSkip || planned.Action == ActionPending {
+			continue
+		}
+		obj, err := p.loadObject(planned)
+		if err != nil {
+			return err
+		}
+		if err := fn(obj.DeepCopy()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"net_exercise/pkg/layout"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// What to do with Pod specs referring to a PriorityClass or RuntimeClass the
+// target cluster does not have
+const (
+	// Restore them unchanged and warn, the API server or scheduler will reject them
+	MissingClassKeep = "keep"
+	// Remove the class from the Pod spec
+	MissingClassStrip = "strip"
+	// Create the class from the copy stored in the backup
+	MissingClassCreate = "create"
+)
+
+var ErrInvalidMissingClassPolicy = errors.New("missing_class_policy must be one of: keep, strip, create")
+
+func (o Options) missingClassPolicy() (string, error) {
+	switch o.MissingClassPolicy {
+	case "", MissingClassKeep:
+		return MissingClassKeep, nil
+	case MissingClassStrip, MissingClassCreate:
+		return o.MissingClassPolicy, nil
+	}
+	return "", ErrInvalidMissingClassPolicy
+}
+
+// classResolver renames the PriorityClass and RuntimeClass references of the
+// restored Pod specs and handles the classes missing from the target cluster.
+type classResolver struct {
+	ctx          context.Context
+	clients      Clients
+	backupLayout layout.Reader
+	policy       string
+	// Class prefix to old name to new name
+	mappings map[string]map[string]string
+
+	// Names of the classes in the target cluster, listed on first use
+	existing map[string]map[string]bool
+	// Classes from the backup planned for creation, keyed by <prefix>/<name>
+	planned map[string]bool
+	objects []PlannedObject
+}
+
+func newClassResolver(ctx context.Context, clients Clients, backupLayout layout.Reader, opts Options) (*classResolver, error) {
+	policy, err := opts.missingClassPolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &classResolver{
+		ctx:          ctx,
+		clients:      clients,
+		backupLayout: backupLayout,
+		policy:       policy,
+		mappings: map[string]map[string]string{
+			layout.PriorityClass: opts.PriorityClassMapping,
+			layout.RuntimeClass:  opts.RuntimeClassMapping,
+		},
+		existing: map[string]map[string]bool{},
+		planned:  map[string]bool{},
+	}, nil
+}
+
+func (r *classResolver) prepare(plan *Plan, obj *unstructured.Unstructured, resource layout.Kind) error {
+	if resource.PodSpec == nil {
+		return nil
+	}
+
+	for _, class := range layout.ClassKinds {
+		name, _, _ := unstructured.NestedString(obj.Object, resource.PodSpecField(class.Field)...)
+		if name == "" {
+			continue
+		}
+
+		if mapped, ok := r.mappings[class.Prefix][name]; ok && mapped != name {
+			name = mapped
+			unstructured.SetNestedField(obj.Object, name, resource.PodSpecField(class.Field)...)
+			r.clearDerived(obj, resource, class)
+		}
+
+		existing, err := r.existingClasses(plan.profiler, class)
+		if err != nil {
+			return err
+		}
+		if existing[name] || r.planned[class.Prefix+"/"+name] {
+			continue
+		}
+
+		ref := fmt.Sprintf("%s/%s uses %s %s, which the target cluster does not have", resource.Kind, obj.GetName(), class.Kind.Kind, name)
+		switch r.policy {
+		case MissingClassKeep:
+			plan.Warnings = append(plan.Warnings, ref)
+		case MissingClassStrip:
+			unstructured.RemoveNestedField(obj.Object, resource.PodSpecField(class.Field)...)
+			r.clearDerived(obj, resource, class)
+			plan.Warnings = append(plan.Warnings, ref+"; removed it from the Pod spec")
+		case MissingClassCreate:
+			classObj, err := r.backedUpClass(class, name)
+			if err != nil {
+				return err
+			}
+			if classObj == nil {
+				plan.Warnings = append(plan.Warnings, ref+" and the backup has no copy of it")
+				continue
+			}
+			r.planned[class.Prefix+"/"+name] = true
+			r.objects = append(r.objects, PlannedObject{
+				Kind:          class.Kind.Kind,
+				Name:          name,
+				Action:        ActionCreate,
+				resource:      class.Kind,
+				object:        classObj,
+				clusterScoped: true,
+			})
+		}
+	}
+	return nil
+}
+
+// clearDerived removes the Pod spec fields admission copied from the old
+// class, it rejects Pods whose values do not match the new one.
+func (r *classResolver) clearDerived(obj *unstructured.Unstructured, resource layout.Kind, class layout.ClassKind) {
+	for _, field := range class.Derived {
+		unstructured.RemoveNestedField(obj.Object, resource.PodSpecField(field)...)
+	}
+}
+
+func (r *classResolver) existingClasses(p *profiler, class layout.ClassKind) (map[string]bool, error) {
+	if names, ok := r.existing[class.Prefix]; ok {
+		return names, nil
+	}
+
+	var list *metav1.PartialObjectMetadataList
+	err := p.api(class.Kind.Kind, "", func() (err error) {
+		list, err = r.clients.Metadata.Resource(class.GVR).List(r.ctx, metav1.ListOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(list.Items))
+	for _, item := range list.Items {
+		names[item.Name] = true
+	}
+	r.existing[class.Prefix] = names
+	return names, nil
+}
+
+// backedUpClass reads the copy of a class stored in the backup, nil if there
+// is none.
+func (r *classResolver) backedUpClass(class layout.ClassKind, name string) (*unstructured.Unstructured, error) {
+	files, err := r.backupLayout.ObjectFiles(class.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if r.backupLayout.ObjectName(file, class.Prefix) != name {
+			continue
+		}
+		obj, err := r.backupLayout.ReadObject(file, class.Kind)
+		if err != nil {
+			return nil, err
+		}
+		obj.SetResourceVersion("")
+		obj.SetUID("")
+		obj.SetManagedFields(nil)
+		return obj, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,17 @@
+package restore
+
+import (
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+)
+
+type Clients struct {
+	// Creates and deletes the restored objects
+	Dynamic dynamic.Interface
+	// Existence checks only need object metadata, which keeps large
+	// Secrets and ConfigMaps from being transferred just to compare names
+	Metadata metadata.Interface
+	// Checks that the target cluster serves every kind in the backup
+	Discovery discovery.DiscoveryInterface
+}
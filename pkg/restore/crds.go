@@ -0,0 +1,109 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// How long to wait for a restored CustomResourceDefinition to be Established
+// before its objects are created
+const crdEstablishTimeout = time.Minute
+
+var ErrCRDNotEstablished = errors.New("CustomResourceDefinition did not become established")
+
+// planCRDs plans the creation of the CustomResourceDefinitions stored in the
+// backup that the target cluster lacks. It returns their names, the kinds
+// they define are not served until they are created.
+func planCRDs(ctx context.Context, clients Clients, backupLayout layout.Reader, p *profiler) ([]PlannedObject, map[string]bool, error) {
+	files, err := backupLayout.ObjectFiles(layout.CustomResourceDefinition)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var objects []PlannedObject
+	created := map[string]bool{}
+	for _, file := range files {
+		obj, err := backupLayout.ReadObject(file, layout.CRDKind)
+		if err != nil {
+			return nil, nil, err
+		}
+		planned := PlannedObject{
+			Kind:          layout.CRDKind.Kind,
+			Name:          obj.GetName(),
+			Action:        ActionCreate,
+			resource:      layout.CRDKind,
+			object:        obj,
+			clusterScoped: true,
+		}
+
+		err = p.api(planned.Kind, planned.Name, func() error {
+			_, err := clients.Metadata.Resource(layout.CRDKind.GVR).Get(ctx, planned.Name, metav1.GetOptions{})
+			return err
+		})
+		switch {
+		case err == nil:
+			// The installed definition wins, it may be newer than the backup
+			planned.Action = ActionSkip
+			planned.Reason = ReasonExists
+		case apierrors.IsNotFound(err):
+			obj.SetResourceVersion("")
+			obj.SetUID("")
+			obj.SetManagedFields(nil)
+			unstructured.RemoveNestedField(obj.Object, "status")
+			created[planned.Name] = true
+		default:
+			return nil, nil, err
+		}
+		objects = append(objects, planned)
+	}
+	return objects, created, nil
+}
+
+// waitEstablished waits until the API server serves the objects of a newly
+// created CustomResourceDefinition.
+func waitEstablished(ctx context.Context, client dynamic.Interface, name string) error {
+	var reason string
+	err := wait.PollUntilContextTimeout(ctx, time.Second, crdEstablishTimeout, true, func(ctx context.Context) (bool, error) {
+		crd, err := client.Resource(layout.CRDKind.GVR).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, _ := c.(map[string]interface{})
+			status, _ := condition["status"].(string)
+			message, _ := condition["message"].(string)
+			switch condition["type"] {
+			case "Established":
+				if status == "True" {
+					return true, nil
+				}
+				reason = message
+			case "NamesAccepted":
+				// Conflicts with the names of another definition never resolve by waiting
+				if status == "False" {
+					return false, fmt.Errorf("%w: %s: names not accepted: %s", ErrCRDNotEstablished, name, message)
+				}
+			}
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		if reason == "" {
+			reason = "no Established condition reported"
+		}
+		return fmt.Errorf("%w: %s within %s: %s", ErrCRDNotEstablished, name, crdEstablishTimeout, reason)
+	}
+	return err
+}
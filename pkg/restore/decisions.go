@@ -0,0 +1,137 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/layout"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Decisions on an object of an interactive restore that was modified since
+// the backup, see Options.Interactive
+const (
+	// Leave the object in the cluster as it is
+	DecisionKeep = "keep"
+	// Delete it and create it from the backup
+	DecisionOverwrite = "overwrite"
+	// Create the backed up object next to it under another name
+	DecisionRename = "rename"
+)
+
+var (
+	ErrDecisionsPending = errors.New("the restore awaits decisions on objects modified since the backup")
+	ErrInvalidDecision  = errors.New("invalid decision")
+	// Overwriting deletes the objects in the cluster, like the replace
+	// policy
+	ErrOverwriteConfirmationRequired = errors.New("overwrite decisions delete existing objects; pass the confirm_token of the paused restore")
+)
+
+// Decision settles what an interactive restore does with one object.
+type Decision struct {
+	// Kind ("ConfigMap") or kind prefix ("configmap")
+	Kind     string `json:"kind" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Decision string `json:"decision" binding:"required"`
+	// Name of the created object, only for DecisionRename
+	NewName string `json:"new_name,omitempty"`
+}
+
+// Pending returns the objects awaiting a decision.
+func (p *Plan) Pending() []PlannedObject {
+	var pending []PlannedObject
+	for _, obj := range p.Objects {
+		if obj.Action == ActionPending {
+			pending = append(pending, obj)
+		}
+	}
+	return pending
+}
+
+// Decide applies decisions to the pending objects of p. Nothing is applied
+// unless every decision is valid. Objects without a decision stay pending.
+// Overwrite decisions need the ConfirmToken of the paused plan.
+func (p *Plan) Decide(decisions []Decision, confirmToken string) error {
+	pending := map[string]int{}
+	for i, obj := range p.Objects {
+		if obj.Action == ActionPending {
+			pending[obj.resource.Prefix+"/"+obj.Name] = i
+		}
+	}
+
+	indexes := make([]int, len(decisions))
+	for n, d := range decisions {
+		k, ok := layout.LookupKind(d.Kind)
+		if !ok {
+			return fmt.Errorf("%w: unknown kind %q", ErrInvalidDecision, d.Kind)
+		}
+		i, ok := pending[k.Prefix+"/"+d.Name]
+		if !ok {
+			return fmt.Errorf("%w: %s/%s is not awaiting a decision", ErrInvalidDecision, k.Kind, d.Name)
+		}
+		switch d.Decision {
+		case DecisionKeep, DecisionOverwrite:
+		case DecisionRename:
+			if errs := validation.IsDNS1123Subdomain(d.NewName); len(errs) > 0 {
+				return fmt.Errorf("%w: new_name of %s/%s: %s", ErrInvalidDecision, k.Kind, d.Name, strings.Join(errs, ", "))
+			}
+		default:
+			return fmt.Errorf("%w: decision for %s/%s must be one of: keep, overwrite, rename", ErrInvalidDecision, k.Kind, d.Name)
+		}
+		indexes[n] = i
+	}
+	overwrite := slices.ContainsFunc(decisions, func(d Decision) bool { return d.Decision == DecisionOverwrite })
+	if overwrite && (p.ConfirmToken == "" || confirmToken != p.ConfirmToken) {
+		return ErrOverwriteConfirmationRequired
+	}
+
+	// Renamed objects are read first, a spill file that can't be read leaves
+	// the plan as it is
+	renamed := map[int]*unstructured.Unstructured{}
+	for n, d := range decisions {
+		if d.Decision == DecisionRename {
+			obj, err := p.loadObject(&p.Objects[indexes[n]])
+			if err != nil {
+				return err
+			}
+			renamed[n] = obj
+		}
+	}
+
+	for n, d := range decisions {
+		planned := &p.Objects[indexes[n]]
+		switch d.Decision {
+		case DecisionKeep:
+			planned.Action = ActionSkip
+		case DecisionOverwrite:
+			planned.Action = ActionReplace
+		case DecisionRename:
+			planned.Action = ActionCreate
+			planned.RenamedFrom = planned.Name
+			planned.Name = d.NewName
+			renamed[n].SetName(d.NewName)
+			if err := p.storeObject(planned, renamed[n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Resume executes the plan of a restore RestoreResources paused with
+// ErrDecisionsPending, once Decide settled every pending object, and closes
+// it.
+func Resume(ctx context.Context, result *Result, clients Clients) error {
+	if len(result.Plan.Pending()) > 0 {
+		return ErrDecisionsPending
+	}
+	defer result.Plan.Close()
+	err := executePlan(ctx, result.Plan, result.Plan.Namespace, clients, result)
+	result.Profile = result.Plan.profiler.profile()
+	return err
+}
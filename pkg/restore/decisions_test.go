@@ -0,0 +1,83 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"net_exercise/pkg/layout"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Overwriting an object of a paused restore deletes it, which takes the
+// confirm token the paused plan reports.
+func TestDecideOverwrite(t *testing.T) {
+	configMap, _ := layout.LookupKind("ConfigMap")
+	backupTime := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name       string
+		decision   string
+		token      func(plan *Plan) string
+		wantErr    error
+		wantAction Action
+	}{
+		{name: "overwrite with the token", decision: DecisionOverwrite, token: func(plan *Plan) string { return plan.ConfirmToken }, wantAction: ActionReplace},
+		{name: "overwrite without a token", decision: DecisionOverwrite, token: func(*Plan) string { return "" }, wantErr: ErrOverwriteConfirmationRequired, wantAction: ActionPending},
+		{name: "overwrite with another token", decision: DecisionOverwrite, token: func(*Plan) string { return "0123456789abcdef0123456789abcdef" }, wantErr: ErrOverwriteConfirmationRequired, wantAction: ActionPending},
+		{name: "keep without a token", decision: DecisionKeep, token: func(*Plan) string { return "" }, wantAction: ActionSkip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backupDir := t.TempDir()
+			writeTestBackup(t, backupDir, newObject(configMap, "source", "settings", map[string]any{"data": map[string]any{"mode": "backup"}}))
+			drifted := newObject(configMap, "target", "settings", nil)
+			drifted.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl-edit", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: time.Now()}}})
+
+			result, err := RestoreResources(context.Background(), backupDir, "target", newTestClients(t, drifted), Options{Interactive: true, BackupTime: backupTime})
+			if !errors.Is(err, ErrDecisionsPending) {
+				t.Fatalf("RestoreResources() error = %v, want %v", err, ErrDecisionsPending)
+			}
+			plan := result.Plan
+			defer plan.Close()
+			if plan.ConfirmToken == "" {
+				t.Fatal("paused plan has no confirm token")
+			}
+
+			err = plan.Decide([]Decision{{Kind: "ConfigMap", Name: "settings", Decision: tt.decision}}, tt.token(plan))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decide() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := plan.Objects[0].Action; got != tt.wantAction {
+				t.Errorf("action = %s, want %s", got, tt.wantAction)
+			}
+		})
+	}
+}
+
+// The token of a paused plan differs from the one of a plan that replaces
+// the same objects without asking, which the caller may have confirmed.
+func TestPausedConfirmTokenDiffers(t *testing.T) {
+	configMap, _ := layout.LookupKind("ConfigMap")
+	backupDir := t.TempDir()
+	writeTestBackup(t, backupDir, newObject(configMap, "source", "settings", nil))
+	existing := []*unstructured.Unstructured{newObject(configMap, "target", "settings", nil)}
+	existing[0].SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl-edit", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: time.Now()}}})
+
+	replace, err := BuildPlan(context.Background(), backupDir, "target", newTestClients(t, existing...), Options{ExistingResourcePolicy: PolicyReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replace.Close()
+	result, err := RestoreResources(context.Background(), backupDir, "target", newTestClients(t, existing...), Options{Interactive: true, BackupTime: time.Now().Add(-time.Hour)})
+	if !errors.Is(err, ErrDecisionsPending) {
+		t.Fatalf("RestoreResources() error = %v, want %v", err, ErrDecisionsPending)
+	}
+	defer result.Plan.Close()
+	if result.Plan.ConfirmToken == replace.ConfirmToken {
+		t.Error("paused plan has the confirm token of the replace plan")
+	}
+}
@@ -0,0 +1,121 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"net_exercise/pkg/layout"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var ErrInvalidFilter = errors.New("invalid restore filter")
+
+// Filter restores only some of the objects of a backup. Objects it leaves
+// out are not part of the plan at all. An empty Filter restores everything.
+type Filter struct {
+	// Kinds, as prefixes or Kinds, to restore; every kind if empty
+	IncludeTypes []string `json:"include_types,omitempty"`
+	// Kinds left out, also when listed in IncludeTypes
+	ExcludeTypes []string `json:"exclude_types,omitempty"`
+	// Names of the objects to restore, or path.Match patterns such as
+	// "web-*"; every name if empty
+	Names []string `json:"names,omitempty"`
+	// Only objects matching this label selector are restored
+	LabelSelector string `json:"label_selector,omitempty"`
+}
+
+func (f Filter) Validate() error {
+	_, err := f.compile()
+	return err
+}
+
+// compiledFilter is a Filter with its kinds looked up and selector parsed.
+type compiledFilter struct {
+	// Kind prefixes, nil for every kind
+	include  map[string]bool
+	exclude  map[string]bool
+	names    []string
+	selector labels.Selector
+}
+
+func (f Filter) compile() (*compiledFilter, error) {
+	c := &compiledFilter{exclude: map[string]bool{}, names: f.Names}
+	kinds := func(names []string, into map[string]bool) error {
+		for _, name := range names {
+			k, ok := layout.LookupKind(name)
+			if !ok {
+				return fmt.Errorf("%w: unknown kind %q", ErrInvalidFilter, name)
+			}
+			into[k.Prefix] = true
+		}
+		return nil
+	}
+	if len(f.IncludeTypes) > 0 {
+		c.include = map[string]bool{}
+		if err := kinds(f.IncludeTypes, c.include); err != nil {
+			return nil, err
+		}
+	}
+	if err := kinds(f.ExcludeTypes, c.exclude); err != nil {
+		return nil, err
+	}
+	for _, name := range f.Names {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("%w: name pattern %q: %v", ErrInvalidFilter, name, err)
+		}
+	}
+	selector, err := labels.Parse(f.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: label_selector: %v", ErrInvalidFilter, err)
+	}
+	c.selector = selector
+	return c, nil
+}
+
+// kindFiltered reports whether the filter leaves out any kind.
+func (c *compiledFilter) kindFiltered() bool {
+	return c.include != nil || len(c.exclude) > 0
+}
+
+func (c *compiledFilter) selectsKind(k layout.Kind) bool {
+	return (c.include == nil || c.include[k.Prefix]) && !c.exclude[k.Prefix]
+}
+
+func (c *compiledFilter) selects(obj *unstructured.Unstructured) bool {
+	if !c.selector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+	if len(c.names) == 0 {
+		return true
+	}
+	for _, pattern := range c.names {
+		if matched, _ := path.Match(pattern, obj.GetName()); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedCRDs leaves out the definitions of custom kinds the filter leaves
+// out, nothing would be restored of them.
+func (c *compiledFilter) selectedCRDs(crds []PlannedObject, kinds []layout.Kind) []PlannedObject {
+	if !c.kindFiltered() {
+		return crds
+	}
+	restored := map[string]bool{}
+	for _, k := range kinds {
+		if k.Custom {
+			restored[k.CRDName()] = true
+		}
+	}
+	var selected []PlannedObject
+	for _, crd := range crds {
+		if restored[crd.Name] {
+			selected = append(selected, crd)
+		}
+	}
+	return selected
+}
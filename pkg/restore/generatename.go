@@ -0,0 +1,41 @@
+package restore
+
+import (
+	"errors"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// What to do with objects whose name was generated from metadata.generateName,
+// typically created by operators. Their recorded name means nothing to the
+// operator, which may already have created a replacement under another name.
+const (
+	// Restore them under the recorded name, like any other object
+	GenerateNameKeep = "keep"
+	// Leave them out, for operators that recreate them
+	GenerateNameSkip = "skip"
+	// Create them under a new name generated from generateName
+	GenerateNameRegenerate = "regenerate"
+)
+
+// Reason for skipping objects with a generated name
+const ReasonGeneratedName = "generated-name"
+
+var ErrInvalidGenerateNamePolicy = errors.New("generate_name_policy must be one of: keep, skip, regenerate")
+
+func (o Options) generateNamePolicy() (string, error) {
+	switch o.GenerateNamePolicy {
+	case "", GenerateNameKeep:
+		return GenerateNameKeep, nil
+	case GenerateNameSkip, GenerateNameRegenerate:
+		return o.GenerateNamePolicy, nil
+	}
+	return "", ErrInvalidGenerateNamePolicy
+}
+
+// hasGeneratedName reports whether the API server generated the name of obj.
+func hasGeneratedName(obj *unstructured.Unstructured) bool {
+	prefix := obj.GetGenerateName()
+	return prefix != "" && strings.HasPrefix(obj.GetName(), prefix)
+}
@@ -0,0 +1,66 @@
+package restore
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// Restore GitOps managed objects and list them as plan warnings
+	GitOpsWarn = "warn"
+	// Leave GitOps managed objects to their controller
+	GitOpsSkip = "skip"
+	// Restore them with annotations that stop the controller from pruning or reverting them
+	GitOpsPause = "pause"
+)
+
+const (
+	gitOpsArgoCD = "argocd"
+	gitOpsFlux   = "flux"
+)
+
+// Labels and annotations the controllers put on the objects they manage
+var gitOpsMarkers = []struct {
+	manager    string
+	key        string
+	annotation bool
+}{
+	{gitOpsArgoCD, "argocd.argoproj.io/instance", false},
+	{gitOpsArgoCD, "argocd.argoproj.io/tracking-id", true},
+	{gitOpsFlux, "kustomize.toolkit.fluxcd.io/name", false},
+	{gitOpsFlux, "helm.toolkit.fluxcd.io/name", false},
+}
+
+// gitOpsManager returns which GitOps controller manages obj, if any.
+func gitOpsManager(obj *unstructured.Unstructured) string {
+	labels := obj.GetLabels()
+	annotations := obj.GetAnnotations()
+
+	for _, marker := range gitOpsMarkers {
+		values := labels
+		if marker.annotation {
+			values = annotations
+		}
+		if _, ok := values[marker.key]; ok {
+			return marker.manager
+		}
+	}
+	return ""
+}
+
+func pauseReconciliation(obj *unstructured.Unstructured, manager string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	switch manager {
+	case gitOpsArgoCD:
+		// https://argo-cd.readthedocs.io/en/stable/user-guide/sync-options/
+		annotations["argocd.argoproj.io/sync-options"] = "Prune=false"
+		annotations["argocd.argoproj.io/compare-options"] = "IgnoreExtraneous"
+	case gitOpsFlux:
+		// https://fluxcd.io/flux/components/kustomize/kustomizations/#reconciliation
+		annotations["kustomize.toolkit.fluxcd.io/reconcile"] = "disabled"
+	}
+	obj.SetAnnotations(annotations)
+}
@@ -0,0 +1,175 @@
+package restore
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"net_exercise/pkg/layout"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// testdata/objects holds an object of every kind as the API server returns
+// it, testdata/golden the object a restore creates from its backup.
+const (
+	objectsDir = "testdata/objects"
+	goldenDir  = "testdata/golden"
+)
+
+// Kinds whose status the restore drops, the others keep it and the API
+// server ignores it on create
+var statusDropped = []string{
+	layout.Pod, layout.ReplicationController, layout.HPA, layout.PDB, layout.Job,
+	layout.CronJob, layout.DataVolume, layout.VirtualMachine,
+}
+
+// backupObject serializes the object in file like a backup does: built-in
+// kinds as typed list items, without apiVersion and kind, custom kinds as
+// they are.
+func backupObject(t *testing.T, k layout.Kind, file string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Custom {
+		return data
+	}
+
+	typed, err := scheme.Scheme.New(k.GVR.GroupVersion().WithKind(k.Kind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, typed); err != nil {
+		t.Fatal(err)
+	}
+	typed.GetObjectKind().SetGroupVersionKind(k.GVR.GroupVersion().WithKind(""))
+	if data, err = json.MarshalIndent(typed, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Every kind is serialized by the backup, read back and sanitized by the
+// restore and compared with its golden file. Run with -update after changing
+// what restores strip.
+func TestReadObjectGolden(t *testing.T) {
+	for _, k := range layout.Kinds {
+		t.Run(k.Prefix, func(t *testing.T) {
+			backupDir := t.TempDir()
+			if err := layout.WriteObject(backupDir, k.Prefix, "obj", backupObject(t, k, filepath.Join(objectsDir, k.Prefix+".json"))); err != nil {
+				t.Fatal(err)
+			}
+
+			obj, err := readObject(layout.Current(backupDir), layout.ObjectFile(backupDir, k.Prefix, "obj"), "target", k, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(obj.Object, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join(goldenDir, k.Prefix+".json")
+			if *updateGolden {
+				if err := os.MkdirAll(goldenDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("restored %s differs from %s:\n%s", k.Kind, golden, got)
+			}
+
+			// The restored object has to decode into its API type, a field
+			// the type doesn't know is rejected by the API server
+			if k.Custom {
+				return
+			}
+			typed, err := scheme.Scheme.New(k.GVR.GroupVersion().WithKind(k.Kind))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructuredWithValidation(obj.Object, typed, true); err != nil {
+				t.Errorf("restored %s does not decode: %v", k.Kind, err)
+			}
+		})
+	}
+}
+
+// FuzzReadObject feeds arbitrary object files to the restore's sanitizer,
+// which must neither panic nor return objects that would be created with the
+// identity of the backed up object.
+func FuzzReadObject(f *testing.F) {
+	for i, k := range layout.Kinds {
+		data, err := os.ReadFile(filepath.Join(objectsDir, k.Prefix+".json"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(uint8(i), data)
+	}
+	f.Add(uint8(0), []byte(`{"metadata": "shop"}`))
+	f.Add(uint8(0), []byte(`null`))
+
+	f.Fuzz(func(t *testing.T, kindIndex uint8, data []byte) {
+		k := layout.Kinds[int(kindIndex)%len(layout.Kinds)]
+		backupDir := t.TempDir()
+		if err := layout.WriteObject(backupDir, k.Prefix, "obj", data); err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := readObject(layout.Current(backupDir), layout.ObjectFile(backupDir, k.Prefix, "obj"), "target", k, nil)
+		if err != nil {
+			return
+		}
+
+		if obj.GetAPIVersion() != k.GVR.GroupVersion().String() || obj.GetKind() != k.Kind {
+			t.Errorf("object is a %s %s, want %s", obj.GetAPIVersion(), obj.GetKind(), k.Kind)
+		}
+		if obj.GetNamespace() != "target" {
+			t.Errorf("object is in namespace %q, want target", obj.GetNamespace())
+		}
+		if obj.GetResourceVersion() != "" || obj.GetUID() != "" {
+			t.Errorf("object keeps resourceVersion %q and uid %q", obj.GetResourceVersion(), obj.GetUID())
+		}
+
+		backedUp := &unstructured.Unstructured{}
+		if json.Unmarshal(data, &backedUp.Object) == nil {
+			if uid := backedUp.GetUID(); uid != "" && obj.GetAnnotations()[OriginalUIDAnnotation] != string(uid) {
+				t.Errorf("object has original UID %q, want %q", obj.GetAnnotations()[OriginalUIDAnnotation], uid)
+			}
+		}
+
+		for _, prefix := range statusDropped {
+			if _, ok := obj.Object["status"]; ok && prefix == k.Prefix {
+				t.Errorf("%s keeps its status", k.Kind)
+			}
+		}
+		switch k.Prefix {
+		case layout.Pod:
+			if _, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "ephemeralContainers"); ok {
+				t.Error("Pod keeps its ephemeral containers")
+			}
+		case layout.Service:
+			if _, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "clusterIP"); ok {
+				t.Error("Service keeps its cluster IP")
+			}
+		}
+	})
+}
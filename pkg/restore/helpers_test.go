@@ -0,0 +1,125 @@
+package restore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newTestClients returns fake clients of a cluster serving every kind of
+// layout.Kinds, in which objects exist. The fakes don't share their objects:
+// objects are only known to the metadata client, which restores find and
+// delete existing objects with, and restores create objects with the
+// dynamic client.
+func newTestClients(t *testing.T, objects ...*unstructured.Unstructured) Clients {
+	t.Helper()
+
+	listKinds := map[schema.GroupVersionResource]string{
+		namespaceGVR:                "NamespaceList",
+		layout.CRDKind.GVR:          "CustomResourceDefinitionList",
+		layout.PVKind.GVR:           "PersistentVolumeList",
+		layout.StorageClassKind.GVR: "StorageClassList",
+	}
+	resources := map[string][]metav1.APIResource{}
+	for _, k := range layout.Kinds {
+		listKinds[k.GVR] = k.Kind + "List"
+		gv := k.GVR.GroupVersion().String()
+		resources[gv] = append(resources[gv], metav1.APIResource{Name: k.GVR.Resource, Kind: k.Kind, Namespaced: true})
+	}
+	for _, k := range layout.ClassKinds {
+		listKinds[k.GVR] = k.Kind.Kind + "List"
+	}
+
+	var metadataObjects []runtime.Object
+	for _, obj := range objects {
+		metadataObjects = append(metadataObjects, &metav1.PartialObjectMetadata{
+			TypeMeta: metav1.TypeMeta{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind()},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              obj.GetName(),
+				Namespace:         obj.GetNamespace(),
+				Labels:            obj.GetLabels(),
+				Annotations:       obj.GetAnnotations(),
+				ResourceVersion:   obj.GetResourceVersion(),
+				CreationTimestamp: obj.GetCreationTimestamp(),
+				ManagedFields:     obj.GetManagedFields(),
+			},
+		})
+	}
+
+	metadataScheme := metadatafake.NewTestScheme()
+	if err := metav1.AddMetaToScheme(metadataScheme); err != nil {
+		t.Fatal(err)
+	}
+
+	discovery := &discoveryfake.FakeDiscovery{
+		Fake:               &clienttesting.Fake{},
+		FakedServerVersion: &version.Info{GitVersion: "v1.29.3"},
+	}
+	for gv, list := range resources {
+		discovery.Resources = append(discovery.Resources, &metav1.APIResourceList{GroupVersion: gv, APIResources: list})
+	}
+
+	return Clients{
+		Dynamic:   dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds),
+		Metadata:  metadatafake.NewSimpleMetadataClient(metadataScheme, metadataObjects...),
+		Discovery: discovery,
+	}
+}
+
+// newObject returns an object of kind k in namespace.
+func newObject(k layout.Kind, namespace, name string, fields map[string]any) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]any{}}
+	for key, value := range fields {
+		obj.Object[key] = value
+	}
+	obj.SetAPIVersion(k.GVR.GroupVersion().String())
+	obj.SetKind(k.Kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+// writeTestBackup writes objects to backupDir as a backup of the current
+// layout with a manifest, the way backups are written.
+func writeTestBackup(t *testing.T, backupDir string, objects ...*unstructured.Unstructured) {
+	t.Helper()
+
+	m := manifest.Manifest{LayoutVersion: layout.CurrentVersion, Namespace: "source", Counts: map[string]int{}}
+	for _, obj := range objects {
+		k, ok := layout.LookupKind(obj.GetKind())
+		if !ok {
+			t.Fatalf("unknown kind %s", obj.GetKind())
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := layout.WriteObject(backupDir, k.Prefix, obj.GetName(), data); err != nil {
+			t.Fatal(err)
+		}
+		if m.Counts[k.Prefix] == 0 {
+			m.Kinds = append(m.Kinds, k.Prefix)
+		}
+		m.Counts[k.Prefix]++
+	}
+
+	var err error
+	if m.Checksums, err = manifest.Checksums(backupDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Write(backupDir, m); err != nil {
+		t.Fatal(err)
+	}
+}
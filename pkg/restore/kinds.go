@@ -0,0 +1,102 @@
+package restore
+
+import (
+	"slices"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/layout"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Optional kind specific cleanup applied before an object is created
+var prepareFuncs = map[string]func(obj *unstructured.Unstructured){
+	layout.Pod:                   preparePod,
+	layout.Service:               prepareService,
+	layout.ReplicationController: dropStatus,
+	layout.HPA:                   dropStatus,
+	layout.PDB:                   dropStatus,
+	layout.Job:                   prepareJob,
+	layout.CronJob:               prepareCronJob,
+	layout.DataVolume:            prepareKubeVirt,
+	layout.VirtualMachine:        prepareKubeVirt,
+}
+
+func prepareKubeVirt(obj *unstructured.Unstructured) {
+	// Set by CDI and KubeVirt, they start over on the restored object
+	unstructured.RemoveNestedField(obj.Object, "status")
+}
+
+func preparePod(obj *unstructured.Unstructured) {
+	// Pods backed up while someone was running kubectl debug carry ephemeral
+	// containers, which can only be added through the ephemeralcontainers
+	// subresource and make the create fail validation
+	unstructured.RemoveNestedField(obj.Object, "spec", "ephemeralContainers")
+
+	// The status is ignored on create, drop it along with the debug containers' statuses
+	unstructured.RemoveNestedField(obj.Object, "status")
+}
+
+// Labels the Job controller adds to the Pod template, naming the UID of the
+// backed up Job
+var jobControllerLabels = []string{"controller-uid", "batch.kubernetes.io/controller-uid"}
+
+func prepareJob(obj *unstructured.Unstructured) {
+	// The generated selector matches the old Job's UID and is rejected on
+	// create, the controller generates a new one
+	if manual, _, _ := unstructured.NestedBool(obj.Object, "spec", "manualSelector"); !manual {
+		unstructured.RemoveNestedField(obj.Object, "spec", "selector")
+		for _, label := range jobControllerLabels {
+			unstructured.RemoveNestedField(obj.Object, "spec", "template", "metadata", "labels", label)
+		}
+	}
+	unstructured.RemoveNestedField(obj.Object, "status")
+}
+
+func prepareCronJob(obj *unstructured.Unstructured) {
+	// lastScheduleTime and the active Jobs refer to the source cluster, the
+	// restored CronJob schedules from scratch
+	unstructured.RemoveNestedField(obj.Object, "status")
+}
+
+// dropStatus removes the status of kinds whose controller computes it afresh.
+func dropStatus(obj *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(obj.Object, "status")
+}
+
+func prepareService(obj *unstructured.Unstructured) {
+	// Unset the IP to allow dynamic allocation
+	unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+
+	// Remove the clusterIPs field
+	unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+}
+
+// applyFinalizerRules strips or renames the finalizers of obj. Finalizers no
+// rule matches are kept.
+func applyFinalizerRules(obj *unstructured.Unstructured, rules []config.FinalizerRule) {
+	finalizers := obj.GetFinalizers()
+	if len(finalizers) == 0 || len(rules) == 0 {
+		return
+	}
+
+	var kept []string
+	for _, finalizer := range finalizers {
+		for _, rule := range rules {
+			if !rule.Matches(finalizer) {
+				continue
+			}
+			switch rule.Action {
+			case config.FinalizerStrip:
+				finalizer = ""
+			case config.FinalizerRename:
+				finalizer = rule.To
+			}
+			break
+		}
+		if finalizer != "" && !slices.Contains(kept, finalizer) {
+			kept = append(kept, finalizer)
+		}
+	}
+	obj.SetFinalizers(kept)
+}
@@ -0,0 +1,152 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	shopContainer     = map[string]any{"name": "shop", "image": "registry.example.com/shop:1.4.2"}
+	debuggerContainer = map[string]any{"name": "debugger-x7k2p", "image": "busybox:1.36", "targetContainerName": "shop"}
+)
+
+func TestPreparePod(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]any
+	}{
+		{
+			name: "debugged",
+			fields: map[string]any{
+				"spec": map[string]any{
+					"containers":          []any{shopContainer},
+					"ephemeralContainers": []any{debuggerContainer},
+				},
+				"status": map[string]any{
+					"phase":                      "Running",
+					"ephemeralContainerStatuses": []any{map[string]any{"name": "debugger-x7k2p", "ready": false}},
+				},
+			},
+		},
+		{
+			name:   "never debugged",
+			fields: map[string]any{"spec": map[string]any{"containers": []any{shopContainer}}},
+		},
+		{
+			name: "ephemeral containers of the wrong type",
+			fields: map[string]any{
+				"spec": map[string]any{"containers": []any{shopContainer}, "ephemeralContainers": "debugger-x7k2p"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod, _ := layout.LookupKind(layout.Pod)
+			obj := newObject(pod, "source", "shop", tt.fields)
+
+			preparePod(obj)
+
+			want := map[string]any{"containers": []any{shopContainer}}
+			if spec, _, _ := unstructured.NestedMap(obj.Object, "spec"); !reflect.DeepEqual(spec, want) {
+				t.Errorf("spec = %v, want %v", spec, want)
+			}
+			if _, ok := obj.Object["status"]; ok {
+				t.Error("status was not dropped")
+			}
+		})
+	}
+}
+
+// rejectPodCreates makes the fake API server validate Pods like the real one
+// does: ephemeral containers can only be added through their subresource.
+// Pods named in denied are refused by admission.
+func rejectPodCreates(clients Clients, denied ...string) {
+	podGVR := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	clients.Dynamic.(*dynamicfake.FakeDynamicClient).PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj := action.(clienttesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		if _, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "ephemeralContainers"); ok {
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, obj.GetName(), field.ErrorList{
+				field.Forbidden(field.NewPath("spec", "ephemeralContainers"), "cannot be set on create"),
+			})
+		}
+		for _, name := range denied {
+			if obj.GetName() == name {
+				return true, nil, apierrors.NewForbidden(podGVR.GroupResource(), name, errors.New("violates PodSecurity \"restricted:latest\""))
+			}
+		}
+		return false, nil, nil
+	})
+}
+
+// Pods that were being debugged when the backup was taken are restored
+// without their debug containers. Pods the API server rejects fail the
+// restore with its error.
+func TestRestoreDebuggedPod(t *testing.T) {
+	pod, _ := layout.LookupKind(layout.Pod)
+	debugged := map[string]any{
+		"spec": map[string]any{
+			"containers":          []any{shopContainer},
+			"ephemeralContainers": []any{debuggerContainer},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		denied      []string
+		wantErr     string
+		wantOutcome Outcome
+	}{
+		{name: "restored", wantOutcome: OutcomeCreated},
+		{name: "rejected", denied: []string{"shop"}, wantErr: "violates PodSecurity", wantOutcome: OutcomeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backupDir := t.TempDir()
+			writeTestBackup(t, backupDir, newObject(pod, "source", "shop", debugged))
+			clients := newTestClients(t)
+			rejectPodCreates(clients, tt.denied...)
+
+			result, err := RestoreResources(ctx, backupDir, "target", clients, Options{})
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("RestoreResources() error = %v, want %q", err, tt.wantErr)
+			}
+			planned := result.Plan.Objects[0]
+			if planned.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %s, want %s", planned.Outcome, tt.wantOutcome)
+			}
+			if tt.wantErr != "" {
+				if !strings.Contains(planned.Error, tt.wantErr) {
+					t.Errorf("object error = %q, want %q", planned.Error, tt.wantErr)
+				}
+				return
+			}
+
+			restored, err := clients.Dynamic.Resource(pod.GVR).Namespace("target").Get(ctx, "shop", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			containers, _, _ := unstructured.NestedSlice(restored.Object, "spec", "containers")
+			if !reflect.DeepEqual(containers, []any{shopContainer}) {
+				t.Errorf("restored containers = %v, want %v", containers, []any{shopContainer})
+			}
+		})
+	}
+}
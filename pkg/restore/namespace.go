@@ -0,0 +1,48 @@
+package restore
+
+import (
+	"context"
+
+	"net_exercise/pkg/manifest"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var namespaceGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+// ensureNamespace creates namespace unless it exists, with the labels and
+// annotations the backed up namespace had. It reports whether it created it.
+func ensureNamespace(ctx context.Context, clients Clients, namespace string, source *manifest.NamespaceMetadata) (bool, error) {
+	_, err := clients.Metadata.Resource(namespaceGVR).Get(ctx, namespace, metav1.GetOptions{})
+	if err == nil {
+		return false, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(namespace)
+	if source != nil {
+		// The API server sets the name label to the new name
+		labels := map[string]string{}
+		for key, value := range source.Labels {
+			if key != namespaceNameLabel {
+				labels[key] = value
+			}
+		}
+		ns.SetLabels(labels)
+		ns.SetAnnotations(source.Annotations)
+	}
+
+	_, err = clients.Dynamic.Resource(namespaceGVR).Create(ctx, ns, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
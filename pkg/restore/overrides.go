@@ -0,0 +1,46 @@
+package restore
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// applyConfigMapOverrides merges the override keys for the ConfigMap obj into
+// its data, replacing the backed up values. It reports whether obj had any.
+func applyConfigMapOverrides(obj *unstructured.Unstructured, overrides map[string]map[string]string) bool {
+	keys, ok := overrides[obj.GetName()]
+	if !ok {
+		return false
+	}
+
+	data, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+	if data == nil {
+		data = map[string]string{}
+	}
+	binaryData, _, _ := unstructured.NestedMap(obj.Object, "binaryData")
+	for key, value := range keys {
+		data[key] = value
+		// A key may only be in one of data and binaryData
+		delete(binaryData, key)
+	}
+	unstructured.SetNestedStringMap(obj.Object, data, "data")
+	if binaryData != nil {
+		unstructured.SetNestedMap(obj.Object, binaryData, "binaryData")
+	}
+	return true
+}
+
+// unusedConfigMapOverrides warns about overrides for ConfigMaps the backup
+// doesn't have, most likely a typo in the name.
+func unusedConfigMapOverrides(overrides map[string]map[string]string, applied map[string]bool) []string {
+	var warnings []string
+	for name := range overrides {
+		if !applied[name] {
+			warnings = append(warnings, fmt.Sprintf("ConfigMap/%s has overrides but is not in the backup", name))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
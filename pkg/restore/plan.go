@@ -0,0 +1,518 @@
+package restore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/drift"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// Leave objects that already exist in the target namespace untouched
+	PolicySkip = "skip"
+	// Delete objects that already exist in the target namespace and create them from the backup
+	PolicyReplace = "replace"
+	// Like skip, but also report existing objects that were modified since the backup
+	PolicyRepair = "repair"
+)
+
+type Action string
+
+const (
+	ActionCreate  Action = "create"
+	ActionSkip    Action = "skip"
+	ActionReplace Action = "replace"
+	// Modified since the backup, waits for a Decision of an interactive restore
+	ActionPending Action = "pending"
+)
+
+var (
+	ErrInvalidPolicy        = errors.New("existing_resource_policy must be one of: skip, replace, repair")
+	ErrInvalidGitOpsMode    = errors.New("gitops_mode must be one of: warn, skip, pause")
+	ErrInvalidRestoreOrder  = errors.New("restore_order must list supported kinds, each once")
+	ErrConfirmationRequired = errors.New("existing_resource_policy=replace deletes existing objects; pass the confirm_token returned by the restore plan")
+)
+
+type Options struct {
+	ExistingResourcePolicy string
+	// Token returned by BuildPlan, required before any object is deleted
+	ConfirmToken string
+	// How to treat objects managed by Argo CD or Flux, GitOpsWarn by default
+	GitOpsMode string
+	// When the backup was taken, PolicyRepair reports objects written to after it
+	BackupTime time.Time
+	// Pause the restore when objects were modified since the backup instead
+	// of skipping them, until Plan.Decide settles each one. Has no effect
+	// with PolicyReplace.
+	Interactive bool
+	// PriorityClass and RuntimeClass renames applied to every Pod spec
+	PriorityClassMapping map[string]string
+	RuntimeClassMapping  map[string]string
+	// How to handle classes missing from the target cluster, MissingClassKeep
+	// by default. Also applies to StorageClasses.
+	MissingClassPolicy string
+	// StorageClass renames applied to every PVC and created PersistentVolume
+	StorageClassMapping map[string]string
+	// How to handle PVCs bound to volumes missing from the target cluster,
+	// VolumeKeep by default
+	VolumePolicy string
+	// Provision the restored PVCs from the CSI snapshots in the backup
+	RestoreSnapshots bool
+	FinalizerRules   []config.FinalizerRule
+	// ConfigMap name to keys merged into its data, replacing the backed up values
+	ConfigMapOverrides map[string]map[string]string
+	// Namespace the backup was taken from, references to it are reported
+	// when restoring into another namespace
+	SourceNamespace string
+	// How to restore objects with a generated name, GenerateNameKeep by default
+	GenerateNamePolicy string
+	// Kinds, as prefixes or Kinds, restored first and in this order. The
+	// others follow in the order of layout.Kinds.
+	RestoreOrder []string
+	// Objects of the backup to restore, all by default
+	Filter Filter
+	// Create the target namespace if it doesn't exist, with the labels and
+	// annotations of the backed up namespace. Only RestoreResources creates
+	// it, plans are built as if it existed empty.
+	CreateNamespace bool
+}
+
+func (o Options) gitOpsMode() (string, error) {
+	switch o.GitOpsMode {
+	case "", GitOpsWarn:
+		return GitOpsWarn, nil
+	case GitOpsSkip, GitOpsPause:
+		return o.GitOpsMode, nil
+	}
+	return "", ErrInvalidGitOpsMode
+}
+
+func (o Options) policy() (string, error) {
+	switch o.ExistingResourcePolicy {
+	case "", PolicySkip:
+		return PolicySkip, nil
+	case PolicyReplace, PolicyRepair:
+		return o.ExistingResourcePolicy, nil
+	}
+	return "", ErrInvalidPolicy
+}
+
+// Set on every restored object to the UID it had in the backup
+const OriginalUIDAnnotation = "netx.io/original-uid"
+
+// Reasons for ActionSkip
+const (
+	ReasonExists        = "exists"
+	ReasonDrifted       = "drifted"
+	ReasonGitOpsManaged = "gitops-managed"
+)
+
+type PlannedObject struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	// GitOps controller managing the object, "argocd" or "flux"
+	GitOps string `json:"gitops,omitempty"`
+	// Set when the name was generated from this prefix
+	GenerateName string `json:"generate_name,omitempty"`
+	// Name in the backup, when a Decision created the object under Name
+	RenamedFrom string `json:"renamed_from,omitempty"`
+	// What executing the plan did, see Outcome. Empty for objects it did
+	// not get to.
+	Outcome Outcome `json:"outcome,omitempty"`
+	Error   string  `json:"error,omitempty"`
+
+	resource layout.Kind
+	// Either the object, or where it is in the spill file of the plan, see
+	// Plan.loadObject
+	object        *unstructured.Unstructured
+	spilled       *spilledObject
+	clusterScoped bool
+}
+
+type Plan struct {
+	Namespace              string          `json:"namespace"`
+	ExistingResourcePolicy string          `json:"existing_resource_policy"`
+	Objects                []PlannedObject `json:"objects"`
+	Warnings               []string        `json:"warnings,omitempty"`
+	// Values of the restored objects still referring to the source namespace
+	NamespaceReferences []NamespaceReference `json:"namespace_references,omitempty"`
+	// Only set when the plan deletes existing objects, or when a paused
+	// restore awaits decisions: overwriting its objects deletes them
+	ConfirmToken string `json:"confirm_token,omitempty"`
+
+	// Identifies the backup in ConfirmToken
+	backupID string
+	profiler *profiler
+	// Set for backups of more than spillThreshold objects
+	spill *spill
+}
+
+func BuildPlan(ctx context.Context, backupDir, namespace string, clients Clients, opts Options) (*Plan, error) {
+	policy, err := opts.policy()
+	if err != nil {
+		return nil, err
+	}
+	gitOpsMode, err := opts.gitOpsMode()
+	if err != nil {
+		return nil, err
+	}
+	generateNamePolicy, err := opts.generateNamePolicy()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := opts.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Namespace:              namespace,
+		ExistingResourcePolicy: policy,
+		Objects:                []PlannedObject{},
+		profiler:               newProfiler(),
+	}
+
+	backupLayout, err := layout.Open(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing is applied from a backup that was tampered with or corrupted
+	m, hasManifest, err := manifest.Read(backupDir)
+	if err != nil {
+		return nil, err
+	} else if hasManifest {
+		if err := manifest.Verify(backupDir, m); err != nil {
+			return nil, err
+		}
+	}
+	classes, err := newClassResolver(ctx, clients, backupLayout, opts)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := newStorageResolver(ctx, clients, backupLayout, opts)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := newSnapshotResolver(ctx, clients, backupLayout, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	kinds, err := orderKinds(opts.RestoreOrder)
+	if err != nil {
+		return nil, err
+	}
+	filesByKind := map[string][]string{}
+	var backedUp []layout.Kind
+	total := 0
+	for _, resource := range kinds {
+		if !filter.selectsKind(resource) {
+			continue
+		}
+		files, err := backupLayout.ObjectFiles(resource.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			filesByKind[resource.Prefix] = files
+			backedUp = append(backedUp, resource)
+			total += len(files)
+		}
+	}
+	// Set once the plan is returned, the spill file is removed otherwise
+	built := false
+	if total > spillThreshold {
+		if plan.spill, err = newSpill(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if !built {
+				plan.Close()
+			}
+		}()
+	}
+
+	overridden := map[string]bool{}
+
+	crds, createdCRDs, err := planCRDs(ctx, clients, backupLayout, plan.profiler)
+	if err != nil {
+		return nil, err
+	}
+	crds = filter.selectedCRDs(crds, backedUp)
+
+	// Kinds whose definition the restore creates are not served yet
+	preflightStart := time.Now()
+	var served []layout.Kind
+	for _, resource := range backedUp {
+		if !resource.Custom || !createdCRDs[resource.CRDName()] {
+			served = append(served, resource)
+		}
+	}
+	if err := preflight(backupDir, served, clients.Discovery); err != nil {
+		return nil, err
+	}
+	plan.profiler.preflight = time.Since(preflightStart)
+
+	for _, resource := range backedUp {
+		files := filesByKind[resource.Prefix]
+
+		var existing map[string]metav1.ObjectMeta
+		if !resource.Custom || !createdCRDs[resource.CRDName()] {
+			err := plan.profiler.api(resource.Kind, "", func() (err error) {
+				existing, err = existingObjects(ctx, clients, resource, namespace)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, file := range files {
+			var obj *unstructured.Unstructured
+			err := plan.profiler.local(resource.Kind, backupLayout.ObjectName(file, resource.Prefix), func() (err error) {
+				obj, err = readObject(backupLayout, file, namespace, resource, opts.FinalizerRules)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !filter.selects(obj) {
+				continue
+			}
+			if err := classes.prepare(plan, obj, resource); err != nil {
+				return nil, err
+			}
+			if resource.Prefix == layout.PVC {
+				// Unbinds the PVCs restored from snapshots before their volumes are looked for
+				if err := snapshots.prepare(plan, obj, namespace); err != nil {
+					return nil, err
+				}
+				if err := storage.prepare(plan, obj, namespace); err != nil {
+					return nil, err
+				}
+			}
+			if resource.Prefix == layout.ConfigMap && applyConfigMapOverrides(obj, opts.ConfigMapOverrides) {
+				overridden[obj.GetName()] = true
+			}
+
+			planned := PlannedObject{
+				Kind:     resource.Kind,
+				Name:     obj.GetName(),
+				Action:   ActionCreate,
+				GitOps:   gitOpsManager(obj),
+				resource: resource,
+			}
+
+			generated := hasGeneratedName(obj)
+			if generated {
+				planned.GenerateName = obj.GetGenerateName()
+			}
+
+			switch {
+			case generated && generateNamePolicy == GenerateNameSkip:
+				planned.Action = ActionSkip
+				planned.Reason = ReasonGeneratedName
+			case generated && generateNamePolicy == GenerateNameRegenerate:
+				// Created under a new name, it can't collide with an existing object
+			default:
+				// Check if the object already exists in the namespace
+				if meta, ok := existing[obj.GetName()]; ok {
+					planned.Action = ActionSkip
+					planned.Reason = ReasonExists
+					switch policy {
+					case PolicyReplace:
+						planned.Action = ActionReplace
+						planned.Reason = ""
+					case PolicyRepair, PolicySkip:
+						if (policy == PolicyRepair || opts.Interactive) && drift.LastWrite(meta).After(opts.BackupTime) {
+							planned.Reason = ReasonDrifted
+							if opts.Interactive {
+								planned.Action = ActionPending
+							} else {
+								plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s/%s was modified since the backup and is left as it is", planned.Kind, planned.Name))
+							}
+						}
+					}
+				}
+			}
+
+			if planned.GitOps != "" && planned.Action != ActionSkip {
+				switch gitOpsMode {
+				case GitOpsWarn:
+					plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s/%s is managed by %s, which may revert or prune the restored object", planned.Kind, planned.Name, planned.GitOps))
+				case GitOpsSkip:
+					planned.Action = ActionSkip
+					planned.Reason = ReasonGitOpsManaged
+				case GitOpsPause:
+					pauseReconciliation(obj, planned.GitOps)
+				}
+			}
+
+			if planned.Action != ActionSkip && opts.SourceNamespace != "" && opts.SourceNamespace != namespace {
+				plan.NamespaceReferences = append(plan.NamespaceReferences, namespaceReferences(obj, opts.SourceNamespace)...)
+			}
+			if generated && generateNamePolicy == GenerateNameRegenerate {
+				obj.SetName("")
+			}
+
+			if err := plan.storeObject(&planned, obj); err != nil {
+				return nil, err
+			}
+			plan.Objects = append(plan.Objects, planned)
+		}
+	}
+
+	if len(plan.NamespaceReferences) > 0 {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("restored objects still refer to the source namespace %s and may need to be changed, see namespace_references", opts.SourceNamespace))
+	}
+
+	plan.Warnings = append(plan.Warnings, unusedConfigMapOverrides(opts.ConfigMapOverrides, overridden)...)
+
+	// Definitions have to exist before their objects, classes before the
+	// Pods using them, and volumes and snapshots before the PVCs using them
+	plan.Objects = slices.Concat(crds, classes.objects, storage.objects(), snapshots.objects(plan.Objects), plan.Objects)
+
+	// Archives, incremental, encrypted and compressed backups are unpacked
+	// into a new directory for every plan, their checksums identify them
+	backupID := filepath.Clean(backupDir)
+	if hasManifest {
+		backupID = checksumsDigest(m.Files())
+	}
+	plan.backupID = backupID
+	plan.ConfirmToken = confirmToken(backupID, plan)
+	built = true
+	return plan, nil
+}
+
+// ValidateRestoreOrder checks a RestoreOrder before it is stored.
+func ValidateRestoreOrder(order []string) error {
+	_, err := orderKinds(order)
+	return err
+}
+
+// orderKinds returns layout.Kinds with the kinds in order moved to the front,
+// in the order given.
+func orderKinds(order []string) ([]layout.Kind, error) {
+	var kinds []layout.Kind
+	listed := map[string]bool{}
+	for _, name := range order {
+		k, ok := layout.LookupKind(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown kind %q", ErrInvalidRestoreOrder, name)
+		}
+		if listed[k.Prefix] {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidRestoreOrder, k.Kind)
+		}
+		listed[k.Prefix] = true
+		kinds = append(kinds, k)
+	}
+	for _, k := range layout.Kinds {
+		if !listed[k.Prefix] {
+			kinds = append(kinds, k)
+		}
+	}
+	return kinds, nil
+}
+
+// existingObjects lists the metadata of all objects of one kind in the
+// namespace, by name, with a single metadata-only List call.
+func existingObjects(ctx context.Context, clients Clients, resource layout.Kind, namespace string) (map[string]metav1.ObjectMeta, error) {
+	list, err := clients.Metadata.Resource(resource.GVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]metav1.ObjectMeta, len(list.Items))
+	for _, item := range list.Items {
+		objects[item.Name] = item.ObjectMeta
+	}
+	return objects, nil
+}
+
+func readObject(backupLayout layout.Reader, file, namespace string, resource layout.Kind, finalizerRules []config.FinalizerRule) (*unstructured.Unstructured, error) {
+	obj, err := backupLayout.ReadObject(file, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the namespace of the restored object to match the requested namespace
+	obj.SetNamespace(namespace)
+
+	// Remove the resourceVersion field to avoid setting it when creating the object
+	obj.SetResourceVersion("")
+
+	// The new object gets its own UID, keep the original one as an annotation
+	if uid := obj.GetUID(); uid != "" {
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[OriginalUIDAnnotation] = string(uid)
+		obj.SetAnnotations(annotations)
+		obj.SetUID("")
+	}
+
+	if prepare, ok := prepareFuncs[resource.Prefix]; ok {
+		prepare(obj)
+	}
+	applyFinalizerRules(obj, finalizerRules)
+	return obj, nil
+}
+
+// The token covers the backup, the target namespace and what the plan does
+// with every object, so a plan has to be rebuilt (and re-confirmed) if any
+// of them changes. backupID must not depend on where the backup was
+// unpacked.
+func confirmToken(backupID string, plan *Plan) string {
+	if !slices.ContainsFunc(plan.Objects, func(obj PlannedObject) bool { return obj.Action == ActionReplace }) {
+		return ""
+	}
+	return planDigest(backupID, plan)
+}
+
+// planDigest hashes the backup, the target namespace and the action of every
+// object of plan.
+func planDigest(backupID string, plan *Plan) string {
+	objects := make([]string, 0, len(plan.Objects))
+	for _, obj := range plan.Objects {
+		objects = append(objects, fmt.Sprintf("%s/%s %s", obj.Kind, obj.Name, obj.Action))
+	}
+	sort.Strings(objects)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", backupID, plan.Namespace)
+	for _, obj := range objects {
+		fmt.Fprintln(h, obj)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// checksumsDigest hashes the checksums of the files of a backup.
+func checksumsDigest(files map[string]string) string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(h, "%s %s\n", path, files[path])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,78 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"net_exercise/pkg/archive"
+	"net_exercise/pkg/layout"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Archive backups are unpacked into a new directory for every plan and
+// restore, the confirm token of the plan has to hold for the restore.
+func TestConfirmTokenOfUnpackedArchive(t *testing.T) {
+	configMap, _ := layout.LookupKind("ConfigMap")
+	backupDir := t.TempDir()
+	writeTestBackup(t, backupDir, newObject(configMap, "source", "settings", map[string]any{"data": map[string]any{"mode": "backup"}}))
+	archivePath := filepath.Join(t.TempDir(), "backup_1.tar.gz")
+	if err := archive.Pack(backupDir, archivePath); err != nil {
+		t.Fatal(err)
+	}
+	unpack := func() string {
+		dir := t.TempDir()
+		if err := archive.Unpack(archivePath, dir); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		wantErr   error
+	}{
+		{name: "same namespace", namespace: "target"},
+		{name: "other namespace", namespace: "other", wantErr: ErrConfirmationRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			existing := []*unstructured.Unstructured{
+				newObject(configMap, "target", "settings", map[string]any{"data": map[string]any{"mode": "live"}}),
+				newObject(configMap, "other", "settings", nil),
+			}
+			opts := Options{ExistingResourcePolicy: PolicyReplace}
+
+			plan, err := BuildPlan(ctx, unpack(), "target", newTestClients(t, existing...), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan.Close()
+			if plan.ConfirmToken == "" {
+				t.Fatal("replace plan has no confirm token")
+			}
+
+			clients := newTestClients(t, existing...)
+			opts.ConfirmToken = plan.ConfirmToken
+			_, err = RestoreResources(ctx, unpack(), tt.namespace, clients, opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RestoreResources() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			restored, err := clients.Dynamic.Resource(configMap.GVR).Namespace("target").Get(ctx, "settings", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode, _, _ := unstructured.NestedString(restored.Object, "data", "mode"); mode != "backup" {
+				t.Errorf("restored ConfigMap has mode %q, want backup", mode)
+			}
+		})
+	}
+}
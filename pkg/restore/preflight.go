@@ -0,0 +1,72 @@
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+
+	"k8s.io/client-go/discovery"
+)
+
+var ErrPreflight = errors.New("restore preflight failed")
+
+// preflight makes sure the target cluster serves the group version of every
+// kind in the backup and, when it does not, explains the mismatch using the
+// discovery snapshot stored in the backup manifest.
+func preflight(backupDir string, kinds []layout.Kind, client discovery.DiscoveryInterface) error {
+	target, err := backup.DescribeCluster(client)
+	if err != nil {
+		return err
+	}
+
+	m, _, err := manifest.Read(backupDir)
+	if err != nil {
+		return err
+	}
+	source := "an unknown version"
+	if m.Cluster != nil {
+		source = m.Cluster.ServerVersion
+	}
+
+	var problems []string
+	for _, k := range kinds {
+		gv := k.GVR.GroupVersion().String()
+		if slices.Contains(target.APIResources[gv], k.Kind) {
+			continue
+		}
+
+		problem := fmt.Sprintf("%s: backed up on %s as %s; target %s", k.Kind, source, gv, target.ServerVersion)
+		if served := servedVersions(target, k); len(served) > 0 {
+			problem += " serves " + strings.Join(served, ", ")
+		} else {
+			problem += " does not serve this kind"
+		}
+		problems = append(problems, problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrPreflight, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// servedVersions lists the group versions of k's group that serve k.
+func servedVersions(cluster *manifest.Cluster, k layout.Kind) []string {
+	var served []string
+	for gv, kinds := range cluster.APIResources {
+		group, _, found := strings.Cut(gv, "/")
+		if !found {
+			group = ""
+		}
+		if group == k.GVR.Group && slices.Contains(kinds, k.Kind) {
+			served = append(served, gv)
+		}
+	}
+	slices.Sort(served)
+	return served
+}
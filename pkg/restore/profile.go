@@ -0,0 +1,131 @@
+package restore
+
+import (
+	"slices"
+	"time"
+)
+
+// Milliseconds is a duration rendered as fractional milliseconds in JSON.
+type Milliseconds float64
+
+func ms(d time.Duration) Milliseconds {
+	return Milliseconds(float64(d) / float64(time.Millisecond))
+}
+
+type KindProfile struct {
+	Kind    string `json:"kind"`
+	Objects int    `json:"objects"`
+	// Time spent on this kind, split into Kubernetes API calls and local work
+	// such as reading and preparing object files
+	TotalMS Milliseconds `json:"total_ms"`
+	APIMS   Milliseconds `json:"api_ms"`
+	LocalMS Milliseconds `json:"local_ms"`
+	// Per object time
+	P50MS Milliseconds `json:"p50_ms"`
+	P95MS Milliseconds `json:"p95_ms"`
+}
+
+type Profile struct {
+	TotalMS Milliseconds `json:"total_ms"`
+	APIMS   Milliseconds `json:"api_ms"`
+	LocalMS Milliseconds `json:"local_ms"`
+	// Discovery calls that check the target serves every kind
+	PreflightMS Milliseconds  `json:"preflight_ms"`
+	Kinds       []KindProfile `json:"kinds"`
+}
+
+type kindTimings struct {
+	api, local time.Duration
+	objects    map[string]time.Duration
+}
+
+// profiler collects timings while a plan is built and executed.
+type profiler struct {
+	start     time.Time
+	preflight time.Duration
+	kinds     map[string]*kindTimings
+	order     []string
+}
+
+func newProfiler() *profiler {
+	return &profiler{start: time.Now(), kinds: map[string]*kindTimings{}}
+}
+
+func (p *profiler) kind(kind string) *kindTimings {
+	t, ok := p.kinds[kind]
+	if !ok {
+		t = &kindTimings{objects: map[string]time.Duration{}}
+		p.kinds[kind] = t
+		p.order = append(p.order, kind)
+	}
+	return t
+}
+
+// api times an API call made for kind, and for one of its objects if name is set.
+func (p *profiler) api(kind, name string, call func() error) error {
+	start := time.Now()
+	err := call()
+	elapsed := time.Since(start)
+
+	t := p.kind(kind)
+	t.api += elapsed
+	if name != "" {
+		t.objects[name] += elapsed
+	}
+	return err
+}
+
+func (p *profiler) local(kind, name string, work func() error) error {
+	start := time.Now()
+	err := work()
+	elapsed := time.Since(start)
+
+	t := p.kind(kind)
+	t.local += elapsed
+	if name != "" {
+		t.objects[name] += elapsed
+	}
+	return err
+}
+
+func (p *profiler) profile() Profile {
+	profile := Profile{
+		TotalMS:     ms(time.Since(p.start)),
+		PreflightMS: ms(p.preflight),
+		Kinds:       []KindProfile{},
+	}
+
+	api := p.preflight
+	for _, kind := range p.order {
+		t := p.kinds[kind]
+		api += t.api
+
+		var objects []time.Duration
+		for _, d := range t.objects {
+			objects = append(objects, d)
+		}
+		slices.Sort(objects)
+
+		profile.Kinds = append(profile.Kinds, KindProfile{
+			Kind:    kind,
+			Objects: len(objects),
+			TotalMS: ms(t.api + t.local),
+			APIMS:   ms(t.api),
+			LocalMS: ms(t.local),
+			P50MS:   ms(percentile(objects, 50)),
+			P95MS:   ms(percentile(objects, 95)),
+		})
+	}
+	profile.APIMS = ms(api)
+	profile.LocalMS = profile.TotalMS - profile.APIMS
+	return profile
+}
+
+// percentile uses the nearest-rank method on sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,88 @@
+package restore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"net_exercise/pkg/redact"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// NamespaceReference is a value in a restored object that names the source
+// namespace, and most likely breaks or keeps pointing at the source when the
+// backup is restored into another namespace.
+type NamespaceReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Field holding the reference, e.g. spec.template.spec.containers[0].env[1].value
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// Label every namespace carries with its own name, used in namespaceSelectors
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// namespaceReferences finds the values of obj referring to the namespace
+// source: Service DNS names such as db.source.svc.cluster.local, namespace
+// fields such as RoleBinding subjects, and namespaceSelectors matching the
+// namespace by name. The object's own metadata.namespace is not reported.
+// Values of Secrets, including their last-applied-configuration annotation,
+// are reported as redact.Mask: plans are shown to callers without Secret
+// access.
+func namespaceReferences(obj *unstructured.Unstructured, source string) []NamespaceReference {
+	serviceDNS := regexp.MustCompile(`\.` + regexp.QuoteMeta(source) + `\.svc\b`)
+
+	var refs []NamespaceReference
+	report := func(path, value string) {
+		if obj.GetKind() == "Secret" {
+			value = redact.Mask
+		}
+		refs = append(refs, NamespaceReference{Kind: obj.GetKind(), Name: obj.GetName(), Path: path, Value: value})
+	}
+	var walk func(path, key string, value interface{})
+	walk = func(path, key string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if path == "" && k == "metadata" {
+					continue
+				}
+				childPath := k
+				if path != "" {
+					childPath = path + "." + k
+				}
+				walk(childPath, k, v[k])
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(fmt.Sprintf("%s[%d]", path, i), key, item)
+			}
+		case string:
+			if ((key == "namespace" || key == namespaceNameLabel) && v == source) || serviceDNS.MatchString(v) {
+				report(path, v)
+			}
+		}
+	}
+	walk("", "", obj.Object)
+
+	// Annotations are often read by controllers, e.g. ingress backends
+	annotations := obj.GetAnnotations()
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if serviceDNS.MatchString(annotations[k]) {
+			report("metadata.annotations."+k, annotations[k])
+		}
+	}
+	return refs
+}
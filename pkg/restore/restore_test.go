@@ -0,0 +1,75 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"net_exercise/pkg/layout"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Every kind a backup contains is restored, from backups of either layout.
+func TestRestoreEveryKind(t *testing.T) {
+	var objects []*unstructured.Unstructured
+	for _, k := range layout.Kinds {
+		data, err := os.ReadFile(filepath.Join(objectsDir, k.Prefix+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(data, &obj.Object); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, obj)
+	}
+
+	tests := []struct {
+		name  string
+		write func(t *testing.T, backupDir string)
+	}{
+		{
+			name: "layout v2",
+			write: func(t *testing.T, backupDir string) {
+				writeTestBackup(t, backupDir, objects...)
+			},
+		},
+		{
+			name: "layout v1",
+			write: func(t *testing.T, backupDir string) {
+				for _, obj := range objects {
+					k, _ := layout.LookupKind(obj.GetKind())
+					data, err := json.Marshal(obj)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(filepath.Join(backupDir, k.Prefix+"-"+obj.GetName()+".json"), data, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backupDir := t.TempDir()
+			tt.write(t, backupDir)
+			clients := newTestClients(t)
+
+			if _, err := RestoreResources(ctx, backupDir, "target", clients, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, obj := range objects {
+				k, _ := layout.LookupKind(obj.GetKind())
+				if _, err := clients.Dynamic.Resource(k.GVR).Namespace("target").Get(ctx, obj.GetName(), metav1.GetOptions{}); err != nil {
+					t.Errorf("%s %s was not restored: %v", obj.GetKind(), obj.GetName(), err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package restore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const schedulingPollInterval = 2 * time.Second
+
+// SchedulingReport lists the Pods the scheduler could not place after a
+// restore, typically because of affinity, anti-affinity or topology spread
+// constraints that the source cluster satisfied and the target does not.
+type SchedulingReport struct {
+	PendingPods []PendingPod `json:"pending_pods"`
+	// PVCs that failed to bind, with the Warning events saying why
+	UnboundVolumes []UnboundVolume `json:"unbound_volumes,omitempty"`
+	// PVCs still unbound without any error, e.g. waiting for their first
+	// consumer or for the provisioner, and the Pods waiting for them. They
+	// are not failures.
+	WaitingVolumes []UnboundVolume `json:"waiting_volumes,omitempty"`
+}
+
+type UnboundVolume struct {
+	Name         string `json:"name"`
+	StorageClass string `json:"storage_class,omitempty"`
+	// Immediate or WaitForFirstConsumer
+	BindingMode string `json:"binding_mode,omitempty"`
+	// Pods mounting the PVC that are not scheduled yet
+	Pods   []string `json:"pods,omitempty"`
+	Events []string `json:"events,omitempty"`
+}
+
+// Scheduler message of Pods whose Immediate PVCs are not bound yet. With
+// the PVCs still being provisioned, the Pod is scheduled once they are.
+const unboundImmediatePVCMessage = "unbound immediate PersistentVolumeClaims"
+
+type PendingPod struct {
+	Name string `json:"name"`
+	// Reason and message of the PodScheduled condition
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// FailedScheduling events of the Pod
+	Events []string `json:"events,omitempty"`
+}
+
+// CheckScheduling waits up to timeout for every Pod and PVC in namespace to
+// be scheduled and bound, and reports the Pods that are still unschedulable
+// and the PVCs that failed to bind. Unbound PVCs only count as failed once
+// Warning events such as ProvisioningFailed were recorded for them: PVCs of
+// WaitForFirstConsumer StorageClasses stay Pending until a Pod using them is
+// scheduled, and Pods waiting for Immediate PVCs being provisioned are
+// retried.
+func CheckScheduling(ctx context.Context, clientset kubernetes.Interface, namespace string, timeout time.Duration) (*SchedulingReport, error) {
+	var state *schedulingState
+	err := wait.PollUntilContextTimeout(ctx, schedulingPollInterval, timeout, false, func(ctx context.Context) (done bool, err error) {
+		state, err = readSchedulingState(ctx, clientset, namespace)
+		if err != nil {
+			return false, err
+		}
+		return state.settled(), nil
+	})
+	if err != nil && !wait.Interrupted(err) {
+		return nil, err
+	}
+
+	report := &SchedulingReport{PendingPods: []PendingPod{}}
+	if state == nil {
+		return report, nil
+	}
+	for _, pvc := range state.unbound {
+		volume := state.volume(pvc)
+		if len(volume.Events) > 0 {
+			report.UnboundVolumes = append(report.UnboundVolumes, volume)
+		} else {
+			report.WaitingVolumes = append(report.WaitingVolumes, volume)
+		}
+	}
+	if len(state.unscheduled) == 0 {
+		return report, nil
+	}
+
+	eventList, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.AndSelectors(
+			fields.OneTermEqualSelector("involvedObject.kind", "Pod"),
+			fields.OneTermEqualSelector("reason", "FailedScheduling"),
+		).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := map[string][]string{}
+	for _, event := range eventList.Items {
+		events[event.InvolvedObject.Name] = append(events[event.InvolvedObject.Name], event.Message)
+	}
+
+	for _, pod := range state.unscheduled {
+		if state.waitingForVolumes(&pod) {
+			continue
+		}
+		condition, _ := unschedulableCondition(&pod)
+		report.PendingPods = append(report.PendingPods, PendingPod{
+			Name:    pod.Name,
+			Reason:  condition.Reason,
+			Message: condition.Message,
+			Events:  events[pod.Name],
+		})
+	}
+	return report, nil
+}
+
+// schedulingState is what CheckScheduling saw in the namespace at one poll.
+type schedulingState struct {
+	unscheduled []corev1.Pod
+	pending     []corev1.Pod
+	unbound     []corev1.PersistentVolumeClaim
+	// Warning events of the unbound PVCs, by PVC name
+	pvcEvents    map[string][]string
+	bindingModes map[string]string
+}
+
+func readSchedulingState(ctx context.Context, clientset kubernetes.Interface, namespace string) (*schedulingState, error) {
+	podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("status.phase", string(corev1.PodPending)).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := &schedulingState{pending: podList.Items, pvcEvents: map[string][]string{}, bindingModes: map[string]string{}}
+	for _, pod := range podList.Items {
+		if _, ok := unschedulableCondition(&pod); ok {
+			state.unscheduled = append(state.unscheduled, pod)
+		}
+	}
+
+	pvcList, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pvc := range pvcList.Items {
+		if pvc.Status.Phase == corev1.ClaimPending {
+			state.unbound = append(state.unbound, pvc)
+		}
+	}
+	if len(state.unbound) == 0 {
+		return state, nil
+	}
+
+	eventList, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.AndSelectors(
+			fields.OneTermEqualSelector("involvedObject.kind", "PersistentVolumeClaim"),
+			fields.OneTermEqualSelector("type", corev1.EventTypeWarning),
+		).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range eventList.Items {
+		state.pvcEvents[event.InvolvedObject.Name] = append(state.pvcEvents[event.InvolvedObject.Name], event.Message)
+	}
+
+	for _, pvc := range state.unbound {
+		class := storageClassName(&pvc)
+		if class == "" {
+			continue
+		}
+		if _, ok := state.bindingModes[class]; ok {
+			continue
+		}
+		// A class that can't be read leaves the binding mode unknown, the
+		// events still tell whether binding failed
+		sc, err := clientset.StorageV1().StorageClasses().Get(ctx, class, metav1.GetOptions{})
+		if err == nil && sc.VolumeBindingMode != nil {
+			state.bindingModes[class] = string(*sc.VolumeBindingMode)
+		} else {
+			state.bindingModes[class] = ""
+		}
+	}
+	return state, nil
+}
+
+// settled reports whether every Pod is scheduled and every PVC is bound,
+// except for WaitForFirstConsumer PVCs no Pod uses yet, which stay unbound.
+func (s *schedulingState) settled() bool {
+	if len(s.unscheduled) > 0 {
+		return false
+	}
+	for _, pvc := range s.unbound {
+		volume := s.volume(pvc)
+		if volume.BindingMode != string(storagev1.VolumeBindingWaitForFirstConsumer) || len(volume.Pods) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *schedulingState) volume(pvc corev1.PersistentVolumeClaim) UnboundVolume {
+	class := storageClassName(&pvc)
+	volume := UnboundVolume{
+		Name:         pvc.Name,
+		StorageClass: class,
+		BindingMode:  s.bindingModes[class],
+		Events:       s.pvcEvents[pvc.Name],
+	}
+	for _, pod := range s.pending {
+		if _, ok := podVolumes(&pod)[pvc.Name]; ok {
+			volume.Pods = append(volume.Pods, pod.Name)
+		}
+	}
+	return volume
+}
+
+// waitingForVolumes reports whether pod is only unschedulable because PVCs it
+// mounts are still being bound without errors.
+func (s *schedulingState) waitingForVolumes(pod *corev1.Pod) bool {
+	condition, _ := unschedulableCondition(pod)
+	if !strings.Contains(condition.Message, unboundImmediatePVCMessage) {
+		return false
+	}
+	claims := podVolumes(pod)
+	for _, pvc := range s.unbound {
+		if _, ok := claims[pvc.Name]; ok && len(s.pvcEvents[pvc.Name]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// podVolumes returns the names of the PVCs pod mounts.
+func podVolumes(pod *corev1.Pod) map[string]struct{} {
+	claims := map[string]struct{}{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			claims[volume.PersistentVolumeClaim.ClaimName] = struct{}{}
+		}
+	}
+	return claims
+}
+
+func storageClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName != nil {
+		return *pvc.Spec.StorageClassName
+	}
+	return ""
+}
+
+func unschedulableCondition(pod *corev1.Pod) (corev1.PodCondition, bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			return condition, true
+		}
+	}
+	return corev1.PodCondition{}, false
+}
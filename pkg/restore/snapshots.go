@@ -0,0 +1,207 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/layout"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// snapshotResolver provisions the restored PVCs from the CSI snapshots
+// recorded in the backup, see backup.SnapshotVolumes.
+type snapshotResolver struct {
+	ctx     context.Context
+	clients Clients
+	enabled bool
+
+	// Recorded VolumeSnapshots by PVC name, and their contents by name
+	snapshots map[string]*unstructured.Unstructured
+	contents  map[string]*unstructured.Unstructured
+	// VolumeSnapshotContents and VolumeSnapshots to create for each PVC
+	byPVC map[string][]PlannedObject
+}
+
+func newSnapshotResolver(ctx context.Context, clients Clients, backupLayout layout.Reader, opts Options) (*snapshotResolver, error) {
+	r := &snapshotResolver{
+		ctx:       ctx,
+		clients:   clients,
+		enabled:   opts.RestoreSnapshots,
+		snapshots: map[string]*unstructured.Unstructured{},
+		contents:  map[string]*unstructured.Unstructured{},
+		byPVC:     map[string][]PlannedObject{},
+	}
+	if !r.enabled {
+		return r, nil
+	}
+
+	files, err := backupLayout.ObjectFiles(layout.VolumeSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		snapshot, err := backupLayout.ReadObject(file, layout.VolumeSnapshotKind)
+		if err != nil {
+			return nil, err
+		}
+		pvcName, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+		r.snapshots[pvcName] = snapshot
+	}
+
+	files, err = backupLayout.ObjectFiles(layout.VolumeSnapshotContent)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := backupLayout.ReadObject(file, layout.VolumeSnapshotContentKind)
+		if err != nil {
+			return nil, err
+		}
+		r.contents[content.GetName()] = content
+	}
+	return r, nil
+}
+
+// prepare points the PVC at its snapshot. A restore into the namespace the
+// snapshot was taken in uses it while it exists; otherwise, e.g. after the
+// namespace was deleted or for another namespace, the snapshot is imported
+// from its retained content under the same name.
+func (r *snapshotResolver) prepare(plan *Plan, pvc *unstructured.Unstructured, namespace string) error {
+	if !r.enabled {
+		return nil
+	}
+	snapshot, ok := r.snapshots[pvc.GetName()]
+	if !ok {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("PersistentVolumeClaim/%s has no volume snapshot in the backup and is restored without its data", pvc.GetName()))
+		return nil
+	}
+	name := snapshot.GetName()
+
+	var exists bool
+	err := plan.profiler.api(layout.VolumeSnapshotKind.Kind, name, func() error {
+		_, err := r.clients.Metadata.Resource(layout.VolumeSnapshotKind.GVR).Namespace(namespace).Get(r.ctx, name, metav1.GetOptions{})
+		exists = err == nil
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		contentName, _, _ := unstructured.NestedString(snapshot.Object, "status", "boundVolumeSnapshotContentName")
+		var handle string
+		content, ok := r.contents[contentName]
+		if ok {
+			handle, _, _ = unstructured.NestedString(content.Object, "status", "snapshotHandle")
+		}
+		if handle == "" {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("PersistentVolumeClaim/%s: the backup does not record the storage snapshot of VolumeSnapshot %s and the PVC is restored without its data", pvc.GetName(), name))
+			return nil
+		}
+		objects, err := r.importSnapshot(plan, snapshot, content, handle, namespace)
+		if err != nil {
+			return err
+		}
+		r.byPVC[pvc.GetName()] = objects
+	}
+
+	unbind(pvc)
+	unstructured.RemoveNestedField(pvc.Object, "spec", "dataSourceRef")
+	unstructured.SetNestedMap(pvc.Object, map[string]interface{}{
+		"apiGroup": layout.VolumeSnapshotKind.GVR.Group,
+		"kind":     layout.VolumeSnapshotKind.Kind,
+		"name":     name,
+	}, "spec", "dataSource")
+	return nil
+}
+
+// importSnapshot plans a pre-provisioned VolumeSnapshotContent for the
+// storage snapshot behind content and a VolumeSnapshot bound to it in
+// namespace. The content is retained, like the one of the backup.
+func (r *snapshotResolver) importSnapshot(plan *Plan, snapshot, content *unstructured.Unstructured, handle, namespace string) ([]PlannedObject, error) {
+	name := snapshot.GetName()
+	contentName := fmt.Sprintf("netx-%s-%s", namespace, name)
+	driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+
+	contentSpec := map[string]interface{}{
+		"deletionPolicy": "Retain",
+		"driver":         driver,
+		"source":         map[string]interface{}{"snapshotHandle": handle},
+		"volumeSnapshotRef": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+	}
+	if class, _, _ := unstructured.NestedString(content.Object, "spec", "volumeSnapshotClassName"); class != "" {
+		contentSpec["volumeSnapshotClassName"] = class
+	}
+	newContent := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": layout.VolumeSnapshotContentKind.GVR.GroupVersion().String(),
+		"kind":       layout.VolumeSnapshotContentKind.Kind,
+		"metadata":   map[string]interface{}{"name": contentName},
+		"spec":       contentSpec,
+	}}
+	newSnapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": layout.VolumeSnapshotKind.GVR.GroupVersion().String(),
+		"kind":       layout.VolumeSnapshotKind.Kind,
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+			"labels":    map[string]interface{}{backup.SnapshotPVCLabel: snapshot.GetLabels()[backup.SnapshotPVCLabel]},
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"volumeSnapshotContentName": contentName},
+		},
+	}}
+
+	contentPlanned := PlannedObject{
+		Kind:          layout.VolumeSnapshotContentKind.Kind,
+		Name:          contentName,
+		Action:        ActionCreate,
+		resource:      layout.VolumeSnapshotContentKind,
+		object:        newContent,
+		clusterScoped: true,
+	}
+	// Left from an earlier restore of the same backup into the namespace
+	err := plan.profiler.api(contentPlanned.Kind, contentName, func() error {
+		_, err := r.clients.Metadata.Resource(layout.VolumeSnapshotContentKind.GVR).Get(r.ctx, contentName, metav1.GetOptions{})
+		if err == nil {
+			contentPlanned.Action = ActionSkip
+			contentPlanned.Reason = ReasonExists
+		}
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []PlannedObject{contentPlanned, {
+		Kind:     layout.VolumeSnapshotKind.Kind,
+		Name:     name,
+		Action:   ActionCreate,
+		resource: layout.VolumeSnapshotKind,
+		object:   newSnapshot,
+	}}, nil
+}
+
+// objects returns the snapshots to create before the PVCs of planned that
+// are restored.
+func (r *snapshotResolver) objects(planned []PlannedObject) []PlannedObject {
+	var objects []PlannedObject
+	for _, p := range planned {
+		if p.resource.Prefix == layout.PVC && p.Action != ActionSkip {
+			objects = append(objects, r.byPVC[p.Name]...)
+		}
+	}
+	return objects
+}
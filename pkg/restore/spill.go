@@ -0,0 +1,108 @@
+package restore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Plans of backups with more objects than this keep the objects in a
+// temporary file instead of memory, so restoring a namespace with tens of
+// thousands of objects doesn't run the service out of memory. Only the
+// PlannedObject fields stay in memory, each object is read back when it is
+// created.
+const spillThreshold = 5000
+
+var errPlanClosed = errors.New("the objects of the plan were removed by Close")
+
+// spill is the file the objects of a large plan are kept in.
+type spill struct {
+	file *os.File
+	size int64
+}
+
+// spilledObject is where an object is in the spill file.
+type spilledObject struct {
+	offset int64
+	length int
+}
+
+func newSpill() (*spill, error) {
+	file, err := os.CreateTemp("", "netx-plan-")
+	if err != nil {
+		return nil, err
+	}
+	return &spill{file: file}, nil
+}
+
+// store appends obj to the file.
+func (s *spill) store(obj *unstructured.Unstructured) (*spilledObject, error) {
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.file.WriteAt(data, s.size); err != nil {
+		return nil, err
+	}
+	stored := &spilledObject{offset: s.size, length: len(data)}
+	s.size += int64(len(data))
+	return stored, nil
+}
+
+func (s *spill) load(stored *spilledObject) (*unstructured.Unstructured, error) {
+	data := make([]byte, stored.length)
+	if _, err := s.file.ReadAt(data, stored.offset); err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *spill) remove() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// loadObject returns the object of planned, reading it back from the spill
+// file if the plan has one.
+func (p *Plan) loadObject(planned *PlannedObject) (*unstructured.Unstructured, error) {
+	switch {
+	case planned.spilled == nil:
+		return planned.object, nil
+	case p.spill == nil:
+		return nil, errPlanClosed
+	}
+	return p.spill.load(planned.spilled)
+}
+
+// storeObject sets the object of planned, in the spill file if the plan has
+// one.
+func (p *Plan) storeObject(planned *PlannedObject, obj *unstructured.Unstructured) error {
+	if p.spill == nil {
+		planned.object = obj
+		return nil
+	}
+	stored, err := p.spill.store(obj)
+	if err != nil {
+		return err
+	}
+	planned.object, planned.spilled = nil, stored
+	return nil
+}
+
+// Close removes the temporary file of a plan built for a large backup. The
+// objects of the plan can't be read afterwards; plans without the file are
+// not affected.
+func (p *Plan) Close() error {
+	if p.spill == nil {
+		return nil
+	}
+	err := p.spill.remove()
+	p.spill = nil
+	return err
+}
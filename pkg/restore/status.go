@@ -0,0 +1,86 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Outcome is what executing a plan did with one object.
+type Outcome string
+
+const (
+	OutcomeCreated  Outcome = "created"
+	OutcomeReplaced Outcome = "replaced"
+	OutcomeSkipped  Outcome = "skipped"
+	OutcomeFailed   Outcome = "failed"
+)
+
+// Labels the status ConfigMap with the restore it describes
+const RestoreIDLabel = "netx.io/restore-id"
+
+var configMapGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// fail records err as the outcome of the object and returns it.
+func (o *PlannedObject) fail(err error) error {
+	o.Outcome = OutcomeFailed
+	o.Error = err.Error()
+	return err
+}
+
+// StatusConfigMapName is the ConfigMap WriteStatus writes for a restore:
+// netx-restore-1 for restore_1.
+func StatusConfigMapName(restoreID string) string {
+	return "netx-restore-" + strings.TrimPrefix(restoreID, "restore_")
+}
+
+// WriteStatus writes the outcome of every object of plan to a ConfigMap in
+// the namespace it restored into, for jobs in the cluster that can't reach
+// the API of the service. Its keys created, replaced, skipped and failed
+// list one Kind/name per line, failed ones followed by their error;
+// not_restored lists the objects the restore did not get to after a
+// failure. A ConfigMap written before for the same restore is replaced.
+func WriteStatus(ctx context.Context, clients Clients, plan *Plan, restoreID, status string) error {
+	lists := map[string][]string{}
+	for _, obj := range plan.Objects {
+		line := obj.Kind + "/" + obj.Name
+		switch obj.Outcome {
+		case "":
+			lists["not_restored"] = append(lists["not_restored"], line)
+		case OutcomeFailed:
+			lists[string(obj.Outcome)] = append(lists[string(obj.Outcome)], line+": "+obj.Error)
+		default:
+			lists[string(obj.Outcome)] = append(lists[string(obj.Outcome)], line)
+		}
+	}
+
+	data := map[string]any{"restore_id": restoreID, "status": status}
+	for key, lines := range lists {
+		data[key] = strings.Join(lines, "\n") + "\n"
+	}
+	cm := &unstructured.Unstructured{Object: map[string]any{"data": data}}
+	cm.SetAPIVersion("v1")
+	cm.SetKind("ConfigMap")
+	cm.SetName(StatusConfigMapName(restoreID))
+	cm.SetLabels(map[string]string{RestoreIDLabel: restoreID})
+
+	client := clients.Dynamic.Resource(configMapGVR).Namespace(plan.Namespace)
+	_, err := client.Create(ctx, cm, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, getErr := client.Get(ctx, cm.GetName(), metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		cm.SetResourceVersion(existing.GetResourceVersion())
+		_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("writing restore status to ConfigMap %s: %w", cm.GetName(), err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"net_exercise/pkg/layout"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// What to do with PVCs bound to a PersistentVolume the target cluster does
+// not have
+const (
+	// Restore them unchanged and warn, they stay Pending until the volume exists
+	VolumeKeep = "keep"
+	// Unbind them, so they are provisioned anew from their StorageClass
+	VolumeStrip = "strip"
+	// Create the volume from the copy stored in the backup, bound to the
+	// restored PVC. The storage it points to must be reachable from the
+	// target cluster.
+	VolumeCreate = "create"
+)
+
+var ErrInvalidVolumePolicy = errors.New("volume_policy must be one of: keep, strip, create")
+
+func (o Options) volumePolicy() (string, error) {
+	switch o.VolumePolicy {
+	case "", VolumeKeep:
+		return VolumeKeep, nil
+	case VolumeStrip, VolumeCreate:
+		return o.VolumePolicy, nil
+	}
+	return "", ErrInvalidVolumePolicy
+}
+
+// Annotations recording how a PVC was bound and provisioned in the source
+// cluster, they make the PV controller treat an unbound PVC as bound
+var bindAnnotations = []string{
+	"pv.kubernetes.io/bind-completed",
+	"pv.kubernetes.io/bound-by-controller",
+	"volume.beta.kubernetes.io/storage-provisioner",
+	"volume.kubernetes.io/storage-provisioner",
+	"volume.kubernetes.io/selected-node",
+}
+
+// storageResolver renames the StorageClasses of the restored PVCs and
+// handles the StorageClasses and PersistentVolumes missing from the target
+// cluster, like classResolver does for Pod specs. StorageClasses follow
+// missing_class_policy.
+type storageResolver struct {
+	ctx          context.Context
+	clients      Clients
+	backupLayout layout.Reader
+	classPolicy  string
+	volumePolicy string
+	mapping      map[string]string
+
+	// Names of the StorageClasses and PersistentVolumes in the target
+	// cluster, by prefix, listed on first use
+	existing map[string]map[string]bool
+	// Objects from the backup planned for creation, keyed by <prefix>/<name>
+	planned map[string]bool
+	classes []PlannedObject
+	volumes []PlannedObject
+}
+
+func newStorageResolver(ctx context.Context, clients Clients, backupLayout layout.Reader, opts Options) (*storageResolver, error) {
+	classPolicy, err := opts.missingClassPolicy()
+	if err != nil {
+		return nil, err
+	}
+	volumePolicy, err := opts.volumePolicy()
+	if err != nil {
+		return nil, err
+	}
+	return &storageResolver{
+		ctx:          ctx,
+		clients:      clients,
+		backupLayout: backupLayout,
+		classPolicy:  classPolicy,
+		volumePolicy: volumePolicy,
+		mapping:      opts.StorageClassMapping,
+		existing:     map[string]map[string]bool{},
+		planned:      map[string]bool{},
+	}, nil
+}
+
+// objects returns the StorageClasses and then the PersistentVolumes to create
+// before the PVCs.
+func (r *storageResolver) objects() []PlannedObject {
+	return append(r.classes, r.volumes...)
+}
+
+func (r *storageResolver) prepare(plan *Plan, pvc *unstructured.Unstructured, namespace string) error {
+	volumeName, _, _ := unstructured.NestedString(pvc.Object, "spec", "volumeName")
+	if volumeName != "" {
+		existing, err := r.existingNames(plan.profiler, layout.PVKind)
+		if err != nil {
+			return err
+		}
+		if !existing[volumeName] {
+			ref := fmt.Sprintf("PersistentVolumeClaim/%s is bound to PersistentVolume %s, which the target cluster does not have", pvc.GetName(), volumeName)
+			switch r.volumePolicy {
+			case VolumeKeep:
+				plan.Warnings = append(plan.Warnings, ref)
+			case VolumeStrip:
+				unbind(pvc)
+			case VolumeCreate:
+				pv, err := r.backedUp(layout.PVKind, volumeName)
+				if err != nil {
+					return err
+				}
+				if pv == nil {
+					plan.Warnings = append(plan.Warnings, ref+" and the backup has no copy of it; provisioning a new volume")
+					unbind(pvc)
+					break
+				}
+				// Bound to the restored PVC, whose UID is not known yet
+				unstructured.RemoveNestedField(pv.Object, "status")
+				// The source cluster may still use the storage, deleting the
+				// restored PVC must not delete it
+				unstructured.SetNestedField(pv.Object, "Retain", "spec", "persistentVolumeReclaimPolicy")
+				unstructured.RemoveNestedField(pv.Object, "spec", "claimRef", "uid")
+				unstructured.RemoveNestedField(pv.Object, "spec", "claimRef", "resourceVersion")
+				unstructured.SetNestedField(pv.Object, namespace, "spec", "claimRef", "namespace")
+				if err := r.prepareClass(plan, pv, "PersistentVolume"); err != nil {
+					return err
+				}
+				r.planned[layout.PersistentVolume+"/"+volumeName] = true
+				r.volumes = append(r.volumes, PlannedObject{
+					Kind:          layout.PVKind.Kind,
+					Name:          volumeName,
+					Action:        ActionCreate,
+					resource:      layout.PVKind,
+					object:        pv,
+					clusterScoped: true,
+				})
+			}
+		}
+	}
+	return r.prepareClass(plan, pvc, "PersistentVolumeClaim")
+}
+
+// unbind turns a bound PVC into a new claim.
+func unbind(pvc *unstructured.Unstructured) {
+	unstructured.RemoveNestedField(pvc.Object, "spec", "volumeName")
+	annotations := pvc.GetAnnotations()
+	for _, annotation := range bindAnnotations {
+		delete(annotations, annotation)
+	}
+	pvc.SetAnnotations(annotations)
+}
+
+// prepareClass renames the StorageClass of a PVC or PersistentVolume and
+// handles it when missing.
+func (r *storageResolver) prepareClass(plan *Plan, obj *unstructured.Unstructured, kind string) error {
+	name, _, _ := unstructured.NestedString(obj.Object, "spec", "storageClassName")
+	if name == "" {
+		return nil
+	}
+	if mapped, ok := r.mapping[name]; ok && mapped != name {
+		name = mapped
+		unstructured.SetNestedField(obj.Object, name, "spec", "storageClassName")
+	}
+
+	existing, err := r.existingNames(plan.profiler, layout.StorageClassKind)
+	if err != nil {
+		return err
+	}
+	if existing[name] || r.planned[layout.StorageClass+"/"+name] {
+		return nil
+	}
+
+	ref := fmt.Sprintf("%s/%s uses StorageClass %s, which the target cluster does not have", kind, obj.GetName(), name)
+	switch r.classPolicy {
+	case MissingClassKeep:
+		plan.Warnings = append(plan.Warnings, ref)
+	case MissingClassStrip:
+		// The default StorageClass of the target cluster applies instead
+		unstructured.RemoveNestedField(obj.Object, "spec", "storageClassName")
+		plan.Warnings = append(plan.Warnings, ref+"; removed it")
+	case MissingClassCreate:
+		class, err := r.backedUp(layout.StorageClassKind, name)
+		if err != nil {
+			return err
+		}
+		if class == nil {
+			plan.Warnings = append(plan.Warnings, ref+" and the backup has no copy of it")
+			return nil
+		}
+		r.planned[layout.StorageClass+"/"+name] = true
+		r.classes = append(r.classes, PlannedObject{
+			Kind:          layout.StorageClassKind.Kind,
+			Name:          name,
+			Action:        ActionCreate,
+			resource:      layout.StorageClassKind,
+			object:        class,
+			clusterScoped: true,
+		})
+	}
+	return nil
+}
+
+func (r *storageResolver) existingNames(p *profiler, kind layout.Kind) (map[string]bool, error) {
+	if names, ok := r.existing[kind.Prefix]; ok {
+		return names, nil
+	}
+
+	var list *metav1.PartialObjectMetadataList
+	err := p.api(kind.Kind, "", func() (err error) {
+		list, err = r.clients.Metadata.Resource(kind.GVR).List(r.ctx, metav1.ListOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(list.Items))
+	for _, item := range list.Items {
+		names[item.Name] = true
+	}
+	r.existing[kind.Prefix] = names
+	return names, nil
+}
+
+// backedUp reads the copy of a cluster scoped object stored in the backup,
+// nil if there is none.
+func (r *storageResolver) backedUp(kind layout.Kind, name string) (*unstructured.Unstructured, error) {
+	files, err := r.backupLayout.ObjectFiles(kind.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if r.backupLayout.ObjectName(file, kind.Prefix) != name {
+			continue
+		}
+		obj, err := r.backupLayout.ReadObject(file, kind)
+		if err != nil {
+			return nil, err
+		}
+		obj.SetResourceVersion("")
+		obj.SetUID("")
+		obj.SetManagedFields(nil)
+		return obj, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Files larger than a part are uploaded to S3 in parts. S3 takes parts of
+// 5 MiB to 5 GiB, at most 10000 of them, so the parts of huge files are
+// larger.
+const (
+	defaultPartSize = 16 << 20
+	maxParts        = 10000
+)
+
+// Attempts at uploading a part before the upload fails. The wait between
+// attempts starts at defaultPartBackoff and doubles.
+const (
+	partAttempts       = 3
+	defaultPartBackoff = time.Second
+)
+
+// uploadedPart is a part of a multipart upload that S3 holds.
+type uploadedPart struct {
+	PartNumber int
+	ETag       string
+	// Base64 encoded SHA-256 of the part, verified by S3 on upload
+	ChecksumSHA256 string
+}
+
+// UploadFile uploads the file at path to key, in parts if it is larger than
+// one. Every part is sent with its SHA-256, which S3 verifies, and retried
+// on its own when it fails. An upload to key that was interrupted before,
+// by a failure or a restart, is resumed: parts S3 already holds with the
+// same checksum are not sent again.
+func (s *S3) UploadFile(ctx context.Context, path, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size <= s.partSize {
+		return s.Put(ctx, key, f, size)
+	}
+	partSize := max(s.partSize, (size+maxParts-1)/maxParts)
+	objectKey := s.config.Prefix + key
+
+	uploadID, uploaded, err := s.pendingUpload(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+	if uploadID == "" {
+		if uploadID, err = s.createUpload(ctx, objectKey); err != nil {
+			return err
+		}
+	}
+
+	var parts []uploadedPart
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+partSize {
+		n := min(partSize, size-offset)
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(f, offset, n)); err != nil {
+			return err
+		}
+		part := uploadedPart{PartNumber: number, ChecksumSHA256: base64.StdEncoding.EncodeToString(hash.Sum(nil))}
+
+		if previous, ok := uploaded[number]; ok && previous.ChecksumSHA256 == part.ChecksumSHA256 {
+			parts = append(parts, previous)
+			continue
+		}
+		if part.ETag, err = s.uploadPart(ctx, objectKey, uploadID, part, f, offset, n); err != nil {
+			return fmt.Errorf("uploading part %d of %s: %w", number, objectKey, err)
+		}
+		parts = append(parts, part)
+	}
+	return s.completeUpload(ctx, objectKey, uploadID, parts)
+}
+
+// pendingUpload returns the newest unfinished multipart upload of key and
+// the parts it holds, an empty ID if there is none.
+func (s *S3) pendingUpload(ctx context.Context, key string) (string, map[int]uploadedPart, error) {
+	resp, err := s.do(ctx, http.MethodGet, "", url.Values{"uploads": {""}, "prefix": {key}}, nil, nil, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	var uploads struct {
+		Upload []struct {
+			Key       string
+			UploadID  string `xml:"UploadId"`
+			Initiated time.Time
+		}
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&uploads)
+	resp.Body.Close()
+	if err != nil {
+		return "", nil, fmt.Errorf("listing uploads of s3://%s/%s: %w", s.config.Bucket, key, err)
+	}
+	var uploadID string
+	var initiated time.Time
+	for _, u := range uploads.Upload {
+		if u.Key == key && (uploadID == "" || u.Initiated.After(initiated)) {
+			uploadID, initiated = u.UploadID, u.Initiated
+		}
+	}
+	if uploadID == "" {
+		return "", nil, nil
+	}
+
+	parts := map[int]uploadedPart{}
+	query := url.Values{"uploadId": {uploadID}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, key, query, nil, nil, 0)
+		if errors.Is(err, ErrNotFound) {
+			// Completed or aborted since it was listed
+			return "", nil, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		var result struct {
+			Part                 []uploadedPart
+			IsTruncated          bool
+			NextPartNumberMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return "", nil, fmt.Errorf("listing parts of s3://%s/%s: %w", s.config.Bucket, key, err)
+		}
+		for _, p := range result.Part {
+			parts[p.PartNumber] = p
+		}
+		if !result.IsTruncated {
+			return uploadID, parts, nil
+		}
+		query.Set("part-number-marker", result.NextPartNumberMarker)
+	}
+}
+
+func (s *S3) createUpload(ctx context.Context, key string) (string, error) {
+	header := s.encryptionHeader()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Amz-Checksum-Algorithm", "SHA256")
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := s.checkEncrypted(resp, key); err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("starting upload of s3://%s/%s: no upload ID returned: %v", s.config.Bucket, key, err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart sends the n bytes of f at offset as part and returns its ETag.
+func (s *S3) uploadPart(ctx context.Context, key, uploadID string, part uploadedPart, f *os.File, offset, n int64) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(part.PartNumber)}, "uploadId": {uploadID}}
+	header := http.Header{"X-Amz-Checksum-Sha256": {part.ChecksumSHA256}}
+
+	backoff := s.partBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := s.do(ctx, http.MethodPut, key, query, header, io.NewSectionReader(f, offset, n), n)
+		if err == nil {
+			resp.Body.Close()
+			return resp.Header.Get("ETag"), nil
+		}
+		if attempt >= partAttempts || ctx.Err() != nil {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// completeUpload assembles the object from parts. S3 returns the checksum
+// of the part checksums, which is compared with the parts sent.
+func (s *S3) completeUpload(ctx context.Context, key, uploadID string, parts []uploadedPart) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Part    []uploadedPart `xml:"Part"`
+	}{Part: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Failures are reported with 200 OK once S3 started assembling the object
+	var result struct {
+		XMLName        xml.Name
+		Code           string
+		Message        string
+		ChecksumSHA256 string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("completing upload of s3://%s/%s: %w", s.config.Bucket, key, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 POST %s: %s: %s", key, result.Code, result.Message)
+	}
+	if want := partsChecksum(parts); result.ChecksumSHA256 != "" && result.ChecksumSHA256 != want {
+		return fmt.Errorf("s3 POST %s: object checksum %s, want %s", key, result.ChecksumSHA256, want)
+	}
+	return nil
+}
+
+// partsChecksum returns the checksum S3 reports for an object uploaded in
+// parts: the SHA-256 of the parts' SHA-256s, followed by the part count.
+func partsChecksum(parts []uploadedPart) string {
+	hash := sha256.New()
+	for _, p := range parts {
+		sum, _ := base64.StdEncoding.DecodeString(p.ChecksumSHA256)
+		hash.Write(sum)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"net_exercise/pkg/config"
+)
+
+// S3 keeps objects in an S3 bucket. Requests are signed with AWS Signature
+// Version 4; payloads are sent unsigned, which TLS already protects.
+type S3 struct {
+	config          config.S3Storage
+	endpoint        *url.URL
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	client          *http.Client
+	// See UploadFile
+	partSize    int64
+	partBackoff time.Duration
+}
+
+func NewS3(c config.S3Storage) (*S3, error) {
+	accessKeyIDEnv := c.AccessKeyIDEnv
+	if accessKeyIDEnv == "" {
+		accessKeyIDEnv = "AWS_ACCESS_KEY_ID"
+	}
+	secretAccessKeyEnv := c.SecretAccessKeyEnv
+	if secretAccessKeyEnv == "" {
+		secretAccessKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	s := &S3{
+		config:          c,
+		accessKeyID:     os.Getenv(accessKeyIDEnv),
+		secretAccessKey: os.Getenv(secretAccessKeyEnv),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		client:          http.DefaultClient,
+		partSize:        defaultPartSize,
+		partBackoff:     defaultPartBackoff,
+	}
+	if s.accessKeyID == "" || s.secretAccessKey == "" {
+		return nil, fmt.Errorf("s3 bucket %s: environment variables %s and %s must be set", c.Bucket, accessKeyIDEnv, secretAccessKeyEnv)
+	}
+	if c.CAFile != "" || c.InsecureSkipVerify || c.Proxy != "" {
+		transport, err := newTransport(c)
+		if err != nil {
+			return nil, fmt.Errorf("s3 bucket %s: %w", c.Bucket, err)
+		}
+		s.client = &http.Client{Transport: transport}
+	}
+
+	// Virtual-hosted style on AWS, path-style on S3 compatible stores
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", c.Bucket, c.Region)
+	if c.Endpoint != "" {
+		endpoint = strings.TrimSuffix(c.Endpoint, "/") + "/" + c.Bucket + "/"
+	}
+	var err error
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 bucket %s: %w", c.Bucket, err)
+	}
+
+	if c.KMSKeyID != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), kmsCheckTimeout)
+		defer cancel()
+		if err := s.checkKMSKey(ctx); err != nil {
+			return nil, fmt.Errorf("s3 bucket %s: kms key %s is not usable: %w", c.Bucket, c.KMSKeyID, err)
+		}
+	}
+	return s, nil
+}
+
+// How long checking the KMS key of a bucket at startup may take
+const kmsCheckTimeout = 30 * time.Second
+
+// Object written and read back to check the KMS key, below the prefix
+const kmsCheckKey = ".netx-kms-check"
+
+// checkKMSKey writes an object encrypted with the KMS key and reads it back,
+// which needs permission to encrypt and decrypt with the key.
+func (s *S3) checkKMSKey(ctx context.Context) error {
+	if err := s.Put(ctx, kmsCheckKey, strings.NewReader("ok"), 2); err != nil {
+		return err
+	}
+	r, err := s.Get(ctx, kmsCheckKey)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, kmsCheckKey)
+}
+
+// encryptionHeader returns the headers asking S3 to encrypt a new object
+// with the configured KMS key, none without one.
+func (s *S3) encryptionHeader() http.Header {
+	if s.config.KMSKeyID == "" {
+		return nil
+	}
+	return http.Header{
+		"X-Amz-Server-Side-Encryption":                {"aws:kms"},
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": {s.config.KMSKeyID},
+	}
+}
+
+// checkEncrypted fails when S3 did not encrypt a new object with KMS as
+// asked, e.g. S3 compatible stores ignoring the headers.
+func (s *S3) checkEncrypted(resp *http.Response, key string) error {
+	if s.config.KMSKeyID != "" && resp.Header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" {
+		return fmt.Errorf("s3 PUT %s: object was not encrypted with kms key %s", key, s.config.KMSKeyID)
+	}
+	return nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, s.config.Prefix+key, nil, s.encryptionHeader(), r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.checkEncrypted(resp, s.config.Prefix+key)
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.config.Prefix+key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s%s: %w", s.config.Bucket, s.config.Prefix, prefix, err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.config.Prefix))
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.config.Prefix+key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// newTransport returns a transport trusting the CA certificates of c and
+// going through its proxy.
+func newTransport(c config.S3Storage) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s holds no PEM certificates", c.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return transport, nil
+}
+
+// do sends a signed request for key, or for the bucket if key is empty. Error
+// responses are returned as errors, 404 as ErrNotFound.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path += key
+	u.RawPath = s.endpoint.EscapedPath() + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+
+	// A zero length body has to be http.NoBody, or it is sent chunked
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the Signature Version 4 authorization header to req.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as Signature Version 4 expects.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes every byte except the unreserved characters,
+// and slashes unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
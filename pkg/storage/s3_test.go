@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"net_exercise/pkg/config"
+)
+
+// fakeS3 serves the object requests of one bucket like S3 does.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// KMS key of every object encrypted with one
+	kmsKeys map[string]string
+	// Keys the credentials may use, nil to ignore the encryption headers
+	// like some S3 compatible stores do
+	usableKMSKeys []string
+	requests      []string
+
+	// Multipart uploads by ID
+	uploads map[string]*fakeUpload
+	// Part numbers received, in order
+	partsReceived []int
+	// Times uploading a part fails before it succeeds, by part number
+	failParts map[int]int
+}
+
+type fakeUpload struct {
+	key    string
+	kmsKey string
+	parts  map[int]uploadedPart
+	data   map[int][]byte
+}
+
+func newFakeS3(t *testing.T, usableKMSKeys ...string) (*fakeS3, config.S3Storage) {
+	t.Helper()
+	f := &fakeS3{
+		objects:       map[string][]byte{},
+		kmsKeys:       map[string]string{},
+		usableKMSKeys: usableKMSKeys,
+		uploads:       map[string]*fakeUpload{},
+		failParts:     map[int]int{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	return f, config.S3Storage{Bucket: "netx", Region: "eu-west-1", Prefix: "prod/", Endpoint: server.URL}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/netx/")
+	if !ok || r.Header.Get("Authorization") == "" {
+		s3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	query := r.URL.Query()
+	kmsKey := r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	if f.usableKMSKeys != nil && kmsKey != "" && !slices.Contains(f.usableKMSKeys, kmsKey) {
+		s3Error(w, http.StatusForbidden, "KMS.AccessDeniedException")
+		return
+	}
+	switch {
+	case query.Has("uploads") || query.Has("uploadId"):
+		f.serveMultipart(w, r, key, kmsKey)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = data
+		delete(f.kmsKeys, key)
+		if f.usableKMSKeys != nil && kmsKey != "" {
+			f.kmsKeys[key] = kmsKey
+			w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+		}
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.kmsKeys, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// serveMultipart serves the requests of multipart uploads.
+func (f *fakeS3) serveMultipart(w http.ResponseWriter, r *http.Request, key, kmsKey string) {
+	query := r.URL.Query()
+	upload := f.uploads[query.Get("uploadId")]
+	if query.Has("uploadId") && (upload == nil || upload.key != key) {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch {
+	// ListMultipartUploads
+	case r.Method == http.MethodGet && key == "":
+		fmt.Fprint(w, "<ListMultipartUploadsResult>")
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, query.Get("prefix")) {
+				fmt.Fprintf(w, "<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>2026-10-15T10:00:00.000Z</Initiated></Upload>", u.key, id)
+			}
+		}
+		fmt.Fprint(w, "</ListMultipartUploadsResult>")
+
+	// CreateMultipartUpload
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		if r.Header.Get("X-Amz-Checksum-Algorithm") != "SHA256" {
+			s3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		id := "upload-" + strconv.Itoa(len(f.uploads)+1)
+		f.uploads[id] = &fakeUpload{key: key, parts: map[int]uploadedPart{}, data: map[int][]byte{}}
+		if f.usableKMSKeys != nil && kmsKey != "" {
+			f.uploads[id].kmsKey = kmsKey
+			w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+		}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	// UploadPart
+	case r.Method == http.MethodPut:
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.partsReceived = append(f.partsReceived, number)
+		if f.failParts[number] > 0 {
+			f.failParts[number]--
+			s3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		sum := sha256.Sum256(data)
+		checksum := base64.StdEncoding.EncodeToString(sum[:])
+		if r.Header.Get("X-Amz-Checksum-Sha256") != checksum {
+			s3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		etag := fmt.Sprintf("%q", checksum[:8])
+		upload.parts[number] = uploadedPart{PartNumber: number, ETag: etag, ChecksumSHA256: checksum}
+		upload.data[number] = data
+		w.Header().Set("ETag", etag)
+
+	// ListParts
+	case r.Method == http.MethodGet:
+		result := struct {
+			XMLName xml.Name       `xml:"ListPartsResult"`
+			Part    []uploadedPart `xml:"Part"`
+		}{}
+		for _, p := range upload.parts {
+			result.Part = append(result.Part, p)
+		}
+		xml.NewEncoder(w).Encode(result)
+
+	// CompleteMultipartUpload
+	case r.Method == http.MethodPost:
+		var request struct {
+			Part []uploadedPart
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for _, p := range request.Part {
+			if upload.parts[p.PartNumber] != p {
+				s3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, upload.data[p.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.kmsKeys, key)
+		if upload.kmsKey != "" {
+			f.kmsKeys[key] = upload.kmsKey
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ChecksumSHA256>%s</ChecksumSHA256></CompleteMultipartUploadResult>", key, partsChecksum(request.Part))
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code><Message>"+code+"</Message></Error>")
+}
+
+func TestS3KMSKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		kmsKeyID      string
+		usableKMSKeys []string
+		wantErr       string
+	}{
+		{name: "no key"},
+		{name: "usable key", kmsKeyID: "alias/netx", usableKMSKeys: []string{"alias/netx"}},
+		{name: "key without access", kmsKeyID: "alias/other", usableKMSKeys: []string{"alias/netx"}, wantErr: "KMS.AccessDeniedException"},
+		{name: "store ignoring encryption", kmsKeyID: "alias/netx", wantErr: "was not encrypted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f, c := newFakeS3(t, tt.usableKMSKeys...)
+			c.KMSKeyID = tt.kmsKeyID
+
+			s, err := NewS3(c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewS3() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(f.objects) != 0 {
+				t.Errorf("objects left after checking the key: %v", f.requests)
+			}
+
+			if err := s.Put(ctx, "backup_1/configmap/shop.json", strings.NewReader("{}"), 2); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.kmsKeys["prod/backup_1/configmap/shop.json"]; got != tt.kmsKeyID {
+				t.Errorf("object encrypted with kms key %q, want %q", got, tt.kmsKeyID)
+			}
+		})
+	}
+}
+
+// Files are uploaded in parts with each part retried on its own, and an
+// upload that failed is resumed from the parts S3 holds.
+func TestS3UploadFile(t *testing.T) {
+	const partSize = 1 << 10
+	content := bytes.Repeat([]byte("0123456789abcdef"), partSize*5/2/16)
+	changed := bytes.ToUpper(content)
+
+	tests := []struct {
+		name string
+		size int
+		// Upload failed before, with these parts sent
+		pending []byte
+		// Part uploads failing, by part number
+		failParts map[int]int
+		wantErr   bool
+		// Part numbers uploaded, including failed attempts
+		wantParts []int
+	}{
+		{name: "single part", size: partSize},
+		{name: "parts", size: len(content), wantParts: []int{1, 2, 3}},
+		{name: "part failing once", size: len(content), failParts: map[int]int{2: 1}, wantParts: []int{1, 2, 2, 3}},
+		{name: "part failing every attempt", size: len(content), failParts: map[int]int{2: partAttempts}, wantErr: true, wantParts: []int{1, 2, 2, 2}},
+		{name: "resumed", size: len(content), pending: content, wantParts: []int{2, 3}},
+		{name: "resumed after the file changed", size: len(content), pending: changed, wantParts: []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f, c := newFakeS3(t)
+			s, err := NewS3(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.partSize, s.partBackoff = partSize, time.Millisecond
+			path := filepath.Join(t.TempDir(), "backup_1.tar.gz")
+
+			if tt.pending != nil {
+				// Part 2 fails every attempt, leaving part 1 uploaded
+				if err := os.WriteFile(path, tt.pending, 0644); err != nil {
+					t.Fatal(err)
+				}
+				f.failParts[2] = partAttempts
+				if err := s.UploadFile(ctx, path, "backup_1.tar.gz"); err == nil {
+					t.Fatal("UploadFile() of the interrupted upload succeeded")
+				}
+				f.partsReceived = nil
+			}
+			if err := os.WriteFile(path, content[:tt.size], 0644); err != nil {
+				t.Fatal(err)
+			}
+			for number, failures := range tt.failParts {
+				f.failParts[number] = failures
+			}
+
+			err = UploadFile(ctx, s, path, "backup_1.tar.gz")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UploadFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(f.partsReceived, tt.wantParts) {
+				t.Errorf("parts uploaded = %v, want %v", f.partsReceived, tt.wantParts)
+			}
+			if tt.wantErr {
+				if len(f.uploads) != 1 {
+					t.Errorf("%d uploads pending, want the failed one kept to resume", len(f.uploads))
+				}
+				return
+			}
+			if got := f.objects["prod/backup_1.tar.gz"]; !bytes.Equal(got, content[:tt.size]) {
+				t.Errorf("object has %d bytes, want the %d of the file", len(got), tt.size)
+			}
+			if len(f.uploads) != 0 {
+				t.Errorf("%d uploads left pending", len(f.uploads))
+			}
+		})
+	}
+}
+
+// Objects uploaded in parts are encrypted with the KMS key too.
+func TestS3UploadFileKMSKey(t *testing.T) {
+	f, c := newFakeS3(t, "alias/netx")
+	c.KMSKeyID = "alias/netx"
+	s, err := NewS3(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.partSize = 1 << 10
+	path := filepath.Join(t.TempDir(), "backup_1.tar.gz")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 3<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.UploadFile(context.Background(), path, "backup_1.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.kmsKeys["prod/backup_1.tar.gz"]; got != "alias/netx" {
+		t.Errorf("object encrypted with kms key %q, want alias/netx", got)
+	}
+}
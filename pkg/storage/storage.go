@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"net_exercise/pkg/config"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Backend stores objects under slash separated keys. Backups are stored as
+// one object per file, keyed <backup_id>/<path in the backup directory>.
+type Backend interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns ErrNotFound for keys that don't exist
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, in lexical order
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete succeeds for keys that don't exist
+	Delete(ctx context.Context, key string) error
+}
+
+// fileUploader is implemented by backends that upload files better than with
+// a single Put, e.g. in parts.
+type fileUploader interface {
+	UploadFile(ctx context.Context, path, key string) error
+}
+
+func New(c config.StorageBackend) (Backend, error) {
+	switch c.Type {
+	case config.StorageFS:
+		return NewFS(c.FS.Path), nil
+	case config.StorageS3:
+		return NewS3(*c.S3)
+	}
+	return nil, fmt.Errorf("storage backend %s: unknown type %q", c.Name, c.Type)
+}
+
+// Upload stores every file below dir under prefix. The files in last, paths
+// relative to dir, are uploaded after all others, e.g. a file marking the
+// upload as complete.
+func Upload(ctx context.Context, b Backend, dir, prefix string, last ...string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(last, rel) {
+			return nil
+		}
+		return UploadFile(ctx, b, path, prefix+filepath.ToSlash(rel))
+	})
+	if err != nil {
+		return err
+	}
+	for _, rel := range last {
+		if err := UploadFile(ctx, b, filepath.Join(dir, rel), prefix+filepath.ToSlash(rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadFile stores the file at path under key.
+func UploadFile(ctx context.Context, b Backend, path, key string) error {
+	if u, ok := b.(fileUploader); ok {
+		return u.UploadFile(ctx, path, key)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return b.Put(ctx, key, f, info.Size())
+}
+
+// Download writes every object under prefix to dir, the reverse of Upload.
+// It returns ErrNotFound if there are none.
+func Download(ctx context.Context, b Backend, prefix, dir string) error {
+	keys, err := b.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, prefix)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("object key %s escapes %s", key, prefix)
+		}
+		if err := DownloadFile(ctx, b, key, filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadFile writes the object key to the file at path.
+func DownloadFile(ctx context.Context, b Backend, key, path string) error {
+	r, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// DeleteAll deletes every object under prefix.
+func DeleteAll(ctx context.Context, b Backend, prefix string) error {
+	keys, err := b.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := b.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store persists the service's metadata as records, one bucket per kind of
+// entity keyed by ID, so registrations and the backup catalog survive
+// restarts. A change only writes the records it touched.
+type Store interface {
+	// Apply writes changes in one transaction, all or none of them
+	Apply(changes ...Change) error
+	// Each calls fn with the key and JSON value of every record in bucket,
+	// in key order. value is only valid until fn returns.
+	Each(bucket string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+// Change is a record to write or delete.
+type Change struct {
+	Bucket string
+	Key    string
+	// Stored as JSON
+	Value  any
+	Delete bool
+}
+
+func Put(bucket, key string, value any) Change {
+	return Change{Bucket: bucket, Key: key, Value: value}
+}
+
+func Delete(bucket, key string) Change {
+	return Change{Bucket: bucket, Key: key, Delete: true}
+}
+
+// Bolt keeps the records in a bbolt database file. Every Apply is a
+// transaction that is synced to disk before it returns, so a crash leaves
+// either all or none of its changes behind.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// How long OpenBolt waits for another process to release the file
+const openTimeout = 5 * time.Second
+
+func OpenBolt(path string) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening metadata store %s: %w", path, err)
+	}
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Apply(changes ...Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, change := range changes {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(change.Bucket))
+			if err != nil {
+				return err
+			}
+			if change.Delete {
+				if err := bucket.Delete([]byte(change.Key)); err != nil {
+					return err
+				}
+				continue
+			}
+			value, err := json.Marshal(change.Value)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", change.Bucket, change.Key, err)
+			}
+			if err := bucket.Put([]byte(change.Key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) Each(bucket string, fn func(key string, value []byte) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket([]byte(bucket))
+		if records == nil {
+			return nil
+		}
+		return records.ForEach(func(key, value []byte) error {
+			return fn(string(key), value)
+		})
+	})
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
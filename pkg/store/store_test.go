@@ -0,0 +1,58 @@
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+type record struct {
+	Name string `json:"name"`
+}
+
+// Records written survive reopening the file, and a failed transaction
+// leaves none of its changes behind.
+func TestBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata", "metadata.db")
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Put("apps", "app_1", record{"shop"}), Put("apps", "app_2", record{"blog"}), Put("settings", "app_counter", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Delete("apps", "app_1"), Delete("apps", "app_9")); err != nil {
+		t.Fatal(err)
+	}
+	// Channels can't be marshalled, failing the transaction
+	if err := s.Apply(Put("apps", "app_3", record{"wiki"}), Put("apps", "app_4", make(chan int))); err == nil {
+		t.Fatal("Apply() of an unmarshallable value succeeded")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	got := map[string]string{}
+	err = s.Each("apps", func(key string, value []byte) error {
+		var r record
+		if err := json.Unmarshal(value, &r); err != nil {
+			return err
+		}
+		got[key] = r.Name
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got["app_2"] != "blog" {
+		t.Errorf("apps = %v, want only app_2", got)
+	}
+	if err := s.Each("restores", func(string, []byte) error { return nil }); err != nil {
+		t.Errorf("Each() of a bucket never written error = %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Number of finished jobs a Pool remembers, older ones are forgotten
+const finishedJobs = 1000
+
+var (
+	ErrQueueFull = errors.New("job queue is full")
+	ErrNotFound  = errors.New("job not found")
+	ErrFinished  = errors.New("job has already finished")
+)
+
+// Func runs a job. It should return soon after ctx is cancelled. The result
+// is kept even if err is set, e.g. to report the ID of a failed restore.
+type Func func(ctx context.Context) (result any, err error)
+
+// Job is what a Pool reports about one of its jobs.
+type Job struct {
+	ID     string `json:"job_id"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (j Job) finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCancelled
+}
+
+type job struct {
+	Job
+	run    Func
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Pool runs jobs on a fixed number of goroutines, in the order they were
+// submitted. Jobs wait in a bounded queue until a worker is free.
+type Pool struct {
+	queue chan *job
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	finished []string
+	counter  int
+}
+
+// New starts a pool of concurrency workers with room for queueSize waiting
+// jobs.
+func New(concurrency, queueSize int) *Pool {
+	p := &Pool{
+		queue: make(chan *job, queueSize),
+		jobs:  map[string]*job{},
+	}
+	for i := 0; i < concurrency; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues run as a job of the given kind, e.g. "backup".
+func (p *Pool) Submit(kind string, run Func) (Job, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		Job: Job{
+			ID:       fmt.Sprintf("job_%d", p.counter+1),
+			Kind:     kind,
+			Status:   StatusQueued,
+			QueuedAt: time.Now().UTC(),
+		},
+		run:    run,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	select {
+	case p.queue <- j:
+	default:
+		cancel()
+		return Job{}, ErrQueueFull
+	}
+	p.counter++
+	p.jobs[j.ID] = j
+	return j.Job, nil
+}
+
+// Get returns the job with the given ID.
+func (p *Pool) Get(id string) (Job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	j, ok := p.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.Job, true
+}
+
+// List returns the jobs the pool knows about, oldest first.
+func (p *Pool) List() []Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	jobs := make([]Job, 0, len(p.jobs))
+	for _, j := range p.jobs {
+		jobs = append(jobs, j.Job)
+	}
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].QueuedAt.Before(jobs[b].QueuedAt)
+	})
+	return jobs
+}
+
+// Cancel cancels a job. Queued jobs never start, running jobs have their
+// context cancelled and are marked cancelled once they return.
+func (p *Pool) Cancel(id string) (Job, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	j, ok := p.jobs[id]
+	switch {
+	case !ok:
+		return Job{}, ErrNotFound
+	case j.finished():
+		return j.Job, ErrFinished
+	}
+	j.cancel()
+	if j.Status == StatusQueued {
+		p.finishLocked(j, StatusCancelled, nil, context.Canceled)
+	}
+	return j.Job, nil
+}
+
+func (p *Pool) work() {
+	for j := range p.queue {
+		p.mu.Lock()
+		if j.Status != StatusQueued {
+			// Cancelled while queued
+			p.mu.Unlock()
+			continue
+		}
+		startedAt := time.Now().UTC()
+		j.Status = StatusRunning
+		j.StartedAt = &startedAt
+		p.mu.Unlock()
+
+		result, err := j.run(j.ctx)
+
+		p.mu.Lock()
+		status := StatusSucceeded
+		switch {
+		case j.ctx.Err() != nil:
+			status = StatusCancelled
+		case err != nil:
+			status = StatusFailed
+		}
+		p.finishLocked(j, status, result, err)
+		p.mu.Unlock()
+	}
+}
+
+// finishLocked records the outcome of j and forgets the oldest finished
+// jobs. Must be called with p.mu held.
+func (p *Pool) finishLocked(j *job, status string, result any, err error) {
+	j.cancel()
+	finishedAt := time.Now().UTC()
+	j.Status = status
+	j.Result = result
+	j.FinishedAt = &finishedAt
+	if err != nil {
+		j.Error = err.Error()
+	}
+
+	p.finished = append(p.finished, j.ID)
+	if len(p.finished) > finishedJobs {
+		delete(p.jobs, p.finished[0])
+		p.finished = p.finished[1:]
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/notify"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// How often namespaces are matched against the protection policies
+const policyReconcileInterval = time.Minute
+
+func runProtectionPolicies(policies []config.ProtectionPolicy) {
+	for {
+		for _, policy := range policies {
+			if err := reconcileProtectionPolicy(context.Background(), policy); err != nil {
+				log.Printf("protection policy %s: %v", policy.Name, err)
+			}
+		}
+		time.Sleep(policyReconcileInterval)
+	}
+}
+
+// reconcileProtectionPolicy registers an application for every namespace
+// matching the policy, backs it up when the last backup is older than the
+// policy interval and deletes backups that fell out of retention.
+func reconcileProtectionPolicy(ctx context.Context, policy config.ProtectionPolicy) error {
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: policy.NamespaceSelector})
+	if err != nil {
+		return err
+	}
+
+	protected := map[string]bool{}
+	defer stopInventoryCaches(policy.Name, protected)
+
+	for _, ns := range namespaces.Items {
+		if !namespaceAllowed(ns.Name) {
+			continue
+		}
+		protected[ns.Name] = true
+
+		appID, existingAppID := registerApplication(Application{
+			Name:      ns.Name,
+			Namespace: ns.Name,
+			Policy:    policy.Name,
+		})
+		if existingAppID != "" {
+			appID = existingAppID
+		} else {
+			log.Printf("protection policy %s: registered %s for namespace %s", policy.Name, appID, ns.Name)
+		}
+
+		stateMu.Lock()
+		app := apps[appID]
+		stateMu.Unlock()
+
+		// A failed run also waits for the next interval, its retries are done
+		last, ok := latestAttempt(appID)
+		cache := inventoryCache(policy, ns.Name)
+		if !ok || time.Since(last.CreatedAt) >= policy.BackupInterval.Duration {
+			submitScheduledRun(policy, app, cache)
+		}
+
+		// Overdue once a run and all its retries should have finished
+		overdue := policy.BackupInterval.Duration + policy.Retry.MaxDuration.Duration + policyReconcileInterval
+		if last, ok := latestRecoveryPoint(appID); ok && time.Since(last.CreatedAt) > overdue && markScheduleMissed(appID) {
+			sendNotification(notify.Event{Type: notify.EventScheduleMissed, BackupID: last.BackupID}, app)
+		}
+
+		pruneBackups(appID)
+	}
+	return nil
+}
+
+// policyBackupJob backs up app, retrying failed attempts within the job
+// according to the policy's retry settings.
+func policyBackupJob(policy config.ProtectionPolicy, app Application, cache *backup.InventoryCache) worker.Func {
+	opts := backupOptions{Cache: cache, Type: policy.BackupType}
+	return func(ctx context.Context) (any, error) {
+		b, err := backupWithRetry(ctx, "protection policy "+policy.Name, app, opts, policy.Retry)
+		if err == nil {
+			log.Printf("protection policy %s: created %s for %s", policy.Name, b.BackupID, app.AppID)
+			clearScheduleMissed(app.AppID)
+		}
+		return gin.H{"backup_id": b.BackupID, "app_id": b.AppID, "status": b.Status, "attempt": b.Attempt}, err
+	}
+}
+
+// backupWithRetry backs up app, retrying failed attempts according to retry.
+// Every attempt shows up in the backup history. Once the attempts are used
+// up, or ctx is done, the run is given up and the failure alerted and
+// notified. source names what the backup is taken for in the log.
+func backupWithRetry(ctx context.Context, source string, app Application, opts backupOptions, retry config.RetryPolicy) (Backup, error) {
+	deadline := time.Now().Add(retry.MaxDuration.Duration)
+	backoff := retry.Backoff.Duration
+
+	for attempt := 1; ; attempt++ {
+		opts.Attempt = attempt
+		b, err := createBackup(ctx, app, opts)
+		if err == nil {
+			return b, nil
+		}
+		log.Printf("%s: backup attempt %d/%d of %s failed: %v", source, attempt, retry.Attempts, app.AppID, err)
+
+		giveUp := attempt >= retry.Attempts || time.Now().Add(backoff).After(deadline)
+		if !giveUp {
+			select {
+			case <-ctx.Done():
+				giveUp = true
+			case <-time.After(backoff):
+			}
+		}
+		if giveUp {
+			log.Printf("ALERT %s: scheduled backup of %s failed after %d attempts", source, app.AppID, attempt)
+			sendNotification(notify.Event{Type: notify.EventBackupFailed, BackupID: b.BackupID, Error: err.Error()}, app)
+			return b, err
+		}
+		backoff *= 2
+	}
+}
+
+type policyInventoryCache struct {
+	policy string
+	cache  *backup.InventoryCache
+}
+
+// Informer caches of the namespaces protected by policies with an
+// inventory_cache, keyed by namespace and guarded by stateMu
+var inventoryCaches = map[string]policyInventoryCache{}
+
+// inventoryCache returns the cache of namespace, started on first use, or nil
+// if the policy doesn't keep one.
+func inventoryCache(policy config.ProtectionPolicy, namespace string) *backup.InventoryCache {
+	if policy.InventoryCache == nil {
+		return nil
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	// Shared when several policies match the namespace
+	if c, ok := inventoryCaches[namespace]; ok {
+		return c.cache
+	}
+	c := backup.NewInventoryCache(clientset, namespace, policy.InventoryCache.MaxAge.Duration)
+	inventoryCaches[namespace] = policyInventoryCache{policy: policy.Name, cache: c}
+	return c
+}
+
+// stopInventoryCaches stops the caches policy keeps for namespaces it no
+// longer protects.
+func stopInventoryCaches(policy string, protected map[string]bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	for ns, c := range inventoryCaches {
+		if c.policy == policy && !protected[ns] {
+			c.cache.Stop()
+			delete(inventoryCaches, ns)
+		}
+	}
+}
+
+// Job of the last scheduled run of every app, guarded by stateMu
+var scheduledRuns = map[string]string{}
+
+// submitScheduledRun queues a backup job for a run of policy, unless the
+// last run of app is still queued or running. If the queue is full, the run
+// is tried again at the next reconcile.
+func submitScheduledRun(policy config.ProtectionPolicy, app Application, cache *backup.InventoryCache) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if id, ok := scheduledRuns[app.AppID]; ok {
+		if job, ok := jobs.Get(id); ok && (job.Status == worker.StatusQueued || job.Status == worker.StatusRunning) {
+			return
+		}
+	}
+	job, err := jobs.Submit("backup", policyBackupJob(policy, app, cache))
+	if err != nil {
+		log.Printf("protection policy %s: queueing backup of %s: %v", policy.Name, app.AppID, err)
+		return
+	}
+	scheduledRuns[app.AppID] = job.ID
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/drift"
+	"net_exercise/pkg/layout"
+	"net_exercise/pkg/manifest"
+
+	"github.com/gin-gonic/gin"
+)
+
+type protectionSchedule struct {
+	Policy   string             `json:"policy"`
+	Interval string             `json:"interval"`
+	Retry    config.RetryPolicy `json:"retry"`
+}
+
+type protectionStatus struct {
+	AppID string `json:"app_id"`
+	// True when the app has a complete, recent enough backup
+	Protected            bool                 `json:"protected"`
+	LastBackup           *Backup              `json:"last_backup,omitempty"`
+	LastSuccessfulBackup *Backup              `json:"last_successful_backup,omitempty"`
+	Schedule             *protectionSchedule  `json:"schedule,omitempty"`
+	Retention            string               `json:"retention,omitempty"`
+	GFSRetention         *config.GFSRetention `json:"gfs_retention,omitempty"`
+	// Changes in the namespace since the last successful backup
+	Drift        *drift.Report `json:"drift,omitempty"`
+	StorageBytes int64         `json:"storage_bytes"`
+	// Kinds the service backs up that the last successful backup lacks
+	MissingKinds []string `json:"missing_kinds,omitempty"`
+	// RPO and RTO against the application's objectives
+	Recovery recoveryStatus `json:"recovery"`
+}
+
+// applicationProtection answers "is this app protected?" in one call.
+func applicationProtection(c *gin.Context) {
+	appID := c.Param("id")
+
+	stateMu.Lock()
+	app, ok := apps[appID]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid app_id"})
+		return
+	}
+
+	status := protectionStatus{AppID: appID, Recovery: applicationRecovery(app)}
+
+	if last, ok := latestAttempt(appID); ok {
+		status.LastBackup = &last
+	}
+
+	var interval time.Duration
+	if policy, ok := protectionPolicy(app.Policy); ok {
+		interval = policy.BackupInterval.Duration
+		status.Schedule = &protectionSchedule{Policy: policy.Name, Interval: interval.String(), Retry: policy.Retry}
+		if policy.Retention.Duration > 0 {
+			status.Retention = policy.Retention.String()
+		}
+		status.GFSRetention = policy.GFSRetention
+	}
+
+	storage, err := backupStorageBytes(appID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status.StorageBytes = storage
+
+	if last, ok := latestBackup(appID); ok {
+		status.LastSuccessfulBackup = &last
+		backupDir, cleanup, err := backupFiles(c.Request.Context(), last.BackupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer cleanup()
+
+		m, ok, err := manifest.Read(backupDir)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, k := range layout.Kinds {
+			if !ok || !slices.Contains(m.Kinds, k.Prefix) {
+				status.MissingKinds = append(status.MissingKinds, k.Prefix)
+			}
+		}
+
+		status.Drift, err = drift.Compare(c.Request.Context(), backupDir, app.Namespace, m.LabelSelector, last.CreatedAt, restoreClients.Metadata)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Scheduled apps are only protected while the schedule keeps up,
+		// unchanged runs count as they confirm the last backup is current
+		point, _ := latestRecoveryPoint(appID)
+		fresh := interval == 0 || time.Since(point.CreatedAt) <= interval+policyReconcileInterval
+		status.Protected = len(status.MissingKinds) == 0 && fresh
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func protectionPolicy(name string) (policy config.ProtectionPolicy, ok bool) {
+	for _, p := range cfg.ProtectionPolicies {
+		if name != "" && p.Name == name {
+			return p, true
+		}
+	}
+	return policy, false
+}
+
+// backupStorageBytes sums the size of all backup files of appID.
+func backupStorageBytes(appID string) (int64, error) {
+	stateMu.Lock()
+	var ids []string
+	for id, b := range backups {
+		if b.AppID == appID {
+			ids = append(ids, id)
+		}
+	}
+	stateMu.Unlock()
+
+	var total int64
+	for _, id := range ids {
+		size, err := backupSizeBytes(id)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// backupSizeBytes returns the size of the files of one backup on disk, or of
+// its archive. A backup without files, e.g. a failed or unchanged run, has
+// size 0.
+func backupSizeBytes(backupID string) (int64, error) {
+	if info, err := os.Stat(backupArchivePath(backupID)); err == nil {
+		return info.Size(), nil
+	}
+
+	var total int64
+	err := filepath.WalkDir(fmt.Sprintf("./backups/%s", backupID), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return total, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// Number of recent completed restores the estimated RTO is based on
+const rtoSampleSize = 10
+
+// recoveryStatus compares what an application would lose and how long it
+// would be down if it had to be restored now with its objectives.
+type recoveryStatus struct {
+	TargetRPO string `json:"target_rpo,omitempty"`
+	// Time since the last successful or unchanged backup, empty without one
+	ActualRPO    string `json:"actual_rpo,omitempty"`
+	RPOCompliant *bool  `json:"rpo_compliant,omitempty"`
+	TargetRTO    string `json:"target_rto,omitempty"`
+	// Longest of the recent completed restores, empty without any
+	EstimatedRTO string `json:"estimated_rto,omitempty"`
+	RTOCompliant *bool  `json:"rto_compliant,omitempty"`
+	// Number of restores EstimatedRTO is based on
+	RestoreSamples int `json:"restore_samples"`
+
+	actualRPO    time.Duration
+	estimatedRTO time.Duration
+}
+
+// applicationRecovery computes the recovery status of app. Compliance is only
+// reported for the objectives app declares, and never without data: an app
+// that was never restored has no estimated RTO to compare.
+func applicationRecovery(app Application) recoveryStatus {
+	var status recoveryStatus
+
+	if last, ok := latestRecoveryPoint(app.AppID); ok {
+		status.actualRPO = time.Since(last.CreatedAt).Round(time.Second)
+		status.ActualRPO = status.actualRPO.String()
+	}
+	if app.TargetRPO != nil {
+		status.TargetRPO = app.TargetRPO.String()
+		// Without any backup everything would be lost
+		compliant := status.ActualRPO != "" && status.actualRPO <= app.TargetRPO.Duration
+		status.RPOCompliant = &compliant
+	}
+
+	durations := restoreDurations(app.AppID)
+	status.RestoreSamples = len(durations)
+	if len(durations) > 0 {
+		status.estimatedRTO = slices.Max(durations).Round(time.Second)
+		status.EstimatedRTO = status.estimatedRTO.String()
+	}
+	if app.TargetRTO != nil {
+		status.TargetRTO = app.TargetRTO.String()
+		if status.EstimatedRTO != "" {
+			compliant := status.estimatedRTO <= app.TargetRTO.Duration
+			status.RTOCompliant = &compliant
+		}
+	}
+	return status
+}
+
+// restoreDurations returns how long the most recent completed restores of
+// appID's backups took.
+func restoreDurations(appID string) []time.Duration {
+	stateMu.Lock()
+	var completed []Restore
+	for _, r := range restores {
+		if r.AppID == appID && r.Status == restoreStatusCompleted {
+			completed = append(completed, r)
+		}
+	}
+	stateMu.Unlock()
+
+	slices.SortFunc(completed, func(a, b Restore) int { return b.FinishedAt.Compare(a.FinishedAt) })
+	if len(completed) > rtoSampleSize {
+		completed = completed[:rtoSampleSize]
+	}
+
+	durations := make([]time.Duration, 0, len(completed))
+	for _, r := range completed {
+		durations = append(durations, r.FinishedAt.Sub(r.StartedAt))
+	}
+	return durations
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"net_exercise/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reindexReport lists what was inconsistent before POST /admin/reindex
+// rebuilt the indexes. Only the index and the counters are repaired; the
+// other findings are for an admin to look into.
+type reindexReport struct {
+	Applications int `json:"applications"`
+	Backups      int `json:"backups"`
+	Restores     int `json:"restores"`
+	// name_namespace keys of appNameNamespaceMap pointing at an unknown app
+	// or at an app with another name or namespace
+	StaleIndexEntries []string `json:"stale_index_entries,omitempty"`
+	// Applications the index didn't find
+	MissingIndexEntries []string `json:"missing_index_entries,omitempty"`
+	// Applications registered more than once with the same name and
+	// namespace. The index keeps the oldest.
+	DuplicateApplications [][]string `json:"duplicate_applications,omitempty"`
+	// ID counters that were behind IDs in use and were raised, so new IDs
+	// don't collide
+	CountersRaised []string `json:"counters_raised,omitempty"`
+	// Backups of applications that are no longer registered, e.g. after
+	// DELETE /application/:id without cascade
+	OrphanedBackups []string `json:"orphaned_backups,omitempty"`
+	// Completed backups with neither files or an archive in ./backups nor a
+	// storage backend
+	MissingBackupFiles []string `json:"missing_backup_files,omitempty"`
+	// Directories and archives in ./backups without a catalog entry
+	UntrackedBackupDirs []string `json:"untracked_backup_dirs,omitempty"`
+}
+
+// reindex reloads applications, backups and restores from the metadata
+// store, e.g. after it was imported or edited, and rebuilds the indexes
+// derived from them.
+func reindex(c *gin.Context) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	// Reloading would drop the changes the store doesn't have
+	if persistErr != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("the metadata store is behind, the last save failed: %v", persistErr)})
+		return
+	}
+
+	state, ok, err := readState()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if ok {
+		appCounter = state.AppCounter
+		backupCounter = state.BackupCounter
+		restoreCounter = state.RestoreCounter
+		scheduleCounter = state.ScheduleCounter
+		apps = state.Apps
+		backups = state.Backups
+		restores = state.Restores
+		schedules = state.Schedules
+	}
+
+	report := reindexReport{Applications: len(apps), Backups: len(backups), Restores: len(restores)}
+	checkIndexLocked(&report)
+	checkCountersLocked(&report)
+	if err := checkBackupFilesLocked(&report); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rebuildIndexesLocked()
+	persistLocked(countersChanges()...)
+	c.JSON(http.StatusOK, report)
+}
+
+func checkIndexLocked(report *reindexReport) {
+	for key, id := range appNameNamespaceMap {
+		app, ok := apps[id]
+		if !ok || fmt.Sprintf("%s_%s", app.Name, app.Namespace) != key {
+			report.StaleIndexEntries = append(report.StaleIndexEntries, key)
+		}
+	}
+	slices.Sort(report.StaleIndexEntries)
+
+	byKey := map[string][]string{}
+	for id, app := range apps {
+		key := fmt.Sprintf("%s_%s", app.Name, app.Namespace)
+		byKey[key] = append(byKey[key], id)
+		if appNameNamespaceMap[key] != id {
+			report.MissingIndexEntries = append(report.MissingIndexEntries, id)
+		}
+	}
+	slices.SortFunc(report.MissingIndexEntries, compareIDs)
+	for _, ids := range byKey {
+		if len(ids) > 1 {
+			slices.SortFunc(ids, compareIDs)
+			report.DuplicateApplications = append(report.DuplicateApplications, ids)
+		}
+	}
+	slices.SortFunc(report.DuplicateApplications, func(a, b []string) int { return compareIDs(a[0], b[0]) })
+	// The one the index keeps for a duplicate isn't missing
+	for _, ids := range report.DuplicateApplications {
+		report.MissingIndexEntries = slices.DeleteFunc(report.MissingIndexEntries, func(id string) bool {
+			return slices.Contains(ids[1:], id)
+		})
+	}
+}
+
+func checkCountersLocked(report *reindexReport) {
+	raise := func(name string, counter *int, ids []string) {
+		for _, id := range ids {
+			_, num, _ := strings.Cut(id, "_")
+			if n, err := strconv.Atoi(num); err == nil && n > *counter {
+				*counter = n
+				if !slices.Contains(report.CountersRaised, name) {
+					report.CountersRaised = append(report.CountersRaised, name)
+				}
+			}
+		}
+	}
+	var appIDs, backupIDs, restoreIDs, scheduleIDs []string
+	for id := range apps {
+		appIDs = append(appIDs, id)
+	}
+	for id := range backups {
+		backupIDs = append(backupIDs, id)
+	}
+	for id := range restores {
+		restoreIDs = append(restoreIDs, id)
+	}
+	for id := range schedules {
+		scheduleIDs = append(scheduleIDs, id)
+	}
+	raise("app_counter", &appCounter, appIDs)
+	raise("backup_counter", &backupCounter, backupIDs)
+	raise("restore_counter", &restoreCounter, restoreIDs)
+	raise("schedule_counter", &scheduleCounter, scheduleIDs)
+}
+
+func checkBackupFilesLocked(report *reindexReport) error {
+	for id, b := range backups {
+		if _, ok := apps[b.AppID]; !ok {
+			report.OrphanedBackups = append(report.OrphanedBackups, id)
+		}
+		if b.Status != backupStatusCompleted || b.Storage != "" {
+			continue
+		}
+		path := fmt.Sprintf("./backups/%s", id)
+		if b.Format == config.FormatArchive {
+			path = backupArchivePath(id)
+		}
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			report.MissingBackupFiles = append(report.MissingBackupFiles, id)
+		}
+	}
+	slices.SortFunc(report.OrphanedBackups, compareIDs)
+	slices.SortFunc(report.MissingBackupFiles, compareIDs)
+
+	entries, err := os.ReadDir("./backups")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, e := range entries {
+		id := e.Name()
+		if !e.IsDir() {
+			var ok bool
+			if id, ok = strings.CutSuffix(id, ".tar.gz"); !ok {
+				continue
+			}
+		}
+		// Backups still being written have logs but no catalog entry yet
+		_, tracked := backups[id]
+		_, running := backupLogs[id]
+		if !tracked && !running && !strings.Contains(id, ".") {
+			report.UntrackedBackupDirs = append(report.UntrackedBackupDirs, e.Name())
+		}
+	}
+	slices.SortFunc(report.UntrackedBackupDirs, compareIDs)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"net_exercise/pkg/auth"
+	"net_exercise/pkg/redact"
+	"net_exercise/pkg/restore"
+
+	"github.com/gin-gonic/gin"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// writeRestoreBundle sends the objects of plan as a single multi-document
+// YAML file that kubectl apply -f accepts.
+func writeRestoreBundle(c *gin.Context, backupID string, plan *restore.Plan) {
+	canReadSecrets := auth.FromContext(c).CanReadSecrets()
+
+	var bundle bytes.Buffer
+	err := plan.EachManifest(func(obj *unstructured.Unstructured) error {
+		if !canReadSecrets {
+			redact.Object(obj)
+		}
+		objYAML, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		bundle.WriteString("---\n")
+		bundle.Write(objYAML)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=restore-%s-%s.yaml", backupID, plan.Namespace))
+	c.Data(http.StatusOK, "application/yaml", bundle.Bytes())
+}
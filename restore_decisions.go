@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"net_exercise/pkg/restore"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long an interactive restore waits for its decisions before it fails
+const decisionTimeout = time.Hour
+
+var (
+	errDecisionTimeout    = errors.New("no decisions were made within " + decisionTimeout.String())
+	errRestoreInterrupted = errors.New("the service restarted before the restore finished")
+)
+
+// pendingRestore is an interactive restore paused for decisions. It keeps
+// the backup acquired and unpacked until it resumes or times out.
+type pendingRestore struct {
+	request restoreRequest
+	result  *restore.Result
+	release func()
+	cleanup func()
+	timer   *time.Timer
+}
+
+// Guarded by stateMu
+var pendingRestores = map[string]*pendingRestore{}
+
+func awaitDecisions(restoreID string, p *pendingRestore) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	p.timer = time.AfterFunc(decisionTimeout, func() { abandonRestore(restoreID) })
+	pendingRestores[restoreID] = p
+}
+
+// abandonRestore fails a paused restore nobody made the decisions for.
+func abandonRestore(restoreID string) {
+	stateMu.Lock()
+	p, ok := pendingRestores[restoreID]
+	delete(pendingRestores, restoreID)
+	r := restores[restoreID]
+	stateMu.Unlock()
+	if !ok {
+		return
+	}
+
+	p.result.Plan.Close()
+	p.cleanup()
+	p.release()
+	notifyRestore(updateRestore(r, nil, errDecisionTimeout))
+}
+
+// pendingDecisions lists the objects a paused restore waits for decisions on.
+func pendingDecisions(c *gin.Context) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	r, ok := restores[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid restore_id"})
+		return
+	}
+
+	pending := r.PendingDecisions
+	if pending == nil {
+		pending = []restore.PlannedObject{}
+	}
+	response := gin.H{"restore_id": r.RestoreID, "status": r.Status, "pending_decisions": pending}
+	if p, ok := pendingRestores[r.RestoreID]; ok {
+		response["confirm_token"] = p.result.Plan.ConfirmToken
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// decideRestore applies decisions to a paused restore: keep the object in
+// the cluster, overwrite it from the backup, or restore the backed up object
+// under a new name. Objects can be decided over several calls, the restore
+// continues as a job once none is left. Overwriting needs the confirm token
+// the paused restore reported.
+func decideRestore(c *gin.Context) {
+	var requestBody struct {
+		Decisions    []restore.Decision `json:"decisions" binding:"required,dive"`
+		ConfirmToken string             `json:"confirm_token"`
+	}
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	r, ok := restores[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid restore_id"})
+		return
+	}
+	p, ok := pendingRestores[r.RestoreID]
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "The restore is not awaiting decisions", "status": r.Status})
+		return
+	}
+
+	if err := p.result.Plan.Decide(requestBody.Decisions, requestBody.ConfirmToken); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, restore.ErrOverwriteConfirmationRequired) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	r.PendingDecisions = p.result.Plan.Pending()
+	if len(r.PendingDecisions) > 0 {
+		restores[r.RestoreID] = r
+		persistLocked(restoreChange(r.RestoreID))
+		c.JSON(http.StatusOK, r)
+		return
+	}
+
+	// Once decided the restore can be resumed with an empty list if the
+	// queue is full now
+	job, err := jobs.Submit("restore", resumeRestoreJob(r, p))
+	if err != nil {
+		restores[r.RestoreID] = r
+		persistLocked(restoreChange(r.RestoreID))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	p.timer.Stop()
+	delete(pendingRestores, r.RestoreID)
+	r.Status = restoreStatusRunning
+	restores[r.RestoreID] = r
+	persistLocked(restoreChange(r.RestoreID))
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// resumeRestoreJob executes the plan of a restore once all its decisions are
+// made.
+func resumeRestoreJob(r Restore, p *pendingRestore) worker.Func {
+	return func(ctx context.Context) (any, error) {
+		defer p.release()
+		defer p.cleanup()
+
+		err := restore.Resume(ctx, p.result, restoreClients)
+		if err == nil {
+			checkScheduling(ctx, p.request, r.BackupID, p.result)
+		}
+		record := updateRestore(r, p.result, err)
+		writeRestoreStatus(ctx, p.request, record, p.result)
+		notifyRestore(record)
+		return restoreJobResult(record, p.result, err), err
+	}
+}
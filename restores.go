@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"net_exercise/pkg/backup"
+	"net_exercise/pkg/manifest"
+	"net_exercise/pkg/notify"
+	"net_exercise/pkg/restore"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	restoreStatusCompleted = "completed"
+	restoreStatusFailed    = "failed"
+	// Interactive restores paused until their decisions are made, see
+	// decideRestore, and running again once they are
+	restoreStatusAwaitingDecisions = "awaiting_decisions"
+	restoreStatusRunning           = "running"
+)
+
+type Restore struct {
+	RestoreID string    `json:"restore_id"`
+	BackupID  string    `json:"backup_id"`
+	AppID     string    `json:"app_id,omitempty"`
+	Namespace string    `json:"namespace"`
+	StartedAt time.Time `json:"started_at"`
+	// Zero until the restore is finished
+	FinishedAt time.Time        `json:"finished_at"`
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	Profile    *restore.Profile `json:"profile,omitempty"`
+	// Objects created by the restore, by their UID in the backup
+	UIDMappings []restore.UIDMapping `json:"uid_mappings,omitempty"`
+	// Pods that could not be scheduled shortly after the restore
+	Scheduling *restore.SchedulingReport `json:"scheduling,omitempty"`
+	// Objects modified since the backup that an interactive restore waits
+	// for decisions on
+	PendingDecisions []restore.PlannedObject `json:"pending_decisions,omitempty"`
+}
+
+var restoreCounter int = 0
+var restores map[string]Restore = make(map[string]Restore)
+
+// recordRestore stores the outcome of a restore under a new restore_id.
+func recordRestore(backupID, namespace string, startedAt time.Time, result *restore.Result, err error) Restore {
+	r := Restore{
+		BackupID:  backupID,
+		Namespace: namespace,
+		StartedAt: startedAt,
+	}
+	r.setOutcome(result, err)
+
+	stateMu.Lock()
+	r.AppID = backups[backupID].AppID
+	restoreCounter++
+	r.RestoreID = fmt.Sprintf("restore_%d", restoreCounter)
+	restores[r.RestoreID] = r
+	persistLocked(restoreChange(r.RestoreID), settingChange("restore_counter", restoreCounter))
+	stateMu.Unlock()
+
+	return r
+}
+
+// updateRestore stores the outcome of a restore that was recorded before,
+// while it awaited decisions.
+func updateRestore(r Restore, result *restore.Result, err error) Restore {
+	r.setOutcome(result, err)
+
+	stateMu.Lock()
+	restores[r.RestoreID] = r
+	persistLocked(restoreChange(r.RestoreID))
+	stateMu.Unlock()
+
+	return r
+}
+
+func (r *Restore) setOutcome(result *restore.Result, err error) {
+	r.Status = restoreStatusCompleted
+	r.Error = ""
+	r.PendingDecisions = nil
+	if errors.Is(err, restore.ErrDecisionsPending) {
+		r.Status = restoreStatusAwaitingDecisions
+		r.PendingDecisions = result.Plan.Pending()
+		return
+	}
+
+	r.FinishedAt = time.Now().UTC()
+	if err != nil {
+		r.Status = restoreStatusFailed
+		r.Error = err.Error()
+	}
+	if result != nil {
+		r.Profile = &result.Profile
+		r.UIDMappings = result.UIDMappings
+		r.Scheduling = result.Scheduling
+	}
+}
+
+// writeRestoreStatus writes the outcome of every object of a finished
+// restore to a ConfigMap in its namespace, if the request asked for it.
+// Restores that failed before any object was planned have nothing to report.
+func writeRestoreStatus(ctx context.Context, request restoreRequest, r Restore, result *restore.Result) {
+	if !request.StatusConfigMap || result == nil {
+		return
+	}
+	// Also written when the restore failed because ctx was canceled
+	if err := restore.WriteStatus(context.WithoutCancel(ctx), restoreClients, result.Plan, r.RestoreID, r.Status); err != nil {
+		log.Printf("restore %s: %v", r.RestoreID, err)
+	}
+}
+
+// notifyRestore tells the recipients of the application the restored backup
+// belongs to and the event bus how the restore went.
+func notifyRestore(r Restore) {
+	stateMu.Lock()
+	app, ok := apps[backups[r.BackupID].AppID]
+	stateMu.Unlock()
+
+	eventType := notify.LifecycleRestoreCompleted
+	if r.Status == restoreStatusFailed {
+		eventType = notify.LifecycleRestoreFailed
+	}
+	publishEvent(notify.LifecycleEvent{
+		Type:      eventType,
+		AppID:     r.AppID,
+		BackupID:  r.BackupID,
+		RestoreID: r.RestoreID,
+		Namespace: r.Namespace,
+		Status:    r.Status,
+		Error:     r.Error,
+		Time:      r.FinishedAt,
+	}, app)
+	if !ok {
+		return
+	}
+
+	sendNotification(notify.Event{
+		Type:      notify.EventRestoreCompleted,
+		BackupID:  r.BackupID,
+		RestoreID: r.RestoreID,
+		Namespace: r.Namespace,
+		Status:    r.Status,
+		Error:     r.Error,
+		Time:      r.FinishedAt,
+	}, app)
+}
+
+// restoreProfile returns the timing breakdown of a restore, to find out
+// which kinds, objects or API calls made it slow.
+func restoreProfile(c *gin.Context) {
+	stateMu.Lock()
+	r, ok := restores[c.Param("id")]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid restore_id"})
+		return
+	}
+	if r.Profile == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Restore failed before any object was processed", "restore_id": r.RestoreID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"restore_id": r.RestoreID, "profile": r.Profile})
+}
+
+// resolveOriginalUID finds the objects restored from the object that had the
+// given UID when it was backed up, for systems that tracked objects by UID.
+func resolveOriginalUID(c *gin.Context) {
+	uid := c.Param("uid")
+
+	type restoredObject struct {
+		RestoreID string `json:"restore_id"`
+		restore.UIDMapping
+	}
+	objects := []restoredObject{}
+
+	stateMu.Lock()
+	for _, r := range restores {
+		for _, m := range r.UIDMappings {
+			if m.OriginalUID == uid {
+				objects = append(objects, restoredObject{RestoreID: r.RestoreID, UIDMapping: m})
+			}
+		}
+	}
+	stateMu.Unlock()
+
+	if len(objects) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No restored object has this original UID"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"original_uid": uid, "objects": objects})
+}
+
+// restoreHealth compares the restored application with how healthy it was
+// when the backup was taken.
+func restoreHealth(c *gin.Context) {
+	stateMu.Lock()
+	r, ok := restores[c.Param("id")]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid restore_id"})
+		return
+	}
+
+	m, ok, err := readManifest(c.Request.Context(), r.BackupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok || m.Health == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The backup has no health snapshot", "backup_id": r.BackupID})
+		return
+	}
+
+	current, err := backup.HealthSnapshot(c.Request.Context(), clientset, r.Namespace, m.LabelSelector)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Workloads with fewer ready replicas than at backup time
+	type degradedWorkload struct {
+		Kind                string `json:"kind"`
+		Name                string `json:"name"`
+		BackupReadyReplicas int32  `json:"backup_ready_replicas"`
+		ReadyReplicas       int32  `json:"ready_replicas"`
+		Missing             bool   `json:"missing,omitempty"`
+	}
+	degraded := []degradedWorkload{}
+
+	live := map[string]manifest.WorkloadHealth{}
+	for _, w := range current.Workloads {
+		live[w.Kind+"/"+w.Name] = w
+	}
+	for _, w := range m.Health.Workloads {
+		now, ok := live[w.Kind+"/"+w.Name]
+		if ok && now.ReadyReplicas >= w.ReadyReplicas {
+			continue
+		}
+		degraded = append(degraded, degradedWorkload{
+			Kind:                w.Kind,
+			Name:                w.Name,
+			BackupReadyReplicas: w.ReadyReplicas,
+			ReadyReplicas:       now.ReadyReplicas,
+			Missing:             !ok,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"restore_id": r.RestoreID,
+		"backup":     m.Health,
+		"current":    current,
+		"degraded":   degraded,
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/store"
+)
+
+// Why a backup is kept, recorded in Backup.RetainedBy
+const (
+	// The most recent completed backup of each type, never pruned so a
+	// failing backup job doesn't leave an app without one
+	retainedLatest = "latest"
+	// Younger than the policy's retention
+	retainedAge     = "retention"
+	retainedDaily   = "daily"
+	retainedWeekly  = "weekly"
+	retainedMonthly = "monthly"
+	// Failed runs under GFS retention, kept for a day to look into
+	retainedRecent = "recent"
+	// Holds the data of a kept unchanged run
+	retainedSameAs = "same_as"
+	// Parent of a kept incremental backup
+	retainedParent = "parent"
+	// Under the retention of an application or schedule
+	retainedKeepLast = "keep_last"
+	retainedMaxAge   = "max_age"
+)
+
+// How long failed runs are kept under GFS retention
+const gfsFailedRunAge = 24 * time.Hour
+
+// How often the backups of all applications are pruned
+const pruneInterval = 10 * time.Minute
+
+// runPruner prunes the backups of every application until the process exits.
+func runPruner() {
+	for {
+		stateMu.Lock()
+		appIDs := make([]string, 0, len(apps))
+		for id := range apps {
+			appIDs = append(appIDs, id)
+		}
+		stateMu.Unlock()
+
+		for _, id := range appIDs {
+			pruneBackups(id)
+		}
+		time.Sleep(pruneInterval)
+	}
+}
+
+// pruneBackups deletes the backups of appID that its retention doesn't
+// keep, and records on the others which rules keep them.
+func pruneBackups(appID string) {
+	if _, ok := latestBackup(appID); !ok {
+		return
+	}
+
+	var expired []string
+	stateMu.Lock()
+	app, ok := apps[appID]
+	if !ok {
+		stateMu.Unlock()
+		return
+	}
+	retained, managed := retainedBackupsLocked(app)
+	var changes []store.Change
+	for id, b := range backups {
+		if !managed[id] {
+			continue
+		}
+		reasons, ok := retained[id]
+		if !ok {
+			expired = append(expired, id)
+			continue
+		}
+		if !slices.Equal(b.RetainedBy, reasons) {
+			b.RetainedBy = reasons
+			backups[id] = b
+			changes = append(changes, backupChange(id))
+		}
+	}
+	persistLocked(changes...)
+	stateMu.Unlock()
+
+	for _, id := range expired {
+		// Retention never forces, a retention shorter than the minimum age
+		// keeps backups until they are old enough. Backups being restored,
+		// and parents or same_as targets whose expired runs are deleted
+		// now, are pruned by a later run.
+		if err := deleteBackup(id, false); err != nil && !errors.Is(err, errBackupTooRecent) && !errors.Is(err, errBackupInUse) && !errors.Is(err, errBackupDeleting) && !errors.Is(err, errBackupIsParent) && !errors.Is(err, errBackupIsSameAs) {
+			log.Printf("deleting expired backup %s: %v", id, err)
+		}
+	}
+}
+
+// retainedBackupsLocked returns the backups of app that a retention rule
+// applies to, and of those the ones kept with the rules keeping each. The
+// retention of the schedule that took a backup applies to it, otherwise the
+// application's, otherwise the protection policy's. Backups without any are
+// kept forever. Must be called with stateMu held.
+func retainedBackupsLocked(app Application) (retained map[string][]string, managed map[string]bool) {
+	var appBackups []Backup
+	for _, b := range backups {
+		if b.AppID == app.AppID {
+			appBackups = append(appBackups, b)
+		}
+	}
+	// Newest first, the first backup in a period is the one kept for it
+	slices.SortFunc(appBackups, func(a, b Backup) int { return b.CreatedAt.Compare(a.CreatedAt) })
+
+	policy, hasPolicy := protectionPolicy(app.Policy)
+	hasPolicy = hasPolicy && (policy.Retention.Duration > 0 || policy.GFSRetention != nil)
+
+	// Backups by the retention applying to them, keyed by schedule_id, or ""
+	// for the application's
+	byRule := map[string][]Backup{}
+	rules := map[string]config.BackupRetention{}
+	var policyBackups []Backup
+	managed = map[string]bool{}
+	for _, b := range appBackups {
+		switch {
+		case b.ScheduleID != "" && schedules[b.ScheduleID].Retention != nil:
+			rules[b.ScheduleID] = *schedules[b.ScheduleID].Retention
+			byRule[b.ScheduleID] = append(byRule[b.ScheduleID], b)
+		case app.Retention != nil:
+			rules[""] = *app.Retention
+			byRule[""] = append(byRule[""], b)
+		case hasPolicy:
+			policyBackups = append(policyBackups, b)
+		default:
+			continue
+		}
+		managed[b.BackupID] = true
+	}
+
+	retained = map[string][]string{}
+	keep := func(id, reason string) {
+		if !slices.Contains(retained[id], reason) {
+			retained[id] = append(retained[id], reason)
+		}
+	}
+
+	// A newer config backup doesn't replace the volume data of a full one
+	latestOfType := map[string]bool{}
+	for _, b := range appBackups {
+		if b.Status == backupStatusCompleted && !latestOfType[b.backupType()] {
+			latestOfType[b.backupType()] = true
+			keep(b.BackupID, retainedLatest)
+		}
+	}
+
+	for key, ruleBackups := range byRule {
+		rule := rules[key]
+		kept := 0
+		for _, b := range ruleBackups {
+			if kept < rule.KeepLast && (b.Status == backupStatusCompleted || b.Status == backupStatusUnchanged) {
+				kept++
+				keep(b.BackupID, retainedKeepLast)
+			}
+			if time.Since(b.CreatedAt) <= rule.MaxAge.Duration {
+				keep(b.BackupID, retainedMaxAge)
+			}
+		}
+	}
+
+	if hasPolicy {
+		retainPolicyBackups(policyBackups, policy, keep)
+	}
+
+	// Unchanged runs that are kept, or that no rule applies to, keep the
+	// backup they refer to, and incremental backups their parent. Both are
+	// older, so whole chains are kept going from newest to oldest.
+	for _, b := range appBackups {
+		if _, ok := retained[b.BackupID]; !ok && managed[b.BackupID] {
+			continue
+		}
+		if b.SameAs != "" {
+			keep(b.SameAs, retainedSameAs)
+		}
+		if b.Parent != "" {
+			keep(b.Parent, retainedParent)
+		}
+	}
+	return retained, managed
+}
+
+// retainPolicyBackups keeps the backups, newest first, that the retention
+// or GFS retention of policy keeps.
+func retainPolicyBackups(appBackups []Backup, policy config.ProtectionPolicy, keep func(id, reason string)) {
+	if g := policy.GFSRetention; g != nil {
+		rules := []struct {
+			reason string
+			count  int
+			period func(time.Time) string
+		}{
+			{retainedDaily, g.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+			{retainedWeekly, g.Weekly, func(t time.Time) string {
+				year, week := t.ISOWeek()
+				return fmt.Sprintf("%d-W%02d", year, week)
+			}},
+			{retainedMonthly, g.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		}
+		for _, rule := range rules {
+			periods := map[string]bool{}
+			for _, b := range appBackups {
+				if b.Status != backupStatusCompleted && b.Status != backupStatusUnchanged {
+					continue
+				}
+				period := rule.period(b.CreatedAt.UTC())
+				if periods[period] {
+					continue
+				}
+				periods[period] = true
+				if len(periods) > rule.count {
+					break
+				}
+				keep(b.BackupID, rule.reason)
+			}
+		}
+		for _, b := range appBackups {
+			if b.Status == backupStatusFailed && time.Since(b.CreatedAt) <= gfsFailedRunAge {
+				keep(b.BackupID, retainedRecent)
+			}
+		}
+	} else {
+		for _, b := range appBackups {
+			if time.Since(b.CreatedAt) <= policy.Retention.Duration {
+				keep(b.BackupID, retainedAge)
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/cron"
+	"net_exercise/pkg/store"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Schedule backs up an application whenever its cron expression matches,
+// in UTC.
+type Schedule struct {
+	ScheduleID string `json:"schedule_id"`
+	AppID      string `json:"app_id"`
+	Cron       string `json:"cron"`
+	// config or full, see withBackupType
+	BackupType string    `json:"backup_type,omitempty"`
+	Paused     bool      `json:"paused"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Unset while paused. Runs missed while the service was down are
+	// caught up once when it is back.
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	// Job taking the backup of the last run
+	LastJobID string `json:"last_job_id,omitempty"`
+	// Applies to the backups of this schedule instead of the retention of
+	// the application
+	Retention *config.BackupRetention `json:"retention,omitempty"`
+	// How failed runs are retried, config.DefaultRetryPolicy by default
+	Retry config.RetryPolicy `json:"retry"`
+}
+
+// How often schedules are checked for due runs
+const scheduleCheckInterval = 30 * time.Second
+
+var scheduleCounter int = 0
+
+// Guarded by stateMu
+var schedules map[string]Schedule = make(map[string]Schedule)
+
+var errScheduleNotFound = errors.New("Invalid schedule_id")
+
+// parseSchedule parses expr and checks that it ever matches.
+func parseSchedule(expr string) (cron.Schedule, error) {
+	s, err := cron.Parse(expr)
+	if err != nil {
+		return s, err
+	}
+	if s.Next(time.Now().UTC()).IsZero() {
+		return s, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return s, nil
+}
+
+// nextRun returns when s runs next after t.
+func (s Schedule) nextRun(t time.Time) *time.Time {
+	parsed, err := cron.Parse(s.Cron)
+	if err != nil {
+		return nil
+	}
+	next := parsed.Next(t.UTC())
+	if next.IsZero() {
+		return nil
+	}
+	return &next
+}
+
+// runSchedules starts the backups of due schedules until the process exits.
+func runSchedules() {
+	for {
+		runDueSchedules(time.Now().UTC())
+		time.Sleep(scheduleCheckInterval)
+	}
+}
+
+func runDueSchedules(now time.Time) {
+	stateMu.Lock()
+	var due []Schedule
+	for _, s := range schedules {
+		if !s.Paused && s.NextRunAt != nil && !s.NextRunAt.After(now) {
+			due = append(due, s)
+		}
+	}
+	stateMu.Unlock()
+
+	for _, s := range due {
+		stateMu.Lock()
+		app, ok := apps[s.AppID]
+		stateMu.Unlock()
+		if !ok {
+			continue
+		}
+
+		// A full queue is tried again at the next check
+		job, err := jobs.Submit("backup", scheduledBackupJob(app, s))
+		if err != nil {
+			log.Printf("schedule %s: queueing backup of %s: %v", s.ScheduleID, s.AppID, err)
+			continue
+		}
+
+		stateMu.Lock()
+		if current, ok := schedules[s.ScheduleID]; ok {
+			current.LastRunAt = &now
+			current.LastJobID = job.ID
+			if !current.Paused {
+				current.NextRunAt = current.nextRun(now)
+			}
+			schedules[s.ScheduleID] = current
+			persistLocked(scheduleChange(s.ScheduleID))
+		}
+		stateMu.Unlock()
+	}
+}
+
+// scheduledBackupJob takes the backup of a run of s, retrying failed
+// attempts within the job.
+func scheduledBackupJob(app Application, s Schedule) worker.Func {
+	opts := backupOptions{Type: s.BackupType, Schedule: s.ScheduleID}
+	return func(ctx context.Context) (any, error) {
+		b, err := backupWithRetry(ctx, "schedule "+s.ScheduleID, app, opts, s.Retry)
+		return gin.H{"backup_id": b.BackupID, "app_id": b.AppID, "status": b.Status, "attempt": b.Attempt}, err
+	}
+}
+
+func createSchedule(c *gin.Context) {
+	var requestBody struct {
+		AppID      string                  `json:"app_id" binding:"required"`
+		Cron       string                  `json:"cron" binding:"required"`
+		BackupType string                  `json:"backup_type" binding:"omitempty,oneof=config full"`
+		Retention  *config.BackupRetention `json:"retention"`
+		Retry      config.RetryPolicy      `json:"retry"`
+	}
+	if !bindJSON(c, &requestBody) {
+		return
+	}
+	if err := requestBody.Retry.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	requestBody.Retry.SetDefaults()
+	if _, err := parseSchedule(requestBody.Cron); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requestBody.Retention != nil {
+		if err := requestBody.Retention.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	app, ok := apps[requestBody.AppID]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid app_id"})
+		return
+	}
+	if _, _, err := withBackupType(app, requestBody.BackupType); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scheduleCounter++
+	s := Schedule{
+		ScheduleID: fmt.Sprintf("schedule_%d", scheduleCounter),
+		AppID:      app.AppID,
+		Cron:       requestBody.Cron,
+		BackupType: requestBody.BackupType,
+		CreatedAt:  time.Now().UTC(),
+		Retention:  requestBody.Retention,
+		Retry:      requestBody.Retry,
+	}
+	s.NextRunAt = s.nextRun(s.CreatedAt)
+	schedules[s.ScheduleID] = s
+	persistLocked(scheduleChange(s.ScheduleID), settingChange("schedule_counter", scheduleCounter))
+
+	c.JSON(http.StatusCreated, s)
+}
+
+// listSchedules returns the schedules oldest first, ?app_id= those of one
+// application.
+func listSchedules(c *gin.Context) {
+	appID := c.Query("app_id")
+
+	stateMu.Lock()
+	list := []Schedule{}
+	for _, s := range schedules {
+		if appID == "" || s.AppID == appID {
+			list = append(list, s)
+		}
+	}
+	stateMu.Unlock()
+
+	slices.SortFunc(list, func(a, b Schedule) int { return compareIDs(a.ScheduleID, b.ScheduleID) })
+	c.JSON(http.StatusOK, gin.H{"schedules": list})
+}
+
+func pauseSchedule(c *gin.Context) {
+	updateSchedule(c, func(s *Schedule) {
+		s.Paused = true
+		s.NextRunAt = nil
+	})
+}
+
+// resumeSchedule continues a paused schedule from now on, the runs missed
+// while it was paused are skipped.
+func resumeSchedule(c *gin.Context) {
+	updateSchedule(c, func(s *Schedule) {
+		if s.Paused {
+			s.Paused = false
+			s.NextRunAt = s.nextRun(time.Now())
+		}
+	})
+}
+
+func updateSchedule(c *gin.Context, update func(*Schedule)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	s, ok := schedules[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errScheduleNotFound.Error()})
+		return
+	}
+	update(&s)
+	schedules[s.ScheduleID] = s
+	persistLocked(scheduleChange(s.ScheduleID))
+
+	c.JSON(http.StatusOK, s)
+}
+
+func deleteSchedule(c *gin.Context) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	id := c.Param("id")
+	if _, ok := schedules[id]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": errScheduleNotFound.Error()})
+		return
+	}
+	delete(schedules, id)
+	persistLocked(scheduleChange(id))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted", "schedule_id": id})
+}
+
+// deleteSchedulesLocked deletes the schedules of appID and returns the
+// changes that delete them from the metadata store. Must be called with
+// stateMu held.
+func deleteSchedulesLocked(appID string) []store.Change {
+	var changes []store.Change
+	for id, s := range schedules {
+		if s.AppID == appID {
+			delete(schedules, id)
+			changes = append(changes, scheduleChange(id))
+		}
+	}
+	return changes
+}
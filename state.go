@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"net_exercise/pkg/auth"
+	"net_exercise/pkg/store"
+)
+
+// Buckets of the metadata store, one per entity, keyed by ID
+const (
+	bucketApps      = "apps"
+	bucketBackups   = "backups"
+	bucketRestores  = "restores"
+	bucketSchedules = "schedules"
+	bucketAPIKeys   = "api_keys"
+	bucketAgents    = "agents"
+	// Counters and settings, keyed by the persistedState field's JSON name
+	bucketSettings = "settings"
+)
+
+// persistedState is the part of the in-memory state kept in the metadata
+// store. Indexes derived from it, like appNameNamespaceMap, are rebuilt on load.
+// It is also the format of the JSON file that held the whole state before
+// the store kept records, see importLegacyState.
+type persistedState struct {
+	AppCounter      int                    `json:"app_counter"`
+	BackupCounter   int                    `json:"backup_counter"`
+	RestoreCounter  int                    `json:"restore_counter"`
+	ScheduleCounter int                    `json:"schedule_counter"`
+	Apps            map[string]Application `json:"apps"`
+	Backups         map[string]Backup      `json:"backups"`
+	Restores        map[string]Restore     `json:"restores"`
+	Schedules       map[string]Schedule    `json:"schedules"`
+	// Hashed API keys with their roles, see api_keys.go
+	APIKeys *auth.APIKeyState `json:"api_keys,omitempty"`
+	// Encryption key new backups use when it was rotated through the API,
+	// see encryption.go
+	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
+	// Agents by name with the credential they are bound to, see agents.go
+	Agents map[string]agentInfo `json:"agents,omitempty"`
+}
+
+var metadataStore store.Store
+
+// Error of the last metadata save, nil once a save succeeds again. Guarded
+// by stateMu.
+var persistErr error
+
+// readState reads every record of the metadata store. ok is false if
+// nothing was saved yet.
+func readState() (state persistedState, ok bool, err error) {
+	state = persistedState{
+		Apps:      map[string]Application{},
+		Backups:   map[string]Backup{},
+		Restores:  map[string]Restore{},
+		Schedules: map[string]Schedule{},
+		Agents:    map[string]agentInfo{},
+	}
+	err = metadataStore.Each(bucketSettings, func(key string, value []byte) error {
+		ok = true
+		switch key {
+		case "app_counter":
+			return json.Unmarshal(value, &state.AppCounter)
+		case "backup_counter":
+			return json.Unmarshal(value, &state.BackupCounter)
+		case "restore_counter":
+			return json.Unmarshal(value, &state.RestoreCounter)
+		case "schedule_counter":
+			return json.Unmarshal(value, &state.ScheduleCounter)
+		case "api_key_counter":
+			state.APIKeys = &auth.APIKeyState{}
+			return json.Unmarshal(value, &state.APIKeys.Counter)
+		case "encryption_key_id":
+			return json.Unmarshal(value, &state.EncryptionKeyID)
+		}
+		return nil
+	})
+	if err != nil || !ok {
+		return persistedState{}, false, err
+	}
+
+	if err := readBucket(bucketApps, state.Apps); err != nil {
+		return persistedState{}, false, err
+	}
+	if err := readBucket(bucketBackups, state.Backups); err != nil {
+		return persistedState{}, false, err
+	}
+	if err := readBucket(bucketRestores, state.Restores); err != nil {
+		return persistedState{}, false, err
+	}
+	if err := readBucket(bucketSchedules, state.Schedules); err != nil {
+		return persistedState{}, false, err
+	}
+	if err := readBucket(bucketAgents, state.Agents); err != nil {
+		return persistedState{}, false, err
+	}
+	if state.APIKeys != nil {
+		err = metadataStore.Each(bucketAPIKeys, func(key string, value []byte) error {
+			var k auth.StoredAPIKey
+			if err := json.Unmarshal(value, &k); err != nil {
+				return fmt.Errorf("%s %s: %w", bucketAPIKeys, key, err)
+			}
+			state.APIKeys.Keys = append(state.APIKeys.Keys, k)
+			return nil
+		})
+		if err != nil {
+			return persistedState{}, false, err
+		}
+	}
+	return state, true, nil
+}
+
+func readBucket[T any](bucket string, records map[string]T) error {
+	return metadataStore.Each(bucket, func(key string, value []byte) error {
+		var record T
+		if err := json.Unmarshal(value, &record); err != nil {
+			return fmt.Errorf("%s %s: %w", bucket, key, err)
+		}
+		records[key] = record
+		return nil
+	})
+}
+
+// loadState restores the state saved by a previous run, if any.
+func loadState() error {
+	state, ok, err := readState()
+	if err != nil || !ok {
+		return err
+	}
+	// Before stateMu, which is locked after agentsMu
+	loadAgents(state.Agents)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	appCounter = state.AppCounter
+	backupCounter = state.BackupCounter
+	restoreCounter = state.RestoreCounter
+	scheduleCounter = state.ScheduleCounter
+	apps = state.Apps
+	backups = state.Backups
+	restores = state.Restores
+	// Paused restores only live in memory, they can't be resumed
+	var interrupted []store.Change
+	for id, r := range restores {
+		if r.Status == restoreStatusAwaitingDecisions || r.Status == restoreStatusRunning {
+			r.Status = restoreStatusFailed
+			r.Error = errRestoreInterrupted.Error()
+			r.PendingDecisions = nil
+			restores[id] = r
+			interrupted = append(interrupted, restoreChange(id))
+		}
+	}
+	schedules = state.Schedules
+	// Schedules saved before they had retry settings get the defaults
+	for id, s := range schedules {
+		s.Retry.SetDefaults()
+		schedules[id] = s
+	}
+	loadEncryptionKeyLocked(state.EncryptionKeyID)
+	if apiKeys != nil && state.APIKeys != nil {
+		apiKeys.Load(*state.APIKeys)
+	}
+	rebuildIndexesLocked()
+	persistLocked(interrupted...)
+	return nil
+}
+
+// openMetadataStore opens the metadata store at path and imports the JSON
+// file the state was kept in before, the path with the .json extension.
+// Configurations that still name that file get the store beside it, with
+// the .db extension.
+func openMetadataStore(path string) error {
+	legacyPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+	if path == legacyPath {
+		path = strings.TrimSuffix(path, ".json") + ".db"
+	}
+	s, err := store.OpenBolt(path)
+	if err != nil {
+		return err
+	}
+	metadataStore = s
+	return importLegacyState(legacyPath)
+}
+
+// importLegacyState copies the state from the JSON file at path, where it
+// was kept as a whole before the metadata store kept records, into the
+// store. Only a store that holds nothing yet is filled, so the file is left
+// alone afterwards.
+func importLegacyState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok, err := readState(); err != nil || ok {
+		return err
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("importing metadata from %s: %w", path, err)
+	}
+
+	changes := []store.Change{
+		store.Put(bucketSettings, "app_counter", state.AppCounter),
+		store.Put(bucketSettings, "backup_counter", state.BackupCounter),
+		store.Put(bucketSettings, "restore_counter", state.RestoreCounter),
+		store.Put(bucketSettings, "schedule_counter", state.ScheduleCounter),
+		store.Put(bucketSettings, "encryption_key_id", state.EncryptionKeyID),
+	}
+	for id, app := range state.Apps {
+		changes = append(changes, store.Put(bucketApps, id, app))
+	}
+	for id, b := range state.Backups {
+		changes = append(changes, store.Put(bucketBackups, id, b))
+	}
+	for id, r := range state.Restores {
+		changes = append(changes, store.Put(bucketRestores, id, r))
+	}
+	for id, s := range state.Schedules {
+		changes = append(changes, store.Put(bucketSchedules, id, s))
+	}
+	if state.APIKeys != nil {
+		changes = append(changes, store.Put(bucketSettings, "api_key_counter", state.APIKeys.Counter))
+		for _, k := range state.APIKeys.Keys {
+			changes = append(changes, store.Put(bucketAPIKeys, k.ID, k))
+		}
+	}
+	if err := metadataStore.Apply(changes...); err != nil {
+		return fmt.Errorf("importing metadata from %s: %w", path, err)
+	}
+	log.Printf("imported metadata from %s, it is no longer used", path)
+	return nil
+}
+
+// rebuildIndexesLocked derives appNameNamespaceMap from apps. It must be
+// called with stateMu held. Of applications registered twice with the same
+// name and namespace, the oldest is indexed.
+func rebuildIndexesLocked() {
+	appNameNamespaceMap = make(map[string]string, len(apps))
+	for id, app := range apps {
+		key := fmt.Sprintf("%s_%s", app.Name, app.Namespace)
+		if existing, ok := appNameNamespaceMap[key]; !ok || compareIDs(id, existing) < 0 {
+			appNameNamespaceMap[key] = id
+		}
+	}
+}
+
+// persistLocked writes the records a change touched to the metadata store,
+// in one transaction. It must be called with stateMu held, so the records
+// are saved in the order they changed. A failed save is logged and kept in
+// persistErr.
+func persistLocked(changes ...store.Change) {
+	if metadataStore == nil || len(changes) == 0 {
+		return
+	}
+	err := metadataStore.Apply(changes...)
+	if err != nil {
+		log.Printf("ALERT saving metadata: %v", err)
+	}
+	persistErr = err
+}
+
+// The changes below save the current value of a record, or delete it when
+// it is gone from the in-memory state.
+
+func appChange(id string) store.Change {
+	return recordChange(bucketApps, id, apps)
+}
+
+func backupChange(id string) store.Change {
+	return recordChange(bucketBackups, id, backups)
+}
+
+func restoreChange(id string) store.Change {
+	return recordChange(bucketRestores, id, restores)
+}
+
+func scheduleChange(id string) store.Change {
+	return recordChange(bucketSchedules, id, schedules)
+}
+
+func recordChange[T any](bucket, id string, records map[string]T) store.Change {
+	record, ok := records[id]
+	if !ok {
+		return store.Delete(bucket, id)
+	}
+	return store.Put(bucket, id, record)
+}
+
+// settingChange saves a counter or setting by its persistedState JSON name,
+// e.g. "backup_counter".
+func settingChange(name string, value any) store.Change {
+	return store.Put(bucketSettings, name, value)
+}
+
+// countersChanges saves every ID counter.
+func countersChanges() []store.Change {
+	return []store.Change{
+		settingChange("app_counter", appCounter),
+		settingChange("backup_counter", backupCounter),
+		settingChange("restore_counter", restoreCounter),
+		settingChange("schedule_counter", scheduleCounter),
+	}
+}
+
+// apiKeyChanges save an API key with the counter its ID was taken from.
+func apiKeyChanges(id string) []store.Change {
+	k, counter, ok := apiKeys.Stored(id)
+	if !ok {
+		return nil
+	}
+	return []store.Change{store.Put(bucketAPIKeys, id, k), settingChange("api_key_counter", counter)}
+}
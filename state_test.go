@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"net_exercise/pkg/auth"
+)
+
+// The JSON file of older versions is imported into the store once, and the
+// state saved record by record is loaded again after a restart.
+func TestMetadataStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	legacy := persistedState{
+		AppCounter:    1,
+		BackupCounter: 1,
+		Apps:          map[string]Application{"app_1": {AppID: "app_1", Name: "shop", Namespace: "shop"}},
+		Backups:       map[string]Backup{"backup_1": {BackupID: "backup_1", AppID: "app_1", Status: backupStatusCompleted}},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		metadataStore.Close()
+		metadataStore, apiKeys = nil, nil
+		apps, backups, restores, schedules = map[string]Application{}, map[string]Backup{}, map[string]Restore{}, map[string]Schedule{}
+		appNameNamespaceMap = map[string]string{}
+		appCounter, backupCounter, restoreCounter, scheduleCounter = 0, 0, 0, 0
+	})
+
+	// Older configurations name the JSON file
+	start := func() {
+		t.Helper()
+		if metadataStore != nil {
+			metadataStore.Close()
+		}
+		apiKeys = auth.NewAPIKeyStore()
+		if err := openMetadataStore(filepath.Join(dir, "metadata.json")); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start()
+	if _, ok := backups["backup_1"]; !ok || appNameNamespaceMap["shop_shop"] != "app_1" {
+		t.Fatalf("state after import: backups %v, index %v", backups, appNameNamespaceMap)
+	}
+
+	key, _, err := apiKeys.Create("ci", auth.RoleOperator, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistAPIKey(key.ID)
+	stateMu.Lock()
+	backupCounter++
+	backups["backup_2"] = Backup{BackupID: "backup_2", AppID: "app_1", Status: backupStatusCompleted}
+	persistLocked(backupChange("backup_2"), settingChange("backup_counter", backupCounter))
+	delete(backups, "backup_1")
+	persistLocked(backupChange("backup_1"))
+	stateMu.Unlock()
+
+	// The JSON file is still there but no longer read
+	start()
+	if _, ok := backups["backup_1"]; ok {
+		t.Error("backup_1 was deleted but is loaded again")
+	}
+	if _, ok := backups["backup_2"]; !ok || backupCounter != 2 {
+		t.Errorf("backup_2 saved with counter 2, loaded backups %v with counter %d", backups, backupCounter)
+	}
+	if keys := apiKeys.List(); len(keys) != 1 || keys[0].ID != key.ID {
+		t.Errorf("API keys after restart = %v, want %s", keys, key.ID)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "metadata.db")); err != nil {
+		t.Errorf("store not kept beside the JSON file: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+)
+
+// registerValidations teaches gin's validator the checks used in the
+// binding tags of the request structs, and makes it report fields by their
+// JSON names.
+func registerValidations() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected gin validator engine")
+	}
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	return v.RegisterValidation("dns1123label", func(fl validator.FieldLevel) bool {
+		return len(k8svalidation.IsDNS1123Label(fl.Field().String())) == 0
+	})
+}
+
+// bindJSON decodes and validates the request body into obj. On failure the
+// response is written and false is returned; validation failures list one
+// message per field, e.g. "namespace: must be a valid DNS-1123 label".
+func bindJSON(c *gin.Context, obj any) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	respondInvalid(c, err)
+	return false
+}
+
+// validateStruct checks the binding tags of obj for bodies not decoded by gin.
+func validateStruct(c *gin.Context, obj any) bool {
+	err := binding.Validator.ValidateStruct(obj)
+	if err == nil {
+		return true
+	}
+	respondInvalid(c, err)
+	return false
+}
+
+func respondInvalid(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit)})
+		return
+	}
+
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fieldErrors := make([]string, 0, len(validationErrors))
+	for _, e := range validationErrors {
+		fieldErrors = append(fieldErrors, fieldPath(e)+": "+fieldMessage(e))
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "field_errors": fieldErrors})
+}
+
+// fieldPath drops the name of the request struct, e.g.
+// "restoreRequest.namespace" becomes "namespace".
+func fieldPath(e validator.FieldError) string {
+	_, path, ok := strings.Cut(e.Namespace(), ".")
+	if !ok {
+		return e.Field()
+	}
+	return path
+}
+
+func fieldMessage(e validator.FieldError) string {
+	switch e.Tag() {
+	case "required", "required_if":
+		return "is required"
+	case "dns1123label":
+		return "must be a valid DNS-1123 label"
+	case "email":
+		return "must be an email address"
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(e.Param(), " ", ", ")
+	}
+	return fmt.Sprintf("failed the %s check", e.Tag())
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Same header and format as GitHub, so generic callers can reuse its tooling:
+// "sha256=" followed by the hex HMAC-SHA256 of the request body. Generic
+// callers sign the timestamp too, see signedPayload.
+const webhookSignatureHeader = "X-Hub-Signature-256"
+
+// Unix time generic callers sent the request at, in seconds
+const webhookTimestampHeader = "X-Netx-Timestamp"
+
+// Requests sent longer ago than this, or as far in the future, are stale.
+// Deliveries are remembered this long to reject them when replayed.
+const webhookTolerance = 5 * time.Minute
+
+var (
+	errWebhookStale    = errors.New("webhook request is stale")
+	errWebhookReplayed = errors.New("webhook request was already delivered")
+)
+
+// Deliveries accepted within webhookTolerance, by webhook name and delivery,
+// to reject replays. Guarded by webhookDeliveriesMu.
+var (
+	webhookDeliveries   = map[string]time.Time{}
+	webhookDeliveriesMu sync.Mutex
+)
+
+type webhook struct {
+	config.Webhook
+	secret []byte
+}
+
+// Configured inbound webhooks by name
+var webhooks = map[string]webhook{}
+
+func loadWebhooks(configs []config.Webhook) error {
+	for _, w := range configs {
+		secret := os.Getenv(w.SecretEnv)
+		if secret == "" {
+			return fmt.Errorf("webhook %s: environment variable %s is not set", w.Name, w.SecretEnv)
+		}
+		webhooks[w.Name] = webhook{Webhook: w, secret: []byte(secret)}
+	}
+	return nil
+}
+
+// signedPayload is what generic callers sign: the timestamp header, a dot
+// and the body, so a captured request can't be sent again later with a
+// fresh timestamp.
+func signedPayload(timestamp string, body []byte) []byte {
+	return append([]byte(timestamp+"."), body...)
+}
+
+// checkTimestamp parses the timestamp header of a generic caller and checks
+// it is within webhookTolerance of now.
+func checkTimestamp(header string, now time.Time) error {
+	seconds, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing or invalid %s", errWebhookStale, webhookTimestampHeader)
+	}
+	return checkFresh(time.Unix(seconds, 0), now)
+}
+
+func checkFresh(sent, now time.Time) error {
+	if skew := now.Sub(sent); skew > webhookTolerance || skew < -webhookTolerance {
+		return fmt.Errorf("%w: sent at %s, more than %s from now", errWebhookStale, sent.UTC().Format(time.RFC3339), webhookTolerance)
+	}
+	return nil
+}
+
+// claimDelivery records the delivery of a request to w, identified by key,
+// and fails if it was delivered before. Deliveries older than
+// webhookTolerance are forgotten, their requests are stale by now.
+func (w webhook) claimDelivery(key string, now time.Time) error {
+	webhookDeliveriesMu.Lock()
+	defer webhookDeliveriesMu.Unlock()
+
+	for k, at := range webhookDeliveries {
+		if now.Sub(at) > 2*webhookTolerance {
+			delete(webhookDeliveries, k)
+		}
+	}
+	key = w.Name + "/" + key
+	if _, ok := webhookDeliveries[key]; ok {
+		return errWebhookReplayed
+	}
+	webhookDeliveries[key] = now
+	return nil
+}
+
+func (w webhook) releaseDelivery(key string) {
+	webhookDeliveriesMu.Lock()
+	delete(webhookDeliveries, w.Name+"/"+key)
+	webhookDeliveriesMu.Unlock()
+}
+
+func (w webhook) validSignature(body []byte, header string) bool {
+	signature, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// triggerWebhook takes a backup of the application mapped to the webhook,
+// typically right before a pipeline deploys it, and returns the backup_id
+// for the pipeline to record with the job taking it. Stale requests and
+// requests delivered before are refused.
+func triggerWebhook(c *gin.Context) {
+	w, ok := webhooks[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown webhook"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondInvalid(c, err)
+		return
+	}
+	now := time.Now()
+	event := c.GetHeader("X-GitHub-Event")
+	signed := body
+	if event == "" {
+		signed = signedPayload(c.GetHeader(webhookTimestampHeader), body)
+	}
+	if !w.validSignature(signed, c.GetHeader(webhookSignatureHeader)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing " + webhookSignatureHeader + " signature"})
+		return
+	}
+
+	// https://docs.github.com/en/webhooks/webhook-events-and-payloads#deployment
+	var delivery string
+	switch event {
+	case "":
+		// Generic caller, any signed request triggers a backup
+		if err := checkTimestamp(c.GetHeader(webhookTimestampHeader), now); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		delivery = c.GetHeader(webhookSignatureHeader)
+	case "ping":
+		c.JSON(http.StatusOK, gin.H{"message": "pong"})
+		return
+	case "deployment":
+		var payload struct {
+			Deployment struct {
+				ID          int64     `json:"id"`
+				Environment string    `json:"environment"`
+				CreatedAt   time.Time `json:"created_at"`
+			} `json:"deployment"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// GitHub only signs the body, the deployment in it dates and
+		// identifies the request
+		if err := checkFresh(payload.Deployment.CreatedAt, now); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		delivery = fmt.Sprintf("deployment/%d", payload.Deployment.ID)
+		environment := payload.Deployment.Environment
+		if len(w.Environments) > 0 && !slices.Contains(w.Environments, environment) {
+			c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("No backup for deployments to %q", environment)})
+			return
+		}
+	default:
+		c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("Ignoring GitHub %s event", event)})
+		return
+	}
+
+	stateMu.Lock()
+	appID, ok := appNameNamespaceMap[fmt.Sprintf("%s_%s", w.Application.Name, w.Application.Namespace)]
+	app := apps[appID]
+	stateMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Application %s in namespace %s is not registered", w.Application.Name, w.Application.Namespace)})
+		return
+	}
+
+	if err := w.claimDelivery(delivery, now); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	backupID := allocateBackupID()
+	job, err := jobs.Submit("backup", backupJob(app, backupOptions{BackupID: backupID}))
+	if err != nil {
+		// Not delivered, the caller may try again
+		w.releaseDelivery(delivery)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, struct {
+		worker.Job
+		BackupID string `json:"backup_id"`
+	}{job, backupID})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"net_exercise/pkg/config"
+	"net_exercise/pkg/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Webhook requests are answered with the backup they queue, and refused
+// when they are stale or were delivered before.
+func TestTriggerWebhookReplay(t *testing.T) {
+	secret := []byte("s3cret")
+	sign := func(payload []byte) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(payload)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	generic := func(body string, sentAt time.Time) http.Header {
+		timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+		return http.Header{
+			webhookTimestampHeader: {timestamp},
+			webhookSignatureHeader: {sign(signedPayload(timestamp, []byte(body)))},
+		}
+	}
+	deployment := func(id int, createdAt time.Time) (string, http.Header) {
+		body := fmt.Sprintf(`{"deployment": {"id": %d, "environment": "production", "created_at": %q}}`, id, createdAt.UTC().Format(time.RFC3339))
+		return body, http.Header{
+			"X-Github-Event":       {"deployment"},
+			webhookSignatureHeader: {sign([]byte(body))},
+		}
+	}
+
+	now := time.Now()
+	forged := generic(`{"ref": "v1.4.0"}`, now.Add(-time.Hour))
+	forged.Set(webhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	deployBody, deployHeader := deployment(1, now)
+	oldDeployBody, oldDeployHeader := deployment(2, now.Add(-time.Hour))
+
+	// In order, on the same webhook
+	requests := []struct {
+		name       string
+		body       string
+		header     http.Header
+		wantStatus int
+	}{
+		{name: "generic", body: `{"ref": "v1.4.0"}`, header: generic(`{"ref": "v1.4.0"}`, now), wantStatus: http.StatusAccepted},
+		{name: "generic replayed", body: `{"ref": "v1.4.0"}`, header: generic(`{"ref": "v1.4.0"}`, now), wantStatus: http.StatusConflict},
+		{name: "generic stale", body: `{"ref": "v1.4.0"}`, header: generic(`{"ref": "v1.4.0"}`, now.Add(-time.Hour)), wantStatus: http.StatusUnauthorized},
+		{name: "generic timestamp not signed", body: `{"ref": "v1.4.0"}`, header: forged, wantStatus: http.StatusUnauthorized},
+		{name: "generic without timestamp", body: `{}`, header: http.Header{webhookSignatureHeader: {sign([]byte(`{}`))}}, wantStatus: http.StatusUnauthorized},
+		{name: "deployment", body: deployBody, header: deployHeader, wantStatus: http.StatusAccepted},
+		{name: "deployment replayed", body: deployBody, header: deployHeader, wantStatus: http.StatusConflict},
+		{name: "deployment stale", body: oldDeployBody, header: oldDeployHeader, wantStatus: http.StatusUnauthorized},
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := webhook{Webhook: config.Webhook{Name: "shop-deploy"}, secret: secret}
+	w.Application.Name, w.Application.Namespace = "shop", "shop"
+	webhooks["shop-deploy"] = w
+	apps = map[string]Application{"app_1": {AppID: "app_1", Name: "shop", Namespace: "shop"}}
+	appNameNamespaceMap = map[string]string{"shop_shop": "app_1"}
+	// Without workers the backups stay queued
+	previousJobs := jobs
+	jobs = worker.New(0, 10)
+	t.Cleanup(func() {
+		jobs = previousJobs
+		delete(webhooks, "shop-deploy")
+		apps, appNameNamespaceMap = map[string]Application{}, map[string]string{}
+		backupCounter = 0
+		webhookDeliveries = map[string]time.Time{}
+	})
+
+	for _, tt := range requests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/webhooks/shop-deploy", bytes.NewBufferString(tt.body))
+		c.Request.Header = tt.header
+		c.Params = gin.Params{{Key: "name", Value: "shop-deploy"}}
+
+		triggerWebhook(c)
+
+		if recorder.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, recorder.Code, tt.wantStatus, recorder.Body)
+			continue
+		}
+		if tt.wantStatus != http.StatusAccepted {
+			continue
+		}
+		var response struct {
+			JobID    string `json:"job_id"`
+			BackupID string `json:"backup_id"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.JobID == "" || response.BackupID == "" {
+			t.Errorf("%s: response %s lacks job_id or backup_id", tt.name, recorder.Body)
+		}
+	}
+}